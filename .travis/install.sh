@@ -8,7 +8,8 @@ go get -v \
 	github.com/proidiot/gone \
 	github.com/stretchr/testify/assert \
 	golang.org/x/crypto \
-	golang.org/x/net/html
+	golang.org/x/net/html \
+	golang.org/x/net/icmp
 
 echo "\nInstallation complete"
 
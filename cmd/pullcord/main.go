@@ -0,0 +1,205 @@
+// The pullcord command runs a Pullcord server as described by a JSON config
+// file.
+//
+// Usage:
+//
+//	pullcord [-check] [-listen address] config.json
+//
+// Every resource package distributed with Pullcord is linked in, so any of the
+// built-in resource types may be used in the config. With -check, the config
+// is fully parsed and validated, but no port is bound and no resource is
+// started. With -listen, the
+// address the server listens on (i.e. ":8080" or "127.0.0.1:80") overrides
+// the port given in the config. A SIGHUP causes the config file to be reloaded
+// without dropping any requests (if the reloaded config is bad, the error is
+// logged and the previous config stays in use). A SIGINT or SIGTERM causes the
+// server to stop accepting new connections, stop every resource in the config
+// (i.e. cancelling any delayed triggers), and exit.
+package main
+
+import (
+	"flag"
+	"fmt"
+	_ "github.com/stuphlabs/pullcord/authentication"
+	"github.com/stuphlabs/pullcord/config"
+	_ "github.com/stuphlabs/pullcord/monitor"
+	_ "github.com/stuphlabs/pullcord/proxy"
+	_ "github.com/stuphlabs/pullcord/store"
+	_ "github.com/stuphlabs/pullcord/trigger"
+	_ "github.com/stuphlabs/pullcord/util"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+// run does all the work of main, but it returns an exit status rather than
+// exiting so that it can be tested.
+func run(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("pullcord", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	check := flags.Bool(
+		"check",
+		false,
+		"validate the config and exit without binding a port",
+	)
+	listen := flags.String(
+		"listen",
+		"",
+		"address to listen on, overriding the port in the config",
+	)
+	flags.Usage = func() {
+		fmt.Fprintln(
+			stderr,
+			"usage: pullcord [-check] [-listen address] config.json",
+		)
+		flags.PrintDefaults()
+	}
+
+	if e := flags.Parse(args); e != nil {
+		return 2
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	configPath := flags.Arg(0)
+
+	if *check {
+		if e := checkFile(configPath); e != nil {
+			fmt.Fprintf(stderr, "pullcord: %v\n", e)
+			return 1
+		}
+		fmt.Fprintf(stderr, "pullcord: %s is valid\n", configPath)
+		return 0
+	}
+
+	server, e := serverFromFile(configPath)
+	if e != nil {
+		fmt.Fprintf(stderr, "pullcord: %v\n", e)
+		return 1
+	}
+
+	if *listen != "" {
+		server.Addr = *listen
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(
+		signals,
+		syscall.SIGHUP,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+	)
+	defer signal.Stop(signals)
+	done := make(chan interface{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case s := <-signals:
+				if s == syscall.SIGHUP {
+					log().Notice(
+						"pullcord received SIGHUP," +
+						" reloading config",
+					)
+					reloadFromFile(server, configPath)
+				} else {
+					log().Notice(
+						fmt.Sprintf(
+							"pullcord received" +
+							" %v, no longer" +
+							" accepting new" +
+							" connections",
+							s,
+						),
+					)
+					server.StopAccepting()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	log().Notice(
+		fmt.Sprintf(
+			"pullcord starting on %s with config: %s",
+			server.Addr,
+			configPath,
+		),
+	)
+	serveErr := server.ListenAndServe()
+
+	if e := server.Close(); e != nil {
+		log().Err(
+			fmt.Sprintf(
+				"pullcord was unable to cleanly stop every" +
+				" resource: %v",
+				e,
+			),
+		)
+	}
+
+	if serveErr != nil {
+		log().Crit(
+			fmt.Sprintf("pullcord server failed: %v", serveErr),
+		)
+		fmt.Fprintf(stderr, "pullcord: %v\n", serveErr)
+		return 1
+	}
+
+	log().Notice("pullcord has shut down")
+	return 0
+}
+
+// checkFile opens the config file at the given path and checks it, without
+// starting anything it describes.
+func checkFile(path string) error {
+	f, e := os.Open(path)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	return config.CheckReader(f)
+}
+
+// serverFromFile opens the config file at the given path and constructs a
+// server from it.
+func serverFromFile(path string) (*config.ReloadableServer, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+
+	return config.NewReloadableServer(f)
+}
+
+// reloadFromFile reopens the config file at the given path and reloads the
+// server from it. Any error will have already been logged, and the server will
+// still be using its previous config.
+func reloadFromFile(server *config.ReloadableServer, path string) error {
+	f, e := os.Open(path)
+	if e != nil {
+		log().Err(
+			fmt.Sprintf(
+				"pullcord was unable to open config for" +
+				" reload, continuing to use the previous" +
+				" config: %v",
+				e,
+			),
+		)
+		return e
+	}
+	defer f.Close()
+
+	return server.Reload(f)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// writeTestConfig is a testing helper function that writes the given config to
+// a temporary file and returns its path.
+func writeTestConfig(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "pullcord_test_config")
+	assert.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.WriteString(contents)
+	assert.NoError(t, err)
+
+	return f.Name()
+}
+
+// TestRunCheckValid verifies that a valid config using resource types from
+// each of the resource packages passes a check without binding a port.
+func TestRunCheckValid(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"resources": {
+			"landing": {
+				"type": "landingfilter",
+				"data": {}
+			},
+			"start": {
+				"type": "shelltrigger",
+				"data": {
+					"command": "true"
+				}
+			},
+			"service": {
+				"type": "minmonitorredservice",
+				"data": {
+					"address": "127.0.0.1",
+					"port": 8080,
+					"protocol": "tcp",
+					"graceperiod": "30s",
+					"ondown": {
+						"type": "ref",
+						"data": "start"
+					}
+				}
+			},
+			"sessions": {
+				"type": "minsessionhandler",
+				"data": {
+					"name": "pullcord",
+					"path": "/",
+					"domain": "example.com"
+				}
+			},
+			"router": {
+				"type": "exactpathrouter",
+				"data": {
+					"routes": {
+						"/": {
+							"type": "ref",
+							"data": "landing"
+						},
+						"/app": {
+							"type": "ref",
+							"data": "service"
+						},
+						"/proxy": {
+							"type": "passthrufilter",
+							"data": {
+								"host": "127.0.0.1",
+								"port": 8081
+							}
+						}
+					}
+				}
+			}
+		},
+		"pipeline": ["router", "landing"],
+		"port": 80
+	}`)
+	defer os.Remove(path)
+
+	var stderr bytes.Buffer
+	status := run([]string{"-check", path}, &stderr)
+	assert.Equal(t, 0, status, "stderr: " + stderr.String())
+	assert.Contains(t, stderr.String(), "is valid")
+}
+
+// TestRunCheckInvalid verifies that a config that cannot be parsed fails a
+// check.
+func TestRunCheckInvalid(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"resources": {
+			"landing": {
+				"type": "nosuchtype",
+				"data": {}
+			}
+		},
+		"pipeline": ["landing"],
+		"port": 80
+	}`)
+	defer os.Remove(path)
+
+	var stderr bytes.Buffer
+	status := run([]string{"-check", path}, &stderr)
+	assert.Equal(t, 1, status)
+	assert.NotEqual(t, "", stderr.String())
+}
+
+// TestRunMissingConfig verifies that a config path that does not exist is
+// reported as an error.
+func TestRunMissingConfig(t *testing.T) {
+	var stderr bytes.Buffer
+	status := run(
+		[]string{"-check", "/nonexistent/pullcord/config.json"},
+		&stderr,
+	)
+	assert.Equal(t, 1, status)
+}
+
+// TestRunUsage verifies that bad invocations produce a usage error.
+func TestRunUsage(t *testing.T) {
+	var stderr bytes.Buffer
+	assert.Equal(t, 2, run([]string{}, &stderr))
+	assert.Contains(t, stderr.String(), "usage")
+
+	stderr.Reset()
+	assert.Equal(t, 2, run([]string{"a.json", "b.json"}, &stderr))
+
+	stderr.Reset()
+	assert.Equal(t, 2, run([]string{"-nosuchflag", "a.json"}, &stderr))
+}
+
+// TestReloadFromFile verifies that a server can be reloaded from a changed
+// config file, and that a bad config file leaves the server usable.
+func TestReloadFromFile(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"resources": {
+			"landing": {
+				"type": "landingfilter",
+				"data": {}
+			}
+		},
+		"pipeline": ["landing"],
+		"port": 80
+	}`)
+	defer os.Remove(path)
+
+	server, err := serverFromFile(path)
+	assert.NoError(t, err)
+
+	err = ioutil.WriteFile(path, []byte(`{
+		"resources": {
+			"notfound": {
+				"type": "standardresponse",
+				"data": 404
+			}
+		},
+		"pipeline": ["notfound"],
+		"port": 80
+	}`), 0600)
+	assert.NoError(t, err)
+	assert.NoError(t, reloadFromFile(server, path))
+
+	err = ioutil.WriteFile(path, []byte("not json"), 0600)
+	assert.NoError(t, err)
+	assert.Error(t, reloadFromFile(server, path))
+
+	assert.Error(t, reloadFromFile(server, "/nonexistent/config.json"))
+}
@@ -21,6 +21,16 @@ var registry map[string]*Resource
 var unregisterredResources map[string]json.RawMessage
 var registrationMutex sync.Mutex
 
+// These are only meaningful while a config is being loaded (and so while
+// registrationMutex is held). The dependencies record which named resources
+// each named resource referenced, the build stack holds the names of the named
+// resources currently under construction, and the reusable resources are
+// those which are unchanged since the previously loaded config (if any).
+var dependencies map[string]map[string]bool
+var buildStack []string
+var reusable map[string]bool
+var previous *loadedConfig
+
 func RegisterResourceType(
 	typeName string,
 	newFunc func() json.Unmarshaler,
@@ -81,28 +91,19 @@ func (rsc *Resource) UnmarshalJSON(input []byte) error {
 			return e
 		}
 
-		d, present := registry[name]
-		if present {
-			if d.complete {
-				rsc.Unmarshaled = d.Unmarshaled
-				rsc.complete = true
-				return nil
-			} else {
-				e := errors.New(
-					fmt.Sprintf(
-						"The resource depenency was" +
-						" already under construction" +
-						" (implying a cyclic" +
-						" dependency): %s",
-						name,
-					),
-				)
-				log().Crit(e.Error())
-				return e
-			}
+		if len(buildStack) > 0 {
+			dependent := buildStack[len(buildStack) - 1]
+			dependencies[dependent][name] = true
+		}
+
+		d, e := buildNamed(name)
+		if e != nil {
+			return e
 		}
 
-		return rsc.unmarshalByName(name)
+		rsc.Unmarshaled = d.Unmarshaled
+		rsc.complete = true
+		return nil
 	}
 
 	newFunc, present := typeRegistry[newRscDef.Type]
@@ -122,24 +123,207 @@ func (rsc *Resource) UnmarshalJSON(input []byte) error {
 	}
 	rsc.Unmarshaled = u
 	rsc.complete = true
+	trackLifecycle(u)
 	return nil
 }
 
-func (r *Resource) unmarshalByName(name string) error {
-	if d, present := unregisterredResources[name]; !present {
-		return errors.New(
+// buildNamed returns the named resource from the registry, constructing it
+// from its definition (or reusing it from the previously loaded config) if it
+// has not yet been constructed. Every reference to the same name within a
+// config therefore shares a single instance.
+func buildNamed(name string) (*Resource, error) {
+	if d, present := registry[name]; present {
+		if d.complete {
+			return d, nil
+		}
+
+		e := errors.New(
+			fmt.Sprintf(
+				"The resource depenency was already under" +
+				" construction (implying a cyclic" +
+				" dependency): %s",
+				name,
+			),
+		)
+		log().Crit(e.Error())
+		return nil, e
+	}
+
+	def, present := unregisterredResources[name]
+	if !present {
+		return nil, errors.New(
 			fmt.Sprintf(
 				"No resource specified with name: %s",
 				name,
 			),
 		)
-	} else {
-		return json.Unmarshal(d, r)
 	}
+
+	r := new(Resource)
+	registry[name] = r
+	dependencies[name] = make(map[string]bool)
+
+	if reusable[name] {
+		// The dependencies are carried over first so that the
+		// lifecycle entries stay in dependency order.
+		for dep := range previous.dependencies[name] {
+			dependencies[name][dep] = true
+			if _, e := buildNamed(dep); e != nil {
+				return nil, e
+			}
+		}
+		r.Unmarshaled = previous.resources[name].Unmarshaled
+		r.complete = true
+		for _, entry := range previous.lifecycle {
+			if entry.owner == name {
+				lifecycle = append(lifecycle, entry)
+			}
+		}
+		log().Debug(
+			fmt.Sprintf(
+				"Reused unchanged resource from previous" +
+				" config: %s",
+				name,
+			),
+		)
+		return r, nil
+	}
+
+	buildStack = append(buildStack, name)
+	e := json.Unmarshal(def, r)
+	buildStack = buildStack[:len(buildStack) - 1]
+	if e != nil {
+		return nil, e
+	}
+
+	r.complete = true
+	log().Debug(
+		fmt.Sprintf(
+			"Saved resource to registry: %s: %v",
+			name,
+			r.Unmarshaled,
+		),
+	)
+	return r, nil
 }
 
-func ServerFromReader(r io.Reader) (*falcore.Server, error) {
+// loadedConfig holds the named resources constructed for a config along with
+// enough information to decide which of them can be reused by a later config.
+type loadedConfig struct {
+	definitions map[string]json.RawMessage
+	resources map[string]*Resource
+	dependencies map[string]map[string]bool
+	pipeline *falcore.Pipeline
+	port int
+	lifecycle []lifecycleEntry
+}
+
+// findReusable determines which named resources from a previously loaded
+// config can be carried over unchanged into a new config with the given
+// resource definitions. A resource can only be reused if its own definition
+// is identical and every resource it references can also be reused, and it is
+// not referenced by a ReferenceStopper which is being discarded (and so would
+// stop it).
+func findReusable(
+	prev *loadedConfig,
+	definitions map[string]json.RawMessage,
+) map[string]bool {
+	if prev == nil {
+		return make(map[string]bool)
+	}
+
+	// Each resource which can no longer be reused may be a
+	// ReferenceStopper, which keeps the resources it references from being
+	// reused, and so on until nothing more changes.
+	stopped := make(map[string]bool)
+	for {
+		result := findUnchanged(prev, definitions, stopped)
+		changed := false
+		for name, r := range prev.resources {
+			if result[name] {
+				continue
+			}
+			s, ok := r.Unmarshaled.(ReferenceStopper)
+			if !ok || !s.StopsReferences() {
+				continue
+			}
+			for dep := range prev.dependencies[name] {
+				if result[dep] && !stopped[dep] {
+					stopped[dep] = true
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			return result
+		}
+	}
+}
+
+// findUnchanged determines which named resources from a previously loaded
+// config are unchanged in a new config with the given resource definitions,
+// which is to say that their own definitions are identical and every resource
+// they reference is also unchanged. The given resources are never considered
+// unchanged.
+func findUnchanged(
+	prev *loadedConfig,
+	definitions map[string]json.RawMessage,
+	excluded map[string]bool,
+) map[string]bool {
+	result := make(map[string]bool)
+	decided := make(map[string]bool)
+	var check func(name string) bool
+	check = func(name string) bool {
+		if ok, present := decided[name]; present {
+			return ok
+		}
+		// The previous config could not have contained a cycle, but
+		// just in case, assume the worst while deciding.
+		decided[name] = false
+		if excluded[name] {
+			return false
+		}
+
+		oldDef, oldPresent := prev.definitions[name]
+		newDef, newPresent := definitions[name]
+		if !oldPresent || !newPresent {
+			return false
+		} else if _, built := prev.resources[name]; !built {
+			return false
+		}
+
+		var oldBuf, newBuf bytes.Buffer
+		if json.Compact(&oldBuf, oldDef) != nil ||
+		    json.Compact(&newBuf, newDef) != nil ||
+		    !bytes.Equal(oldBuf.Bytes(), newBuf.Bytes()) {
+			return false
+		}
+
+		for dep := range prev.dependencies[name] {
+			if !check(dep) {
+				return false
+			}
+		}
+
+		decided[name] = true
+		return true
+	}
+
+	for name := range definitions {
+		if check(name) {
+			result[name] = true
+		}
+	}
+
+	return result
+}
+
+// load constructs all the resources and the pipeline described by a config,
+// reusing any unchanged resources from a previously loaded config (which may
+// be nil).
+func load(r io.Reader, prev *loadedConfig) (*loadedConfig, error) {
 	registrationMutex.Lock()
+	defer registrationMutex.Unlock()
 
 	var config struct {
 		Resources map[string]json.RawMessage
@@ -149,6 +333,17 @@ func ServerFromReader(r io.Reader) (*falcore.Server, error) {
 
 	dec := json.NewDecoder(r)
 	registry = make(map[string]*Resource)
+	dependencies = make(map[string]map[string]bool)
+	buildStack = nil
+	lifecycle = nil
+	defer func() {
+		lifecycle = nil
+		registry = nil
+		dependencies = nil
+		unregisterredResources = nil
+		reusable = nil
+		previous = nil
+	}()
 
 	if e := dec.Decode(&config); e != nil {
 		log().Crit(
@@ -157,7 +352,6 @@ func ServerFromReader(r io.Reader) (*falcore.Server, error) {
 				e,
 			),
 		)
-		registrationMutex.Unlock()
 		return nil, e
 	}
 
@@ -170,29 +364,15 @@ func ServerFromReader(r io.Reader) (*falcore.Server, error) {
 			),
 		)
 		log().Crit(e.Error())
-		registrationMutex.Unlock()
 		return nil, e
 	}
 
 	unregisterredResources = config.Resources
+	previous = prev
+	reusable = findReusable(prev, config.Resources)
 	for name, _ := range config.Resources {
-		if _, present := registry[name]; !present {
-			r := new(Resource)
-			registry[name] = r
-			if e := r.unmarshalByName(name); e != nil {
-				registrationMutex.Unlock()
-				return nil, e
-			} else {
-				r.complete = true
-				log().Debug(
-					fmt.Sprintf(
-						"Saved resource to" +
-						" registry: %s: %v",
-						name,
-						r.Unmarshaled,
-					),
-				)
-			}
+		if _, e := buildNamed(name); e != nil {
+			return nil, e
 		}
 	}
 
@@ -209,12 +389,12 @@ func ServerFromReader(r io.Reader) (*falcore.Server, error) {
 				),
 			)
 			log().Crit(e.Error())
-			registrationMutex.Unlock()
 			return nil, e
 		}
 		u := r.Unmarshaled
 		switch u := u.(type) {
 		case falcore.Router:
+			pipeline.Upstream.PushBack(u)
 		case falcore.RequestFilter:
 			pipeline.Upstream.PushBack(u)
 		default:
@@ -226,7 +406,6 @@ func ServerFromReader(r io.Reader) (*falcore.Server, error) {
 				),
 			)
 			log().Crit(e.Error())
-			registrationMutex.Unlock()
 			return nil, e
 		}
 		log().Debug(
@@ -237,12 +416,37 @@ func ServerFromReader(r io.Reader) (*falcore.Server, error) {
 		)
 	}
 
-	server := falcore.NewServer(config.Port, pipeline)
+	return &loadedConfig{
+		config.Resources,
+		registry,
+		dependencies,
+		pipeline,
+		config.Port,
+		lifecycle,
+	}, nil
+}
 
-	registry = nil
+// CheckReader builds every resource and the pipeline described by the given
+// config, reporting any error, but it neither starts nor stops anything. This
+// suits checking a config without touching whatever the config manages.
+func CheckReader(r io.Reader) error {
+	_, e := load(r, nil)
+	return e
+}
+
+// ServerFromReader constructs a falcore.Server from the given config. Any
+// resources which implement Starter are started once the pipeline has been
+// built, but since the resources cannot be stopped again, a server which will
+// be shut down (or reloaded) should be created with NewReloadableServer.
+func ServerFromReader(r io.Reader) (*falcore.Server, error) {
+	c, e := load(r, nil)
+	if e != nil {
+		return nil, e
+	}
 
-	registrationMutex.Unlock()
+	if e = c.start(nil); e != nil {
+		return nil, e
+	}
 
-	return server, nil
+	return falcore.NewServer(c.port, c.pipeline), nil
 }
-
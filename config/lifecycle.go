@@ -0,0 +1,159 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Starter is implemented by resources which have work to do (such as
+// starting goroutines or opening connections) once the entire config has been
+// built, rather than while they are being unmarshaled. If Start returns an
+// error, the config fails to load.
+type Starter interface {
+	Start() (err error)
+}
+
+// Stopper is implemented by resources which have work to do (such as shutting
+// down goroutines) before they are discarded. Stop should not return until
+// that work is done. A resource may also (or instead) implement io.Closer, in
+// which case it is closed after being stopped.
+type Stopper interface {
+	Stop() (err error)
+}
+
+// ReferenceStopper is implemented by a Stopper which also stops the resources
+// it references when it is stopped (as a trigger which wraps other triggers
+// does). If a reload discards a ReferenceStopper, the named resources it
+// references are not carried over, since they are stopped along with it.
+type ReferenceStopper interface {
+	Stopper
+	StopsReferences() bool
+}
+
+// lifecycleEntry records a resource which implements at least one of Starter,
+// Stopper, or io.Closer, along with the name of the named resource which was
+// under construction when it was built (which may be the resource itself).
+type lifecycleEntry struct {
+	owner string
+	resource json.Unmarshaler
+}
+
+// lifecycle holds the lifecycle entries for the config being loaded, in the
+// order their construction completed. Since a resource's construction does not
+// complete until every resource it references has been constructed, this
+// order has every resource after all of its dependencies. Like the other
+// loading state, it is only meaningful while registrationMutex is held.
+var lifecycle []lifecycleEntry
+
+// hasLifecycle determines whether a resource implements any of the lifecycle
+// interfaces.
+func hasLifecycle(r json.Unmarshaler) bool {
+	switch r.(type) {
+	case Starter, Stopper, io.Closer:
+		return true
+	default:
+		return false
+	}
+}
+
+// trackLifecycle records a newly constructed resource if it implements any of
+// the lifecycle interfaces and a config is being loaded.
+func trackLifecycle(r json.Unmarshaler) {
+	if len(buildStack) > 0 && hasLifecycle(r) {
+		lifecycle = append(
+			lifecycle,
+			lifecycleEntry{buildStack[len(buildStack) - 1], r},
+		)
+	}
+}
+
+// contains determines whether the config holds the given resource.
+func (c *loadedConfig) contains(r json.Unmarshaler) bool {
+	if c == nil {
+		return false
+	}
+	for _, entry := range c.lifecycle {
+		if entry.resource == r {
+			return true
+		}
+	}
+	return false
+}
+
+// start starts (in dependency order) each resource in the config which is a
+// Starter, except those which were carried over from the given previous config
+// (which may be nil) and so have already been started. If any resource fails
+// to start, the config cannot be used, so every resource which was not carried
+// over is stopped again and the error is returned.
+func (c *loadedConfig) start(prev *loadedConfig) error {
+	for _, entry := range c.lifecycle {
+		if prev.contains(entry.resource) {
+			continue
+		}
+
+		if s, ok := entry.resource.(Starter); ok {
+			if e := s.Start(); e != nil {
+				log().Crit(
+					fmt.Sprintf(
+						"Unable to start resource" +
+						" in %s: %v",
+						entry.owner,
+						e,
+					),
+				)
+				c.stop(prev)
+				return e
+			}
+		}
+	}
+
+	return nil
+}
+
+// stop stops and closes (in reverse dependency order) each resource in the
+// config, except those which have been carried over into the given next
+// config (which may be nil) and so are still in use. Every resource is stopped
+// even if some fail, but the first error encountered is returned.
+func (c *loadedConfig) stop(next *loadedConfig) (err error) {
+	for i := len(c.lifecycle) - 1; i >= 0; i-- {
+		entry := c.lifecycle[i]
+		if next.contains(entry.resource) {
+			continue
+		}
+
+		if s, ok := entry.resource.(Stopper); ok {
+			if e := s.Stop(); e != nil {
+				log().Err(
+					fmt.Sprintf(
+						"Unable to stop resource in" +
+						" %s: %v",
+						entry.owner,
+						e,
+					),
+				)
+				if err == nil {
+					err = e
+				}
+			}
+		}
+
+		if cl, ok := entry.resource.(io.Closer); ok {
+			if e := cl.Close(); e != nil {
+				log().Err(
+					fmt.Sprintf(
+						"Unable to close resource in" +
+						" %s: %v",
+						entry.owner,
+						e,
+					),
+				)
+				if err == nil {
+					err = e
+				}
+			}
+		}
+	}
+
+	return err
+}
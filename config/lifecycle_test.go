@@ -0,0 +1,348 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fitstar/falcore"
+	"github.com/proidiot/gone/errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lifecycleEvents records the lifecycle calls made on every dummyLifecycle
+// resource, in order.
+var lifecycleEvents []string
+var lifecycleEventsMutex sync.Mutex
+
+func recordLifecycleEvent(event string) {
+	lifecycleEventsMutex.Lock()
+	defer lifecycleEventsMutex.Unlock()
+	lifecycleEvents = append(lifecycleEvents, event)
+}
+
+// takeLifecycleEvents returns the events recorded so far and forgets them.
+func takeLifecycleEvents() []string {
+	lifecycleEventsMutex.Lock()
+	defer lifecycleEventsMutex.Unlock()
+	result := lifecycleEvents
+	lifecycleEvents = nil
+	return result
+}
+
+// dummyLifecycle is a RequestFilter which records each time it is started,
+// stopped, or closed, and which may hold another resource. If it is named
+// "fail", it cannot be started. If its name begins with "owner", it stops the
+// resource it holds when it is stopped.
+type dummyLifecycle struct {
+	name string
+	dep json.Unmarshaler
+}
+func (d *dummyLifecycle) UnmarshalJSON(input []byte) error {
+	var t struct {
+		Name string
+		Dep *Resource
+	}
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+	d.name = t.Name
+	if t.Dep != nil {
+		d.dep = t.Dep.Unmarshaled
+	}
+	return nil
+}
+func (d *dummyLifecycle) FilterRequest(*falcore.Request) *http.Response {
+	return nil
+}
+func (d *dummyLifecycle) Start() error {
+	recordLifecycleEvent("start " + d.name)
+	if d.name == "fail" {
+		return errors.New("dummyLifecycle failed to start")
+	}
+	return nil
+}
+func (d *dummyLifecycle) Stop() error {
+	recordLifecycleEvent("stop " + d.name)
+	if s, ok := d.dep.(Stopper); ok && d.StopsReferences() {
+		return s.Stop()
+	}
+	return nil
+}
+func (d *dummyLifecycle) StopsReferences() bool {
+	return strings.HasPrefix(d.name, "owner")
+}
+func (d *dummyLifecycle) Close() error {
+	recordLifecycleEvent("close " + d.name)
+	return nil
+}
+func newDummyLifecycle() json.Unmarshaler {
+	return new(dummyLifecycle)
+}
+
+func init() {
+	RegisterResourceType("dummyLifecycle", newDummyLifecycle)
+}
+
+// lifecycleTestConfig generates a config whose pipeline is a dummyLifecycle
+// with the first given name, which references a named dummyLifecycle with the
+// second given name, which in turn holds an unnamed dummyLifecycle with the
+// third given name.
+func lifecycleTestConfig(front, middle, back string) string {
+	return fmt.Sprintf(
+		`{
+			"resources": {
+				"front": {
+					"type": "dummyLifecycle",
+					"data": {
+						"name": %q,
+						"dep": {
+							"type": "ref",
+							"data": "middle"
+						}
+					}
+				},
+				"middle": {
+					"type": "dummyLifecycle",
+					"data": {
+						"name": %q,
+						"dep": {
+							"type": "dummyLifecycle",
+							"data": {
+								"name": %q
+							}
+						}
+					}
+				}
+			},
+			"pipeline": ["front"],
+			"port": 80
+		}`,
+		front,
+		middle,
+		back,
+	)
+}
+
+// TestLifecycleOrder verifies that resources are started in dependency order
+// and stopped and closed in the reverse order.
+func TestLifecycleOrder(t *testing.T) {
+	takeLifecycleEvents()
+
+	s, err := NewReloadableServer(
+		strings.NewReader(lifecycleTestConfig("a", "b", "c")),
+	)
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		[]string{"start c", "start b", "start a"},
+		takeLifecycleEvents(),
+	)
+
+	err = s.Close()
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		[]string{
+			"stop a",
+			"close a",
+			"stop b",
+			"close b",
+			"stop c",
+			"close c",
+		},
+		takeLifecycleEvents(),
+	)
+
+	err = s.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(takeLifecycleEvents()))
+
+	err = s.Reload(strings.NewReader(lifecycleTestConfig("a", "b", "c")))
+	assert.Equal(t, ServerClosedError, err)
+	assert.Equal(t, 0, len(takeLifecycleEvents()))
+}
+
+// TestLifecycleReload verifies that a reload only starts new resources, only
+// stops resources which were not carried over, and that a reload which fails
+// to start leaves the previous resources alone.
+func TestLifecycleReload(t *testing.T) {
+	s, err := NewReloadableServer(
+		strings.NewReader(lifecycleTestConfig("a", "b", "c")),
+	)
+	assert.NoError(t, err)
+	takeLifecycleEvents()
+
+	err = s.Reload(strings.NewReader(lifecycleTestConfig("x", "b", "c")))
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		[]string{"start x", "stop a", "close a"},
+		takeLifecycleEvents(),
+	)
+
+	err = s.Reload(
+		strings.NewReader(lifecycleTestConfig("fail", "b", "c")),
+	)
+	assert.Error(t, err)
+	assert.Equal(
+		t,
+		[]string{"start fail", "stop fail", "close fail"},
+		takeLifecycleEvents(),
+	)
+
+	err = s.Reload(strings.NewReader(lifecycleTestConfig("x", "b", "y")))
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		[]string{
+			"start y",
+			"start b",
+			"start x",
+			"stop x",
+			"close x",
+			"stop b",
+			"close b",
+			"stop c",
+			"close c",
+		},
+		takeLifecycleEvents(),
+	)
+
+	err = s.Close()
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		[]string{
+			"stop x",
+			"close x",
+			"stop b",
+			"close b",
+			"stop y",
+			"close y",
+		},
+		takeLifecycleEvents(),
+	)
+}
+
+// TestCheckReader verifies that checking a config builds it without starting,
+// stopping, or closing anything, and that a bad config is reported.
+func TestCheckReader(t *testing.T) {
+	takeLifecycleEvents()
+
+	err := CheckReader(
+		strings.NewReader(lifecycleTestConfig("a", "b", "c")),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(takeLifecycleEvents()))
+
+	err = CheckReader(strings.NewReader("not json"))
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(takeLifecycleEvents()))
+}
+
+// TestLifecycleReloadReferenceStopper verifies that a resource referenced by a
+// discarded ReferenceStopper is not carried over by a reload, as it will have
+// been stopped along with the ReferenceStopper.
+func TestLifecycleReloadReferenceStopper(t *testing.T) {
+	s, err := NewReloadableServer(
+		strings.NewReader(lifecycleTestConfig("owner1", "b", "c")),
+	)
+	assert.NoError(t, err)
+	takeLifecycleEvents()
+	first := s.current.resources
+
+	err = s.Reload(
+		strings.NewReader(lifecycleTestConfig("owner2", "b", "c")),
+	)
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		[]string{
+			"start c",
+			"start b",
+			"start owner2",
+			"stop owner1",
+			"stop b",
+			"close owner1",
+			"stop b",
+			"close b",
+			"stop c",
+			"close c",
+		},
+		takeLifecycleEvents(),
+	)
+	assert.False(
+		t,
+		first["middle"].Unmarshaled ==
+		    s.current.resources["middle"].Unmarshaled,
+		"A resource referenced by a discarded ReferenceStopper should" +
+		" be rebuilt.",
+	)
+
+	// a resource which isn't discarded doesn't keep anything from being
+	// carried over
+	second := s.current.resources
+	err = s.Reload(
+		strings.NewReader(lifecycleTestConfig("owner2", "b", "c")),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(takeLifecycleEvents()))
+	assert.True(
+		t,
+		second["middle"].Unmarshaled ==
+		    s.current.resources["middle"].Unmarshaled,
+	)
+
+	err = s.Close()
+	assert.NoError(t, err)
+	takeLifecycleEvents()
+}
+
+// TestLifecycleStartFailure verifies that a config with a resource which fails
+// to start cannot be loaded, and that everything it built is stopped again.
+func TestLifecycleStartFailure(t *testing.T) {
+	takeLifecycleEvents()
+
+	s, err := NewReloadableServer(
+		strings.NewReader(lifecycleTestConfig("a", "fail", "c")),
+	)
+	assert.Error(t, err)
+	assert.Nil(t, s)
+	assert.Equal(
+		t,
+		[]string{
+			"start c",
+			"start fail",
+			"stop a",
+			"close a",
+			"stop fail",
+			"close fail",
+			"stop c",
+			"close c",
+		},
+		takeLifecycleEvents(),
+	)
+
+	server, err := ServerFromReader(
+		strings.NewReader(lifecycleTestConfig("a", "fail", "c")),
+	)
+	assert.Error(t, err)
+	assert.Nil(t, server)
+	takeLifecycleEvents()
+
+	server, err = ServerFromReader(
+		strings.NewReader(lifecycleTestConfig("a", "b", "c")),
+	)
+	assert.NoError(t, err)
+	assert.NotNil(t, server)
+	assert.Equal(
+		t,
+		[]string{"start c", "start b", "start a"},
+		takeLifecycleEvents(),
+	)
+}
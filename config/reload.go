@@ -0,0 +1,135 @@
+package config
+
+import (
+	"fmt"
+	"github.com/fitstar/falcore"
+	"github.com/proidiot/gone/errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ServerClosedError indicates that a ReloadableServer has been closed, and so
+// its config cannot be reloaded.
+const ServerClosedError = errors.New(
+	"The server has been closed.",
+)
+
+// ReloadableServer is a falcore.Server built from a config, but unlike a
+// server created by ServerFromReader, its pipeline can be replaced while it is
+// running by reloading the config. Requests which are already in flight during
+// a reload finish on the pipeline they started on. Any named resource whose
+// definition (and whose referenced resources' definitions) did not change is
+// carried over into the new pipeline as the very same object, so any state it
+// holds (such as sessions, cached statuses, or running timers) is kept.
+//
+// Resources which implement Starter are started (in dependency order) once
+// their pipeline has been built. Resources which implement Stopper or
+// io.Closer are stopped and closed (in the reverse order) when a reload
+// discards them, or when the server is closed.
+type ReloadableServer struct {
+	*falcore.Server
+	current *loadedConfig
+	pipeline atomic.Value
+	reloadMutex sync.Mutex
+}
+
+// NewReloadableServer constructs a ReloadableServer from the given config.
+func NewReloadableServer(r io.Reader) (*ReloadableServer, error) {
+	c, e := load(r, nil)
+	if e != nil {
+		return nil, e
+	}
+
+	if e = c.start(nil); e != nil {
+		return nil, e
+	}
+
+	s := &ReloadableServer{current: c}
+	s.pipeline.Store(c.pipeline)
+
+	outer := falcore.NewPipeline()
+	outer.Upstream.PushBack(s)
+	s.Server = falcore.NewServer(c.port, outer)
+
+	return s, nil
+}
+
+// Reload replaces the pipeline of the server with one constructed from the
+// given config. If the new config cannot be loaded, the error is logged and
+// returned, and the server continues to use the pipeline it already had. The
+// port cannot be changed by a reload, so any change to it is ignored until the
+// server is restarted.
+func (s *ReloadableServer) Reload(r io.Reader) error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	if s.current == nil {
+		return ServerClosedError
+	}
+
+	c, e := load(r, s.current)
+	if e == nil {
+		e = c.start(s.current)
+	}
+	if e != nil {
+		log().Err(
+			fmt.Sprintf(
+				"Unable to reload config, continuing to use" +
+				" the previous config: %v",
+				e,
+			),
+		)
+		return e
+	}
+
+	if c.port != s.current.port {
+		log().Warning(
+			fmt.Sprintf(
+				"Reloaded config changes the port from %d" +
+				" to %d, but the port cannot change until" +
+				" the server is restarted",
+				s.current.port,
+				c.port,
+			),
+		)
+	}
+
+	s.pipeline.Store(c.pipeline)
+	prev := s.current
+	s.current = c
+	log().Notice("Reloaded config")
+
+	prev.stop(c)
+
+	return nil
+}
+
+// Close stops and closes every resource in the current config which
+// implements Stopper or io.Closer, in the reverse of the order in which they
+// were started. The server should no longer be serving requests, and it cannot
+// be reloaded once it has been closed. Every resource is stopped even if some
+// fail, but the first error encountered is returned.
+func (s *ReloadableServer) Close() error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	if s.current == nil {
+		return nil
+	}
+
+	e := s.current.stop(nil)
+	s.current = nil
+	log().Notice("Closed config")
+
+	return e
+}
+
+// FilterRequest passes the request along to the pipeline from the most
+// recently loaded config.
+func (s *ReloadableServer) FilterRequest(
+	req *falcore.Request,
+) (*http.Response) {
+	return s.pipeline.Load().(*falcore.Pipeline).FilterRequest(req)
+}
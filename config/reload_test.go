@@ -0,0 +1,211 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fitstar/falcore"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// dummyStringFilter is a RequestFilter which always responds with its own
+// configured string, which lets tests see which pipeline handled a request.
+type dummyStringFilter struct {
+	text string
+}
+func (f *dummyStringFilter) UnmarshalJSON(input []byte) error {
+	return json.Unmarshal(input, &f.text)
+}
+func (f *dummyStringFilter) FilterRequest(
+	req *falcore.Request,
+) *http.Response {
+	return falcore.StringResponse(req.HttpRequest, 200, nil, f.text)
+}
+func newDummyStringFilter() json.Unmarshaler {
+	return new(dummyStringFilter)
+}
+
+// dummyWrapper is a resource which holds another resource, much like a
+// wrapping trigger would.
+type dummyWrapper struct {
+	wrapped json.Unmarshaler
+}
+func (w *dummyWrapper) UnmarshalJSON(input []byte) error {
+	var r Resource
+	if e := json.Unmarshal(input, &r); e != nil {
+		return e
+	}
+	w.wrapped = r.Unmarshaled
+	return nil
+}
+func newDummyWrapper() json.Unmarshaler {
+	return new(dummyWrapper)
+}
+
+func init() {
+	RegisterResourceType("dummyString", newDummyStringFilter)
+	RegisterResourceType("dummyWrapper", newDummyWrapper)
+}
+
+// reloadTestConfig generates a config whose pipeline is made up of a single
+// dummyString filter with the given text, alongside a dummyString filter
+// (which is also wrapped) with the other given text.
+func reloadTestConfig(text, otherText string) string {
+	return fmt.Sprintf(
+		`{
+			"resources": {
+				"front": {
+					"type": "dummyString",
+					"data": %q
+				},
+				"other": {
+					"type": "dummyString",
+					"data": %q
+				},
+				"otherWrapper": {
+					"type": "dummyWrapper",
+					"data": {
+						"type": "ref",
+						"data": "other"
+					}
+				},
+				"otherRef": {
+					"type": "ref",
+					"data": "other"
+				}
+			},
+			"pipeline": ["front"],
+			"port": 80
+		}`,
+		text,
+		otherText,
+	)
+}
+
+// responseText is a testing helper function that runs a request through a
+// RequestFilter and returns the body of the response.
+func responseText(t *testing.T, f falcore.RequestFilter) string {
+	request, err := http.NewRequest("GET", "/", nil)
+	assert.NoError(t, err)
+	_, response := falcore.TestWithRequest(request, f, nil)
+	contents, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	return string(contents)
+}
+
+// TestReloadableServer verifies that a reload replaces the pipeline, reuses
+// unchanged resources (along with anything depending only on unchanged
+// resources), and leaves the old pipeline in place if the new config is bad.
+func TestReloadableServer(t *testing.T) {
+	s, err := NewReloadableServer(
+		strings.NewReader(reloadTestConfig("one", "two")),
+	)
+	assert.NoError(t, err)
+	assert.NotNil(t, s)
+	assert.Equal(t, "one", responseText(t, s))
+
+	first := s.current.resources
+	assert.True(
+		t,
+		first["other"].Unmarshaled == first["otherRef"].Unmarshaled,
+		"A reference to a named resource should share the same" +
+		" object as the named resource itself.",
+	)
+	assert.True(
+		t,
+		first["other"].Unmarshaled ==
+		    first["otherWrapper"].Unmarshaled.(*dummyWrapper).wrapped,
+		"A reference to a named resource nested within another" +
+		" resource should share the same object as the named" +
+		" resource itself.",
+	)
+
+	err = s.Reload(strings.NewReader(reloadTestConfig("uno", "two")))
+	assert.NoError(t, err)
+	assert.Equal(t, "uno", responseText(t, s))
+
+	second := s.current.resources
+	assert.False(
+		t,
+		first["front"].Unmarshaled == second["front"].Unmarshaled,
+		"A resource whose definition changed should be rebuilt.",
+	)
+	assert.True(
+		t,
+		first["other"].Unmarshaled == second["other"].Unmarshaled,
+		"A resource whose definition did not change should be" +
+		" reused.",
+	)
+	assert.True(
+		t,
+		first["otherWrapper"].Unmarshaled ==
+		    second["otherWrapper"].Unmarshaled,
+		"A resource which only references unchanged resources should" +
+		" be reused.",
+	)
+
+	err = s.Reload(strings.NewReader("not json"))
+	assert.Error(t, err)
+	assert.Equal(t, "uno", responseText(t, s))
+	assert.True(
+		t,
+		second["front"].Unmarshaled ==
+		    s.current.resources["front"].Unmarshaled,
+		"A failed reload should leave the previous config in place.",
+	)
+
+	err = s.Reload(strings.NewReader(reloadTestConfig("uno", "dos")))
+	assert.NoError(t, err)
+	assert.Equal(t, "uno", responseText(t, s))
+
+	third := s.current.resources
+	assert.True(
+		t,
+		second["front"].Unmarshaled == third["front"].Unmarshaled,
+	)
+	assert.False(
+		t,
+		second["other"].Unmarshaled == third["other"].Unmarshaled,
+	)
+	assert.False(
+		t,
+		second["otherWrapper"].Unmarshaled ==
+		    third["otherWrapper"].Unmarshaled,
+		"A resource which references a changed resource should be" +
+		" rebuilt even if its own definition did not change.",
+	)
+	assert.True(
+		t,
+		third["other"].Unmarshaled ==
+		    third["otherWrapper"].Unmarshaled.(*dummyWrapper).wrapped,
+	)
+}
+
+// TestReloadableServerBadInitialConfig verifies that no server is created from
+// a bad config.
+func TestReloadableServerBadInitialConfig(t *testing.T) {
+	s, err := NewReloadableServer(strings.NewReader("{}"))
+	assert.Error(t, err)
+	assert.Nil(t, s)
+}
+
+// TestServerFromReaderDoesNotReuse verifies that separately created servers
+// never share resources.
+func TestServerFromReaderDoesNotReuse(t *testing.T) {
+	s1, err := NewReloadableServer(
+		strings.NewReader(reloadTestConfig("one", "two")),
+	)
+	assert.NoError(t, err)
+	s2, err := NewReloadableServer(
+		strings.NewReader(reloadTestConfig("one", "two")),
+	)
+	assert.NoError(t, err)
+	assert.False(
+		t,
+		s1.current.resources["other"].Unmarshaled ==
+		    s2.current.resources["other"].Unmarshaled,
+	)
+}
@@ -0,0 +1,168 @@
+package monitor
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// DefaultProbeThreshold is the number of consecutive background probes which
+// must agree before the status of a service is changed, if no other value is
+// given.
+const DefaultProbeThreshold = 1
+
+// Start begins probing the service in the background if it has a probe
+// interval, making MinMonitorredService a valid config.Starter implementation.
+// The service is probed right away, and then again after each probe interval
+// (plus a random amount of time up to the probe jitter, so that many services
+// aren't all probed at once). A service which is up is only found down after
+// DownThreshold consecutive failed probes, and a service which is down is only
+// found up after UpThreshold consecutive successful probes. A forced probe or
+// an explicit up status still takes effect immediately, and the thresholds
+// start over from there.
+//
+// A service without a probe interval is only probed when its status is
+// requested, so starting it does nothing (besides restoring its state and stats
+// from its state store, if it has one, keeping the services it depends on
+// from being stopped by an IdleController while it is up, and enforcing its
+// schedule, if it has one, every so often in the background).
+func (svc *MinMonitorredService) Start() error {
+	if e := svc.restoreState(); e != nil {
+		return e
+	}
+	svc.restoreStats()
+
+	for _, d := range svc.DependsOn {
+		d.addDependent(svc)
+	}
+
+	svc.startSchedule()
+
+	if svc.ProbeInterval <= 0 {
+		return nil
+	}
+
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	if svc.probeDone != nil {
+		return nil
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	svc.probeStop = stop
+	svc.probeDone = done
+	go svc.probeLoop(stop, done)
+
+	log().Info(
+		fmt.Sprintf(
+			"minmonitor is probing \"%s:%d\" in the background" +
+			" every %v",
+			svc.Address,
+			svc.Port,
+			svc.ProbeInterval,
+		),
+	)
+
+	return nil
+}
+
+// Stop ends any background probing of the service (waiting for a probe in
+// progress to finish), making MinMonitorredService a valid config.Stopper
+// implementation. The service is then only probed when its status is
+// requested, it no longer keeps the services it depends on from being stopped
+// by an IdleController, and its schedule is no longer enforced.
+func (svc *MinMonitorredService) Stop() error {
+	// a service which has been stopped (i.e. one which has been replaced
+	// by a reloaded config) no longer keeps its dependencies up
+	for _, d := range svc.DependsOn {
+		d.removeDependent(svc)
+	}
+
+	svc.stopSchedule()
+
+	svc.mutex.Lock()
+	stop, done := svc.probeStop, svc.probeDone
+	svc.probeStop = nil
+	svc.probeDone = nil
+	svc.mutex.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+
+	close(stop)
+	<-done
+
+	log().Info(
+		fmt.Sprintf(
+			"minmonitor is no longer probing \"%s:%d\" in the" +
+			" background",
+			svc.Address,
+			svc.Port,
+		),
+	)
+
+	return nil
+}
+
+// probeLoop probes the service until it is told to stop.
+func (svc *MinMonitorredService) probeLoop(
+	stop <-chan struct{},
+	done chan<- struct{},
+) {
+	defer close(done)
+
+	for {
+		svc.backgroundProbe()
+
+		wait := svc.ProbeInterval
+		if svc.ProbeJitter > 0 {
+			jitter := rand.Int63n(int64(svc.ProbeJitter))
+			wait += time.Duration(jitter)
+		}
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// probeThreshold gives the number of consecutive probes which must agree, using
+// the default if none was given.
+func probeThreshold(threshold int) int {
+	if threshold <= 0 {
+		return DefaultProbeThreshold
+	}
+	return threshold
+}
+
+// backgroundProbe probes the service once, changing its status if enough
+// consecutive probes have disagreed with it.
+func (svc *MinMonitorredService) backgroundProbe() {
+	up, _ := svc.probe(svc.ProbeInterval)
+
+	svc.mutex.Lock()
+	svc.lastChecked = time.Now()
+	if up {
+		svc.successes += 1
+		svc.failures = 0
+		if svc.successes >= probeThreshold(svc.UpThreshold) {
+			svc.up = true
+		}
+	} else {
+		svc.failures += 1
+		svc.successes = 0
+		if svc.failures >= probeThreshold(svc.DownThreshold) {
+			svc.up = false
+		}
+	}
+	t := svc.probed(svc.up)
+	svc.mutex.Unlock()
+	svc.notify(t)
+}
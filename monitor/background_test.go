@@ -0,0 +1,105 @@
+package monitor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stuphlabs/pullcord/config"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestBackgroundProbeThresholds verifies that the status of a service probed in
+// the background only changes once enough consecutive probes agree.
+func TestBackgroundProbeThresholds(t *testing.T) {
+	server, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	_, rawPort, err := net.SplitHostPort(server.Addr().String())
+	assert.NoError(t, err)
+	testPort, err := strconv.Atoi(rawPort)
+	assert.NoError(t, err)
+
+	svc, err := NewMinMonitorredService(
+		"localhost",
+		testPort,
+		"tcp",
+		time.Duration(0),
+		nil,
+		nil,
+		nil,
+	)
+	assert.NoError(t, err)
+	svc.ProbeInterval = time.Second
+	svc.UpThreshold = 2
+	svc.DownThreshold = 3
+
+	svc.backgroundProbe()
+	state, _ := svc.State()
+	assert.Equal(t, ServiceStopped, state)
+
+	svc.backgroundProbe()
+	state, _ = svc.State()
+	assert.Equal(t, ServiceUp, state)
+
+	err = server.Close()
+	assert.NoError(t, err)
+
+	svc.backgroundProbe()
+	svc.backgroundProbe()
+	state, _ = svc.State()
+	assert.Equal(t, ServiceUp, state)
+
+	// an explicit up status starts the count over
+	svc.SetStatusUp()
+	svc.backgroundProbe()
+	svc.backgroundProbe()
+	state, _ = svc.State()
+	assert.Equal(t, ServiceUp, state)
+
+	svc.backgroundProbe()
+	state, _ = svc.State()
+	assert.Equal(t, ServiceStopped, state)
+}
+
+// TestBackgroundProbeStatus verifies that the status of a service probed in
+// the background is cached (even when it is down) until probing is stopped.
+func TestBackgroundProbeStatus(t *testing.T) {
+	svc := newIdleTestService(t, nil)
+	svc.ProbeInterval = time.Hour
+	var _ config.Starter = svc
+	var _ config.Stopper = svc
+
+	err := svc.Start()
+	assert.NoError(t, err)
+	err = svc.Start()
+	assert.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		svc.mutex.Lock()
+		lastChecked := svc.lastChecked
+		svc.mutex.Unlock()
+		if !lastChecked.IsZero() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	up, err := svc.Status()
+	assert.NoError(t, err)
+	assert.False(t, up)
+
+	// no probe happens despite the lack of a grace period
+	svc.SetStatusUp()
+	up, err = svc.Status()
+	assert.NoError(t, err)
+	assert.True(t, up)
+
+	err = svc.Stop()
+	assert.NoError(t, err)
+	err = svc.Stop()
+	assert.NoError(t, err)
+
+	up, err = svc.Status()
+	assert.NoError(t, err)
+	assert.False(t, up)
+}
@@ -0,0 +1,301 @@
+package monitor
+
+import (
+	"fmt"
+	"github.com/proidiot/gone/errors"
+	"github.com/stuphlabs/pullcord/trigger"
+	"time"
+)
+
+// DependencyCycleError indicates that a service would (directly or indirectly)
+// depend on itself.
+const DependencyCycleError = errors.New(
+	"A service cannot depend on itself, even through other services",
+)
+
+// DependencyFailedError indicates that a dependency of a service did not come
+// up, so the service was not started.
+const DependencyFailedError = errors.New(
+	"A dependency of the service did not come up",
+)
+
+// AddDependency makes the service depend on the given service. Whenever the
+// service is started, each of its dependencies (and each of theirs, and so on)
+// is started first, in an order such that every service is up before any
+// service which depends on it is started. Once the service has been started,
+// and while it is up (or starting), an IdleController will not stop any
+// service it depends on.
+func (svc *MinMonitorredService) AddDependency(
+	dependency *MinMonitorredService,
+) error {
+	if dependency == svc || dependency.dependsOn(svc) {
+		return DependencyCycleError
+	}
+
+	// the dependency only learns of the service once it is started
+	svc.DependsOn = append(svc.DependsOn, dependency)
+	return nil
+}
+
+// dependsOn reports whether the service depends on the given service, either
+// directly or through other services.
+func (svc *MinMonitorredService) dependsOn(
+	other *MinMonitorredService,
+) bool {
+	for _, d := range svc.DependsOn {
+		if d == other || d.dependsOn(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// addDependent records that the given service depends on this one (unless it
+// has already been recorded).
+func (svc *MinMonitorredService) addDependent(dependent *MinMonitorredService) {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	for _, d := range svc.dependents {
+		if d == dependent {
+			return
+		}
+	}
+	svc.dependents = append(svc.dependents, dependent)
+}
+
+// removeDependent forgets that the given service depends on this one.
+func (svc *MinMonitorredService) removeDependent(
+	dependent *MinMonitorredService,
+) {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	for i, d := range svc.dependents {
+		if d == dependent {
+			svc.dependents = append(
+				svc.dependents[:i],
+				svc.dependents[i + 1:]...,
+			)
+			return
+		}
+	}
+}
+
+// dependencyOrder gives every service the service depends on (directly or
+// through other services), each only once, and each after every service it
+// depends on.
+func (svc *MinMonitorredService) dependencyOrder() []*MinMonitorredService {
+	var order []*MinMonitorredService
+	seen := make(map[*MinMonitorredService]bool)
+
+	var visit func(s *MinMonitorredService)
+	visit = func(s *MinMonitorredService) {
+		for _, d := range s.DependsOn {
+			if !seen[d] {
+				seen[d] = true
+				visit(d)
+				order = append(order, d)
+			}
+		}
+	}
+	visit(svc)
+
+	return order
+}
+
+// dependentsActive reports whether any service which depends on this one is up
+// or starting.
+func (svc *MinMonitorredService) dependentsActive() bool {
+	svc.mutex.Lock()
+	dependents := append([]*MinMonitorredService(nil), svc.dependents...)
+	svc.mutex.Unlock()
+
+	for _, d := range dependents {
+		if state, _ := d.State(); state == ServiceStarting {
+			return true
+		}
+		if up, err := d.Status(); err == nil && up {
+			return true
+		}
+	}
+	return false
+}
+
+// runOnDown runs the OnDown trigger of the service (if it has one), moving the
+// service into the failed state if the trigger fails.
+func (svc *MinMonitorredService) runOnDown(ctx trigger.TriggerContext) error {
+	if svc.OnDown == nil {
+		return nil
+	}
+
+	ctx.Service = svc.Name
+	ctx.Hook = "OnDown"
+	err := trigger.WithContext(svc.OnDown).TriggerWith(ctx)
+	if err == trigger.ServiceStartingError {
+		log().Info(
+			fmt.Sprintf(
+				"minmonitor was told by the onDown trigger" +
+				" that \"%s:%d\" is already starting",
+				svc.Address,
+				svc.Port,
+			),
+		)
+	} else if err != nil {
+		log().Warning(
+			fmt.Sprintf(
+				"minmonitor received an error while running" +
+				" the onDown trigger on \"%s:%d\": %v",
+				svc.Address,
+				svc.Port,
+				err,
+			),
+		)
+		svc.transition(ServiceFailed)
+		return err
+	}
+
+	return nil
+}
+
+// startBoot moves the service into the starting state (if it is stopped or
+// failed), timing its boot from the given time, and reports whether it did so.
+// As the state is checked and changed at once, only one caller can start the
+// service.
+func (svc *MinMonitorredService) startBoot(fired time.Time) bool {
+	svc.mutex.Lock()
+	state := svc.state
+	if state == "" {
+		state = ServiceStopped
+	}
+	if state != ServiceStopped && state != ServiceFailed {
+		svc.mutex.Unlock()
+		return false
+	}
+	t := svc.setState(ServiceStarting)
+	svc.bootStarted = fired
+	svc.mutex.Unlock()
+
+	svc.notify(t)
+	return true
+}
+
+// waitUntil waits until the given function reports that it is done, checking
+// each time the service comes up, and otherwise every so often, but giving up
+// once the timeout has passed. It reports whether the function was done in
+// time.
+func (svc *MinMonitorredService) waitUntil(
+	timeout time.Duration,
+	done func() bool,
+) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(holdPollInterval)
+	defer poll.Stop()
+
+	for {
+		signal := svc.upSignal()
+		if done() {
+			return true
+		}
+
+		select {
+		case <-signal:
+		case <-poll.C:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+// startAndWait starts the service (unless it is already up or starting) and
+// waits for it to come up.
+func (svc *MinMonitorredService) startAndWait(
+	ctx trigger.TriggerContext,
+) error {
+	started := false
+	var err error
+
+	up := svc.waitUntil(
+		svc.startTimeout(),
+		func() bool {
+			if up, e := svc.Status(); e == nil && up {
+				return true
+			}
+
+			// a service which is stopping is waited out before it
+			// is started again
+			state, _ := svc.State()
+			if state == ServiceFailed && started {
+				err = DependencyFailedError
+				return true
+			} else if state == ServiceStopped ||
+				state == ServiceFailed {
+				w := svc.scheduleWindow()
+				if w != nil && w.Mode == ScheduleDown {
+					err = ScheduledDownError
+					return true
+				}
+				// the service is starting before its OnDown
+				// trigger is run, so that nothing else runs the
+				// trigger in the meantime
+				if !svc.startBoot(time.Now()) {
+					return false
+				}
+				started = true
+				if e := svc.runOnDown(ctx); e != nil {
+					err = e
+					return true
+				}
+			}
+			return false
+		},
+	)
+
+	if err != nil {
+		return err
+	} else if !up {
+		return DependencyFailedError
+	}
+	return nil
+}
+
+// startWithDependencies starts each dependency of the service in turn (waiting
+// for each to come up), and then runs the OnDown trigger of the service. The
+// service must already be starting. If any dependency does not come up, the
+// service has failed.
+func (svc *MinMonitorredService) startWithDependencies(
+	ctx trigger.TriggerContext,
+) {
+	for _, d := range svc.dependencyOrder() {
+		log().Info(
+			fmt.Sprintf(
+				"minmonitor is starting \"%s:%d\" as a" +
+				" dependency of \"%s:%d\"",
+				d.Address,
+				d.Port,
+				svc.Address,
+				svc.Port,
+			),
+		)
+
+		if err := d.startAndWait(ctx); err != nil {
+			log().Warning(
+				fmt.Sprintf(
+					"minmonitor was unable to start" +
+					" \"%s:%d\" as \"%s:%d\" did not come" +
+					" up: %v",
+					svc.Address,
+					svc.Port,
+					d.Address,
+					d.Port,
+					err,
+				),
+			)
+			svc.transition(ServiceFailed, ServiceStarting)
+			return
+		}
+	}
+
+	svc.runOnDown(ctx)
+}
@@ -0,0 +1,253 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stuphlabs/pullcord/config"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// funcTriggerHandler is a testing trigger which runs the given function.
+type funcTriggerHandler func() error
+
+func (f funcTriggerHandler) Trigger() error {
+	return f()
+}
+
+// listenTriggerHandler gives a trigger which starts the given service by
+// listening on its port, sending the listener on the given channel.
+func listenTriggerHandler(
+	svc **MinMonitorredService,
+	listeners chan<- net.Listener,
+) funcTriggerHandler {
+	return func() error {
+		l, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("localhost:%d", (*svc).Port),
+		)
+		if err != nil {
+			return err
+		}
+		listeners <- l
+		return nil
+	}
+}
+
+func TestDependencyOrder(t *testing.T) {
+	a := newIdleTestService(t, nil)
+	b := newIdleTestService(t, nil)
+	c := newIdleTestService(t, nil)
+	d := newIdleTestService(t, nil)
+
+	assert.NoError(t, b.AddDependency(a))
+	assert.NoError(t, c.AddDependency(a))
+	assert.NoError(t, d.AddDependency(b))
+	assert.NoError(t, d.AddDependency(c))
+
+	order := d.dependencyOrder()
+	if assert.Equal(t, 3, len(order)) {
+		assert.Equal(t, a, order[0])
+		assert.Equal(t, b, order[1])
+		assert.Equal(t, c, order[2])
+	}
+	assert.Equal(t, 0, len(a.dependencyOrder()))
+
+	assert.Equal(t, DependencyCycleError, a.AddDependency(a))
+	assert.Equal(t, DependencyCycleError, a.AddDependency(d))
+	assert.Equal(t, 0, len(a.DependsOn))
+}
+
+// TestDependencyStart verifies that the dependencies of a service are up
+// before its own OnDown trigger is run.
+func TestDependencyStart(t *testing.T) {
+	listeners := make(chan net.Listener, 1)
+	var db *MinMonitorredService
+	db = newIdleTestService(t, listenTriggerHandler(&db, listeners))
+
+	dbUp := make(chan bool, 1)
+	app := newIdleTestService(
+		t,
+		funcTriggerHandler(
+			func() error {
+				up, _ := db.Status()
+				dbUp <- up
+				return nil
+			},
+		),
+	)
+	assert.NoError(t, app.AddDependency(db))
+
+	stateTestRequest(t, app, 503)
+	state, _ := app.State()
+	assert.Equal(t, ServiceStarting, state)
+
+	select {
+	case up := <-dbUp:
+		assert.True(t, up)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the OnDown trigger of the service was not run")
+	}
+	(<-listeners).Close()
+
+	state, _ = db.State()
+	assert.Equal(t, ServiceUp, state)
+	assert.Equal(t, 1, len(db.Stats().Boots))
+
+	// further requests don't start the service again
+	stateTestRequest(t, app, 503)
+	assert.Equal(t, 0, len(dbUp))
+}
+
+// TestDependencySlowStart verifies that a dependency shared by two services
+// which are started at once is only started once, even while its OnDown
+// trigger is still running.
+func TestDependencySlowStart(t *testing.T) {
+	onDown := &lockedCounterTriggerHandler{}
+	release := make(chan struct{})
+	db := newIdleTestService(
+		t,
+		funcTriggerHandler(
+			func() error {
+				onDown.Trigger()
+				<-release
+				return nil
+			},
+		),
+	)
+	db.StartTimeout = time.Second
+	app := newIdleTestService(t, nil)
+	assert.NoError(t, app.AddDependency(db))
+	wiki := newIdleTestService(t, nil)
+	assert.NoError(t, wiki.AddDependency(db))
+
+	stateTestRequest(t, app, 503)
+	stateTestRequest(t, wiki, 503)
+	for i := 0; i < 50 && onDown.Count() == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, onDown.Count())
+	state, _ := db.State()
+	assert.Equal(t, ServiceStarting, state)
+	close(release)
+}
+
+// TestDependencyFailure verifies that a service fails to start if one of its
+// dependencies fails to start.
+func TestDependencyFailure(t *testing.T) {
+	db := newIdleTestService(
+		t,
+		funcTriggerHandler(
+			func() error {
+				return errors.New("no database today")
+			},
+		),
+	)
+	onDown := &lockedCounterTriggerHandler{}
+	app := newIdleTestService(t, onDown)
+	assert.NoError(t, app.AddDependency(db))
+
+	stateTestRequest(t, app, 503)
+	for i := 0; i < 50; i++ {
+		if state, _ := app.State(); state == ServiceFailed {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	state, _ := app.State()
+	assert.Equal(t, ServiceFailed, state)
+	state, _ = db.State()
+	assert.Equal(t, ServiceFailed, state)
+	assert.Equal(t, 0, onDown.Count())
+}
+
+// TestIdleControllerKeepsDependency verifies that a service is not stopped for
+// being idle while a service which depends on it is up.
+func TestIdleControllerKeepsDependency(t *testing.T) {
+	db := newIdleTestService(t, nil)
+	app := newIdleTestService(t, nil)
+	app.GracePeriod = time.Minute
+	assert.NoError(t, app.AddDependency(db))
+	assert.NoError(t, app.Start())
+	app.SetStatusUp()
+
+	onIdle := &lockedCounterTriggerHandler{}
+	c := NewIdleController(db, 100 * time.Millisecond, onIdle)
+	assert.NoError(t, c.Start())
+	defer c.Stop()
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 0, onIdle.Count())
+	assert.Equal(t, IdleWaiting, c.IdleStatus().State)
+
+	// a stopped service no longer keeps its dependencies up
+	assert.NoError(t, app.Stop())
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 1, onIdle.Count())
+}
+
+// TestDependencyNotStarted verifies that a service which was given its
+// dependencies but never started (i.e. one built by a reload which failed)
+// doesn't keep them up.
+func TestDependencyNotStarted(t *testing.T) {
+	db := newIdleTestService(t, nil)
+	app := newIdleTestService(t, nil)
+	app.GracePeriod = time.Minute
+	assert.NoError(t, app.AddDependency(db))
+	app.SetStatusUp()
+	assert.False(t, db.dependentsActive())
+
+	assert.NoError(t, app.Start())
+	assert.True(t, db.dependentsActive())
+	assert.NoError(t, app.Stop())
+	assert.False(t, db.dependentsActive())
+}
+
+func TestDependencyCycleFromConfig(t *testing.T) {
+	_, err := config.ServerFromReader(
+		strings.NewReader(
+			`{
+				"resources": {
+					"app": {
+						"type": "minmonitorredservice",
+						"data": {
+							"address": "127.0.0.1",
+							"port": 80,
+							"protocol": "tcp",
+							"graceperiod": "1s",
+							"dependson": [
+								{
+									"type": "ref",
+									"data": "db"
+								}
+							]
+						}
+					},
+					"db": {
+						"type": "minmonitorredservice",
+						"data": {
+							"address": "127.0.0.1",
+							"port": 5432,
+							"protocol": "tcp",
+							"graceperiod": "1s",
+							"dependson": [
+								{
+									"type": "ref",
+									"data": "app"
+								}
+							]
+						}
+					}
+				},
+				"pipeline": ["app"],
+				"port": 80
+			}`,
+		),
+	)
+	assert.Error(t, err)
+}
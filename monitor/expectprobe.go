@@ -0,0 +1,186 @@
+package monitor
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/proidiot/gone/errors"
+	"github.com/stuphlabs/pullcord/config"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// NoProbeExpectationError indicates that an ExpectProbe was configured without
+// a regex to match.
+const NoProbeExpectationError = errors.New(
+	"An expect probe requires a regex to match",
+)
+
+// ExpectProbe is a Prober which has a conversation with a service to check
+// whether it is up, for services which don't speak HTTP (i.e. sshd, an SFTP
+// server, or an SMTP server). A connection is opened to the service, the
+// payload is sent (if one is given), and then the service is only up if what
+// it sends back (i.e. its banner) matches the expected regex before the
+// timeout passes. For example, an expected regex of "^SSH-2\.0" matches the
+// banner of sshd once it has finished starting.
+//
+// If TLS is used, the connection is wrapped in TLS before anything is sent,
+// and the certificate of the service is checked against the server name (or
+// the address of the service if no server name is given), unless the probe is
+// insecure.
+type ExpectProbe struct {
+	Send string
+	Expect *regexp.Regexp
+	Timeout time.Duration
+	TLS bool
+	Insecure bool
+	ServerName string
+}
+
+func init() {
+	config.RegisterResourceType(
+		"expectprobe",
+		func() json.Unmarshaler {
+			return new(ExpectProbe)
+		},
+	)
+}
+
+func (p *ExpectProbe) UnmarshalJSON(input []byte) error {
+	var t struct {
+		Send string
+		Expect string
+		Timeout string
+		TLS bool
+		Insecure bool
+		ServerName string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	if t.Expect == "" {
+		return NoProbeExpectationError
+	} else if r, e := regexp.Compile(t.Expect); e != nil {
+		return e
+	} else {
+		p.Expect = r
+	}
+
+	p.Timeout = 0
+	if t.Timeout != "" {
+		if d, e := time.ParseDuration(t.Timeout); e != nil {
+			return e
+		} else if d <= 0 {
+			return errors.New(
+				"An expect probe timeout must be positive",
+			)
+		} else {
+			p.Timeout = d
+		}
+	}
+
+	p.Send = t.Send
+	p.TLS = t.TLS
+	p.Insecure = t.Insecure
+	p.ServerName = t.ServerName
+
+	return nil
+}
+
+// Probe has the conversation with the service at the given address and port,
+// and reports whether the service answered as expected, making ExpectProbe a
+// valid Prober implementation. An error is only given if no connection could
+// be made at all.
+func (p *ExpectProbe) Probe(
+	protocol, address string,
+	port int,
+) (up bool, err error) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	host := net.JoinHostPort(address, strconv.Itoa(port))
+
+	var conn net.Conn
+	if p.TLS {
+		serverName := p.ServerName
+		if serverName == "" {
+			serverName = address
+		}
+		conn, err = tls.DialWithDialer(
+			&net.Dialer{Timeout: timeout},
+			protocol,
+			host,
+			&tls.Config{
+				ServerName: serverName,
+				InsecureSkipVerify: p.Insecure,
+			},
+		)
+	} else {
+		conn, err = net.DialTimeout(protocol, host, timeout)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(deadline); err != nil {
+		return false, err
+	}
+
+	if p.Send != "" {
+		if _, e := conn.Write([]byte(p.Send)); e != nil {
+			log().Debug(
+				fmt.Sprintf(
+					"minmonitor expect probe of %s was" +
+					" unable to send its payload: %v",
+					host,
+					e,
+				),
+			)
+			return false, nil
+		}
+	}
+
+	var received []byte
+	chunk := make([]byte, 512)
+	for len(received) < maxProbeBody {
+		n, e := conn.Read(chunk)
+		received = append(received, chunk[:n]...)
+		if p.Expect.Match(received) {
+			return true, nil
+		}
+
+		if e != nil {
+			log().Debug(
+				fmt.Sprintf(
+					"minmonitor expect probe of %s did" +
+					" not receive a match for %s" +
+					" before: %v",
+					host,
+					p.Expect,
+					e,
+				),
+			)
+			return false, nil
+		}
+	}
+
+	log().Debug(
+		fmt.Sprintf(
+			"minmonitor expect probe of %s gave up after" +
+			" receiving %d bytes without a match for %s",
+			host,
+			len(received),
+			p.Expect,
+		),
+	)
+	return false, nil
+}
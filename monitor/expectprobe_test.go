@@ -0,0 +1,153 @@
+package monitor
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serveConversation accepts connections on the given listener until it is
+// closed, and has the given conversation with each of them.
+func serveConversation(listener net.Listener, converse func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			converse(conn)
+		}()
+	}
+}
+
+// newExpectProbeTestService creates a service which is probed with the given
+// ExpectProbe at a local listener with the given conversation.
+func newExpectProbeTestService(
+	t *testing.T,
+	probe *ExpectProbe,
+	converse func(net.Conn),
+) (*MinMonitorredService, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go serveConversation(listener, converse)
+	_, rawPort, err := net.SplitHostPort(listener.Addr().String())
+	assert.NoError(t, err)
+	port, err := strconv.Atoi(rawPort)
+	assert.NoError(t, err)
+
+	svc, err := NewMinMonitorredService(
+		"127.0.0.1",
+		port,
+		"tcp",
+		time.Duration(0),
+		nil,
+		nil,
+		nil,
+	)
+	assert.NoError(t, err)
+	svc.Prober = probe
+	return svc, listener
+}
+
+// TestExpectProbeBanner verifies that a service is only up once its banner
+// matches.
+func TestExpectProbeBanner(t *testing.T) {
+	probe := &ExpectProbe{
+		Expect: regexp.MustCompile(`^SSH-2\.0`),
+		Timeout: 200 * time.Millisecond,
+	}
+
+	svc, listener := newExpectProbeTestService(
+		t,
+		probe,
+		func(conn net.Conn) {
+			conn.Write([]byte("220 starting\r\n"))
+			time.Sleep(time.Second)
+		},
+	)
+	up, err := svc.Reprobe()
+	assert.NoError(t, err)
+	assert.False(t, up)
+	listener.Close()
+
+	svc, listener = newExpectProbeTestService(
+		t,
+		probe,
+		func(conn net.Conn) {
+			conn.Write([]byte("SSH-2.0-OpenSSH_7.4\r\n"))
+		},
+	)
+	up, err = svc.Reprobe()
+	assert.NoError(t, err)
+	assert.True(t, up)
+
+	listener.Close()
+	up, err = svc.Reprobe()
+	assert.NoError(t, err)
+	assert.False(t, up)
+}
+
+// TestExpectProbeSend verifies that the payload is sent, and that the service
+// is down if the expected answer isn't received.
+func TestExpectProbeSend(t *testing.T) {
+	probe := &ExpectProbe{
+		Send: "PING\r\n",
+		Expect: regexp.MustCompile(`(?m)^PONG$`),
+		Timeout: 200 * time.Millisecond,
+	}
+	svc, listener := newExpectProbeTestService(
+		t,
+		probe,
+		func(conn net.Conn) {
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err == nil && line == "PING\r\n" {
+				conn.Write([]byte("+OK\nPONG\n"))
+			}
+		},
+	)
+	defer listener.Close()
+
+	up, err := svc.Reprobe()
+	assert.NoError(t, err)
+	assert.True(t, up)
+
+	probe.Send = "HELLO\r\n"
+	up, err = svc.Reprobe()
+	assert.NoError(t, err)
+	assert.False(t, up)
+}
+
+// TestExpectProbeTLS verifies that a conversation can be had over TLS.
+func TestExpectProbeTLS(t *testing.T) {
+	server := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			},
+		),
+	)
+	defer server.Close()
+
+	probe := &ExpectProbe{
+		Send: "GET / HTTP/1.0\r\n\r\n",
+		Expect: regexp.MustCompile(`^HTTP/1\.[01] 200`),
+		TLS: true,
+	}
+	svc := newHTTPProbeTestService(t, server, probe)
+
+	up, err := svc.Reprobe()
+	assert.Error(t, err)
+	assert.False(t, up)
+
+	probe.Insecure = true
+	up, err = svc.Reprobe()
+	assert.NoError(t, err)
+	assert.True(t, up)
+}
@@ -0,0 +1,274 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fitstar/falcore"
+	"github.com/proidiot/gone/errors"
+	"github.com/stuphlabs/pullcord/trigger"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultHoldTimeout is the longest a request is held while its service starts
+// if no other value is given.
+const DefaultHoldTimeout = time.Minute
+
+// DefaultMaxHeldRequests is the most requests which are held at once for a
+// service if no other value is given.
+const DefaultMaxHeldRequests = 100
+
+// DefaultMaxHeldBytes is the most request body bytes which are buffered at
+// once for a service if no other value is given.
+const DefaultMaxHeldBytes = 16 * 1024 * 1024
+
+// holdPollInterval is how often the status of a service is checked while
+// requests are held for it (in case nothing else is probing it).
+const holdPollInterval = time.Second
+
+// RequestHold describes how requests are held while a service starts. Rather
+// than being answered with the warm-up page, a request for a service which is
+// not up is held (with its body buffered) until the service is up, at which
+// point the request is passed along to the service as usual. If the service
+// doesn't come up within the timeout, the warm-up page is given after all.
+// This suits clients which don't retry (i.e. API clients, git over HTTP, and
+// webhooks).
+//
+// Only so many requests are held at once, and only so many bytes of request
+// bodies are buffered at once. A request which would go over either limit is
+// answered with the warm-up page right away.
+type RequestHold struct {
+	Timeout time.Duration
+	MaxRequests int
+	MaxBytes int64
+	mutex sync.Mutex
+	held int
+	heldBytes int64
+}
+
+// NewRequestHold constructs a RequestHold with the default limits.
+func NewRequestHold() *RequestHold {
+	return &RequestHold{
+		Timeout: DefaultHoldTimeout,
+		MaxRequests: DefaultMaxHeldRequests,
+		MaxBytes: DefaultMaxHeldBytes,
+	}
+}
+
+func (h *RequestHold) UnmarshalJSON(input []byte) error {
+	var t struct {
+		Timeout string
+		MaxRequests *int
+		MaxBytes *int64
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	h.Timeout = DefaultHoldTimeout
+	if t.Timeout != "" {
+		if d, e := time.ParseDuration(t.Timeout); e != nil {
+			return e
+		} else if d <= 0 {
+			return errors.New("A hold timeout must be positive")
+		} else {
+			h.Timeout = d
+		}
+	}
+
+	h.MaxRequests = DefaultMaxHeldRequests
+	if t.MaxRequests != nil {
+		if *t.MaxRequests <= 0 {
+			return errors.New(
+				"The most requests held must be positive",
+			)
+		}
+		h.MaxRequests = *t.MaxRequests
+	}
+
+	h.MaxBytes = DefaultMaxHeldBytes
+	if t.MaxBytes != nil {
+		if *t.MaxBytes < 0 {
+			return errors.New(
+				"The most bytes held must not be negative",
+			)
+		}
+		h.MaxBytes = *t.MaxBytes
+	}
+
+	return nil
+}
+
+// reserve makes room for one more held request, reporting whether there was
+// room.
+func (h *RequestHold) reserve() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.held >= h.MaxRequests {
+		return false
+	}
+	h.held += 1
+	return true
+}
+
+// reserveBytes makes room for the given number of buffered bytes, reporting
+// whether there was room.
+func (h *RequestHold) reserveBytes(n int64) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.heldBytes + n > h.MaxBytes {
+		return false
+	}
+	h.heldBytes += n
+	return true
+}
+
+// remainingBytes gives the number of bytes which could still be buffered.
+func (h *RequestHold) remainingBytes() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.MaxBytes - h.heldBytes
+}
+
+// release gives back the room taken by a held request with the given number of
+// buffered bytes.
+func (h *RequestHold) release(n int64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.held -= 1
+	h.heldBytes -= n
+}
+
+// buffer reads the whole body of the request (if there is room for it), and
+// replaces the body with what was read. It gives the number of bytes which
+// were buffered (and reserved), and whether there was room.
+func (h *RequestHold) buffer(req *http.Request) (int64, bool) {
+	if req.Body == nil {
+		return 0, true
+	}
+
+	if req.ContentLength > 0 && req.ContentLength > h.remainingBytes() {
+		return 0, false
+	}
+
+	body, err := ioutil.ReadAll(
+		io.LimitReader(req.Body, h.remainingBytes() + 1),
+	)
+	req.Body.Close()
+	n := int64(len(body))
+	if err != nil || !h.reserveBytes(n) {
+		return 0, false
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return n, true
+}
+
+// upSignal gives a channel which will be closed the next time the service
+// comes up.
+func (svc *MinMonitorredService) upSignal() <-chan struct{} {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	if svc.upWaiters == nil {
+		svc.upWaiters = make(chan struct{})
+	}
+	return svc.upWaiters
+}
+
+// hold holds the request until the service is up, reporting whether it came
+// up before the timeout (or false if the request could not be held at all).
+// As the buffered body of the request is still needed once the request is
+// passed along, the room it takes is only given back once the returned
+// function is called (which it must be, even if the request wasn't held).
+func (svc *MinMonitorredService) hold(
+	req *falcore.Request,
+) (up bool, release func()) {
+	h := svc.Hold
+	if !h.reserve() {
+		log().Warning(
+			fmt.Sprintf(
+				"minmonitor is already holding as many" +
+				" requests as it can for \"%s:%d\"",
+				svc.Address,
+				svc.Port,
+			),
+		)
+		return false, func() {}
+	}
+
+	n, ok := h.buffer(req.HttpRequest)
+	release = func() {
+		h.release(n)
+	}
+	if !ok {
+		log().Warning(
+			fmt.Sprintf(
+				"minmonitor cannot hold a request for" +
+				" \"%s:%d\" as its body is too large",
+				svc.Address,
+				svc.Port,
+			),
+		)
+		return false, release
+	}
+
+	log().Info(
+		fmt.Sprintf(
+			"minmonitor is holding a request for \"%s:%d\" for up" +
+			" to %v",
+			svc.Address,
+			svc.Port,
+			h.Timeout,
+		),
+	)
+
+	up = svc.waitUntil(
+		h.Timeout,
+		func() bool {
+			up, err := svc.Status()
+			return err == nil && up
+		},
+	)
+	if !up {
+		log().Info(
+			fmt.Sprintf(
+				"minmonitor gave up holding a request for" +
+				" \"%s:%d\" after %v",
+				svc.Address,
+				svc.Port,
+				h.Timeout,
+			),
+		)
+	}
+
+	return up, release
+}
+
+// notReadyResponse answers a request for a service which is not up, either by
+// holding it until the service is up (if the service holds requests), or with
+// the warm-up page.
+func (svc *MinMonitorredService) notReadyResponse(
+	req *falcore.Request,
+	ctx trigger.TriggerContext,
+) (*http.Response) {
+	if svc.Hold != nil {
+		up, release := svc.hold(req)
+		defer release()
+		if up {
+			return svc.upResponse(req, ctx)
+		}
+	}
+
+	return svc.warmupResponse(req)
+}
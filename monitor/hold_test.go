@@ -0,0 +1,168 @@
+package monitor
+
+import (
+	"fmt"
+	"github.com/fitstar/falcore"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// holdTestRequest runs a POST request with the given body through the given
+// service, giving the response and its body.
+func holdTestRequest(
+	t *testing.T,
+	svc *MinMonitorredService,
+	body io.Reader,
+) (*http.Response, string) {
+	request, err := http.NewRequest("POST", "http://localhost/hook", body)
+	assert.NoError(t, err)
+
+	_, response := falcore.TestWithRequest(request, svc, nil)
+	defer response.Body.Close()
+	content, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	return response, string(content)
+}
+
+// heldRequests gives the number of requests the given hold is holding.
+func heldRequests(h *RequestHold) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.held
+}
+
+// TestRequestHoldForwardsBody verifies that a request held while its service
+// starts is passed along (body and all) once the service is up.
+func TestRequestHoldForwardsBody(t *testing.T) {
+	onDown := &lockedCounterTriggerHandler{}
+	svc := newIdleTestService(t, onDown)
+	svc.Hold = NewRequestHold()
+	svc.Hold.Timeout = 10 * time.Second
+
+	// the room taken by the body is only given back once the service is
+	// done with the request
+	heldDuring := make(chan int64, 1)
+
+	started := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		l, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("localhost:%d", svc.Port),
+		)
+		if err != nil {
+			started <- nil
+			return
+		}
+		started <- l
+		http.Serve(
+			l,
+			http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					svc.Hold.mutex.Lock()
+					heldDuring <- svc.Hold.heldBytes
+					svc.Hold.mutex.Unlock()
+					io.Copy(w, r.Body)
+				},
+			),
+		)
+	}()
+
+	response, body := holdTestRequest(
+		t,
+		svc,
+		strings.NewReader("payload"),
+	)
+	l := <-started
+	if l == nil {
+		t.Skip("unable to start the service on its reserved port")
+	}
+	defer l.Close()
+
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "payload", body)
+	assert.Equal(t, 1, onDown.Count())
+	assert.Equal(t, 0, heldRequests(svc.Hold))
+	assert.Equal(t, int64(len("payload")), <-heldDuring)
+	assert.Equal(t, int64(0), svc.Hold.heldBytes)
+
+	state, _ := svc.State()
+	assert.Equal(t, ServiceUp, state)
+}
+
+// TestRequestHoldTimeout verifies that the warm-up page is given for a held
+// request if the service doesn't come up in time.
+func TestRequestHoldTimeout(t *testing.T) {
+	onDown := &lockedCounterTriggerHandler{}
+	svc := newIdleTestService(t, onDown)
+	svc.Hold = NewRequestHold()
+	svc.Hold.Timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	response, body := holdTestRequest(t, svc, strings.NewReader("payload"))
+	assert.True(t, time.Since(start) >= 200 * time.Millisecond)
+	assert.Equal(t, 503, response.StatusCode)
+	assert.Contains(t, body, "Service Not Ready")
+	assert.Equal(t, 1, onDown.Count())
+	assert.Equal(t, 0, heldRequests(svc.Hold))
+
+	// while the service is starting, requests are still held
+	start = time.Now()
+	response, _ = holdTestRequest(t, svc, nil)
+	assert.True(t, time.Since(start) >= 200 * time.Millisecond)
+	assert.Equal(t, 503, response.StatusCode)
+	assert.Equal(t, 1, onDown.Count())
+}
+
+// TestRequestHoldLimits verifies that requests which would go over the limits
+// of a hold are given the warm-up page right away.
+func TestRequestHoldLimits(t *testing.T) {
+	svc := newIdleTestService(t, &lockedCounterTriggerHandler{})
+	svc.Hold = NewRequestHold()
+	svc.Hold.Timeout = 2 * time.Second
+	svc.Hold.MaxRequests = 1
+	svc.Hold.MaxBytes = 8
+
+	done := make(chan struct{})
+	go func() {
+		holdTestRequest(t, svc, strings.NewReader("payload"))
+		close(done)
+	}()
+	for heldRequests(svc.Hold) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	response, _ := holdTestRequest(t, svc, nil)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 503, response.StatusCode)
+	<-done
+
+	svc.Hold.MaxRequests = 2
+	start = time.Now()
+	response, _ = holdTestRequest(t, svc, strings.NewReader("too large"))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 503, response.StatusCode)
+
+	// a body of unknown length is read only until it is known to be too
+	// large
+	start = time.Now()
+	response, _ = holdTestRequest(
+		t,
+		svc,
+		ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 1024))),
+	)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 503, response.StatusCode)
+	assert.Equal(t, 0, heldRequests(svc.Hold))
+
+	svc.Hold.mutex.Lock()
+	assert.Equal(t, int64(0), svc.Hold.heldBytes)
+	svc.Hold.mutex.Unlock()
+}
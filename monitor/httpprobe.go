@@ -0,0 +1,234 @@
+package monitor
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/proidiot/gone/errors"
+	"github.com/stuphlabs/pullcord/config"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// DefaultProbeTimeout is the amount of time a probe is given to get an answer
+// from a service if no other value is given.
+const DefaultProbeTimeout = 10 * time.Second
+
+// maxProbeBody is the most of a response body which will be searched by the
+// body regex of an HTTPProbe.
+const maxProbeBody = 64 * 1024
+
+// InvalidProbeStatusError indicates that an HTTPProbe was configured to expect
+// a status code which could never be given.
+const InvalidProbeStatusError = errors.New(
+	"An HTTP probe can only expect status codes from 100 to 599",
+)
+
+// HTTPProbe is a Prober which sends an HTTP (or HTTPS) request to a service to
+// check whether it is up. The service is only up if it answers with one of the
+// expected status codes (any 2xx or 3xx status if none are given), and if the
+// body of the answer matches the body regex (if one is given). Redirects are
+// not followed. A service which accepts a connection but then answers some
+// other way (i.e. a web app which is still running its migrations) is down.
+//
+// The request is sent to the address and port of the service, using the given
+// method (GET by default) and path ("/" by default). If a host is given, it is
+// sent as the Host header, and (for HTTPS) it is the name the certificate of
+// the service is checked against. Certificate checks can be skipped entirely
+// with the insecure option, which is meant for services with self-signed
+// certificates.
+type HTTPProbe struct {
+	Method string
+	Path string
+	Host string
+	TLS bool
+	Insecure bool
+	ExpectStatus []int
+	BodyRegex *regexp.Regexp
+	Timeout time.Duration
+}
+
+func init() {
+	config.RegisterResourceType(
+		"httpprobe",
+		func() json.Unmarshaler {
+			return new(HTTPProbe)
+		},
+	)
+}
+
+func (p *HTTPProbe) UnmarshalJSON(input []byte) error {
+	var t struct {
+		Method string
+		Path string
+		Host string
+		TLS bool
+		Insecure bool
+		ExpectStatus []int
+		BodyRegex string
+		Timeout string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	if t.Path != "" && t.Path[0] != '/' {
+		return errors.New("An HTTP probe path must begin with a slash")
+	}
+
+	for _, status := range t.ExpectStatus {
+		if status < 100 || status > 599 {
+			return InvalidProbeStatusError
+		}
+	}
+
+	p.BodyRegex = nil
+	if t.BodyRegex != "" {
+		if r, e := regexp.Compile(t.BodyRegex); e != nil {
+			return e
+		} else {
+			p.BodyRegex = r
+		}
+	}
+
+	p.Timeout = 0
+	if t.Timeout != "" {
+		if d, e := time.ParseDuration(t.Timeout); e != nil {
+			return e
+		} else if d <= 0 {
+			return errors.New(
+				"An HTTP probe timeout must be positive",
+			)
+		} else {
+			p.Timeout = d
+		}
+	}
+
+	p.Method = t.Method
+	p.Path = t.Path
+	p.Host = t.Host
+	p.TLS = t.TLS
+	p.Insecure = t.Insecure
+	p.ExpectStatus = t.ExpectStatus
+
+	return nil
+}
+
+// expected determines whether the given status code is one of the expected
+// status codes.
+func (p *HTTPProbe) expected(status int) bool {
+	if len(p.ExpectStatus) == 0 {
+		return status >= 200 && status < 400
+	}
+
+	for _, s := range p.ExpectStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Probe sends the request to the given address and port, and reports whether
+// the answer was as expected, making HTTPProbe a valid Prober implementation.
+// An error is only given if no answer was received at all.
+func (p *HTTPProbe) Probe(
+	protocol, address string,
+	port int,
+) (up bool, err error) {
+	method := p.Method
+	if method == "" {
+		method = "GET"
+	}
+	path := p.Path
+	if path == "" {
+		path = "/"
+	}
+	scheme := "http"
+	if p.TLS {
+		scheme = "https"
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+
+	host := net.JoinHostPort(address, strconv.Itoa(port))
+	req, err := http.NewRequest(method, scheme + "://" + host + path, nil)
+	if err != nil {
+		return false, err
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: p.Insecure}
+	if p.Host != "" {
+		req.Host = p.Host
+		if h, _, e := net.SplitHostPort(p.Host); e == nil {
+			tlsConfig.ServerName = h
+		} else {
+			tlsConfig.ServerName = p.Host
+		}
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: timeout,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			return false, urlErr.Err
+		}
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if !p.expected(resp.StatusCode) {
+		log().Debug(
+			fmt.Sprintf(
+				"minmonitor http probe of %s received an" +
+				" unexpected status: %d",
+				host,
+				resp.StatusCode,
+			),
+		)
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+
+	if p.BodyRegex != nil {
+		limited := io.LimitReader(resp.Body, maxProbeBody)
+		body, e := ioutil.ReadAll(limited)
+		if e != nil {
+			return false, e
+		}
+		if !p.BodyRegex.Match(body) {
+			log().Debug(
+				fmt.Sprintf(
+					"minmonitor http probe of %s received" +
+					" a body which does not match: %s",
+					host,
+					p.BodyRegex,
+				),
+			)
+			return false, nil
+		}
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	return true, nil
+}
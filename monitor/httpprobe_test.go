@@ -0,0 +1,180 @@
+package monitor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHealthCheck is an in-process web app which answers with a given status
+// and body, and records the requests it receives.
+type fakeHealthCheck struct {
+	mutex sync.Mutex
+	status int
+	body string
+	requests []*http.Request
+}
+
+func (f *fakeHealthCheck) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.requests = append(f.requests, r)
+	if f.status == 302 {
+		w.Header().Set("Location", "/elsewhere")
+	}
+	w.WriteHeader(f.status)
+	w.Write([]byte(f.body))
+}
+
+func (f *fakeHealthCheck) Set(status int, body string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.status = status
+	f.body = body
+}
+
+func (f *fakeHealthCheck) LastRequest() *http.Request {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.requests) == 0 {
+		return nil
+	}
+	return f.requests[len(f.requests) - 1]
+}
+
+// newHTTPProbeTestService creates a service which is probed with the given
+// Prober at the given test server.
+func newHTTPProbeTestService(
+	t *testing.T,
+	server *httptest.Server,
+	probe Prober,
+) *MinMonitorredService {
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+	host, rawPort, err := net.SplitHostPort(u.Host)
+	assert.NoError(t, err)
+	port, err := strconv.Atoi(rawPort)
+	assert.NoError(t, err)
+
+	svc, err := NewMinMonitorredService(
+		host,
+		port,
+		"tcp",
+		time.Duration(0),
+		nil,
+		nil,
+		nil,
+	)
+	assert.NoError(t, err)
+	svc.Prober = probe
+	return svc
+}
+
+// TestHTTPProbeStatus verifies that a service which accepts connections is
+// only up once it answers with an expected status.
+func TestHTTPProbeStatus(t *testing.T) {
+	app := &fakeHealthCheck{status: 503, body: "migrating"}
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	probe := &HTTPProbe{
+		Method: "HEAD",
+		Path: "/health?full=1",
+		Host: "app.example.com",
+	}
+	svc := newHTTPProbeTestService(t, server, probe)
+
+	up, err := svc.Reprobe()
+	assert.NoError(t, err)
+	assert.False(t, up)
+	if r := app.LastRequest(); assert.NotNil(t, r) {
+		assert.Equal(t, "HEAD", r.Method)
+		assert.Equal(t, "/health", r.URL.Path)
+		assert.Equal(t, "1", r.URL.Query().Get("full"))
+		assert.Equal(t, "app.example.com", r.Host)
+	}
+
+	app.Set(200, "ok")
+	up, err = svc.Reprobe()
+	assert.NoError(t, err)
+	assert.True(t, up)
+
+	// redirects are not followed, but count as up by default
+	app.Set(302, "")
+	up, err = svc.Reprobe()
+	assert.NoError(t, err)
+	assert.True(t, up)
+
+	probe.ExpectStatus = []int{200, 204}
+	up, err = svc.Reprobe()
+	assert.NoError(t, err)
+	assert.False(t, up)
+
+	app.Set(204, "")
+	up, err = svc.Reprobe()
+	assert.NoError(t, err)
+	assert.True(t, up)
+
+	server.Close()
+	up, err = svc.Reprobe()
+	assert.NoError(t, err)
+	assert.False(t, up)
+}
+
+// TestHTTPProbeBodyRegex verifies that a service is only up if the body of its
+// answer matches the body regex.
+func TestHTTPProbeBodyRegex(t *testing.T) {
+	app := &fakeHealthCheck{status: 200, body: `{"db": "pending"}`}
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	svc := newHTTPProbeTestService(
+		t,
+		server,
+		&HTTPProbe{BodyRegex: regexp.MustCompile(`"db": "ok"`)},
+	)
+
+	up, err := svc.Reprobe()
+	assert.NoError(t, err)
+	assert.False(t, up)
+	if r := app.LastRequest(); assert.NotNil(t, r) {
+		assert.Equal(t, "GET", r.Method)
+		assert.Equal(t, "/", r.URL.Path)
+	}
+
+	app.Set(200, `{"db": "ok"}`)
+	up, err = svc.Reprobe()
+	assert.NoError(t, err)
+	assert.True(t, up)
+}
+
+// TestHTTPProbeTLS verifies that an HTTPS service can be probed, and that its
+// certificate is checked unless the probe is insecure.
+func TestHTTPProbeTLS(t *testing.T) {
+	app := &fakeHealthCheck{status: 200, body: "ok"}
+	server := httptest.NewTLSServer(app)
+	defer server.Close()
+
+	probe := &HTTPProbe{TLS: true}
+	svc := newHTTPProbeTestService(t, server, probe)
+
+	up, err := svc.Reprobe()
+	assert.Error(t, err)
+	assert.False(t, up)
+
+	probe.Insecure = true
+	up, err = svc.Reprobe()
+	assert.NoError(t, err)
+	assert.True(t, up)
+	if r := app.LastRequest(); assert.NotNil(t, r) {
+		assert.NotNil(t, r.TLS)
+	}
+}
@@ -0,0 +1,162 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stuphlabs/pullcord/config"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+)
+
+// icmpProbePayload is the data sent in (and expected back in) each echo
+// request, so that replies to other programs can be told apart.
+var icmpProbePayload = []byte("pullcord icmp probe")
+
+// ICMPProbe is a Prober which sends an ICMP echo request (i.e. a ping) to the
+// address of the service, and finds it up if an echo reply arrives before the
+// timeout. This says nothing about whether any particular port is open, but
+// it can be used (perhaps in an allofprobe) to check that the network of a VM
+// is up before the app on it has started. The port and protocol of the
+// service are ignored.
+//
+// An unprivileged ping socket is used where available (on Linux, this depends
+// on the net.ipv4.ping_group_range sysctl). Otherwise, a raw socket is used,
+// which requires root (or CAP_NET_RAW).
+type ICMPProbe struct {
+	Timeout time.Duration
+}
+
+func init() {
+	config.RegisterResourceType(
+		"icmpprobe",
+		func() json.Unmarshaler {
+			return new(ICMPProbe)
+		},
+	)
+}
+
+func (p *ICMPProbe) UnmarshalJSON(input []byte) error {
+	var t struct {
+		Timeout string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	d, e := parseProbeTimeout(t.Timeout)
+	p.Timeout = d
+	return e
+}
+
+// listenICMP opens a socket for sending echo requests to the given address,
+// preferring an unprivileged ping socket. It gives the socket, the address to
+// send to, and the protocol number of the replies.
+func listenICMP(ip net.IP) (*icmp.PacketConn, net.Addr, int, error) {
+	udpNetwork, rawNetwork := "udp4", "ip4:icmp"
+	listen, proto := "0.0.0.0", 1
+	if ip.To4() == nil {
+		udpNetwork, rawNetwork = "udp6", "ip6:ipv6-icmp"
+		listen, proto = "::", 58
+	}
+
+	if conn, e := icmp.ListenPacket(udpNetwork, listen); e == nil {
+		return conn, &net.UDPAddr{IP: ip}, proto, nil
+	}
+
+	conn, e := icmp.ListenPacket(rawNetwork, listen)
+	if e != nil {
+		return nil, nil, 0, e
+	}
+	return conn, &net.IPAddr{IP: ip}, proto, nil
+}
+
+// Probe pings the address of the service, making ICMPProbe a valid Prober
+// implementation. An error is given if the address could not be resolved, or
+// if no socket could be opened to send the ping.
+func (p *ICMPProbe) Probe(
+	protocol, address string,
+	port int,
+) (up bool, err error) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	ipAddr, err := net.ResolveIPAddr("ip", address)
+	if err != nil {
+		return false, err
+	}
+
+	conn, dest, proto, err := listenICMP(ipAddr.IP)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var requestType icmp.Type = ipv4.ICMPTypeEcho
+	var replyType icmp.Type = ipv4.ICMPTypeEchoReply
+	if proto != 1 {
+		requestType = ipv6.ICMPTypeEchoRequest
+		replyType = ipv6.ICMPTypeEchoReply
+	}
+
+	// The ID is replaced by the kernel for a ping socket, so replies are
+	// matched by their sequence number and data instead.
+	seq := rand.Intn(0x10000)
+	request := icmp.Message{
+		Type: requestType,
+		Body: &icmp.Echo{
+			ID: os.Getpid() & 0xffff,
+			Seq: seq,
+			Data: icmpProbePayload,
+		},
+	}
+	b, err := request.Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+
+	if err = conn.SetDeadline(deadline); err != nil {
+		return false, err
+	}
+	if _, err = conn.WriteTo(b, dest); err != nil {
+		return false, err
+	}
+
+	reply := make([]byte, 1500)
+	for {
+		n, _, e := conn.ReadFrom(reply)
+		if e != nil {
+			log().Debug(
+				fmt.Sprintf(
+					"minmonitor icmp probe of %s did not" +
+					" receive a reply: %v",
+					address,
+					e,
+				),
+			)
+			return false, nil
+		}
+
+		m, e := icmp.ParseMessage(proto, reply[:n])
+		if e != nil || m.Type != replyType {
+			continue
+		}
+		echo, ok := m.Body.(*icmp.Echo)
+		if ok && echo.Seq == seq && bytes.Equal(
+			echo.Data,
+			icmpProbePayload,
+		) {
+			return true, nil
+		}
+	}
+}
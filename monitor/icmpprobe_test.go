@@ -0,0 +1,20 @@
+package monitor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestICMPProbe(t *testing.T) {
+	probe := &ICMPProbe{Timeout: time.Second}
+
+	up, err := probe.Probe("tcp", "127.0.0.1", 80)
+	if err != nil {
+		t.Skipf("unable to send a ping from this environment: %v", err)
+	}
+	assert.True(t, up)
+
+	_, err = probe.Probe("tcp", "nonexistent.invalid", 80)
+	assert.Error(t, err)
+}
@@ -0,0 +1,642 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fitstar/falcore"
+	"github.com/proidiot/gone/errors"
+	"github.com/stuphlabs/pullcord/config"
+	"github.com/stuphlabs/pullcord/trigger"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NoIdleTriggerError indicates that an idle controller was configured without
+// a trigger to run once its service is idle.
+const NoIdleTriggerError = errors.New(
+	"An idle controller requires a trigger to run once the service is idle",
+)
+
+// The states an IdleController can be in, as given in an IdleStatus.
+const (
+	IdleActive = "active"
+	IdleWaiting = "waiting"
+	IdleFired = "idle"
+	IdleStopped = "stopped"
+)
+
+// IdleStatus describes the traffic an IdleController has seen: the number of
+// requests which are still in flight, the total number of requests, when the
+// most recent request started or finished, and what the controller is doing
+// (i.e. whether it is waiting out the idle timeout, or it has already run its
+// trigger).
+type IdleStatus struct {
+	State string
+	InFlight int
+	Requests uint64
+	LastActive time.Time
+}
+
+// IdleController is a Falcore RequestFilter which sits in front of a
+// MinMonitorredService (in place of it in a pipeline) and counts the requests
+// which pass through to it. A request is in flight until the body of its
+// response has been closed, so a long-lived connection (such as a large
+// download or a stream of events) keeps the service busy for as long as it is
+// open. Requests for the status or stats of the service (whether at its status
+// and stats paths, or with the PullcordQuery parameter) are not counted. Once
+// no request has been in flight for the idle timeout, the OnIdle
+// trigger is run (presumably to stop the service). It is run only once until
+// more traffic arrives.
+//
+// The OnIdle trigger is never run while a start of the service is in progress
+// (which is known if the OnDown trigger of the service keeps track of its
+// status, as an asynctrigger does), nor while any service which depends on the
+// service is up or starting, nor during a window of the schedule of the service
+// during which it is pinned up. Instead, the idle timeout starts over. During a
+// window in which the service is pinned down, the OnIdle trigger is run as
+// soon as the service is found up, whether or not it is idle.
+//
+// A service which was up is stopping while the OnIdle trigger is run, and
+// until a probe finds it down (or the start timeout of the service passes). If
+// the OnIdle trigger fails, the service is left up.
+//
+// The idle timeout is first started when the controller is started, so a
+// service which receives no traffic at all will still be stopped.
+//
+// If the service has a state store, the controller keeps when the service was
+// last active in it, so that the idle timeout isn't started over by a restart
+// of Pullcord. So as not to write to the store with every request, this is
+// only kept once it has moved on by a tenth of the idle timeout (and whenever
+// the OnIdle trigger is run, or the controller is stopped), so after a crash
+// the service may be found idle that much sooner.
+type IdleController struct {
+	Service *MinMonitorredService
+	IdleTimeout time.Duration
+	OnIdle trigger.TriggerHandler
+	mutex sync.Mutex
+	inFlight int
+	requests uint64
+	lastActive time.Time
+	fired bool
+	started bool
+	timer *time.Timer
+	generation uint64
+	firing sync.WaitGroup
+	saved idleRecord
+}
+
+func init() {
+	config.RegisterResourceType(
+		"idlecontroller",
+		func() json.Unmarshaler {
+			return new(IdleController)
+		},
+	)
+}
+
+func (c *IdleController) UnmarshalJSON(data []byte) error {
+	var t struct {
+		Service config.Resource
+		IdleTimeout string
+		OnIdle *config.Resource
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	switch s := t.Service.Unmarshaled.(type) {
+	case *MinMonitorredService:
+		c.Service = s
+	default:
+		log().Err(
+			fmt.Sprintf(
+				"Registry value is not a" +
+				" MinMonitorredService: %s",
+				s,
+			),
+		)
+		return config.UnexpectedResourceType
+	}
+
+	if d, e := time.ParseDuration(t.IdleTimeout); e != nil {
+		return e
+	} else if d <= 0 {
+		return errors.New("An idle timeout must be positive")
+	} else {
+		c.IdleTimeout = d
+	}
+
+	if t.OnIdle == nil {
+		return NoIdleTriggerError
+	}
+	switch o := t.OnIdle.Unmarshaled.(type) {
+	case trigger.TriggerHandler:
+		c.OnIdle = o
+	default:
+		log().Err(
+			fmt.Sprintf(
+				"Registry value is not a Trigger: %s",
+				o,
+			),
+		)
+		return config.UnexpectedResourceType
+	}
+
+	return nil
+}
+
+// NewIdleController constructs a new IdleController for the given service,
+// which will run the given trigger once the service has been idle for the
+// given amount of time. The controller does nothing until it is started.
+func NewIdleController(
+	service *MinMonitorredService,
+	idleTimeout time.Duration,
+	onIdle trigger.TriggerHandler,
+) *IdleController {
+	return &IdleController{
+		Service: service,
+		IdleTimeout: idleTimeout,
+		OnIdle: onIdle,
+	}
+}
+
+// idleController gives the controller which has been started for the service,
+// or nil if there isn't one.
+func (svc *MinMonitorredService) idleController() *IdleController {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	return svc.idle
+}
+
+// bindIdle makes the given controller the one started for the service.
+func (svc *MinMonitorredService) bindIdle(c *IdleController) {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	svc.idle = c
+}
+
+// unbindIdle forgets the given controller if it is the one started for the
+// service (and not one which has replaced it since).
+func (svc *MinMonitorredService) unbindIdle(c *IdleController) {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	if svc.idle == c {
+		svc.idle = nil
+	}
+}
+
+// name gives the name by which the service is known in logs.
+func (c *IdleController) name() string {
+	if c.Service.Name != "" {
+		return c.Service.Name
+	}
+	return fmt.Sprintf("%s:%d", c.Service.Address, c.Service.Port)
+}
+
+// arm starts the idle timeout over. The mutex must be held.
+func (c *IdleController) arm() {
+	c.armFor(c.IdleTimeout)
+}
+
+// armFor starts the idle timeout over, but with only the given amount of time
+// left in it. The mutex must be held.
+func (c *IdleController) armFor(timeout time.Duration) {
+	c.generation += 1
+	generation := c.generation
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.timer = time.AfterFunc(
+		timeout,
+		func() {
+			c.expire(generation)
+		},
+	)
+}
+
+// disarm cancels the idle timeout. The mutex must be held.
+func (c *IdleController) disarm() {
+	c.generation += 1
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// expire is called once the idle timeout started by the given generation has
+// passed, and runs the OnIdle trigger unless something has happened since.
+func (c *IdleController) expire(generation uint64) {
+	c.mutex.Lock()
+	if !c.started || generation != c.generation || c.inFlight > 0 {
+		c.mutex.Unlock()
+		return
+	}
+
+	if c.Service.starting() {
+		log().Info(
+			fmt.Sprintf(
+				"idlecontroller will not stop \"%s\" while it" +
+				" is starting, waiting another %v",
+				c.name(),
+				c.IdleTimeout,
+			),
+		)
+		c.arm()
+		c.mutex.Unlock()
+		return
+	}
+
+	if w := c.Service.scheduleWindow(); w != nil && w.Mode == ScheduleUp {
+		log().Info(
+			fmt.Sprintf(
+				"idlecontroller will not stop \"%s\" during" +
+				" its scheduled up time \"%s\", waiting" +
+				" another %v",
+				c.name(),
+				w,
+				c.IdleTimeout,
+			),
+		)
+		c.arm()
+		c.mutex.Unlock()
+		return
+	}
+
+	// the dependents may need to be probed, which shouldn't hold up any
+	// requests in the meantime
+	c.mutex.Unlock()
+	active := c.Service.dependentsActive()
+	c.mutex.Lock()
+	if !c.started || generation != c.generation || c.inFlight > 0 {
+		c.mutex.Unlock()
+		return
+	}
+
+	if active {
+		log().Info(
+			fmt.Sprintf(
+				"idlecontroller will not stop \"%s\" while a" +
+				" service which depends on it is up, waiting" +
+				" another %v",
+				c.name(),
+				c.IdleTimeout,
+			),
+		)
+		c.arm()
+		c.mutex.Unlock()
+		return
+	}
+
+	log().Info(
+		fmt.Sprintf(
+			"idlecontroller found \"%s\" idle for %v, running the" +
+			" idle trigger",
+			c.name(),
+			c.IdleTimeout,
+		),
+	)
+	c.fire()
+}
+
+// fire runs the OnIdle trigger. The mutex must be held, and it is released.
+func (c *IdleController) fire() {
+	c.fired = true
+	c.timer = nil
+	c.firing.Add(1)
+	record := c.keep()
+	c.mutex.Unlock()
+	defer c.firing.Done()
+
+	c.save(record)
+
+	stopping := c.Service.transition(ServiceStopping, ServiceUp)
+
+	ctx := trigger.NewTriggerContext()
+	ctx.Service = c.Service.Name
+	ctx.Hook = "OnIdle"
+	if e := trigger.WithContext(c.OnIdle).TriggerWith(ctx); e != nil {
+		if stopping {
+			c.Service.transition(ServiceUp, ServiceStopping)
+		}
+		log().Err(
+			fmt.Sprintf(
+				"idlecontroller received an error while" +
+				" running the idle trigger for \"%s\": %v",
+				c.name(),
+				e,
+			),
+		)
+	}
+}
+
+// force runs the OnIdle trigger right away (for the given reason), whether or
+// not the service is idle, unless the controller has been stopped.
+func (c *IdleController) force(reason string) {
+	c.mutex.Lock()
+	if !c.started {
+		c.mutex.Unlock()
+		return
+	}
+	c.disarm()
+
+	log().Info(
+		fmt.Sprintf(
+			"idlecontroller is running the idle trigger for" +
+			" \"%s\" for %s",
+			c.name(),
+			reason,
+		),
+	)
+	c.fire()
+}
+
+// wake starts the idle timeout over if the OnIdle trigger has already been
+// run, as it would be if more traffic had arrived.
+func (c *IdleController) wake() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.started && c.fired && c.inFlight == 0 {
+		c.fired = false
+		c.arm()
+	}
+}
+
+// begin records the start of a request.
+func (c *IdleController) begin() {
+	c.mutex.Lock()
+
+	wasFired := c.fired
+	if c.inFlight == 0 {
+		c.disarm()
+		if c.fired {
+			log().Info(
+				fmt.Sprintf(
+					"idlecontroller found \"%s\" active" +
+					" again",
+					c.name(),
+				),
+			)
+		}
+	}
+	c.inFlight += 1
+	c.requests += 1
+	c.fired = false
+	c.lastActive = time.Now()
+	var record idleRecord
+	if wasFired {
+		record = c.keep()
+	}
+	c.mutex.Unlock()
+
+	// otherwise the state store only needs to know once the request ends
+	if wasFired {
+		c.save(record)
+	}
+}
+
+// end records the end of a request.
+func (c *IdleController) end() {
+	c.mutex.Lock()
+
+	c.inFlight -= 1
+	c.lastActive = time.Now()
+	idle := c.inFlight == 0
+	if idle && c.started {
+		log().Debug(
+			fmt.Sprintf(
+				"idlecontroller found no requests in flight" +
+				" for \"%s\", waiting %v",
+				c.name(),
+				c.IdleTimeout,
+			),
+		)
+		c.arm()
+	}
+	record := c.record()
+	save := idle && c.stale(record)
+	if save {
+		c.keep()
+	}
+	c.mutex.Unlock()
+
+	if save {
+		c.save(record)
+	}
+}
+
+// idleRecord is what an IdleController keeps in the state store of its
+// service.
+type idleRecord struct {
+	LastActive time.Time `json:"lastactive"`
+	Fired bool `json:"fired"`
+}
+
+// storeKey gives the key under which the controller keeps its record in the
+// state store of its service.
+func (c *IdleController) storeKey() string {
+	return "idlecontroller/" + c.name()
+}
+
+// record gives what the controller would keep in the state store. The mutex
+// must be held.
+func (c *IdleController) record() idleRecord {
+	return idleRecord{LastActive: c.lastActive, Fired: c.fired}
+}
+
+// idleSaveFraction is the fraction of the idle timeout by which the time the
+// service was last active must move on before it is kept in the state store
+// again.
+const idleSaveFraction = 10
+
+// stale reports whether the record last kept in the state store is far enough
+// behind the given record that the given record should be kept instead. The
+// mutex must be held.
+func (c *IdleController) stale(record idleRecord) bool {
+	return record.Fired != c.saved.Fired ||
+		record.LastActive.Sub(c.saved.LastActive) >=
+		c.IdleTimeout / idleSaveFraction
+}
+
+// keep gives the current record of the controller, noting that it is the
+// record which is about to be kept in the state store. The mutex must be held.
+func (c *IdleController) keep() idleRecord {
+	c.saved = c.record()
+	return c.saved
+}
+
+// save keeps the given record in the state store of the service (if it has
+// one).
+func (c *IdleController) save(record idleRecord) {
+	if c.Service.Store == nil {
+		return
+	}
+
+	if e := c.Service.Store.Save(c.storeKey(), record); e != nil {
+		log().Err(
+			fmt.Sprintf(
+				"idlecontroller was unable to save the state" +
+				" of \"%s\": %v",
+				c.name(),
+				e,
+			),
+		)
+	}
+}
+
+// idleTrackingBody is the body of a response to a request counted by an
+// IdleController, which ends the request once it is closed.
+type idleTrackingBody struct {
+	io.ReadCloser
+	once sync.Once
+	end func()
+}
+
+func (b *idleTrackingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.end)
+	return err
+}
+
+func (c *IdleController) FilterRequest(
+	req *falcore.Request,
+) (*http.Response) {
+	// the status and stats of the service are answered by the service
+	// itself, and the warm-up page polls the status path, so neither
+	// counts as traffic
+	if c.Service.isStatusRequest(req.HttpRequest) ||
+	    c.Service.isStatsRequest(req.HttpRequest) {
+		return c.Service.FilterRequest(req)
+	}
+
+	c.begin()
+
+	resp := c.Service.FilterRequest(req)
+	if resp == nil || resp.Body == nil {
+		c.end()
+	} else {
+		resp.Body = &idleTrackingBody{ReadCloser: resp.Body, end: c.end}
+	}
+
+	return resp
+}
+
+// IdleStatus gives the traffic seen by the controller and its current state.
+func (c *IdleController) IdleStatus() IdleStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	result := IdleStatus{
+		InFlight: c.inFlight,
+		Requests: c.requests,
+		LastActive: c.lastActive,
+	}
+	if !c.started {
+		result.State = IdleStopped
+	} else if c.inFlight > 0 {
+		result.State = IdleActive
+	} else if c.fired {
+		result.State = IdleFired
+	} else {
+		result.State = IdleWaiting
+	}
+	return result
+}
+
+// Start begins the idle timeout (unless a request is already in flight),
+// making IdleController a valid config.Starter implementation. The service
+// only knows about the controller (i.e. to give its status, or to stop the
+// service during a scheduled down time) once it has been started. If the
+// service has a state store which knows when the service was last active (i.e.
+// before a restart of Pullcord), the idle timeout is started from then rather
+// than from now, and if the OnIdle trigger had already been run since, it is
+// not run again until more traffic arrives.
+func (c *IdleController) Start() error {
+	var record idleRecord
+	found := false
+	if c.Service.Store != nil {
+		var err error
+		found, err = c.Service.Store.Load(c.storeKey(), &record)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.started = true
+	if found && c.requests == 0 && c.timer == nil && !c.fired {
+		c.lastActive = record.LastActive
+		c.fired = record.Fired
+		c.saved = record
+		remaining := c.IdleTimeout - time.Since(record.LastActive)
+		if remaining < 0 {
+			remaining = 0
+		}
+		if !c.fired {
+			c.armFor(remaining)
+		}
+
+		log().Info(
+			fmt.Sprintf(
+				"idlecontroller restored \"%s\", last active" +
+				" at %v",
+				c.name(),
+				record.LastActive,
+			),
+		)
+	} else if c.inFlight == 0 && c.timer == nil {
+		c.arm()
+	}
+
+	c.Service.bindIdle(c)
+
+	log().Info(
+		fmt.Sprintf(
+			"idlecontroller started for \"%s\" with an idle" +
+			" timeout of %v",
+			c.name(),
+			c.IdleTimeout,
+		),
+	)
+
+	return nil
+}
+
+// Stop cancels the idle timeout and waits for any run of the OnIdle trigger
+// which is in progress to finish, making IdleController a valid
+// config.Stopper implementation. Requests are still passed along to the
+// service, but the OnIdle trigger will not be run again, and the service no
+// longer knows about the controller. If the state store of the service doesn't
+// yet know when the service was last active, it is told.
+func (c *IdleController) Stop() error {
+	c.Service.unbindIdle(c)
+
+	c.mutex.Lock()
+	c.started = false
+	c.disarm()
+	record := c.record()
+	save := record.Fired != c.saved.Fired ||
+		!record.LastActive.Equal(c.saved.LastActive)
+	if save {
+		c.keep()
+	}
+	c.mutex.Unlock()
+
+	c.firing.Wait()
+
+	if save {
+		c.save(record)
+	}
+
+	return nil
+}
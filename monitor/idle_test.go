@@ -0,0 +1,423 @@
+package monitor
+
+import (
+	"encoding/json"
+	"github.com/fitstar/falcore"
+	"github.com/proidiot/gone/errors"
+	"github.com/stretchr/testify/assert"
+	configutil "github.com/stuphlabs/pullcord/config/util"
+	"github.com/stuphlabs/pullcord/trigger"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedCounterTriggerHandler is a testing trigger which counts how many times
+// it has been fired, and which can be fired from another goroutine.
+type lockedCounterTriggerHandler struct {
+	mutex sync.Mutex
+	count int
+}
+
+func (th *lockedCounterTriggerHandler) Trigger() error {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	th.count += 1
+	return nil
+}
+
+func (th *lockedCounterTriggerHandler) Count() int {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	return th.count
+}
+
+// blockingTriggerHandler is a testing trigger which doesn't return until it is
+// released.
+type blockingTriggerHandler struct {
+	release chan struct{}
+}
+
+func (th *blockingTriggerHandler) Trigger() error {
+	<-th.release
+	return nil
+}
+
+// newIdleTestService creates a service (which is down) to be used by an
+// IdleController.
+func newIdleTestService(
+	t *testing.T,
+	onDown trigger.TriggerHandler,
+) *MinMonitorredService {
+	server, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	_, rawPort, err := net.SplitHostPort(server.Addr().String())
+	assert.NoError(t, err)
+	testPort, err := strconv.Atoi(rawPort)
+	assert.NoError(t, err)
+	err = server.Close()
+	assert.NoError(t, err)
+
+	svc, err := NewMinMonitorredService(
+		"localhost",
+		testPort,
+		"tcp",
+		time.Duration(0),
+		onDown,
+		nil,
+		nil,
+	)
+	assert.NoError(t, err)
+	svc.Name = "test"
+	return svc
+}
+
+// idleTestRequest runs a request through the given IdleController, returning
+// the response without closing its body.
+func idleTestRequest(t *testing.T, c *IdleController) *http.Response {
+	request, err := http.NewRequest("GET", "http://localhost", nil)
+	assert.NoError(t, err)
+
+	_, response := falcore.TestWithRequest(request, c, nil)
+	assert.Equal(t, 503, response.StatusCode)
+	return response
+}
+
+// TestIdleControllerBinding verifies that a service only knows about an idle
+// controller while the controller is started, so that one which was built but
+// never started (i.e. by a reload which failed) doesn't replace it.
+func TestIdleControllerBinding(t *testing.T) {
+	svc := newIdleTestService(t, nil)
+	onIdle := &lockedCounterTriggerHandler{}
+	live := NewIdleController(svc, time.Hour, onIdle)
+	assert.Nil(t, svc.idleController())
+	assert.NoError(t, live.Start())
+	assert.True(t, live == svc.idleController())
+
+	NewIdleController(svc, 2 * time.Hour, onIdle)
+	assert.True(t, live == svc.idleController())
+
+	replacement := NewIdleController(svc, 2 * time.Hour, onIdle)
+	assert.NoError(t, replacement.Start())
+	assert.NoError(t, live.Stop())
+	assert.True(t, replacement == svc.idleController())
+	assert.NoError(t, replacement.Stop())
+	assert.Nil(t, svc.idleController())
+}
+
+func TestIdleControllerFiresAfterTimeout(t *testing.T) {
+	onIdle := &lockedCounterTriggerHandler{}
+	c := NewIdleController(
+		newIdleTestService(t, nil),
+		200 * time.Millisecond,
+		onIdle,
+	)
+	err := c.Start()
+	assert.NoError(t, err)
+	defer c.Stop()
+
+	response := idleTestRequest(t, c)
+	status := c.IdleStatus()
+	assert.Equal(t, IdleActive, status.State)
+	assert.Equal(t, 1, status.InFlight)
+	assert.Equal(t, uint64(1), status.Requests)
+
+	// the response is still being sent, so the service is not idle
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, 0, onIdle.Count())
+
+	response.Body.Close()
+	response.Body.Close()
+	status = c.IdleStatus()
+	assert.Equal(t, IdleWaiting, status.State)
+	assert.Equal(t, 0, status.InFlight)
+	assert.False(t, status.LastActive.IsZero())
+
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, 1, onIdle.Count())
+	assert.Equal(t, IdleFired, c.IdleStatus().State)
+
+	// the trigger is only run once until there is more traffic
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, 1, onIdle.Count())
+
+	idleTestRequest(t, c).Body.Close()
+	assert.Equal(t, IdleWaiting, c.IdleStatus().State)
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, 2, onIdle.Count())
+	assert.Equal(t, uint64(2), c.IdleStatus().Requests)
+}
+
+func TestIdleControllerNoTraffic(t *testing.T) {
+	onIdle := &lockedCounterTriggerHandler{}
+	c := NewIdleController(
+		newIdleTestService(t, nil),
+		200 * time.Millisecond,
+		onIdle,
+	)
+
+	// nothing happens until the controller is started
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, 0, onIdle.Count())
+	assert.Equal(t, IdleStopped, c.IdleStatus().State)
+
+	err := c.Start()
+	assert.NoError(t, err)
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, 1, onIdle.Count())
+
+	err = c.Stop()
+	assert.NoError(t, err)
+	assert.Equal(t, IdleStopped, c.IdleStatus().State)
+}
+
+// TestIdleControllerStatusPolling verifies that requests for the status and
+// stats of the service (i.e. from a warm-up page) don't keep it from idling.
+func TestIdleControllerStatusPolling(t *testing.T) {
+	onIdle := &lockedCounterTriggerHandler{}
+	c := NewIdleController(
+		newIdleTestService(t, nil),
+		300 * time.Millisecond,
+		onIdle,
+	)
+	err := c.Start()
+	assert.NoError(t, err)
+	defer c.Stop()
+
+	paths := []string{
+		DefaultStatusPath,
+		DefaultStatsPath,
+		"/wiki?" + PullcordQuery + "=status",
+	}
+	for i := 0; i < 5; i++ {
+		for _, path := range paths {
+			request, err := http.NewRequest(
+				"GET",
+				"http://localhost" + path,
+				nil,
+			)
+			assert.NoError(t, err)
+			_, response := falcore.TestWithRequest(request, c, nil)
+			assert.Equal(t, 200, response.StatusCode)
+			response.Body.Close()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.Equal(t, 1, onIdle.Count())
+	assert.Equal(t, uint64(0), c.IdleStatus().Requests)
+}
+
+func TestIdleControllerStop(t *testing.T) {
+	onIdle := &lockedCounterTriggerHandler{}
+	c := NewIdleController(
+		newIdleTestService(t, nil),
+		200 * time.Millisecond,
+		onIdle,
+	)
+	err := c.Start()
+	assert.NoError(t, err)
+
+	idleTestRequest(t, c).Body.Close()
+	err = c.Stop()
+	assert.NoError(t, err)
+
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, 0, onIdle.Count())
+	assert.Equal(t, IdleStopped, c.IdleStatus().State)
+}
+
+func TestIdleControllerWhileStarting(t *testing.T) {
+	start := &blockingTriggerHandler{make(chan struct{})}
+	onDown := trigger.NewAsyncTrigger(start)
+	onIdle := &lockedCounterTriggerHandler{}
+	c := NewIdleController(
+		newIdleTestService(t, onDown),
+		200 * time.Millisecond,
+		onIdle,
+	)
+	err := c.Start()
+	assert.NoError(t, err)
+	defer c.Stop()
+
+	idleTestRequest(t, c).Body.Close()
+	assert.Equal(t, trigger.TriggerRunning, onDown.TriggerStatus().State)
+
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 0, onIdle.Count())
+	assert.Equal(t, IdleWaiting, c.IdleStatus().State)
+
+	// the service is still starting until it is found to be up
+	close(start.release)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 0, onIdle.Count())
+	state, _ := c.Service.State()
+	assert.Equal(t, ServiceStarting, state)
+
+	c.Service.SetStatusUp()
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 1, onIdle.Count())
+	state, _ = c.Service.State()
+	assert.Equal(t, ServiceStopping, state)
+}
+
+func TestIdleControllerStatusFilter(t *testing.T) {
+	svc := newIdleTestService(t, nil)
+	c := NewIdleController(svc, time.Minute, &lockedCounterTriggerHandler{})
+	err := c.Start()
+	assert.NoError(t, err)
+	defer c.Stop()
+
+	response := idleTestRequest(t, c)
+	defer response.Body.Close()
+
+	request, err := http.NewRequest("GET", "http://localhost/status", nil)
+	assert.NoError(t, err)
+	_, statusResponse := falcore.TestWithRequest(
+		request,
+		NewMinMonitorStatusFilter([]*MinMonitorredService{svc}),
+		nil,
+	)
+	assert.Equal(t, 200, statusResponse.StatusCode)
+
+	var doc map[string]struct {
+		Idle struct {
+			State string
+			InFlight int
+			Requests uint64
+			LastActive *time.Time
+		}
+	}
+	err = json.NewDecoder(statusResponse.Body).Decode(&doc)
+	assert.NoError(t, err)
+	if assert.Contains(t, doc, "test") {
+		idle := doc["test"].Idle
+		assert.Equal(t, "active", idle.State)
+		assert.Equal(t, 1, idle.InFlight)
+		assert.Equal(t, uint64(1), idle.Requests)
+		assert.NotNil(t, idle.LastActive)
+	}
+}
+
+func TestIdleControllerFromConfig(t *testing.T) {
+	test := configutil.ConfigTest{
+		ResourceType: "idlecontroller",
+		IsValid: func(i json.Unmarshaler) error {
+			c, ok := i.(*IdleController)
+			if !ok {
+				return errors.New(
+					"IdleController IsValid received an" +
+					" object of the wrong type.",
+				)
+			}
+
+			if c.Service == nil || c.OnIdle == nil {
+				return errors.New(
+					"IdleController IsValid received an" +
+					" incomplete controller.",
+				)
+			}
+
+			if c.Service.idle != nil {
+				return errors.New(
+					"IdleController IsValid received a" +
+					" controller bound to its service" +
+					" before it was started.",
+				)
+			}
+
+			return nil
+		},
+		SyntacticallyBad: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: "",
+				Explanation: "empty config",
+			},
+			configutil.ConfigTestData{
+				Data: "{}",
+				Explanation: "empty object",
+			},
+			configutil.ConfigTestData{
+				Data: "null",
+				Explanation: "null config",
+			},
+			configutil.ConfigTestData{
+				Data: "42",
+				Explanation: "numeric config",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"service": {
+						"type": "compoundtrigger",
+						"data": {}
+					},
+					"idletimeout": "30m",
+					"onidle": {
+						"type": "compoundtrigger",
+						"data": {}
+					}
+				}`,
+				Explanation: "non-service as service",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"service": {
+						"type": "minmonitorredservice",
+						"data": {
+							"address": "127.0.0.1",
+							"port": 80,
+							"protocol": "tcp",
+							"graceperiod": "1s"
+						}
+					},
+					"idletimeout": "30m"
+				}`,
+				Explanation: "no idle trigger",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"service": {
+						"type": "minmonitorredservice",
+						"data": {
+							"address": "127.0.0.1",
+							"port": 80,
+							"protocol": "tcp",
+							"graceperiod": "1s"
+						}
+					},
+					"idletimeout": "0s",
+					"onidle": {
+						"type": "compoundtrigger",
+						"data": {}
+					}
+				}`,
+				Explanation: "zero idle timeout",
+			},
+		},
+		Good: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: `{
+					"service": {
+						"type": "minmonitorredservice",
+						"data": {
+							"address": "127.0.0.1",
+							"port": 80,
+							"protocol": "tcp",
+							"graceperiod": "1s"
+						}
+					},
+					"idletimeout": "30m",
+					"onidle": {
+						"type": "compoundtrigger",
+						"data": {}
+					}
+				}`,
+				Explanation: "basic valid idle controller config",
+			},
+		},
+	}
+	test.Run(t)
+}
@@ -9,10 +9,12 @@ import (
 	// "github.com/stuphlabs/pullcord"
 	"github.com/stuphlabs/pullcord/config"
 	"github.com/stuphlabs/pullcord/proxy"
+	"github.com/stuphlabs/pullcord/store"
 	"github.com/stuphlabs/pullcord/trigger"
+	"html/template"
 	"net"
 	"net/http"
-	"strconv"
+	"sync"
 	"time"
 )
 
@@ -29,17 +31,52 @@ const UnknownServiceError = errors.New(
 )
 
 // MonitorredService holds the information for a single service definition.
+// It keeps track of the state of the service, running its OnDown trigger when
+// a request arrives while the service is down, and answering requests with a
+// warm-up page (or holding them) until the service is up. See Start, Schedule,
+// and AddDependency for the rest of what a service may be given.
 type MinMonitorredService struct {
+	Name string
 	Address string
 	Port int
 	Protocol string
 	GracePeriod time.Duration
+	StartTimeout time.Duration
+	ProbeInterval time.Duration
+	ProbeJitter time.Duration
+	UpThreshold int
+	DownThreshold int
+	Prober Prober
+	WarmupPage *template.Template
+	StatusPath string
+	StatsPath string
+	Store store.StateStore
+	Hold *RequestHold
+	DependsOn []*MinMonitorredService
+	Schedule *Schedule
 	OnDown trigger.TriggerHandler
 	OnUp trigger.TriggerHandler
 	Always trigger.TriggerHandler
+	mutex sync.Mutex
 	lastChecked time.Time
 	up bool
+	state string
+	stateSince time.Time
+	listenerMutex sync.Mutex
+	listeners []StateListener
+	successes int
+	failures int
+	stats ServiceStats
+	bootStarted time.Time
+	idleSince time.Time
+	upWaiters chan struct{}
+	dependents []*MinMonitorredService
+	probeStop chan<- struct{}
+	probeDone <-chan struct{}
+	scheduleStop chan<- struct{}
+	scheduleDone <-chan struct{}
 	passthru falcore.RequestFilter
+	idle *IdleController
 }
 
 func init() {
@@ -53,10 +90,24 @@ func init() {
 
 func (s *MinMonitorredService) UnmarshalJSON(data []byte) error {
 	var t struct {
+		Name string
 		Address string
 		Port int
 		Protocol string
 		GracePeriod string
+		StartTimeout string
+		ProbeInterval string
+		ProbeJitter string
+		UpThreshold int
+		DownThreshold int
+		Prober *config.Resource
+		WarmupPage string
+		StatusPath string
+		StatsPath string
+		Store *config.Resource
+		Hold *RequestHold
+		DependsOn []config.Resource
+		Schedule *config.Resource
 		OnDown *config.Resource
 		OnUp *config.Resource
 		Always *config.Resource
@@ -73,6 +124,107 @@ func (s *MinMonitorredService) UnmarshalJSON(data []byte) error {
 		s.GracePeriod = g
 	}
 
+	s.StartTimeout = DefaultStartTimeout
+	if t.StartTimeout != "" {
+		if d, e := time.ParseDuration(t.StartTimeout); e != nil {
+			return e
+		} else if d <= 0 {
+			return errors.New("A start timeout must be positive")
+		} else {
+			s.StartTimeout = d
+		}
+	}
+
+	if t.ProbeInterval != "" {
+		if d, e := time.ParseDuration(t.ProbeInterval); e != nil {
+			return e
+		} else if d <= 0 {
+			return errors.New("A probe interval must be positive")
+		} else {
+			s.ProbeInterval = d
+		}
+	}
+
+	if t.ProbeJitter != "" {
+		if d, e := time.ParseDuration(t.ProbeJitter); e != nil {
+			return e
+		} else if d < 0 {
+			return errors.New("A probe jitter must not be negative")
+		} else {
+			s.ProbeJitter = d
+		}
+	}
+
+	if t.UpThreshold < 0 || t.DownThreshold < 0 {
+		return errors.New("A probe threshold must not be negative")
+	}
+	s.UpThreshold = t.UpThreshold
+	s.DownThreshold = t.DownThreshold
+
+	s.WarmupPage = nil
+	if t.WarmupPage != "" {
+		p, e := template.New("warmup").Parse(t.WarmupPage)
+		if e != nil {
+			return e
+		}
+		s.WarmupPage = p
+	}
+
+	if t.StatusPath != "" && t.StatusPath[0] != '/' {
+		return errors.New("A status path must begin with a slash")
+	}
+	s.StatusPath = t.StatusPath
+
+	if t.StatsPath != "" && t.StatsPath[0] != '/' {
+		return errors.New("A stats path must begin with a slash")
+	}
+	s.StatsPath = t.StatsPath
+
+	s.Store = nil
+	if t.Store != nil && t.Store.Unmarshaled != nil {
+		switch st := t.Store.Unmarshaled.(type) {
+		case store.StateStore:
+			s.Store = st
+		default:
+			return config.UnexpectedResourceType
+		}
+	}
+
+	s.Hold = t.Hold
+
+	s.DependsOn = nil
+	for _, r := range t.DependsOn {
+		switch d := r.Unmarshaled.(type) {
+		case *MinMonitorredService:
+			if e := s.AddDependency(d); e != nil {
+				return e
+			}
+		default:
+			return config.UnexpectedResourceType
+		}
+	}
+
+	s.Schedule = nil
+	if t.Schedule != nil && t.Schedule.Unmarshaled != nil {
+		switch sc := t.Schedule.Unmarshaled.(type) {
+		case *Schedule:
+			s.Schedule = sc
+		default:
+			return config.UnexpectedResourceType
+		}
+	}
+
+	if t.Prober != nil {
+		switch p := t.Prober.Unmarshaled.(type) {
+		case Prober:
+			s.Prober = p
+		default:
+			return config.UnexpectedResourceType
+		}
+	} else {
+		s.Prober = nil
+	}
+
 	if t.OnDown != nil {
 		d := t.OnDown.Unmarshaled
 		switch d := d.(type) {
@@ -102,7 +254,7 @@ func (s *MinMonitorredService) UnmarshalJSON(data []byte) error {
 		a := t.Always.Unmarshaled
 		switch a := a.(type) {
 		case trigger.TriggerHandler:
-			s.OnDown = a
+			s.Always = a
 		default:
 			return config.UnexpectedResourceType
 		}
@@ -110,9 +262,11 @@ func (s *MinMonitorredService) UnmarshalJSON(data []byte) error {
 		s.Always = nil
 	}
 
+	s.Name = t.Name
 	s.Address = t.Address
 	s.Port = t.Port
 	s.Protocol = t.Protocol
+	s.passthru = proxy.NewPassthruFilter(s.Address, s.Port)
 
 	return nil
 }
@@ -127,16 +281,15 @@ func NewMinMonitorredService(
 	always trigger.TriggerHandler,
 ) (service *MinMonitorredService, err error) {
 	result := MinMonitorredService{
-		address,
-		port,
-		protocol,
-		gracePeriod,
-		onDown,
-		onUp,
-		always,
-		time.Time{},
-		false,
-		proxy.NewPassthruFilter(address, port),
+		Address: address,
+		Port: port,
+		Protocol: protocol,
+		GracePeriod: gracePeriod,
+		StartTimeout: DefaultStartTimeout,
+		OnDown: onDown,
+		OnUp: onUp,
+		Always: always,
+		passthru: proxy.NewPassthruFilter(address, port),
 	}
 
 	return &result, nil
@@ -147,7 +300,8 @@ func NewMinMonitorredService(
 // down status will never be cached. It is possible to explicitly set a service
 // as being up (which will be cached as with a normal probe). It is also
 // possible to explicitly re-probe a service regardless of the status of the
-// cache.
+// cache. A service which is probed in the background has its status (whether
+// up or down) cached until the next background probe.
 type MinMonitor struct {
 	table map[string]*MinMonitorredService
 }
@@ -159,15 +313,15 @@ type MinMonitor struct {
 // This function also allows the initial probe to either begin immediately or
 // to be deferred until the first status request.
 //
-// At this time, it is suggested that only TCP services be probed as the
-// current version of MinMonitor only checks to see that net.Dial() does not
-// fail, which would not be enough information to make a determination of the
-// status of a service that communicates over UDP. As the inability to interact
-// beyond an attempt to open a connection is a handicap in determining even the
-// status of some TCP-based services, future monitor implementations (including
-// any intended to be used in a production environment) should allow service
-// status to be determined by some amount of specified interaction (perhaps
-// involving regular expressions or callback functions).
+// By default, MinMonitor only checks to see that net.Dial() does not fail,
+// which would not be enough information to make a determination of the status
+// of a service that communicates over UDP (which should instead be given a
+// UDPProbe). As the inability to interact beyond an attempt to open a
+// connection is a handicap in determining even the status of some TCP-based
+// services, a service can instead be given a Prober, such as an HTTPProbe
+// (which checks the answer to an actual request), an ExpectProbe (which checks
+// what the service sends back, i.e. its banner), or a ShellProbe (which leaves
+// the decision to a command).
 func (monitor *MinMonitor) Add(
 	name string,
 	service *MinMonitorredService,
@@ -198,6 +352,9 @@ func (monitor *MinMonitor) Add(
 		monitor.table = make(map[string]*MinMonitorredService)
 	}
 
+	if service.Name == "" {
+		service.Name = name
+	}
 	monitor.table[name] = service
 
 	log().Info(
@@ -230,13 +387,33 @@ func (monitor *MinMonitor) Reprobe(name string) (up bool, err error) {
 }
 
 func (svc *MinMonitorredService) Reprobe() (up bool, err error) {
-	conn, err := net.Dial(
-		svc.Protocol,
-		svc.Address + ":" + strconv.Itoa(int(svc.Port)),
-	)
+	up, err = svc.probe(0)
+
+	svc.mutex.Lock()
 	svc.lastChecked = time.Now()
+	svc.up = up
+	svc.successes = 0
+	svc.failures = 0
+	t := svc.probed(up)
+	svc.mutex.Unlock()
+	svc.notify(t)
+
+	return up, err
+}
+
+// probe checks whether the service is up (giving up after the given timeout,
+// unless it is zero) without recording the result. If the service has a
+// Prober, it is used instead of just opening a connection.
+func (svc *MinMonitorredService) probe(
+	timeout time.Duration,
+) (up bool, err error) {
+	prober := svc.Prober
+	if prober == nil {
+		prober = &TCPProbe{Timeout: timeout}
+	}
+	up, err = prober.Probe(svc.Protocol, svc.Address, svc.Port)
+
 	if err != nil {
-		svc.up = false
 		// TODO check what the error was
 
 		switch castErr := err.(type) {
@@ -281,10 +458,18 @@ func (svc *MinMonitorredService) Reprobe() (up bool, err error) {
 
 			return false, err
 		}
-	} else {
-		defer conn.Close()
-		svc.up = true
+	} else if !up {
+		log().Info(
+			fmt.Sprintf(
+				"minmonitor reached \"%s:%d\", but it is not" +
+				" yet ready (interpereted as a down status)",
+				svc.Address,
+				svc.Port,
+			),
+		)
 
+		return false, nil
+	} else {
 		log().Info(
 			fmt.Sprintf(
 				"minmonitor successfully probed: \"%s:%d\"",
@@ -307,7 +492,9 @@ func (svc *MinMonitorredService) Reprobe() (up bool, err error) {
 // period (and no other forced re-probe has occurred since this forced status
 // up assignment). However, if the status of the service is reported as being
 // down, then it necessarily means that a probe has just occurred and the
-// service was unable to be reached.
+// service was unable to be reached. The exception is a service which is probed
+// in the background, for which the cached status is always given without a
+// new probe.
 func (monitor *MinMonitor) Status(name string) (up bool, err error) {
 	svc, entryExists := monitor.table[name]
 	if ! entryExists {
@@ -326,9 +513,28 @@ func (monitor *MinMonitor) Status(name string) (up bool, err error) {
 }
 
 func (svc *MinMonitorredService) Status() (up bool, err error) {
-	if (! svc.up) || time.Now().After(
+	svc.mutex.Lock()
+	if svc.probeDone != nil {
+		up = svc.up
+		svc.mutex.Unlock()
+
+		log().Debug(
+			fmt.Sprintf(
+				"minmonitor is using the status from the" +
+				" background probe of: \"%s:%d\"",
+				svc.Address,
+				svc.Port,
+			),
+		)
+
+		return up, nil
+	}
+	cached := svc.up && !time.Now().After(
 		svc.lastChecked.Add(svc.GracePeriod),
-	) {
+	)
+	svc.mutex.Unlock()
+
+	if !cached {
 		log().Info(
 			fmt.Sprintf(
 				"minmonitor must reprobe as either the grace" +
@@ -384,12 +590,73 @@ func (svc *MinMonitorredService) SetStatusUp() (error) {
 			svc.Port,
 		),
 	)
+	svc.mutex.Lock()
 	svc.lastChecked = time.Now()
 	svc.up = true
+	svc.successes = 0
+	svc.failures = 0
+	t := svc.setState(ServiceUp)
+	svc.mutex.Unlock()
+	svc.notify(t)
 
 	return nil
 }
 
+// TriggerStatuses gives the status of the most recent run of each of the
+// triggers of the named service which keeps track of such things (i.e. an
+// asynctrigger), keyed by the hook ("OnDown", "OnUp", or "Always").
+func (monitor *MinMonitor) TriggerStatuses(
+	name string,
+) (map[string]trigger.TriggerStatus, error) {
+	svc, entryExists := monitor.table[name]
+	if ! entryExists {
+		log().Err(
+			fmt.Sprintf(
+				"minmonitor cannot get the trigger statuses" +
+				" of unknown service: \"%s\"",
+				name,
+			),
+		)
+
+		return nil, UnknownServiceError
+	}
+
+	return svc.TriggerStatuses(), nil
+}
+
+// TriggerStatuses gives the status of the most recent run of each of the
+// triggers of this service which keeps track of such things, keyed by hook.
+func (svc *MinMonitorredService) TriggerStatuses() (
+	result map[string]trigger.TriggerStatus,
+) {
+	result = make(map[string]trigger.TriggerStatus)
+	hooks := map[string]trigger.TriggerHandler{
+		"OnDown": svc.OnDown,
+		"OnUp": svc.OnUp,
+		"Always": svc.Always,
+	}
+	for hook, t := range hooks {
+		if r, ok := t.(trigger.StatusReporter); ok {
+			result[hook] = r.TriggerStatus()
+		}
+	}
+
+	return result
+}
+
+// starting determines whether a start of the service is in progress, either
+// because the service is in the starting state, or because the OnDown trigger
+// keeps track of its status (i.e. it is an asynctrigger) and is still running.
+func (svc *MinMonitorredService) starting() bool {
+	if state, _ := svc.State(); state == ServiceStarting {
+		return true
+	}
+	if r, ok := svc.OnDown.(trigger.StatusReporter); ok {
+		return r.TriggerStatus().State == trigger.TriggerRunning
+	}
+	return false
+}
+
 // NewMonitorFilter produces a Falcore RequestFilter for a given named service.
 // This filter will forward to the service if it is up, otherwise it will
 // display an error page to the requester. There are also optional triggers
@@ -414,13 +681,93 @@ func (monitor *MinMonitor) NewMinMonitorFilter(
 	return svc, nil
 }
 
+// triggerContext creates the context under which the triggers of this service
+// are fired for the given request.
+func (svc *MinMonitorredService) triggerContext(
+	req *falcore.Request,
+) trigger.TriggerContext {
+	ctx := trigger.NewTriggerContext()
+	ctx.Service = svc.Name
+	ctx.Host = req.HttpRequest.Host
+	ctx.Path = req.HttpRequest.URL.Path
+
+	remote := req.HttpRequest.RemoteAddr
+	if host, _, e := net.SplitHostPort(remote); e == nil {
+		ctx.ClientIP = host
+	} else {
+		ctx.ClientIP = remote
+	}
+
+	return ctx
+}
+
+// upResponse passes a request along to a service which is up, running the
+// OnUp trigger first.
+func (svc *MinMonitorredService) upResponse(
+	req *falcore.Request,
+	ctx trigger.TriggerContext,
+) (*http.Response) {
+	if svc.OnUp != nil {
+		ctx.Hook = "OnUp"
+		err := trigger.WithContext(svc.OnUp).TriggerWith(ctx)
+		if err != nil {
+			log().Warning(
+				fmt.Sprintf(
+					"minmonitor filter" +
+					" received an error" +
+					" while running the" +
+					" onDown trigger on" +
+					" \"%s:%d\": %v",
+					svc.Address,
+					svc.Port,
+					err,
+				),
+			)
+			return falcore.StringResponse(
+				req.HttpRequest,
+				500,
+				nil,
+				"<html><head><title>Pullcord" +
+				" - Internal Server Error" +
+				"</title></head><body><h1>" +
+				"Pullcord - Internal Server" +
+				" Error</h1><p>An internal" +
+				" server error has occurred," +
+				" but it might not be" +
+				" serious. However, if the" +
+				" problem persists, the site" +
+				" administrator should be" +
+				" contacted.</p></body></html>",
+			)
+		}
+	}
+
+	log().Debug("minmonitor filter passthru")
+	return svc.passthru.FilterRequest(req)
+}
+
+// FilterRequest passes the request along to the service once it is up, and
+// until then answers it with a warm-up page (or holds it, if the service has a
+// RequestHold). Requests for the status or stats of the service (see
+// PullcordQuery) are always answered by the service itself.
 func (svc *MinMonitorredService) FilterRequest(
 	req *falcore.Request,
 ) (*http.Response) {
 	log().Debug("running minmonitor filter")
 
+	if svc.isStatsRequest(req.HttpRequest) {
+		return svc.statsResponse(req)
+	}
+
+	ctx := svc.triggerContext(req)
+	window := svc.scheduleWindow()
+
 	up, err := svc.Status()
-	if err != nil {
+	if err == nil && svc.isStatusRequest(req.HttpRequest) {
+		return svc.statusResponse(req, up)
+	} else if window != nil && window.Mode == ScheduleDown {
+		return svc.scheduledDownResponse(req, window)
+	} else if err != nil {
 		log().Warning(
 			fmt.Sprintf(
 				"minmonitor filter received an error" +
@@ -446,7 +793,8 @@ func (svc *MinMonitorredService) FilterRequest(
 	}
 
 	if svc.Always != nil {
-		err = svc.Always.Trigger()
+		ctx.Hook = "Always"
+		err = trigger.WithContext(svc.Always).TriggerWith(ctx)
 		if err != nil {
 			log().Warning(
 				fmt.Sprintf(
@@ -477,71 +825,53 @@ func (svc *MinMonitorredService) FilterRequest(
 	}
 
 	if up {
-		if svc.OnUp != nil {
-			err = svc.OnUp.Trigger()
-			if err != nil {
-				log().Warning(
-					fmt.Sprintf(
-						"minmonitor filter" +
-						" received an error" +
-						" while running the" +
-						" onDown trigger on" +
-						" \"%s:%d\": %v",
-						svc.Address,
-						svc.Port,
-						err,
-					),
-				)
-				return falcore.StringResponse(
-					req.HttpRequest,
-					500,
-					nil,
-					"<html><head><title>Pullcord" +
-					" - Internal Server Error" +
-					"</title></head><body><h1>" +
-					"Pullcord - Internal Server" +
-					" Error</h1><p>An internal" +
-					" server error has occurred," +
-					" but it might not be" +
-					" serious. However, if the" +
-					" problem persists, the site" +
-					" administrator should be" +
-					" contacted.</p></body></html>",
-				)
-			}
-		}
+		return svc.upResponse(req, ctx)
+	}
 
-		log().Debug("minmonitor filter passthru")
-		return svc.passthru.FilterRequest(req)
+	state, since := svc.State()
+	if state == ServiceStarting || state == ServiceStopping {
+		log().Info(
+			fmt.Sprintf(
+				"minmonitor filter has reached a service" +
+				" (\"%s:%d\") which has been %s since %v, not" +
+				" running the onDown trigger again",
+				svc.Address,
+				svc.Port,
+				state,
+				since,
+			),
+		)
+		return svc.notReadyResponse(req, ctx)
+	}
+
+	if len(svc.DependsOn) > 0 {
+		// the dependencies are started in the background, as each
+		// must be up before the next can be started
+		if svc.startBoot(time.Now()) {
+			go svc.startWithDependencies(ctx)
+		}
+		return svc.notReadyResponse(req, ctx)
 	}
 
 	if svc.OnDown != nil {
-		err = svc.OnDown.Trigger()
-		if err != nil {
-			log().Warning(
-				fmt.Sprintf(
-					"minmonitor filter received" +
-					" an error while running the" +
-					" onDown trigger on \"%s:%d\": %v",
-					svc.Address,
-					svc.Port,
-					err,
-				),
-			)
+		// the service is starting before its OnDown trigger is run
+		// (which may take some time), so that requests which arrive in
+		// the meantime don't run the trigger again
+		if !svc.startBoot(time.Now()) {
+			return svc.notReadyResponse(req, ctx)
+		}
+		if err = svc.runOnDown(ctx); err != nil {
 			return falcore.StringResponse(
 				req.HttpRequest,
 				500,
 				nil,
-				"<html><head><title>Pullcord -" +
-				" Internal Server Error</title>" +
-				"</head><body><h1>Pullcord -" +
-				" Internal Server Error</h1><p>" +
-				"An internal server error has" +
-				" occurred, but it might not be" +
-				" serious. However, If the problem" +
-				" persists, the site administrator" +
-				" should be contacted.</p></body>" +
-				"</html>",
+				"<html><head><title>Pullcord - Internal" +
+				" Server Error</title></head><body><h1>" +
+				"Pullcord - Internal Server Error</h1><p>An" +
+				" internal server error has occurred, but it" +
+				" might not be serious. However, If the" +
+				" problem persists, the site administrator" +
+				" should be contacted.</p></body></html>",
 			)
 		}
 	}
@@ -555,19 +885,7 @@ func (svc *MinMonitorredService) FilterRequest(
 			svc.Port,
 		),
 	)
-	return falcore.StringResponse(
-		req.HttpRequest,
-		503,
-		nil,
-		"<html><head><title>Pullcord - Service Not Ready"+
-		"</title></head><body><h1>Pullcord - Service Not" +
-		" Ready</h1><p>The requested service is not yet" +
-		" ready, but any trigger to start the service has" +
-		" been started successfully, so hopefully the" +
-		" service will be up in a few minutes.</p><p>If you" +
-		" would like further information, please contact the" +
-		" site administrator.</p></body></html>",
-	)
+	return svc.notReadyResponse(req, ctx)
 }
 
 // NewMinMonitor constructs a new MinMonitor.
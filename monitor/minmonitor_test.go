@@ -2,11 +2,13 @@ package monitor
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"github.com/fitstar/falcore"
 	"github.com/proidiot/gone/errors"
 	"github.com/stretchr/testify/assert"
 	configutil "github.com/stuphlabs/pullcord/config/util"
+	"github.com/stuphlabs/pullcord/trigger"
 	"github.com/stuphlabs/pullcord/util"
 	"io/ioutil"
 	"net"
@@ -828,6 +830,165 @@ func TestMonitorFilterDownOnDownTriggerError(t *testing.T) {
 	assert.Equal(t, -1, onDown.count)
 }
 
+// startingTriggerHandler is a trigger which always reports that the service is
+// already starting.
+type startingTriggerHandler struct {
+	count int
+}
+
+func (th *startingTriggerHandler) Trigger() error {
+	th.count += 1
+	return trigger.ServiceStartingError
+}
+
+func TestMonitorFilterDownOnDownTriggerStarting(t *testing.T) {
+	request, err := http.NewRequest("GET", "http://localhost", nil)
+	assert.NoError(t, err)
+
+	testServiceName := "test"
+	testHost := "localhost"
+	testProtocol := "tcp"
+	gracePeriod := time.Duration(0)
+
+	server, err := net.Listen(testProtocol, ":0")
+	assert.NoError(t, err)
+	_, rawPort, err := net.SplitHostPort(server.Addr().String())
+	assert.NoError(t, err)
+	testPort, err := strconv.Atoi(rawPort)
+	assert.NoError(t, err)
+	err = server.Close()
+	assert.NoError(t, err)
+
+	onDown := &startingTriggerHandler{}
+
+	svc, err := NewMinMonitorredService(
+		testHost,
+		testPort,
+		testProtocol,
+		gracePeriod,
+		onDown,
+		nil,
+		nil,
+	)
+	assert.NoError(t, err)
+	mon := MinMonitor{}
+	err = mon.Add(
+		testServiceName,
+		svc,
+	)
+	assert.NoError(t, err)
+
+	filter, err := mon.NewMinMonitorFilter(
+		testServiceName,
+	)
+	assert.NoError(t, err)
+
+	_, response := falcore.TestWithRequest(
+		request,
+		filter,
+		nil,
+	)
+
+	assert.Equal(t, 503, response.StatusCode)
+	contents, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.True(
+		t,
+		strings.Contains(string(contents), "Service Not Ready"),
+		"content is: " + string(contents),
+	)
+	assert.Equal(t, 1, onDown.count)
+}
+
+// contextTriggerHandler is a trigger which keeps each context it is fired
+// with.
+type contextTriggerHandler struct {
+	contexts []trigger.TriggerContext
+}
+
+func (th *contextTriggerHandler) Trigger() error {
+	return th.TriggerWith(trigger.NewTriggerContext())
+}
+
+func (th *contextTriggerHandler) TriggerWith(
+	ctx trigger.TriggerContext,
+) error {
+	th.contexts = append(th.contexts, ctx)
+	return nil
+}
+
+func TestMonitorFilterDownTriggerContext(t *testing.T) {
+	request, err := http.NewRequest(
+		"GET",
+		"http://wiki.example.com/index",
+		nil,
+	)
+	assert.NoError(t, err)
+	request.RemoteAddr = "192.0.2.1:54321"
+
+	testServiceName := "wiki"
+	testHost := "localhost"
+	testProtocol := "tcp"
+	gracePeriod := time.Duration(0)
+
+	server, err := net.Listen(testProtocol, ":0")
+	assert.NoError(t, err)
+	_, rawPort, err := net.SplitHostPort(server.Addr().String())
+	assert.NoError(t, err)
+	testPort, err := strconv.Atoi(rawPort)
+	assert.NoError(t, err)
+	err = server.Close()
+	assert.NoError(t, err)
+
+	onDown := &contextTriggerHandler{}
+	onUp := &contextTriggerHandler{}
+	always := &contextTriggerHandler{}
+
+	svc, err := NewMinMonitorredService(
+		testHost,
+		testPort,
+		testProtocol,
+		gracePeriod,
+		onDown,
+		onUp,
+		always,
+	)
+	assert.NoError(t, err)
+	mon := MinMonitor{}
+	err = mon.Add(
+		testServiceName,
+		svc,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, testServiceName, svc.Name)
+
+	filter, err := mon.NewMinMonitorFilter(
+		testServiceName,
+	)
+	assert.NoError(t, err)
+
+	_, response := falcore.TestWithRequest(
+		request,
+		filter,
+		nil,
+	)
+
+	assert.Equal(t, 503, response.StatusCode)
+	assert.Equal(t, 0, len(onUp.contexts))
+	if assert.Equal(t, 1, len(always.contexts)) {
+		assert.Equal(t, "Always", always.contexts[0].Hook)
+	}
+	if assert.Equal(t, 1, len(onDown.contexts)) {
+		ctx := onDown.contexts[0]
+		assert.Equal(t, "wiki", ctx.Service)
+		assert.Equal(t, "OnDown", ctx.Hook)
+		assert.Equal(t, "192.0.2.1", ctx.ClientIP)
+		assert.Equal(t, "wiki.example.com", ctx.Host)
+		assert.Equal(t, "/index", ctx.Path)
+		assert.False(t, ctx.Time.IsZero())
+	}
+}
+
 func TestMonitorFilterDownAlwaysTriggerError(t *testing.T) {
 	request, err := http.NewRequest("GET", "http://localhost", nil)
 	assert.NoError(t, err)
@@ -892,6 +1053,26 @@ func TestMonitorFilterDownAlwaysTriggerError(t *testing.T) {
 func TestMinMonitorFromConfig(t *testing.T) {
 	test := configutil.ConfigTest{
 		ResourceType: "minmonitorredservice",
+		IsValid: func(i json.Unmarshaler) error {
+			svc, ok := i.(*MinMonitorredService)
+			if !ok {
+				return errors.New(
+					"MinMonitorredService IsValid" +
+					" received an object of the wrong" +
+					" type.",
+				)
+			}
+
+			if svc.passthru == nil {
+				return errors.New(
+					"MinMonitorredService IsValid" +
+					" received a service with an" +
+					" uninitialized passthru filter.",
+				)
+			}
+
+			return nil
+		},
 		SyntacticallyBad: []configutil.ConfigTestData{
 			configutil.ConfigTestData{
 				Data: "",
@@ -909,6 +1090,232 @@ func TestMinMonitorFromConfig(t *testing.T) {
 				Data: "42",
 				Explanation: "numeric config",
 			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"starttimeout": "0s"
+				}`,
+				Explanation: "zero start timeout",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"probeinterval": "0s"
+				}`,
+				Explanation: "zero probe interval",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"probeinterval": "30s",
+					"downthreshold": -1
+				}`,
+				Explanation: "negative probe threshold",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"prober": {
+						"type": "httpprobe",
+						"data": {
+							"path": "health"
+						}
+					}
+				}`,
+				Explanation: "relative http probe path",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"prober": {
+						"type": "httpprobe",
+						"data": {
+							"expectstatus": [42]
+						}
+					}
+				}`,
+				Explanation: "impossible http probe status",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"prober": {
+						"type": "httpprobe",
+						"data": {
+							"bodyregex": "("
+						}
+					}
+				}`,
+				Explanation: "bad http probe body regex",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 22,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"prober": {
+						"type": "expectprobe",
+						"data": {
+							"send": "hello"
+						}
+					}
+				}`,
+				Explanation: "expect probe without a regex",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 22,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"prober": {
+						"type": "compoundtrigger",
+						"data": {}
+					}
+				}`,
+				Explanation: "non-probe as prober",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"warmuppage": "{{.Service"
+				}`,
+				Explanation: "bad warm-up page template",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"statuspath": "status"
+				}`,
+				Explanation: "relative status path",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"statspath": "stats"
+				}`,
+				Explanation: "relative stats path",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"store": {
+						"type": "fixedprobe",
+						"data": {}
+					}
+				}`,
+				Explanation: "non-store as store",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"dependson": [
+						{
+							"type": "fixedprobe",
+							"data": {}
+						}
+					]
+				}`,
+				Explanation: "non-service as dependency",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"schedule": {
+						"type": "fixedprobe",
+						"data": {}
+					}
+				}`,
+				Explanation: "non-schedule as schedule",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"schedule": {
+						"type": "schedule",
+						"data": {
+							"windows": []
+						}
+					}
+				}`,
+				Explanation: "schedule without windows",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"hold": {
+						"timeout": "forever"
+					}
+				}`,
+				Explanation: "bad hold timeout",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"hold": {
+						"maxrequests": 0
+					}
+				}`,
+				Explanation: "hold without room for requests",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"hold": {
+						"maxbytes": -1
+					}
+				}`,
+				Explanation: "negative hold byte limit",
+			},
 		},
 		Good: []configutil.ConfigTestData{
 			configutil.ConfigTestData{
@@ -920,6 +1327,253 @@ func TestMinMonitorFromConfig(t *testing.T) {
 				}`,
 				Explanation: "basic valid monitor config",
 			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"always": {
+						"type": "compoundtrigger",
+						"data": {}
+					}
+				}`,
+				Explanation: "monitor config with always trigger",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "wiki",
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s"
+				}`,
+				Explanation: "named monitor config",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"starttimeout": "10m"
+				}`,
+				Explanation: "monitor config with start timeout",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "wiki",
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"warmuppage": "<p>{{.Service}} is {{.State}}</p>",
+					"statuspath": "/.well-known/pullcord"
+				}`,
+				Explanation: "monitor config with warm-up page",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "git",
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"hold": {
+						"timeout": "2m",
+						"maxrequests": 10,
+						"maxbytes": 1048576
+					}
+				}`,
+				Explanation: "monitor config with request hold",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "wiki",
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"statspath": "/.well-known/pullcord-stats",
+					"statsfile": "/nonexistent/pullcord/wiki.json"
+				}`,
+				Explanation: "monitor config with stats",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "wiki",
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"store": {
+						"type": "jsonfilestore",
+						"data": {
+							"path": "/var/lib/pullcord/state.json"
+						}
+					}
+				}`,
+				Explanation: "monitor config with state store",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "wiki",
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"dependson": [
+						{
+							"type": "minmonitorredservice",
+							"data": {
+								"name": "db",
+								"address": "127.0.0.1",
+								"port": 5432,
+								"protocol": "tcp",
+								"graceperiod": "1s"
+							}
+						}
+					]
+				}`,
+				Explanation: "monitor config with dependency",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"schedule": {
+						"type": "schedule",
+						"data": {
+							"timezone": "America/New_York",
+							"windows": [
+								{
+									"name": "business hours",
+									"mode": "up",
+									"days": ["mon", "tue", "wed", "thu", "fri"],
+									"start": "08:00",
+									"end": "18:00"
+								},
+								{
+									"name": "weekends",
+									"mode": "down",
+									"cron": "* * * * sat,sun"
+								}
+							]
+						}
+					}
+				}`,
+				Explanation: "monitor config with schedule",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"probeinterval": "30s",
+					"probejitter": "5s",
+					"upthreshold": 2,
+					"downthreshold": 3
+				}`,
+				Explanation: "monitor config with background probing",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 443,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"prober": {
+						"type": "httpprobe",
+						"data": {
+							"method": "HEAD",
+							"path": "/health",
+							"host": "app.example.com",
+							"tls": true,
+							"insecure": true,
+							"expectstatus": [200, 204],
+							"bodyregex": "^ok$",
+							"timeout": "5s"
+						}
+					}
+				}`,
+				Explanation: "monitor config with http probe",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 22,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"prober": {
+						"type": "expectprobe",
+						"data": {
+							"expect": "^SSH-2\\.0",
+							"timeout": "5s"
+						}
+					}
+				}`,
+				Explanation: "monitor config with expect probe",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 465,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"prober": {
+						"type": "expectprobe",
+						"data": {
+							"send": "EHLO pullcord\r\n",
+							"expect": "^220 ",
+							"tls": true,
+							"servername": "mail.example.com"
+						}
+					}
+				}`,
+				Explanation: "monitor config with tls expect probe",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"address": "127.0.0.1",
+					"port": 80,
+					"protocol": "tcp",
+					"graceperiod": "1s",
+					"prober": {
+						"type": "allofprobe",
+						"data": {
+							"probes": [
+								{
+									"type": "tcpprobe",
+									"data": {
+										"timeout": "1s"
+									}
+								},
+								{
+									"type": "anyofprobe",
+									"data": {
+										"probes": [
+											{
+												"type": "shellprobe",
+												"data": {
+													"command": "true"
+												}
+											},
+											{
+												"type": "fixedprobe",
+												"data": {}
+											}
+										]
+									}
+								}
+							]
+						}
+					}
+				}`,
+				Explanation: "monitor config with composite probe",
+			},
 		},
 	}
 	test.Run(t)
@@ -0,0 +1,94 @@
+package monitor
+
+import (
+	"fmt"
+	"time"
+)
+
+// serviceRecord is what a MinMonitorredService keeps in its state store.
+type serviceRecord struct {
+	Up bool `json:"up"`
+	LastChecked time.Time `json:"lastchecked"`
+	State string `json:"state"`
+	StateSince time.Time `json:"statesince"`
+}
+
+// storeKey gives the key under which the service keeps its record in its state
+// store.
+func (svc *MinMonitorredService) storeKey() string {
+	if svc.Name != "" {
+		return "minmonitorredservice/" + svc.Name
+	}
+	return fmt.Sprintf("minmonitorredservice/%s:%d", svc.Address, svc.Port)
+}
+
+// saveState keeps the status and state of the service in its state store (if
+// it has one).
+func (svc *MinMonitorredService) saveState() {
+	if svc.Store == nil {
+		return
+	}
+
+	svc.mutex.Lock()
+	record := serviceRecord{
+		Up: svc.up,
+		LastChecked: svc.lastChecked,
+		State: svc.state,
+		StateSince: svc.stateSince,
+	}
+	svc.mutex.Unlock()
+
+	if e := svc.Store.Save(svc.storeKey(), record); e != nil {
+		log().Err(
+			fmt.Sprintf(
+				"minmonitor was unable to save the state of" +
+				" \"%s:%d\": %v",
+				svc.Address,
+				svc.Port,
+				e,
+			),
+		)
+	}
+}
+
+// restoreState takes up the status and state which the service kept in its
+// state store (i.e. before a restart of Pullcord), but only if nothing has
+// happened to the service yet. A service restored as starting is not started
+// again until its start timeout has passed since it was first started, and a
+// service restored as up is not probed again until its grace period has
+// passed since it was last probed.
+func (svc *MinMonitorredService) restoreState() error {
+	if svc.Store == nil {
+		return nil
+	}
+
+	var record serviceRecord
+	found, err := svc.Store.Load(svc.storeKey(), &record)
+	if err != nil || !found {
+		return err
+	}
+
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	if svc.state != "" || !svc.lastChecked.IsZero() {
+		return nil
+	}
+
+	svc.up = record.Up
+	svc.lastChecked = record.LastChecked
+	svc.state = record.State
+	svc.stateSince = record.StateSince
+
+	log().Info(
+		fmt.Sprintf(
+			"minmonitor restored \"%s:%d\" as %s since %v",
+			svc.Address,
+			svc.Port,
+			record.State,
+			record.StateSince,
+		),
+	)
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package monitor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stuphlabs/pullcord/store"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestServiceRestoreState verifies that a service started with the state store
+// of a previous service takes up where the previous service left off.
+func TestServiceRestoreState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullcord-persist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := store.NewJSONFileStore(filepath.Join(dir, "state.json"))
+
+	onDown := &lockedCounterTriggerHandler{}
+	svc := newIdleTestService(t, onDown)
+	svc.Store = s
+	assert.NoError(t, svc.Start())
+	stateTestRequest(t, svc, 503)
+	assert.Equal(t, 1, onDown.Count())
+	state, since := svc.State()
+	assert.Equal(t, ServiceStarting, state)
+
+	// the restored service is still starting, so it isn't started again
+	restored := newIdleTestService(t, onDown)
+	restored.Port = svc.Port
+	restored.Store = s
+	assert.NoError(t, restored.Start())
+	restoredState, restoredSince := restored.State()
+	assert.Equal(t, ServiceStarting, restoredState)
+	assert.True(t, since.Equal(restoredSince))
+	stateTestRequest(t, restored, 503)
+	assert.Equal(t, 1, onDown.Count())
+
+	// a service which has already changed state keeps its own state
+	svc.SetStatusUp()
+	assert.NoError(t, restored.Start())
+	restoredState, _ = restored.State()
+	assert.Equal(t, ServiceStarting, restoredState)
+
+	// a service restored as up within its grace period isn't probed
+	restored = newIdleTestService(t, onDown)
+	restored.Port = svc.Port
+	restored.Store = s
+	restored.GracePeriod = time.Minute
+	assert.NoError(t, restored.Start())
+	up, err := restored.Status()
+	assert.NoError(t, err)
+	assert.True(t, up)
+}
+
+// TestIdleControllerRestore verifies that an idle controller started with the
+// state store of a previous controller waits out only the remainder of the
+// idle timeout, and doesn't run its trigger again if it has already been run.
+func TestIdleControllerRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullcord-persist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := store.NewJSONFileStore(filepath.Join(dir, "state.json"))
+
+	// without an OnDown trigger, the service is never starting
+	svc := newIdleTestService(t, nil)
+	svc.Store = s
+	onIdle := &lockedCounterTriggerHandler{}
+	c := NewIdleController(svc, time.Second, onIdle)
+	assert.NoError(t, c.Start())
+	idleTestRequest(t, c).Body.Close()
+	assert.NoError(t, c.Stop())
+	time.Sleep(500 * time.Millisecond)
+
+	restoredIdle := &lockedCounterTriggerHandler{}
+	restored := NewIdleController(svc, time.Second, restoredIdle)
+	assert.NoError(t, restored.Start())
+	assert.True(t, restored.IdleStatus().LastActive.Equal(
+		c.IdleStatus().LastActive,
+	))
+	time.Sleep(700 * time.Millisecond)
+	assert.Equal(t, 1, restoredIdle.Count())
+	assert.Equal(t, 0, onIdle.Count())
+	assert.Equal(t, IdleFired, restored.IdleStatus().State)
+	assert.NoError(t, restored.Stop())
+
+	// the trigger has already been run, so it isn't run again
+	again := NewIdleController(svc, 100 * time.Millisecond, restoredIdle)
+	assert.NoError(t, again.Start())
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 1, restoredIdle.Count())
+	assert.Equal(t, IdleFired, again.IdleStatus().State)
+
+	// until more traffic arrives
+	idleTestRequest(t, again).Body.Close()
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 2, restoredIdle.Count())
+	assert.NoError(t, again.Stop())
+}
+
+// countingStore is a StateStore which counts the values saved to it under each
+// key.
+type countingStore struct {
+	store.StateStore
+	mutex sync.Mutex
+	saves map[string]int
+}
+
+func (s *countingStore) Save(key string, value interface{}) error {
+	s.mutex.Lock()
+	if s.saves == nil {
+		s.saves = make(map[string]int)
+	}
+	s.saves[key] += 1
+	s.mutex.Unlock()
+	return s.StateStore.Save(key, value)
+}
+
+func (s *countingStore) Saves(key string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saves[key]
+}
+
+// TestIdleControllerSaveSparingly verifies that an idle controller doesn't save
+// to the state store of its service with every request, but that the store is
+// told exactly when the service was last active once the controller is
+// stopped.
+func TestIdleControllerSaveSparingly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullcord-persist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := &countingStore{
+		StateStore: store.NewJSONFileStore(
+			filepath.Join(dir, "state.json"),
+		),
+	}
+
+	svc := newIdleTestService(t, nil)
+	svc.Store = s
+	onIdle := &lockedCounterTriggerHandler{}
+	c := NewIdleController(svc, time.Minute, onIdle)
+	assert.NoError(t, c.Start())
+	for i := 0; i < 10; i++ {
+		idleTestRequest(t, c).Body.Close()
+	}
+	assert.Equal(t, 1, s.Saves(c.storeKey()))
+
+	assert.NoError(t, c.Stop())
+	assert.Equal(t, 2, s.Saves(c.storeKey()))
+	var record idleRecord
+	found, err := s.Load(c.storeKey(), &record)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, record.LastActive.Equal(c.IdleStatus().LastActive))
+	assert.Equal(t, 0, onIdle.Count())
+
+	// nothing has changed since, so there is nothing more to save
+	assert.NoError(t, c.Stop())
+	assert.Equal(t, 2, s.Saves(c.storeKey()))
+}
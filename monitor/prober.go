@@ -0,0 +1,326 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/proidiot/gone/errors"
+	"github.com/stuphlabs/pullcord/config"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// NoProbersError indicates that a composite probe was configured without any
+// probes to combine.
+const NoProbersError = errors.New(
+	"A composite probe requires at least one probe",
+)
+
+// Prober determines whether a service is up. A service which could be checked
+// and was found not to be up is down (and no error is given). An error means
+// that the status of the service couldn't be determined, except that a
+// *net.OpError with an address (i.e. a refused connection) is also taken to
+// mean that the service is down.
+//
+// A Prober is given to a MinMonitorredService as a resource (in the same way
+// as a trigger), so a package outside of Pullcord can add a new kind of probe
+// (i.e. one which pings a database) by implementing Prober and json.Unmarshaler
+// and registering the type with config.RegisterResourceType.
+type Prober interface {
+	Probe(protocol, address string, port int) (up bool, err error)
+}
+
+func init() {
+	config.RegisterResourceType(
+		"tcpprobe",
+		func() json.Unmarshaler {
+			return new(TCPProbe)
+		},
+	)
+	config.RegisterResourceType(
+		"shellprobe",
+		func() json.Unmarshaler {
+			return new(ShellProbe)
+		},
+	)
+	config.RegisterResourceType(
+		"allofprobe",
+		func() json.Unmarshaler {
+			return new(AllOfProbe)
+		},
+	)
+	config.RegisterResourceType(
+		"anyofprobe",
+		func() json.Unmarshaler {
+			return new(AnyOfProbe)
+		},
+	)
+}
+
+// parseProbeTimeout parses the timeout of a probe, which must be positive if it
+// is given at all.
+func parseProbeTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return 0, nil
+	} else if d, e := time.ParseDuration(timeout); e != nil {
+		return 0, e
+	} else if d <= 0 {
+		return 0, errors.New("A probe timeout must be positive")
+	} else {
+		return d, nil
+	}
+}
+
+// TCPProbe is a Prober which only checks that a connection can be opened to
+// the service (giving up after the timeout, if one is given). This is what a
+// MinMonitorredService does if it isn't given a Prober.
+type TCPProbe struct {
+	Timeout time.Duration
+}
+
+func (p *TCPProbe) UnmarshalJSON(input []byte) error {
+	var t struct {
+		Timeout string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	d, e := parseProbeTimeout(t.Timeout)
+	p.Timeout = d
+	return e
+}
+
+// Probe opens (and then closes) a connection to the service, making TCPProbe a
+// valid Prober implementation.
+func (p *TCPProbe) Probe(
+	protocol, address string,
+	port int,
+) (up bool, err error) {
+	conn, err := net.DialTimeout(
+		protocol,
+		net.JoinHostPort(address, strconv.Itoa(port)),
+		p.Timeout,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	conn.Close()
+	return true, nil
+}
+
+// ShellProbe is a Prober which runs a command, and finds the service up if the
+// command exits successfully, or down if it exits with any other status or
+// runs for longer than the timeout (in which case it and anything else in its
+// process group is killed). The command is run with the environment of
+// pullcord, along with any variables given in Env, and the service it is to
+// probe is given in PULLCORD_PROTOCOL, PULLCORD_ADDRESS, and PULLCORD_PORT.
+type ShellProbe struct {
+	Command string
+	Args []string
+	Env map[string]string
+	Timeout time.Duration
+}
+
+func (p *ShellProbe) UnmarshalJSON(input []byte) error {
+	var t struct {
+		Command string
+		Args []string
+		Env map[string]string
+		Timeout string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	if t.Command == "" {
+		return errors.New("A shell probe requires a command")
+	}
+
+	d, e := parseProbeTimeout(t.Timeout)
+	if e != nil {
+		return e
+	}
+
+	p.Command = t.Command
+	p.Args = t.Args
+	p.Env = t.Env
+	p.Timeout = d
+
+	return nil
+}
+
+// Probe runs the command, making ShellProbe a valid Prober implementation. An
+// error is only given if the command could not be started.
+func (p *ShellProbe) Probe(
+	protocol, address string,
+	port int,
+) (up bool, err error) {
+	cmd := exec.Command(p.Command, p.Args...)
+	cmd.Env = os.Environ()
+	for name, value := range p.Env {
+		cmd.Env = append(cmd.Env, name + "=" + value)
+	}
+	cmd.Env = append(
+		cmd.Env,
+		"PULLCORD_PROTOCOL=" + protocol,
+		"PULLCORD_ADDRESS=" + address,
+		"PULLCORD_PORT=" + strconv.Itoa(port),
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err = cmd.Start(); err != nil {
+		return false, err
+	}
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	select {
+	case err = <-done:
+		timer.Stop()
+	case <-timer.C:
+		// Killing the negated process ID kills the whole process
+		// group, so nothing started by the command is left behind.
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		log().Debug(
+			fmt.Sprintf(
+				"minmonitor shell probe %s timed out after %v",
+				p.Command,
+				timeout,
+			),
+		)
+		return false, nil
+	}
+
+	if err != nil {
+		log().Debug(
+			fmt.Sprintf(
+				"minmonitor shell probe %s failed: %v",
+				p.Command,
+				err,
+			),
+		)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// unmarshalProbers unmarshals a composite probe, which is a list of probes.
+func unmarshalProbers(input []byte) ([]Prober, error) {
+	var t struct {
+		Probes []config.Resource
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return nil, e
+	}
+
+	if len(t.Probes) == 0 {
+		return nil, NoProbersError
+	}
+
+	result := make([]Prober, 0, len(t.Probes))
+	for _, i := range t.Probes {
+		switch p := i.Unmarshaled.(type) {
+		case Prober:
+			result = append(result, p)
+		default:
+			log().Err(
+				fmt.Sprintf(
+					"Registry value is not a Prober: %s",
+					p,
+				),
+			)
+			return nil, config.UnexpectedResourceType
+		}
+	}
+
+	return result, nil
+}
+
+// AllOfProbe is a Prober which finds the service up only if every one of its
+// probes does. The probes are run in order, and the first probe which finds
+// the service down (or gives an error) ends the probe.
+type AllOfProbe struct {
+	Probers []Prober
+}
+
+func (p *AllOfProbe) UnmarshalJSON(input []byte) (err error) {
+	p.Probers, err = unmarshalProbers(input)
+	return err
+}
+
+// Probe runs each of the probes, making AllOfProbe a valid Prober
+// implementation.
+func (p *AllOfProbe) Probe(
+	protocol, address string,
+	port int,
+) (up bool, err error) {
+	for _, prober := range p.Probers {
+		up, err = prober.Probe(protocol, address, port)
+		if !up || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// AnyOfProbe is a Prober which finds the service up if any one of its probes
+// does. The probes are run in order, and the first probe which finds the
+// service up ends the probe. An error is only given if every probe gave an
+// error.
+type AnyOfProbe struct {
+	Probers []Prober
+}
+
+func (p *AnyOfProbe) UnmarshalJSON(input []byte) (err error) {
+	p.Probers, err = unmarshalProbers(input)
+	return err
+}
+
+// Probe runs the probes until one finds the service up, making AnyOfProbe a
+// valid Prober implementation.
+func (p *AnyOfProbe) Probe(
+	protocol, address string,
+	port int,
+) (up bool, err error) {
+	var firstErr error
+	failures := 0
+	for _, prober := range p.Probers {
+		up, err = prober.Probe(protocol, address, port)
+		if up && err == nil {
+			return true, nil
+		} else if err != nil {
+			failures += 1
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if failures == len(p.Probers) {
+		return false, firstErr
+	}
+	return false, nil
+}
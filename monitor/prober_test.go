@@ -0,0 +1,233 @@
+package monitor
+
+import (
+	"encoding/json"
+	"github.com/proidiot/gone/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stuphlabs/pullcord/config"
+	configutil "github.com/stuphlabs/pullcord/config/util"
+	"testing"
+	"time"
+)
+
+// fixedProber is a testing Prober (registered as a resource type in the same
+// way a third-party probe would be) which always gives the same result, and
+// counts how many times it has been run.
+type fixedProber struct {
+	up bool
+	err error
+	count int
+}
+
+func (p *fixedProber) UnmarshalJSON(input []byte) error {
+	return json.Unmarshal(input, &struct{}{})
+}
+
+func (p *fixedProber) Probe(
+	protocol, address string,
+	port int,
+) (bool, error) {
+	p.count += 1
+	return p.up, p.err
+}
+
+func init() {
+	config.RegisterResourceType(
+		"fixedprobe",
+		func() json.Unmarshaler {
+			return new(fixedProber)
+		},
+	)
+}
+
+func TestShellProbe(t *testing.T) {
+	probe := &ShellProbe{
+		Command: "sh",
+		Args: []string{
+			"-c",
+			`test "$PULLCORD_PROTOCOL:$PULLCORD_ADDRESS:` +
+			`$PULLCORD_PORT" = "tcp:db.example.com:$EXPECTED_PORT"`,
+		},
+		Env: map[string]string{"EXPECTED_PORT": "5432"},
+	}
+
+	up, err := probe.Probe("tcp", "db.example.com", 5432)
+	assert.NoError(t, err)
+	assert.True(t, up)
+
+	up, err = probe.Probe("tcp", "db.example.com", 3306)
+	assert.NoError(t, err)
+	assert.False(t, up)
+
+	probe = &ShellProbe{
+		Command: "sleep",
+		Args: []string{"5"},
+		Timeout: 100 * time.Millisecond,
+	}
+	start := time.Now()
+	up, err = probe.Probe("tcp", "localhost", 80)
+	assert.NoError(t, err)
+	assert.False(t, up)
+	assert.True(t, time.Since(start) < time.Second)
+
+	probe = &ShellProbe{Command: "/nonexistent/pullcord/probe"}
+	up, err = probe.Probe("tcp", "localhost", 80)
+	assert.Error(t, err)
+	assert.False(t, up)
+}
+
+func TestAllOfProbe(t *testing.T) {
+	up := &fixedProber{up: true}
+	down := &fixedProber{}
+	broken := &fixedProber{err: errors.New("probe failed")}
+
+	result, err := (&AllOfProbe{[]Prober{up, up}}).Probe("tcp", "x", 1)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 2, up.count)
+
+	result, err = (&AllOfProbe{[]Prober{down, up}}).Probe("tcp", "x", 1)
+	assert.NoError(t, err)
+	assert.False(t, result)
+	assert.Equal(t, 1, down.count)
+	assert.Equal(t, 2, up.count)
+
+	result, err = (&AllOfProbe{[]Prober{up, broken}}).Probe("tcp", "x", 1)
+	assert.Error(t, err)
+	assert.False(t, result)
+}
+
+func TestAnyOfProbe(t *testing.T) {
+	up := &fixedProber{up: true}
+	down := &fixedProber{}
+	broken := &fixedProber{err: errors.New("probe failed")}
+
+	result, err := (&AnyOfProbe{[]Prober{up, down}}).Probe("tcp", "x", 1)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 0, down.count)
+
+	result, err = (&AnyOfProbe{[]Prober{broken, up}}).Probe("tcp", "x", 1)
+	assert.NoError(t, err)
+	assert.True(t, result)
+
+	result, err = (&AnyOfProbe{[]Prober{broken, down}}).Probe("tcp", "x", 1)
+	assert.NoError(t, err)
+	assert.False(t, result)
+
+	result, err = (&AnyOfProbe{[]Prober{broken, broken}}).Probe(
+		"tcp",
+		"x",
+		1,
+	)
+	assert.Error(t, err)
+	assert.False(t, result)
+}
+
+// TestServiceProber verifies that a service uses its Prober, and that a
+// refused connection from a Prober is taken to mean the service is down.
+func TestServiceProber(t *testing.T) {
+	svc := newIdleTestService(t, nil)
+	prober := &fixedProber{up: true}
+	svc.Prober = prober
+
+	up, err := svc.Reprobe()
+	assert.NoError(t, err)
+	assert.True(t, up)
+	assert.Equal(t, 1, prober.count)
+
+	svc.Prober = &AllOfProbe{[]Prober{prober, &TCPProbe{}}}
+	up, err = svc.Reprobe()
+	assert.NoError(t, err)
+	assert.False(t, up)
+	assert.Equal(t, 2, prober.count)
+}
+
+func TestAllOfProbeFromConfig(t *testing.T) {
+	test := configutil.ConfigTest{
+		ResourceType: "allofprobe",
+		IsValid: func(i json.Unmarshaler) error {
+			p, ok := i.(*AllOfProbe)
+			if !ok {
+				return errors.New(
+					"AllOfProbe IsValid received an object" +
+					" of the wrong type.",
+				)
+			}
+
+			if len(p.Probers) != 2 {
+				return errors.New(
+					"AllOfProbe IsValid received the wrong" +
+					" number of probes.",
+				)
+			}
+
+			return nil
+		},
+		SyntacticallyBad: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: "",
+				Explanation: "empty config",
+			},
+			configutil.ConfigTestData{
+				Data: "{}",
+				Explanation: "empty object",
+			},
+			configutil.ConfigTestData{
+				Data: "null",
+				Explanation: "null config",
+			},
+			configutil.ConfigTestData{
+				Data: "42",
+				Explanation: "numeric config",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"probes": [
+						{
+							"type": "compoundtrigger",
+							"data": {}
+						}
+					]
+				}`,
+				Explanation: "non-probe as probe",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"probes": [
+						{
+							"type": "shellprobe",
+							"data": {}
+						}
+					]
+				}`,
+				Explanation: "shell probe without a command",
+			},
+		},
+		Good: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: `{
+					"probes": [
+						{
+							"type": "tcpprobe",
+							"data": {}
+						},
+						{
+							"type": "shellprobe",
+							"data": {
+								"command": "pg_isready",
+								"args": ["-q"],
+								"env": {
+									"PGCONNECT_TIMEOUT": "2"
+								},
+								"timeout": "5s"
+							}
+						}
+					]
+				}`,
+				Explanation: "basic valid all-of probe config",
+			},
+		},
+	}
+	test.Run(t)
+}
@@ -0,0 +1,751 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fitstar/falcore"
+	"github.com/proidiot/gone/errors"
+	"github.com/stuphlabs/pullcord/config"
+	"github.com/stuphlabs/pullcord/trigger"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The modes a ScheduleWindow can pin a service to.
+const (
+	ScheduleUp = "up"
+	ScheduleDown = "down"
+)
+
+// NoScheduleWindowsError indicates that a schedule was configured without any
+// windows.
+const NoScheduleWindowsError = errors.New(
+	"A schedule requires at least one window",
+)
+
+// InvalidScheduleModeError indicates that a schedule window was configured
+// with a mode other than ScheduleUp or ScheduleDown.
+const InvalidScheduleModeError = errors.New(
+	"A schedule window must have a mode of either \"up\" or \"down\"",
+)
+
+// InvalidScheduleWindowError indicates that a schedule window was configured
+// with neither a cron expression nor weekly days and times (or with both).
+const InvalidScheduleWindowError = errors.New(
+	"A schedule window requires either a cron expression, or days with a" +
+	" start and end time",
+)
+
+// ScheduledDownError indicates that a service was not started because it is
+// in a window of its schedule during which it is pinned down.
+const ScheduledDownError = errors.New(
+	"The service is scheduled to be down",
+)
+
+// scheduleCheckInterval is how often a service with a schedule checks whether
+// it should be started or stopped for its schedule.
+const scheduleCheckInterval = 30 * time.Second
+
+// maxScheduleLookahead is how far ahead the end of a window is looked for.
+const maxScheduleLookahead = 8 * 24 * time.Hour
+
+// ScheduleWindow is a span of time during which a service is pinned either up
+// (kept warm, even without any traffic) or down (never started, even when
+// requested). A window is either weekly, in which case it is active from the
+// start time until the end time (as offsets from midnight) on each of the
+// given days (and if the end is before the start, the window runs past
+// midnight into the next day), or it is given by a cron expression, in which
+// case it is active during each minute the expression matches.
+//
+// A cron expression has the usual five fields: minute, hour, day of the month,
+// month, and day of the week. Each field is "*", a value, a range ("1-5"), or
+// a comma separated list of those, and any of them may be followed by a step
+// ("*/15"). Months and days of the week may be given by name ("jan", "mon"),
+// and Sunday is either 0 or 7. As usual, if both the day of the month and the
+// day of the week are restricted (that is, neither field starts with "*"), a
+// day matching either is enough.
+type ScheduleWindow struct {
+	Name string
+	Mode string
+	Days []time.Weekday
+	Start time.Duration
+	End time.Duration
+	Cron string
+	cron *cronExpression
+}
+
+// Schedule is a list of windows, along with the time zone in which they are
+// given. If more than one window is active at once, the first one given wins.
+type Schedule struct {
+	Location *time.Location
+	Windows []*ScheduleWindow
+	mutex sync.Mutex
+	ends map[*ScheduleWindow]scheduleEnd
+}
+
+// scheduleEnd is when a window was found to next stop being active, and when
+// that was looked for.
+type scheduleEnd struct {
+	checked time.Time
+	until time.Time
+}
+
+func init() {
+	config.RegisterResourceType(
+		"schedule",
+		func() json.Unmarshaler {
+			return new(Schedule)
+		},
+	)
+}
+
+// weekdays are the names by which days of the week may be given.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// months are the names by which months may be given.
+var months = map[string]time.Month{
+	"jan": time.January,
+	"feb": time.February,
+	"mar": time.March,
+	"apr": time.April,
+	"may": time.May,
+	"jun": time.June,
+	"jul": time.July,
+	"aug": time.August,
+	"sep": time.September,
+	"oct": time.October,
+	"nov": time.November,
+	"dec": time.December,
+}
+
+// parseTimeOfDay parses a time of day given as "HH:MM" into an offset from
+// midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		h, eh := strconv.Atoi(parts[0])
+		m, em := strconv.Atoi(parts[1])
+		if eh == nil && em == nil && h >= 0 && m >= 0 && m < 60 &&
+			(h < 24 || h == 24 && m == 0) {
+			return time.Duration(h) * time.Hour +
+				time.Duration(m) * time.Minute, nil
+		}
+	}
+
+	return 0, errors.New(
+		fmt.Sprintf("Invalid time of day (expected HH:MM): %s", s),
+	)
+}
+
+func (w *ScheduleWindow) UnmarshalJSON(input []byte) error {
+	var t struct {
+		Name string
+		Mode string
+		Days []string
+		Start string
+		End string
+		Cron string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	if t.Mode != ScheduleUp && t.Mode != ScheduleDown {
+		return InvalidScheduleModeError
+	}
+	w.Name = t.Name
+	w.Mode = t.Mode
+
+	weekly := len(t.Days) > 0 || t.Start != "" || t.End != ""
+	if weekly == (t.Cron != "") {
+		return InvalidScheduleWindowError
+	}
+
+	w.Cron = t.Cron
+	w.cron = nil
+	if t.Cron != "" {
+		c, e := parseCronExpression(t.Cron)
+		if e != nil {
+			return e
+		}
+		w.cron = c
+	}
+
+	w.Days = nil
+	for _, name := range t.Days {
+		d, present := weekdays[strings.ToLower(name)]
+		if !present {
+			return errors.New(
+				fmt.Sprintf(
+					"Invalid day of the week: %s",
+					name,
+				),
+			)
+		}
+		w.Days = append(w.Days, d)
+	}
+
+	if weekly {
+		var e error
+		if len(w.Days) == 0 {
+			return InvalidScheduleWindowError
+		} else if w.Start, e = parseTimeOfDay(t.Start); e != nil {
+			return e
+		} else if w.Start == 24 * time.Hour {
+			return errors.New(
+				"A schedule window must not start at 24:00",
+			)
+		} else if w.End, e = parseTimeOfDay(t.End); e != nil {
+			return e
+		} else if w.Start == w.End {
+			return errors.New(
+				"A schedule window must not start and end at" +
+				" the same time",
+			)
+		}
+	}
+
+	return nil
+}
+
+// onDay reports whether the window is given for the given day of the week.
+func (w *ScheduleWindow) onDay(day time.Weekday) bool {
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// expression gives the parsed cron expression of the window (if it has one).
+func (w *ScheduleWindow) expression() *cronExpression {
+	if w.cron != nil || w.Cron == "" {
+		return w.cron
+	}
+
+	// a window which wasn't unmarshaled has to be parsed each time
+	c, e := parseCronExpression(w.Cron)
+	if e != nil {
+		return nil
+	}
+	return c
+}
+
+// Active reports whether the window is active at the given time (which should
+// already be in the time zone of the schedule).
+func (w *ScheduleWindow) Active(now time.Time) bool {
+	if w.Cron != "" {
+		c := w.expression()
+		return c != nil && c.matches(now)
+	}
+
+	offset := time.Duration(now.Hour()) * time.Hour +
+		time.Duration(now.Minute()) * time.Minute +
+		time.Duration(now.Second()) * time.Second +
+		time.Duration(now.Nanosecond())
+	if w.Start < w.End {
+		return w.onDay(now.Weekday()) &&
+			offset >= w.Start && offset < w.End
+	}
+
+	yesterday := (now.Weekday() + 6) % 7
+	return w.onDay(now.Weekday()) && offset >= w.Start ||
+		w.onDay(yesterday) && offset < w.End
+}
+
+// String gives the name of the window, or a description of it if it has no
+// name.
+func (w *ScheduleWindow) String() string {
+	if w.Name != "" {
+		return w.Name
+	} else if w.Cron != "" {
+		return w.Cron
+	}
+
+	days := make([]string, 0, len(w.Days))
+	for _, d := range w.Days {
+		days = append(days, strings.ToLower(d.String()[:3]))
+	}
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf(
+			"%02d:%02d",
+			int(d / time.Hour),
+			int(d % time.Hour / time.Minute),
+		)
+	}
+	return fmt.Sprintf(
+		"%s %s-%s",
+		strings.Join(days, ","),
+		clock(w.Start),
+		clock(w.End),
+	)
+}
+
+func (s *Schedule) UnmarshalJSON(input []byte) error {
+	var t struct {
+		TimeZone string
+		Windows []*ScheduleWindow
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	if len(t.Windows) == 0 {
+		return NoScheduleWindowsError
+	}
+	for _, w := range t.Windows {
+		if w == nil {
+			return InvalidScheduleWindowError
+		}
+	}
+	s.Windows = t.Windows
+
+	s.Location = time.Local
+	if t.TimeZone != "" {
+		l, e := time.LoadLocation(t.TimeZone)
+		if e != nil {
+			return e
+		}
+		s.Location = l
+	}
+
+	return nil
+}
+
+// location gives the time zone of the schedule, using the local time zone if
+// none was given.
+func (s *Schedule) location() *time.Location {
+	if s.Location == nil {
+		return time.Local
+	}
+	return s.Location
+}
+
+// Active gives the window which is active at the given time, or nil if none
+// is.
+func (s *Schedule) Active(now time.Time) *ScheduleWindow {
+	now = now.In(s.location())
+	for _, w := range s.Windows {
+		if w.Active(now) {
+			return w
+		}
+	}
+	return nil
+}
+
+// ActiveUntil gives when the given window (which should be active at the given
+// time) will next stop being active, or the zero time if it will not stop
+// being active for more than a week. As windows begin and end on the minute,
+// only the start of each minute is checked. The end of each window is
+// remembered, so it is only looked for again once the window has ended (or
+// after a day, if it was not found).
+func (s *Schedule) ActiveUntil(w *ScheduleWindow, now time.Time) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if end, present := s.ends[w]; present && !now.Before(end.checked) {
+		if end.until.IsZero() {
+			if now.Before(end.checked.Add(24 * time.Hour)) {
+				return end.until
+			}
+		} else if now.Before(end.until) {
+			return end.until
+		}
+	}
+
+	until := s.activeUntil(w, now)
+	if s.ends == nil {
+		s.ends = make(map[*ScheduleWindow]scheduleEnd)
+	}
+	s.ends[w] = scheduleEnd{checked: now, until: until}
+	return until
+}
+
+// activeUntil looks for when the given window will next stop being active.
+func (s *Schedule) activeUntil(w *ScheduleWindow, now time.Time) time.Time {
+	now = now.In(s.location())
+	next := now.Truncate(time.Minute)
+	for next.Sub(now) < maxScheduleLookahead {
+		next = next.Add(time.Minute)
+		if !w.Active(next) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// cronField is the set of values a field of a cron expression matches, and
+// whether the field started with "*".
+type cronField struct {
+	values uint64
+	star bool
+}
+
+// cronExpression is a parsed cron expression.
+type cronExpression struct {
+	minute cronField
+	hour cronField
+	dayOfMonth cronField
+	month cronField
+	dayOfWeek cronField
+}
+
+// parseCronField parses a field of a cron expression, which must be between
+// the given bounds, and in which the given names may be used for values.
+func parseCronField(
+	field string,
+	min, max int,
+	names map[string]int,
+) (cronField, error) {
+	var result cronField
+	invalid := errors.New(
+		fmt.Sprintf("Invalid cron expression field: %s", field),
+	)
+
+	value := func(s string) (int, bool) {
+		if v, present := names[strings.ToLower(s)]; present {
+			return v, true
+		}
+		v, e := strconv.Atoi(s)
+		return v, e == nil && v >= min && v <= max
+	}
+
+	// as with other crons, a field starting with "*" (even with a step)
+	// doesn't count as restricted when it comes to the days
+	result.star = strings.HasPrefix(field, "*")
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, e := strconv.Atoi(part[i + 1:])
+			if e != nil || s <= 0 {
+				return result, invalid
+			}
+			step = s
+			part = part[:i]
+		}
+
+		low, high := min, max
+		if part == "*" {
+			// the whole range, which low and high already are
+		} else if i := strings.Index(part, "-"); i >= 0 {
+			var okLow, okHigh bool
+			low, okLow = value(part[:i])
+			high, okHigh = value(part[i + 1:])
+			if !okLow || !okHigh || low > high {
+				return result, invalid
+			}
+		} else {
+			var ok bool
+			if low, ok = value(part); !ok {
+				return result, invalid
+			}
+			if step == 1 {
+				high = low
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			result.values |= 1 << uint(v)
+		}
+	}
+
+	return result, nil
+}
+
+func (f cronField) matches(v int) bool {
+	return f.values & (1 << uint(v)) != 0
+}
+
+// parseCronExpression parses a five field cron expression.
+func parseCronExpression(expression string) (*cronExpression, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, errors.New(
+			fmt.Sprintf(
+				"A cron expression must have five fields: %s",
+				expression,
+			),
+		)
+	}
+
+	monthNames := make(map[string]int)
+	for name, m := range months {
+		monthNames[name] = int(m)
+	}
+	dayNames := make(map[string]int)
+	for name, d := range weekdays {
+		dayNames[name] = int(d)
+	}
+
+	var c cronExpression
+	var e error
+	if c.minute, e = parseCronField(fields[0], 0, 59, nil); e != nil {
+		return nil, e
+	}
+	if c.hour, e = parseCronField(fields[1], 0, 23, nil); e != nil {
+		return nil, e
+	}
+	c.dayOfMonth, e = parseCronField(fields[2], 1, 31, nil)
+	if e != nil {
+		return nil, e
+	}
+	c.month, e = parseCronField(fields[3], 1, 12, monthNames)
+	if e != nil {
+		return nil, e
+	}
+	c.dayOfWeek, e = parseCronField(fields[4], 0, 7, dayNames)
+	if e != nil {
+		return nil, e
+	}
+	if c.dayOfWeek.matches(7) {
+		c.dayOfWeek.values |= 1
+	}
+
+	return &c, nil
+}
+
+// matches reports whether the expression matches the minute of the given time.
+func (c *cronExpression) matches(t time.Time) bool {
+	if !c.minute.matches(t.Minute()) || !c.hour.matches(t.Hour()) ||
+		!c.month.matches(int(t.Month())) {
+		return false
+	}
+
+	dom := c.dayOfMonth.matches(t.Day())
+	dow := c.dayOfWeek.matches(int(t.Weekday()))
+	if c.dayOfMonth.star || c.dayOfWeek.star {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// scheduleWindow gives the window of the schedule of the service which is
+// active right now, or nil if the service has no schedule or no window of it
+// is active.
+func (svc *MinMonitorredService) scheduleWindow() *ScheduleWindow {
+	if svc.Schedule == nil {
+		return nil
+	}
+	return svc.Schedule.Active(time.Now())
+}
+
+// scheduleWindowDocument is the JSON representation of an active window of the
+// schedule of a service.
+type scheduleWindowDocument struct {
+	Name string `json:"name"`
+	Mode string `json:"mode"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// windowDocument gives the JSON representation of the window of the schedule
+// of the service which is active right now, or nil if none is.
+func (svc *MinMonitorredService) windowDocument() *scheduleWindowDocument {
+	w := svc.scheduleWindow()
+	if w == nil {
+		return nil
+	}
+
+	result := &scheduleWindowDocument{Name: w.String(), Mode: w.Mode}
+	if until := svc.Schedule.ActiveUntil(w, time.Now()); !until.IsZero() {
+		result.Until = &until
+	}
+	return result
+}
+
+// scheduledDownResponse answers a request for a service which is in a window
+// of its schedule during which it is pinned down. The client is asked to try
+// again once the window is over, but (as with the warm-up page) never after
+// more than a minute.
+func (svc *MinMonitorredService) scheduledDownResponse(
+	req *falcore.Request,
+	w *ScheduleWindow,
+) (*http.Response) {
+	log().Info(
+		fmt.Sprintf(
+			"minmonitor filter is not starting \"%s:%d\" during" +
+			" its scheduled down time \"%s\"",
+			svc.Address,
+			svc.Port,
+			w,
+		),
+	)
+
+	// as with the warm-up page, the client is never asked to wait very
+	// long (or not at all), even if the window ends much later
+	retryAfter := maxRetryAfter
+	now := time.Now()
+	if until := svc.Schedule.ActiveUntil(w, now); !until.IsZero() {
+		retryAfter = until.Sub(now)
+		if retryAfter < minRetryAfter {
+			retryAfter = minRetryAfter
+		} else if retryAfter > maxRetryAfter {
+			retryAfter = maxRetryAfter
+		}
+	}
+
+	return falcore.StringResponse(
+		req.HttpRequest,
+		503,
+		http.Header{
+			"Content-Type": []string{"text/html; charset=utf-8"},
+			"Cache-Control": []string{"no-cache"},
+			"Retry-After": []string{
+				strconv.Itoa(int(retryAfter / time.Second)),
+			},
+		},
+		"<html><head><title>Pullcord - Service Unavailable" +
+		"</title></head><body><h1>Pullcord - Service" +
+		" Unavailable</h1><p>The requested service is not" +
+		" available during its scheduled down time (" +
+		html.EscapeString(w.String()) + "). If you would like" +
+		" further information, please contact the site" +
+		" administrator.</p></body></html>",
+	)
+}
+
+// startSchedule begins enforcing the schedule of the service in the
+// background (if it has one). The mutex must not be held.
+func (svc *MinMonitorredService) startSchedule() {
+	if svc.Schedule == nil {
+		return
+	}
+
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	if svc.scheduleDone != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	svc.scheduleStop = stop
+	svc.scheduleDone = done
+	go svc.scheduleLoop(stop, done)
+}
+
+// stopSchedule ends any enforcement of the schedule of the service, waiting
+// for a check in progress to finish.
+func (svc *MinMonitorredService) stopSchedule() {
+	svc.mutex.Lock()
+	stop, done := svc.scheduleStop, svc.scheduleDone
+	svc.scheduleStop = nil
+	svc.scheduleDone = nil
+	svc.mutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// scheduleLoop enforces the schedule of the service until it is told to stop.
+func (svc *MinMonitorredService) scheduleLoop(
+	stop <-chan struct{},
+	done chan<- struct{},
+) {
+	defer close(done)
+
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		svc.enforceSchedule()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// enforceSchedule starts the service if it is in a window during which it is
+// pinned up, or runs the OnIdle trigger of its IdleController if it is in a
+// window during which it is pinned down, unless the service is already where
+// it should be.
+func (svc *MinMonitorredService) enforceSchedule() {
+	w := svc.scheduleWindow()
+	if w == nil {
+		return
+	}
+
+	up, err := svc.Status()
+	if err != nil {
+		return
+	}
+	state, _ := svc.State()
+	idle := svc.idleController()
+
+	if w.Mode == ScheduleDown {
+		if !up || state == ServiceStopping {
+			return
+		} else if idle == nil {
+			log().Warning(
+				fmt.Sprintf(
+					"minmonitor has no idle controller" +
+					" with which to stop \"%s:%d\" for" +
+					" its scheduled down time \"%s\"",
+					svc.Address,
+					svc.Port,
+					w,
+				),
+			)
+			return
+		}
+
+		idle.force(
+			fmt.Sprintf("its scheduled down time \"%s\"", w),
+		)
+		return
+	}
+
+	if up || state == ServiceStarting || state == ServiceStopping {
+		return
+	}
+
+	log().Info(
+		fmt.Sprintf(
+			"minmonitor is starting \"%s:%d\" for its scheduled" +
+			" up time \"%s\"",
+			svc.Address,
+			svc.Port,
+			w,
+		),
+	)
+
+	// otherwise the idle timeout would never start again once the service
+	// has come up without any traffic
+	if idle != nil {
+		idle.wake()
+	}
+
+	ctx := trigger.NewTriggerContext()
+	ctx.Service = svc.Name
+	if len(svc.DependsOn) > 0 {
+		if svc.startBoot(time.Now()) {
+			go svc.startWithDependencies(ctx)
+		}
+	} else if svc.OnDown != nil && svc.startBoot(time.Now()) {
+		svc.runOnDown(ctx)
+	}
+}
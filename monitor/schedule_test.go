@@ -0,0 +1,630 @@
+package monitor
+
+import (
+	"encoding/json"
+	"github.com/proidiot/gone/errors"
+	"github.com/stretchr/testify/assert"
+	configutil "github.com/stuphlabs/pullcord/config/util"
+	"testing"
+	"time"
+)
+
+// newTestSchedule creates a schedule from the given config.
+func newTestSchedule(t *testing.T, data string) *Schedule {
+	var s Schedule
+	assert.NoError(t, json.Unmarshal([]byte(data), &s))
+	return &s
+}
+
+// at gives the given time on the given day of January 2024 (which began on a
+// Monday) in UTC.
+func at(day, hour, minute int) time.Time {
+	return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestScheduleWeekly(t *testing.T) {
+	s := newTestSchedule(
+		t,
+		`{
+			"timezone": "UTC",
+			"windows": [
+				{
+					"name": "business hours",
+					"mode": "up",
+					"days": ["mon", "tue", "wed", "thu", "fri"],
+					"start": "09:00",
+					"end": "17:00"
+				},
+				{
+					"mode": "down",
+					"days": ["sat"],
+					"start": "22:00",
+					"end": "02:00"
+				}
+			]
+		}`,
+	)
+
+	if w := s.Active(at(1, 9, 0)); assert.NotNil(t, w) {
+		assert.Equal(t, "business hours", w.String())
+		assert.Equal(t, ScheduleUp, w.Mode)
+	}
+	assert.NotNil(t, s.Active(at(5, 16, 59)))
+	assert.Nil(t, s.Active(at(1, 8, 59)))
+	assert.Nil(t, s.Active(at(1, 17, 0)))
+	assert.Nil(t, s.Active(at(6, 12, 0)))
+
+	// the window runs past midnight into Sunday, but not Saturday morning
+	if w := s.Active(at(7, 1, 59)); assert.NotNil(t, w) {
+		assert.Equal(t, "sat 22:00-02:00", w.String())
+		assert.Equal(t, ScheduleDown, w.Mode)
+	}
+	assert.NotNil(t, s.Active(at(6, 22, 0)))
+	assert.Nil(t, s.Active(at(6, 1, 0)))
+	assert.Nil(t, s.Active(at(7, 2, 0)))
+
+	w := s.Active(at(1, 12, 30))
+	assert.True(t, at(1, 17, 0).Equal(s.ActiveUntil(w, at(1, 12, 30))))
+	w = s.Active(at(6, 23, 0))
+	assert.True(t, at(7, 2, 0).Equal(s.ActiveUntil(w, at(6, 23, 0))))
+	assert.True(t, at(7, 2, 0).Equal(s.ActiveUntil(w, at(7, 1, 0))))
+
+	// the end of the window is looked for again once it has ended
+	w = s.Active(at(13, 22, 30))
+	assert.True(t, at(14, 2, 0).Equal(s.ActiveUntil(w, at(13, 22, 30))))
+}
+
+func TestScheduleCron(t *testing.T) {
+	s := newTestSchedule(
+		t,
+		`{
+			"timezone": "UTC",
+			"windows": [
+				{
+					"name": "reports",
+					"mode": "up",
+					"cron": "*/15 9-10 * jan mon-fri"
+				},
+				{
+					"name": "maintenance",
+					"mode": "down",
+					"cron": "0-29 3 13 * 7"
+				}
+			]
+		}`,
+	)
+
+	assert.NotNil(t, s.Active(at(2, 9, 0)))
+	assert.NotNil(t, s.Active(at(2, 10, 45)))
+	assert.Nil(t, s.Active(at(2, 10, 46)))
+	assert.Nil(t, s.Active(at(2, 11, 0)))
+	assert.Nil(t, s.Active(at(6, 9, 0)))
+	assert.Nil(t, s.Active(time.Date(2024, 2, 5, 9, 0, 0, 0, time.UTC)))
+
+	// either the day of the month or the day of the week will do
+	assert.NotNil(t, s.Active(at(13, 3, 0)))
+	assert.NotNil(t, s.Active(at(14, 3, 29)))
+	assert.Nil(t, s.Active(at(14, 3, 30)))
+	assert.Nil(t, s.Active(at(15, 3, 0)))
+
+	w := s.Active(at(14, 3, 10))
+	assert.True(t, at(14, 3, 30).Equal(s.ActiveUntil(w, at(14, 3, 10))))
+
+	always := newTestSchedule(
+		t,
+		`{"windows": [{"mode": "up", "cron": "* * * * *"}]}`,
+	)
+	w = always.Active(time.Now())
+	if assert.NotNil(t, w) {
+		assert.True(t, always.ActiveUntil(w, time.Now()).IsZero())
+	}
+}
+
+func TestCronExpression(t *testing.T) {
+	type testCase struct {
+		expression string
+		matching []time.Time
+		notMatching []time.Time
+	}
+
+	testCases := []testCase{
+		testCase{
+			expression: "*/15 * * * *",
+			matching: []time.Time{at(1, 9, 0), at(1, 9, 45)},
+			notMatching: []time.Time{at(1, 9, 1), at(1, 9, 50)},
+		},
+		testCase{
+			expression: "5/20 * * * *",
+			matching: []time.Time{at(1, 9, 5), at(1, 9, 45)},
+			notMatching: []time.Time{at(1, 9, 0), at(1, 9, 6)},
+		},
+		testCase{
+			expression: "10-30/10 * * * *",
+			matching: []time.Time{at(1, 9, 10), at(1, 9, 30)},
+			notMatching: []time.Time{
+				at(1, 9, 0),
+				at(1, 9, 15),
+				at(1, 9, 40),
+			},
+		},
+		testCase{
+			expression: "* 9-17 * * *",
+			matching: []time.Time{at(1, 9, 0), at(1, 17, 59)},
+			notMatching: []time.Time{at(1, 8, 59), at(1, 18, 0)},
+		},
+		testCase{
+			expression: "0 0-6,20-23 * * *",
+			matching: []time.Time{at(1, 3, 0), at(1, 21, 0)},
+			notMatching: []time.Time{at(1, 12, 0), at(1, 3, 1)},
+		},
+		testCase{
+			expression: "* * * feb *",
+			matching: []time.Time{
+				time.Date(2024, 2, 5, 9, 0, 0, 0, time.UTC),
+			},
+			notMatching: []time.Time{at(5, 9, 0)},
+		},
+		testCase{
+			expression: "* * 1-7 * *",
+			matching: []time.Time{at(1, 0, 0), at(7, 23, 59)},
+			notMatching: []time.Time{at(8, 0, 0)},
+		},
+		testCase{
+			expression: "* * * * mon-fri",
+			matching: []time.Time{at(1, 0, 0), at(5, 0, 0)},
+			notMatching: []time.Time{at(6, 0, 0), at(7, 0, 0)},
+		},
+		testCase{
+			expression: "* * * * 5-7",
+			matching: []time.Time{at(5, 0, 0), at(7, 0, 0)},
+			notMatching: []time.Time{at(3, 0, 0), at(8, 0, 0)},
+		},
+		testCase{
+			expression: "* * * * 0",
+			matching: []time.Time{at(7, 0, 0), at(14, 0, 0)},
+			notMatching: []time.Time{at(6, 0, 0)},
+		},
+		// only the day of the month is restricted
+		testCase{
+			expression: "* * 13 * *",
+			matching: []time.Time{at(13, 0, 0)},
+			notMatching: []time.Time{at(6, 0, 0), at(14, 0, 0)},
+		},
+		// only the day of the week is restricted
+		testCase{
+			expression: "* * * * sat",
+			matching: []time.Time{at(6, 0, 0), at(13, 0, 0)},
+			notMatching: []time.Time{at(12, 0, 0)},
+		},
+		// both are restricted, so either will do
+		testCase{
+			expression: "* * 13 * fri",
+			matching: []time.Time{
+				at(5, 0, 0),
+				at(12, 0, 0),
+				at(13, 0, 0),
+			},
+			notMatching: []time.Time{at(6, 0, 0), at(14, 0, 0)},
+		},
+		testCase{
+			expression: "* * 1,15 * mon",
+			matching: []time.Time{
+				at(1, 0, 0),
+				at(8, 0, 0),
+				at(15, 0, 0),
+			},
+			notMatching: []time.Time{at(2, 0, 0), at(16, 0, 0)},
+		},
+		// a field starting with "*" isn't restricted, even with a step,
+		// so both must match
+		testCase{
+			expression: "* * 13 * */2",
+			matching: []time.Time{at(13, 0, 0)},
+			notMatching: []time.Time{at(14, 0, 0), at(2, 0, 0)},
+		},
+		testCase{
+			expression: "* * */2 * mon",
+			matching: []time.Time{at(1, 0, 0), at(15, 0, 0)},
+			notMatching: []time.Time{at(8, 0, 0), at(3, 0, 0)},
+		},
+	}
+
+	for _, c := range testCases {
+		expression, err := parseCronExpression(c.expression)
+		if !assert.NoError(t, err, c.expression) {
+			continue
+		}
+		for _, m := range c.matching {
+			assert.True(
+				t,
+				expression.matches(m),
+				c.expression + " should match " + m.String(),
+			)
+		}
+		for _, m := range c.notMatching {
+			assert.False(
+				t,
+				expression.matches(m),
+				c.expression + " should not match " +
+				m.String(),
+			)
+		}
+	}
+}
+
+func TestScheduleTimeZone(t *testing.T) {
+	s := newTestSchedule(
+		t,
+		`{
+			"timezone": "America/New_York",
+			"windows": [
+				{
+					"mode": "up",
+					"days": ["mon"],
+					"start": "09:00",
+					"end": "17:00"
+				}
+			]
+		}`,
+	)
+
+	assert.Nil(t, s.Active(at(1, 9, 0)))
+	assert.NotNil(t, s.Active(at(1, 14, 0)))
+	assert.NotNil(t, s.Active(at(1, 21, 59)))
+	assert.Nil(t, s.Active(at(1, 22, 0)))
+}
+
+func TestScheduleFromConfig(t *testing.T) {
+	test := configutil.ConfigTest{
+		ResourceType: "schedule",
+		IsValid: func(i json.Unmarshaler) error {
+			s, ok := i.(*Schedule)
+			if !ok {
+				return errors.New(
+					"Schedule IsValid received an object" +
+					" of the wrong type.",
+				)
+			}
+
+			if s.Location == nil || len(s.Windows) == 0 {
+				return errors.New(
+					"Schedule IsValid received an" +
+					" incomplete schedule.",
+				)
+			}
+
+			return nil
+		},
+		SyntacticallyBad: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: "",
+				Explanation: "empty config",
+			},
+			configutil.ConfigTestData{
+				Data: "{}",
+				Explanation: "empty object",
+			},
+			configutil.ConfigTestData{
+				Data: "null",
+				Explanation: "null config",
+			},
+			configutil.ConfigTestData{
+				Data: "42",
+				Explanation: "numeric config",
+			},
+			configutil.ConfigTestData{
+				Data: `{"windows": [null]}`,
+				Explanation: "null window",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"timezone": "Nowhere/Special",
+					"windows": [{"mode": "up", "cron": "* * * * *"}]
+				}`,
+				Explanation: "unknown time zone",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [{"mode": "off", "cron": "* * * * *"}]
+				}`,
+				Explanation: "unknown mode",
+			},
+			configutil.ConfigTestData{
+				Data: `{"windows": [{"mode": "up"}]}`,
+				Explanation: "window without times",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [
+						{
+							"mode": "up",
+							"cron": "* * * * *",
+							"days": ["mon"],
+							"start": "09:00",
+							"end": "17:00"
+						}
+					]
+				}`,
+				Explanation: "window with both cron and days",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [
+						{
+							"mode": "up",
+							"start": "09:00",
+							"end": "17:00"
+						}
+					]
+				}`,
+				Explanation: "weekly window without days",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [
+						{
+							"mode": "up",
+							"days": ["someday"],
+							"start": "09:00",
+							"end": "17:00"
+						}
+					]
+				}`,
+				Explanation: "unknown day",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [
+						{
+							"mode": "up",
+							"days": ["mon"],
+							"start": "9am",
+							"end": "17:00"
+						}
+					]
+				}`,
+				Explanation: "bad start time",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [
+						{
+							"mode": "up",
+							"days": ["mon"],
+							"start": "09:00",
+							"end": "25:00"
+						}
+					]
+				}`,
+				Explanation: "bad end time",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [
+						{
+							"mode": "up",
+							"days": ["mon"],
+							"start": "09:00",
+							"end": "09:00"
+						}
+					]
+				}`,
+				Explanation: "empty window",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [{"mode": "up", "cron": "* * * *"}]
+				}`,
+				Explanation: "cron with too few fields",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [{"mode": "up", "cron": "60 * * * *"}]
+				}`,
+				Explanation: "cron with minute out of range",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [{"mode": "up", "cron": "* 5-1 * * *"}]
+				}`,
+				Explanation: "cron with backwards range",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [{"mode": "up", "cron": "*/0 * * * *"}]
+				}`,
+				Explanation: "cron with zero step",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [{"mode": "up", "cron": "* * * foo *"}]
+				}`,
+				Explanation: "cron with unknown month",
+			},
+		},
+		Good: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: `{
+					"windows": [{"mode": "down", "cron": "* * * * *"}]
+				}`,
+				Explanation: "always down in the local time zone",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"timezone": "Europe/Berlin",
+					"windows": [
+						{
+							"name": "business hours",
+							"mode": "up",
+							"days": ["Mon", "TUE", "wed", "thu", "fri"],
+							"start": "08:30",
+							"end": "18:00"
+						},
+						{
+							"name": "night",
+							"mode": "down",
+							"days": ["sun", "mon", "tue", "wed", "thu", "fri", "sat"],
+							"start": "22:00",
+							"end": "06:00"
+						},
+						{
+							"name": "end of day",
+							"mode": "up",
+							"days": ["sat"],
+							"start": "20:00",
+							"end": "24:00"
+						},
+						{
+							"name": "month end",
+							"mode": "up",
+							"cron": "*/5 0-6,20-23 28-31 Jan-Dec */2"
+						}
+					]
+				}`,
+				Explanation: "business hours in Berlin",
+			},
+		},
+	}
+	test.Run(t)
+}
+
+// TestScheduledDown verifies that a service is not started during a window in
+// which it is pinned down, and that the window is given with its status.
+func TestScheduledDown(t *testing.T) {
+	onDown := &lockedCounterTriggerHandler{}
+	svc := newIdleTestService(t, onDown)
+	svc.Schedule = newTestSchedule(
+		t,
+		`{
+			"windows": [
+				{"name": "<budget>", "mode": "down", "cron": "* * * * *"}
+			]
+		}`,
+	)
+
+	response, body := warmupTestRequest(t, svc, "/")
+	assert.Equal(t, 503, response.StatusCode)
+	assert.Contains(t, body, "Service Unavailable")
+	assert.Contains(t, body, "&lt;budget&gt;")
+	// the window never ends, so the longest wait is given
+	assert.Equal(t, "60", response.Header.Get("Retry-After"))
+	assert.Equal(t, 0, onDown.Count())
+	state, _ := svc.State()
+	assert.Equal(t, ServiceStopped, state)
+
+	// dependents aren't able to start the service either
+	app := newIdleTestService(t, onDown)
+	assert.NoError(t, app.AddDependency(svc))
+	stateTestRequest(t, app, 503)
+	for i := 0; i < 50; i++ {
+		if state, _ := app.State(); state == ServiceFailed {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	state, _ = app.State()
+	assert.Equal(t, ServiceFailed, state)
+	assert.Equal(t, 0, onDown.Count())
+
+	response, body = warmupTestRequest(t, svc, DefaultStatusPath)
+	assert.Equal(t, 200, response.StatusCode)
+	var doc struct {
+		Up bool
+		Window *struct {
+			Name string
+			Mode string
+			Until *time.Time
+		}
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &doc))
+	assert.False(t, doc.Up)
+	if assert.NotNil(t, doc.Window) {
+		assert.Equal(t, "<budget>", doc.Window.Name)
+		assert.Equal(t, ScheduleDown, doc.Window.Mode)
+		assert.Nil(t, doc.Window.Until)
+	}
+}
+
+// TestScheduledDownStopsService verifies that a service which is up during a
+// window in which it is pinned down is stopped, even if it isn't idle.
+func TestScheduledDownStopsService(t *testing.T) {
+	svc := newIdleTestService(t, nil)
+	svc.GracePeriod = time.Minute
+	svc.Schedule = newTestSchedule(
+		t,
+		`{"windows": [{"mode": "down", "cron": "* * * * *"}]}`,
+	)
+
+	// without an idle controller, there is no way to stop the service
+	svc.SetStatusUp()
+	svc.enforceSchedule()
+
+	onIdle := &lockedCounterTriggerHandler{}
+	c := NewIdleController(svc, time.Minute, onIdle)
+	assert.NoError(t, c.Start())
+	defer c.Stop()
+
+	svc.enforceSchedule()
+	assert.Equal(t, 1, onIdle.Count())
+	assert.Equal(t, IdleFired, c.IdleStatus().State)
+	state, _ := svc.State()
+	assert.Equal(t, ServiceStopping, state)
+
+	// the service is already stopping
+	svc.enforceSchedule()
+	assert.Equal(t, 1, onIdle.Count())
+}
+
+// TestScheduledUp verifies that a service is started during a window in which
+// it is pinned up, and that it is not stopped for being idle.
+func TestScheduledUp(t *testing.T) {
+	onDown := &lockedCounterTriggerHandler{}
+	svc := newIdleTestService(t, onDown)
+	svc.Schedule = newTestSchedule(
+		t,
+		`{
+			"windows": [
+				{"name": "warm", "mode": "up", "cron": "* * * * *"}
+			]
+		}`,
+	)
+
+	assert.NoError(t, svc.Start())
+	for i := 0; i < 50 && onDown.Count() == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NoError(t, svc.Stop())
+	assert.Equal(t, 1, onDown.Count())
+	state, _ := svc.State()
+	assert.Equal(t, ServiceStarting, state)
+
+	// a service which is already starting isn't started again
+	svc.enforceSchedule()
+	assert.Equal(t, 1, onDown.Count())
+
+	svc.GracePeriod = time.Minute
+	svc.SetStatusUp()
+	onIdle := &lockedCounterTriggerHandler{}
+	c := NewIdleController(svc, 100 * time.Millisecond, onIdle)
+	assert.NoError(t, c.Start())
+	defer c.Stop()
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 0, onIdle.Count())
+	assert.Equal(t, IdleWaiting, c.IdleStatus().State)
+
+	doc := svc.statusDocument()
+	if assert.NotNil(t, doc.Window) {
+		assert.Equal(t, "warm", doc.Window.Name)
+		assert.Equal(t, ScheduleUp, doc.Window.Mode)
+		assert.Nil(t, doc.Window.Until)
+	}
+
+	// once the window is over, the service is stopped once it is idle
+	assert.NoError(t, c.Stop())
+	svc.Schedule = nil
+	assert.NoError(t, c.Start())
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 1, onIdle.Count())
+	assert.Nil(t, svc.statusDocument().Window)
+}
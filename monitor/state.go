@@ -0,0 +1,225 @@
+package monitor
+
+import (
+	"fmt"
+	"time"
+)
+
+// The states a MinMonitorredService can be in. A service starts out stopped
+// (until a probe finds it up). A stopped or failed service becomes starting
+// just before its OnDown trigger is run, and stays that way (so the OnDown
+// trigger isn't run again) until a probe finds it up, or until the start
+// timeout passes (or the OnDown trigger fails), at which point it has failed.
+// A service which is being stopped by an IdleController is stopping until a
+// probe finds it down. A service which is up becomes stopped if a probe finds
+// it down.
+const (
+	ServiceStopped = "stopped"
+	ServiceStarting = "starting"
+	ServiceUp = "up"
+	ServiceStopping = "stopping"
+	ServiceFailed = "failed"
+)
+
+// DefaultStartTimeout is the amount of time a service is given to start (or
+// to stop) if no other value is given.
+const DefaultStartTimeout = 5 * time.Minute
+
+// StateTransition describes a change in the state of a service.
+type StateTransition struct {
+	Service string
+	From string
+	To string
+	Time time.Time
+}
+
+// StateListener is a function which is called with each change in the state
+// of a service it has been added to. Listeners are called one at a time in the
+// order they were added, but they may be called from any goroutine.
+type StateListener func(transition StateTransition)
+
+// State gives the current state of the named service, and when it entered
+// that state.
+func (monitor *MinMonitor) State(
+	name string,
+) (state string, since time.Time, err error) {
+	svc, entryExists := monitor.table[name]
+	if ! entryExists {
+		log().Err(
+			fmt.Sprintf(
+				"minmonitor cannot get the state of unknown" +
+				" service: \"%s\"",
+				name,
+			),
+		)
+
+		return "", time.Time{}, UnknownServiceError
+	}
+
+	state, since = svc.State()
+	return state, since, nil
+}
+
+// State gives the current state of the service, and when it entered that
+// state.
+func (svc *MinMonitorredService) State() (state string, since time.Time) {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	if svc.state == "" {
+		return ServiceStopped, svc.stateSince
+	}
+	return svc.state, svc.stateSince
+}
+
+// AddStateListener adds a function to be called with each change in the state
+// of the service.
+func (svc *MinMonitorredService) AddStateListener(listener StateListener) {
+	svc.listenerMutex.Lock()
+	defer svc.listenerMutex.Unlock()
+
+	svc.listeners = append(svc.listeners, listener)
+}
+
+// setState moves the service into the given state, keeping the stats of the
+// service up to date. The mutex must be held, and the returned transition (if
+// any) must be passed to notify once the mutex has been released.
+func (svc *MinMonitorredService) setState(to string) *StateTransition {
+	from := svc.state
+	if from == "" {
+		from = ServiceStopped
+	}
+	if from == to {
+		return nil
+	}
+
+	now := time.Now()
+	switch {
+	case from == ServiceStarting && to == ServiceUp:
+		started := svc.bootStarted
+		if started.IsZero() {
+			started = svc.stateSince
+		}
+		svc.recordBoot(now.Sub(started))
+	case to == ServiceFailed:
+		svc.recordFailure(now)
+	case to == ServiceStarting && !svc.idleSince.IsZero():
+		svc.recordIdle(now.Sub(svc.idleSince))
+	}
+	switch to {
+	case ServiceStarting:
+		svc.bootStarted = time.Time{}
+		svc.idleSince = time.Time{}
+	case ServiceStopping:
+		svc.idleSince = now
+	case ServiceUp:
+		svc.idleSince = time.Time{}
+		if svc.upWaiters != nil {
+			close(svc.upWaiters)
+			svc.upWaiters = nil
+		}
+	}
+	svc.state = to
+	svc.stateSince = now
+
+	log().Info(
+		fmt.Sprintf(
+			"minmonitor service \"%s:%d\" has gone from %s to %s",
+			svc.Address,
+			svc.Port,
+			from,
+			to,
+		),
+	)
+
+	return &StateTransition{svc.Name, from, to, now}
+}
+
+// transition moves the service into the given state, but only if it is in one
+// of the given states (or any state at all if none are given), and reports
+// whether it did so.
+func (svc *MinMonitorredService) transition(
+	to string,
+	from ...string,
+) bool {
+	svc.mutex.Lock()
+	current := svc.state
+	if current == "" {
+		current = ServiceStopped
+	}
+	allowed := len(from) == 0
+	for _, f := range from {
+		if f == current {
+			allowed = true
+		}
+	}
+	var t *StateTransition
+	if allowed {
+		t = svc.setState(to)
+	}
+	svc.mutex.Unlock()
+
+	svc.notify(t)
+	return allowed
+}
+
+// probed moves the service into the state implied by the result of a probe.
+// The mutex must be held, and the returned transition (if any) must be passed
+// to notify once the mutex has been released.
+func (svc *MinMonitorredService) probed(up bool) *StateTransition {
+	state := svc.state
+	if state == "" {
+		state = ServiceStopped
+	}
+	timeout := svc.startTimeout()
+	expired := time.Now().After(svc.stateSince.Add(timeout))
+
+	switch {
+	case up && state == ServiceStopping && !expired:
+		return nil
+	case up:
+		return svc.setState(ServiceUp)
+	case state == ServiceStarting && expired:
+		log().Warning(
+			fmt.Sprintf(
+				"minmonitor service \"%s:%d\" did not start" +
+				" within %v",
+				svc.Address,
+				svc.Port,
+				timeout,
+			),
+		)
+		return svc.setState(ServiceFailed)
+	case state == ServiceUp || state == ServiceStopping:
+		return svc.setState(ServiceStopped)
+	default:
+		return nil
+	}
+}
+
+// startTimeout gives the start timeout of the service, using the default if
+// none was given.
+func (svc *MinMonitorredService) startTimeout() time.Duration {
+	if svc.StartTimeout <= 0 {
+		return DefaultStartTimeout
+	}
+	return svc.StartTimeout
+}
+
+// notify saves the stats and state of the service and calls each listener with
+// the given transition (unless it is nil).
+func (svc *MinMonitorredService) notify(t *StateTransition) {
+	if t == nil {
+		return
+	}
+
+	svc.saveStats()
+	svc.saveState()
+
+	svc.listenerMutex.Lock()
+	defer svc.listenerMutex.Unlock()
+
+	for _, listener := range svc.listeners {
+		listener(*t)
+	}
+}
@@ -0,0 +1,171 @@
+package monitor
+
+import (
+	"github.com/fitstar/falcore"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stateTestRequest runs a request through the given service, verifying the
+// status code of the response.
+func stateTestRequest(
+	t *testing.T,
+	svc *MinMonitorredService,
+	expectedStatus int,
+) {
+	request, err := http.NewRequest("GET", "http://localhost", nil)
+	assert.NoError(t, err)
+
+	_, response := falcore.TestWithRequest(request, svc, nil)
+	assert.Equal(t, expectedStatus, response.StatusCode)
+	response.Body.Close()
+}
+
+// TestServiceStateStarting verifies that a down service is only started once,
+// no matter how many requests arrive while it is starting.
+func TestServiceStateStarting(t *testing.T) {
+	onDown := &lockedCounterTriggerHandler{}
+	svc := newIdleTestService(t, onDown)
+
+	state, since := svc.State()
+	assert.Equal(t, ServiceStopped, state)
+	assert.True(t, since.IsZero())
+
+	stateTestRequest(t, svc, 503)
+	assert.Equal(t, 1, onDown.Count())
+	state, since = svc.State()
+	assert.Equal(t, ServiceStarting, state)
+	assert.False(t, since.IsZero())
+
+	stateTestRequest(t, svc, 503)
+	stateTestRequest(t, svc, 503)
+	assert.Equal(t, 1, onDown.Count())
+
+	svc.SetStatusUp()
+	state, _ = svc.State()
+	assert.Equal(t, ServiceUp, state)
+}
+
+// TestServiceStateSlowTrigger verifies that requests which arrive while the
+// OnDown trigger is still running don't run it again.
+func TestServiceStateSlowTrigger(t *testing.T) {
+	onDown := &lockedCounterTriggerHandler{}
+	release := make(chan struct{})
+	svc := newIdleTestService(
+		t,
+		funcTriggerHandler(
+			func() error {
+				onDown.Trigger()
+				<-release
+				return nil
+			},
+		),
+	)
+
+	done := make(chan struct{})
+	go func() {
+		stateTestRequest(t, svc, 503)
+		close(done)
+	}()
+	for i := 0; i < 50 && onDown.Count() == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	state, _ := svc.State()
+	assert.Equal(t, ServiceStarting, state)
+	stateTestRequest(t, svc, 503)
+	stateTestRequest(t, svc, 503)
+	assert.Equal(t, 1, onDown.Count())
+
+	close(release)
+	<-done
+	assert.Equal(t, 1, onDown.Count())
+}
+
+// TestServiceStateStartTimeout verifies that a service which doesn't start
+// within its start timeout has failed, and that it is started again by the
+// next request.
+func TestServiceStateStartTimeout(t *testing.T) {
+	onDown := &lockedCounterTriggerHandler{}
+	svc := newIdleTestService(t, onDown)
+	svc.StartTimeout = 100 * time.Millisecond
+
+	stateTestRequest(t, svc, 503)
+	assert.Equal(t, 1, onDown.Count())
+
+	_, err := svc.Reprobe()
+	assert.NoError(t, err)
+	state, _ := svc.State()
+	assert.Equal(t, ServiceStarting, state)
+
+	time.Sleep(200 * time.Millisecond)
+	_, err = svc.Reprobe()
+	assert.NoError(t, err)
+	state, _ = svc.State()
+	assert.Equal(t, ServiceFailed, state)
+
+	stateTestRequest(t, svc, 503)
+	assert.Equal(t, 2, onDown.Count())
+	state, _ = svc.State()
+	assert.Equal(t, ServiceStarting, state)
+}
+
+// TestServiceStateTriggerError verifies that a service whose OnDown trigger
+// fails has failed.
+func TestServiceStateTriggerError(t *testing.T) {
+	svc := newIdleTestService(t, &counterTriggerHandler{-1})
+
+	stateTestRequest(t, svc, 500)
+	state, _ := svc.State()
+	assert.Equal(t, ServiceFailed, state)
+}
+
+// TestServiceStateListeners verifies that listeners are given each transition,
+// and that a service which is found down after being up has stopped.
+func TestServiceStateListeners(t *testing.T) {
+	svc := newIdleTestService(t, nil)
+
+	var mutex sync.Mutex
+	var transitions []StateTransition
+	svc.AddStateListener(
+		func(transition StateTransition) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			transitions = append(transitions, transition)
+		},
+	)
+
+	svc.SetStatusUp()
+	svc.SetStatusUp()
+	_, err := svc.Reprobe()
+	assert.NoError(t, err)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if assert.Equal(t, 2, len(transitions)) {
+		assert.Equal(t, "test", transitions[0].Service)
+		assert.Equal(t, ServiceStopped, transitions[0].From)
+		assert.Equal(t, ServiceUp, transitions[0].To)
+		assert.Equal(t, ServiceUp, transitions[1].From)
+		assert.Equal(t, ServiceStopped, transitions[1].To)
+		assert.False(t, transitions[1].Time.Before(transitions[0].Time))
+	}
+}
+
+// TestMinMonitorState verifies that a MinMonitor gives the state of the
+// services it knows about.
+func TestMinMonitorState(t *testing.T) {
+	mon := NewMinMonitor()
+	err := mon.Add("test", newIdleTestService(t, nil))
+	assert.NoError(t, err)
+
+	state, _, err := mon.State("test")
+	assert.NoError(t, err)
+	assert.Equal(t, ServiceStopped, state)
+
+	_, _, err = mon.State("unknown_service")
+	assert.Equal(t, UnknownServiceError, err)
+}
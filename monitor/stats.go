@@ -0,0 +1,232 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fitstar/falcore"
+	"net/http"
+	"time"
+)
+
+// DefaultStatsPath is the path at which a MinMonitorredService answers with
+// its statistics if no other path is given.
+const DefaultStatsPath = "/_pullcord/stats"
+
+// maxStatsHistory is the number of recent boots, failures, and idle periods a
+// service keeps.
+const maxStatsHistory = 10
+
+// ServiceStats is the recent history of a service. Boots are the durations
+// from the OnDown trigger being run until the service was first found up.
+// Failures are the times at which the service failed to start. Idles are the
+// durations from the service being stopped for being idle until it was next
+// started. Only the most recent of each are kept. If the service has a state
+// store, its stats are kept in the store so they outlive the process.
+type ServiceStats struct {
+	Boots []time.Duration `json:"boots"`
+	Failures []time.Time `json:"failures"`
+	Idles []time.Duration `json:"idles"`
+}
+
+// keepRecentDurations appends the given duration, forgetting the oldest ones
+// if there are too many.
+func keepRecentDurations(
+	history []time.Duration,
+	d time.Duration,
+) []time.Duration {
+	history = append(history, d)
+	if len(history) > maxStatsHistory {
+		history = history[len(history) - maxStatsHistory:]
+	}
+	return history
+}
+
+// recordBoot keeps the duration of a boot which has just finished. The mutex
+// must be held.
+func (svc *MinMonitorredService) recordBoot(duration time.Duration) {
+	svc.stats.Boots = keepRecentDurations(svc.stats.Boots, duration)
+}
+
+// recordIdle keeps the duration of an idle period which has just finished. The
+// mutex must be held.
+func (svc *MinMonitorredService) recordIdle(duration time.Duration) {
+	svc.stats.Idles = keepRecentDurations(svc.stats.Idles, duration)
+}
+
+// recordFailure keeps the time of a failure to start. The mutex must be held.
+func (svc *MinMonitorredService) recordFailure(when time.Time) {
+	svc.stats.Failures = append(svc.stats.Failures, when)
+	if len(svc.stats.Failures) > maxStatsHistory {
+		svc.stats.Failures = svc.stats.Failures[
+			len(svc.stats.Failures) - maxStatsHistory:
+		]
+	}
+}
+
+// Stats gives a copy of the recent history of the service.
+func (svc *MinMonitorredService) Stats() ServiceStats {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	return ServiceStats{
+		Boots: append([]time.Duration(nil), svc.stats.Boots...),
+		Failures: append([]time.Time(nil), svc.stats.Failures...),
+		Idles: append([]time.Duration(nil), svc.stats.Idles...),
+	}
+}
+
+// statsKey gives the key under which the service keeps its stats in its state
+// store.
+func (svc *MinMonitorredService) statsKey() string {
+	return svc.storeKey() + "/stats"
+}
+
+// restoreStats takes up the stats which the service kept in its state store
+// (if it has one), but only if the service has no stats of its own yet. Stats
+// which cannot be read are only logged, as the service works just as well
+// without them.
+func (svc *MinMonitorredService) restoreStats() {
+	if svc.Store == nil {
+		return
+	}
+
+	var stats ServiceStats
+	found, err := svc.Store.Load(svc.statsKey(), &stats)
+	if err != nil {
+		log().Warning(
+			fmt.Sprintf(
+				"minmonitor was unable to restore the stats" +
+				" of \"%s:%d\", starting without them: %v",
+				svc.Address,
+				svc.Port,
+				err,
+			),
+		)
+		return
+	} else if !found {
+		return
+	}
+
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	if len(svc.stats.Boots) == 0 && len(svc.stats.Failures) == 0 &&
+	    len(svc.stats.Idles) == 0 {
+		svc.stats = stats
+	}
+}
+
+// saveStats keeps the stats of the service in its state store (if it has one).
+func (svc *MinMonitorredService) saveStats() {
+	if svc.Store == nil {
+		return
+	}
+
+	if e := svc.Store.Save(svc.statsKey(), svc.Stats()); e != nil {
+		log().Err(
+			fmt.Sprintf(
+				"minmonitor was unable to save the stats of" +
+				" \"%s:%d\": %v",
+				svc.Address,
+				svc.Port,
+				e,
+			),
+		)
+	}
+}
+
+// statsPath gives the path at which the service answers with its stats.
+func (svc *MinMonitorredService) statsPath() string {
+	if svc.StatsPath == "" {
+		return DefaultStatsPath
+	}
+	return svc.StatsPath
+}
+
+// durationStatsDocument is the JSON representation of a history of durations
+// (in seconds) given at the stats path of a service.
+type durationStatsDocument struct {
+	Count int `json:"count"`
+	Average *float64 `json:"average,omitempty"`
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	Recent []float64 `json:"recent"`
+}
+
+func newDurationStatsDocument(
+	history []time.Duration,
+) durationStatsDocument {
+	doc := durationStatsDocument{
+		Count: len(history),
+		Recent: make([]float64, len(history)),
+	}
+	if len(history) == 0 {
+		return doc
+	}
+
+	var total, min, max time.Duration
+	for i, d := range history {
+		doc.Recent[i] = d.Seconds()
+		total += d
+		if i == 0 || d < min {
+			min = d
+		}
+		if i == 0 || d > max {
+			max = d
+		}
+	}
+	average := (total / time.Duration(len(history))).Seconds()
+	minSeconds := min.Seconds()
+	maxSeconds := max.Seconds()
+	doc.Average = &average
+	doc.Min = &minSeconds
+	doc.Max = &maxSeconds
+
+	return doc
+}
+
+// serviceStatsDocument is the JSON representation of the stats of a service
+// given at its stats path.
+type serviceStatsDocument struct {
+	Service string `json:"service"`
+	State string `json:"state"`
+	Since time.Time `json:"since"`
+	EstimatedWait *int `json:"estimatedwait,omitempty"`
+	Boots durationStatsDocument `json:"boots"`
+	Idles durationStatsDocument `json:"idles"`
+	Failures []time.Time `json:"failures"`
+}
+
+// statsResponse produces the stats of the service, as given at its stats path.
+func (svc *MinMonitorredService) statsResponse(
+	req *falcore.Request,
+) (*http.Response) {
+	stats := svc.Stats()
+	data := svc.warmupPageData(req.HttpRequest)
+	doc := serviceStatsDocument{
+		Service: svc.Name,
+		State: data.State,
+		Since: data.Since,
+		Boots: newDurationStatsDocument(stats.Boots),
+		Idles: newDurationStatsDocument(stats.Idles),
+		Failures: stats.Failures,
+	}
+	if doc.Failures == nil {
+		doc.Failures = []time.Time{}
+	}
+	if data.EstimateKnown {
+		wait := int(data.EstimatedWait / time.Second)
+		doc.EstimatedWait = &wait
+	}
+
+	body, _ := json.Marshal(doc)
+	return falcore.StringResponse(
+		req.HttpRequest,
+		200,
+		http.Header{
+			"Content-Type": []string{"application/json"},
+			"Cache-Control": []string{"no-cache"},
+		},
+		string(body),
+	)
+}
@@ -0,0 +1,147 @@
+package monitor
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stuphlabs/pullcord/store"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestServiceStatsHistory verifies that boots, failures, and idle periods are
+// kept as the service changes state.
+func TestServiceStatsHistory(t *testing.T) {
+	onDown := &blockingTriggerHandler{release: make(chan struct{})}
+	svc := newIdleTestService(t, onDown)
+
+	done := make(chan struct{})
+	go func() {
+		stateTestRequest(t, svc, 503)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(onDown.release)
+	<-done
+	svc.SetStatusUp()
+
+	// the boot is timed from when the OnDown trigger was run
+	stats := svc.Stats()
+	assert.Equal(t, 1, len(stats.Boots))
+	assert.True(t, stats.Boots[0] >= 100 * time.Millisecond)
+	assert.Equal(t, 0, len(stats.Idles))
+	assert.Equal(t, 0, len(stats.Failures))
+
+	assert.True(t, svc.transition(ServiceStopping, ServiceUp))
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, svc.transition(ServiceStopped, ServiceStopping))
+	stateTestRequest(t, svc, 503)
+
+	stats = svc.Stats()
+	assert.Equal(t, 1, len(stats.Idles))
+	assert.True(t, stats.Idles[0] >= 50 * time.Millisecond)
+
+	assert.True(t, svc.transition(ServiceFailed, ServiceStarting))
+	stats = svc.Stats()
+	assert.Equal(t, 1, len(stats.Failures))
+	assert.Equal(t, 1, len(stats.Boots))
+
+	svc.mutex.Lock()
+	for i := 0; i < maxStatsHistory + 2; i++ {
+		svc.recordIdle(time.Duration(i) * time.Second)
+		svc.recordFailure(time.Unix(int64(i), 0))
+	}
+	svc.mutex.Unlock()
+	stats = svc.Stats()
+	assert.Equal(t, maxStatsHistory, len(stats.Idles))
+	assert.Equal(t, 2 * time.Second, stats.Idles[0])
+	assert.Equal(t, maxStatsHistory, len(stats.Failures))
+	assert.Equal(t, int64(2), stats.Failures[0].Unix())
+}
+
+// TestServiceStatsStore verifies that stats are kept in the state store, that
+// they are restored by another service once it is started, and that stats
+// which cannot be read are ignored.
+func TestServiceStatsStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullcord-stats")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := store.NewJSONFileStore(filepath.Join(dir, "state.json"))
+
+	svc := newIdleTestService(t, &lockedCounterTriggerHandler{})
+	svc.Store = s
+	stateTestRequest(t, svc, 503)
+	svc.SetStatusUp()
+	assert.Equal(t, 1, len(svc.Stats().Boots))
+
+	other := newIdleTestService(t, &lockedCounterTriggerHandler{})
+	other.Port = svc.Port
+	other.Store = s
+	assert.Equal(t, 0, len(other.Stats().Boots))
+	assert.NoError(t, other.Start())
+	defer other.Stop()
+	assert.Equal(t, svc.Stats(), other.Stats())
+
+	err = s.Save(svc.statsKey(), "not stats")
+	assert.NoError(t, err)
+	broken := newIdleTestService(t, &lockedCounterTriggerHandler{})
+	broken.Port = svc.Port
+	broken.Store = s
+	assert.NoError(t, broken.Start())
+	defer broken.Stop()
+	assert.Equal(t, 0, len(broken.Stats().Boots))
+}
+
+// TestServiceStatsPath verifies that the stats of a service are given at its
+// stats path without starting the service.
+func TestServiceStatsPath(t *testing.T) {
+	onDown := &lockedCounterTriggerHandler{}
+	svc := newIdleTestService(t, onDown)
+
+	var doc struct {
+		Service string
+		State string
+		EstimatedWait *int
+		Boots struct {
+			Count int
+			Average *float64
+			Min *float64
+			Max *float64
+			Recent []float64
+		}
+		Idles struct {
+			Count int
+		}
+		Failures []time.Time
+	}
+
+	response, body := warmupTestRequest(t, svc, DefaultStatsPath)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.NoError(t, json.Unmarshal([]byte(body), &doc))
+	assert.Equal(t, "test", doc.Service)
+	assert.Equal(t, ServiceStopped, doc.State)
+	assert.Nil(t, doc.EstimatedWait)
+	assert.Equal(t, 0, doc.Boots.Count)
+	assert.Nil(t, doc.Boots.Average)
+	assert.NotNil(t, doc.Failures)
+	assert.Equal(t, 0, onDown.Count())
+
+	svc.mutex.Lock()
+	svc.recordBoot(10 * time.Second)
+	svc.recordBoot(30 * time.Second)
+	svc.mutex.Unlock()
+	svc.StatsPath = "/stats"
+
+	response, body = warmupTestRequest(t, svc, "/stats")
+	assert.Equal(t, 200, response.StatusCode)
+	assert.NoError(t, json.Unmarshal([]byte(body), &doc))
+	assert.Equal(t, 2, doc.Boots.Count)
+	assert.Equal(t, 20.0, *doc.Boots.Average)
+	assert.Equal(t, 10.0, *doc.Boots.Min)
+	assert.Equal(t, 30.0, *doc.Boots.Max)
+	assert.Equal(t, []float64{10, 30}, doc.Boots.Recent)
+	assert.Equal(t, 20, *doc.EstimatedWait)
+	assert.Equal(t, 0, onDown.Count())
+}
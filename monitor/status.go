@@ -0,0 +1,213 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fitstar/falcore"
+	"github.com/proidiot/gone/errors"
+	"github.com/stuphlabs/pullcord/config"
+	"github.com/stuphlabs/pullcord/trigger"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NoStatusServicesError indicates that a status filter was configured without
+// any services to report on.
+const NoStatusServicesError = errors.New(
+	"A status filter requires at least one service",
+)
+
+// MinMonitorStatusFilter is a Falcore RequestFilter that produces a JSON
+// document describing the last known status and state of each of a list of
+// services (without probing them), along with the status of the most recent
+// run of any of their triggers which keep track of such things, the traffic
+// seen by any IdleController in front of them, and the active window of their
+// schedule (if any). The services are keyed by name, or by address and port if
+// they have no name.
+type MinMonitorStatusFilter struct {
+	Services []*MinMonitorredService
+}
+
+// triggerStatusDocument is the JSON representation of a trigger.TriggerStatus.
+type triggerStatusDocument struct {
+	State string `json:"state"`
+	Started *time.Time `json:"started,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// idleStatusDocument is the JSON representation of an IdleStatus.
+type idleStatusDocument struct {
+	State string `json:"state"`
+	InFlight int `json:"inflight"`
+	Requests uint64 `json:"requests"`
+	LastActive *time.Time `json:"lastactive,omitempty"`
+}
+
+// serviceStatusDocument is the JSON representation of the status of a
+// service.
+type serviceStatusDocument struct {
+	Up bool `json:"up"`
+	State string `json:"state"`
+	StateSince *time.Time `json:"statesince,omitempty"`
+	LastChecked *time.Time `json:"lastchecked,omitempty"`
+	Triggers map[string]triggerStatusDocument `json:"triggers,omitempty"`
+	Idle *idleStatusDocument `json:"idle,omitempty"`
+	Window *scheduleWindowDocument `json:"window,omitempty"`
+}
+
+func init() {
+	config.RegisterResourceType(
+		"minmonitorstatusfilter",
+		func() json.Unmarshaler {
+			return new(MinMonitorStatusFilter)
+		},
+	)
+}
+
+func (f *MinMonitorStatusFilter) UnmarshalJSON(data []byte) error {
+	var t struct {
+		Services []config.Resource
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	if len(t.Services) == 0 {
+		return NoStatusServicesError
+	}
+
+	f.Services = make([]*MinMonitorredService, 0, len(t.Services))
+	for _, r := range t.Services {
+		switch s := r.Unmarshaled.(type) {
+		case *MinMonitorredService:
+			f.Services = append(f.Services, s)
+		default:
+			log().Err(
+				fmt.Sprintf(
+					"Registry value is not a" +
+					" MinMonitorredService: %s",
+					s,
+				),
+			)
+			return config.UnexpectedResourceType
+		}
+	}
+
+	return nil
+}
+
+// NewMinMonitorStatusFilter constructs a new MinMonitorStatusFilter for the
+// given services.
+func NewMinMonitorStatusFilter(
+	services []*MinMonitorredService,
+) *MinMonitorStatusFilter {
+	return &MinMonitorStatusFilter{services}
+}
+
+func newTriggerStatusDocument(
+	status trigger.TriggerStatus,
+) triggerStatusDocument {
+	result := triggerStatusDocument{State: status.State}
+	if !status.Started.IsZero() {
+		started := status.Started
+		result.Started = &started
+		result.Duration = status.Duration.String()
+	}
+	if status.Err != nil {
+		result.Error = status.Err.Error()
+	}
+	return result
+}
+
+// statusDocument produces the JSON representation of the status of a service.
+func (svc *MinMonitorredService) statusDocument() serviceStatusDocument {
+	svc.mutex.Lock()
+	up, lastChecked := svc.up, svc.lastChecked
+	svc.mutex.Unlock()
+
+	state, since := svc.State()
+	result := serviceStatusDocument{Up: up, State: state}
+	if !since.IsZero() {
+		result.StateSince = &since
+	}
+	if !lastChecked.IsZero() {
+		result.LastChecked = &lastChecked
+	}
+
+	statuses := svc.TriggerStatuses()
+	if len(statuses) > 0 {
+		result.Triggers = make(map[string]triggerStatusDocument)
+		for hook, status := range statuses {
+			result.Triggers[hook] = newTriggerStatusDocument(status)
+		}
+	}
+
+	if idle := svc.idleController(); idle != nil {
+		status := idle.IdleStatus()
+		result.Idle = &idleStatusDocument{
+			State: status.State,
+			InFlight: status.InFlight,
+			Requests: status.Requests,
+		}
+		if !status.LastActive.IsZero() {
+			result.Idle.LastActive = &status.LastActive
+		}
+	}
+
+	result.Window = svc.windowDocument()
+
+	return result
+}
+
+func (f *MinMonitorStatusFilter) FilterRequest(
+	req *falcore.Request,
+) (*http.Response) {
+	log().Debug("running minmonitor status filter")
+
+	doc := make(map[string]serviceStatusDocument)
+	for _, svc := range f.Services {
+		name := svc.Name
+		if name == "" {
+			name = svc.Address + ":" + strconv.Itoa(svc.Port)
+		}
+		doc[name] = svc.statusDocument()
+	}
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		log().Err(
+			fmt.Sprintf(
+				"minmonitor status filter was unable to" +
+				" encode the status: %v",
+				err,
+			),
+		)
+		return falcore.StringResponse(
+			req.HttpRequest,
+			500,
+			nil,
+			"<html><head><title>Pullcord - Internal" +
+			" Server Error</title></head><body><h1>" +
+			"Pullcord - Internal Server Error</h1><p>An" +
+			" internal server error has occurred, but it" +
+			" might not be serious. However, If the" +
+			" problem persists, the site administrator" +
+			" should be contacted.</p></body></html>",
+		)
+	}
+
+	return falcore.StringResponse(
+		req.HttpRequest,
+		200,
+		http.Header{
+			"Content-Type": []string{"application/json"},
+			"Cache-Control": []string{"no-cache"},
+		},
+		string(body),
+	)
+}
@@ -0,0 +1,257 @@
+package monitor
+
+import (
+	"encoding/json"
+	"github.com/fitstar/falcore"
+	"github.com/proidiot/gone/errors"
+	"github.com/stretchr/testify/assert"
+	configutil "github.com/stuphlabs/pullcord/config/util"
+	"github.com/stuphlabs/pullcord/trigger"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// statusDoc mirrors the JSON produced by MinMonitorStatusFilter.
+type statusDoc map[string]struct {
+	Up bool
+	State string
+	StateSince *time.Time
+	LastChecked *time.Time
+	Triggers map[string]struct {
+		State string
+		Started *time.Time
+		Duration string
+		Error string
+	}
+}
+
+// getStatusDoc runs a request through the given status filter and decodes the
+// result.
+func getStatusDoc(t *testing.T, filter falcore.RequestFilter) statusDoc {
+	request, err := http.NewRequest("GET", "http://localhost/status", nil)
+	assert.NoError(t, err)
+
+	_, response := falcore.TestWithRequest(request, filter, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(
+		t,
+		"application/json",
+		response.Header.Get("Content-Type"),
+	)
+
+	body, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+
+	var doc statusDoc
+	err = json.Unmarshal(body, &doc)
+	assert.NoError(t, err)
+	return doc
+}
+
+func TestMinMonitorStatusFilter(t *testing.T) {
+	request, err := http.NewRequest("GET", "http://localhost", nil)
+	assert.NoError(t, err)
+
+	testServiceName := "test"
+	testHost := "localhost"
+	testProtocol := "tcp"
+	gracePeriod := time.Duration(0)
+
+	server, err := net.Listen(testProtocol, ":0")
+	assert.NoError(t, err)
+	_, rawPort, err := net.SplitHostPort(server.Addr().String())
+	assert.NoError(t, err)
+	testPort, err := strconv.Atoi(rawPort)
+	assert.NoError(t, err)
+	err = server.Close()
+	assert.NoError(t, err)
+
+	onDown := trigger.NewAsyncTrigger(&counterTriggerHandler{-1})
+	onUp := trigger.NewAsyncTrigger(&counterTriggerHandler{})
+
+	svc, err := NewMinMonitorredService(
+		testHost,
+		testPort,
+		testProtocol,
+		gracePeriod,
+		onDown,
+		onUp,
+		nil,
+	)
+	assert.NoError(t, err)
+	mon := MinMonitor{}
+	err = mon.Add(
+		testServiceName,
+		svc,
+	)
+	assert.NoError(t, err)
+
+	unnamed, err := NewMinMonitorredService(
+		testHost,
+		testPort + 1,
+		testProtocol,
+		gracePeriod,
+		nil,
+		nil,
+		nil,
+	)
+	assert.NoError(t, err)
+
+	statusFilter := NewMinMonitorStatusFilter(
+		[]*MinMonitorredService{svc, unnamed},
+	)
+
+	doc := getStatusDoc(t, statusFilter)
+	assert.Equal(t, 2, len(doc))
+	if assert.Contains(t, doc, testServiceName) {
+		s := doc[testServiceName]
+		assert.False(t, s.Up)
+		assert.Nil(t, s.LastChecked)
+		assert.Equal(t, "stopped", s.State)
+		assert.Nil(t, s.StateSince)
+		assert.Equal(t, "idle", s.Triggers["OnDown"].State)
+		assert.Equal(t, "idle", s.Triggers["OnUp"].State)
+		assert.NotContains(t, s.Triggers, "Always")
+	}
+	unnamedKey := testHost + ":" + strconv.Itoa(testPort + 1)
+	if assert.Contains(t, doc, unnamedKey) {
+		assert.Equal(t, 0, len(doc[unnamedKey].Triggers))
+	}
+
+	filter, err := mon.NewMinMonitorFilter(
+		testServiceName,
+	)
+	assert.NoError(t, err)
+
+	_, response := falcore.TestWithRequest(
+		request,
+		filter,
+		nil,
+	)
+	assert.Equal(t, 503, response.StatusCode)
+
+	for i := 0; i < 100; i++ {
+		if onDown.TriggerStatus().State != trigger.TriggerRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	statuses, err := mon.TriggerStatuses(testServiceName)
+	assert.NoError(t, err)
+	assert.Equal(t, trigger.TriggerFailed, statuses["OnDown"].State)
+	assert.Equal(t, trigger.TriggerIdle, statuses["OnUp"].State)
+
+	doc = getStatusDoc(t, statusFilter)
+	if assert.Contains(t, doc, testServiceName) {
+		s := doc[testServiceName]
+		assert.False(t, s.Up)
+		assert.NotNil(t, s.LastChecked)
+		assert.Equal(t, "starting", s.State)
+		assert.NotNil(t, s.StateSince)
+		onDownStatus := s.Triggers["OnDown"]
+		assert.Equal(t, "failed", onDownStatus.State)
+		assert.NotNil(t, onDownStatus.Started)
+		assert.NotEqual(t, "", onDownStatus.Duration)
+		assert.Equal(
+			t,
+			"this trigger always errors",
+			onDownStatus.Error,
+		)
+	}
+}
+
+func TestMinMonitorNonExistantTriggerStatuses(t *testing.T) {
+	mon := NewMinMonitor()
+
+	_, err := mon.TriggerStatuses("test")
+	assert.Error(t, err)
+	assert.Equal(t, UnknownServiceError, err)
+}
+
+func TestMinMonitorStatusFilterFromConfig(t *testing.T) {
+	test := configutil.ConfigTest{
+		ResourceType: "minmonitorstatusfilter",
+		IsValid: func(i json.Unmarshaler) error {
+			f, ok := i.(*MinMonitorStatusFilter)
+			if !ok {
+				return errors.New(
+					"MinMonitorStatusFilter IsValid" +
+					" received an object of the wrong" +
+					" type.",
+				)
+			}
+
+			for _, svc := range f.Services {
+				if svc == nil {
+					return errors.New(
+						"MinMonitorStatusFilter" +
+						" IsValid received a nil" +
+						" service.",
+					)
+				}
+			}
+
+			return nil
+		},
+		SyntacticallyBad: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: "",
+				Explanation: "empty config",
+			},
+			configutil.ConfigTestData{
+				Data: "{}",
+				Explanation: "empty object",
+			},
+			configutil.ConfigTestData{
+				Data: "null",
+				Explanation: "null config",
+			},
+			configutil.ConfigTestData{
+				Data: "42",
+				Explanation: "numeric config",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"services": []
+				}`,
+				Explanation: "no services",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"services": [
+						{
+							"type": "compoundtrigger",
+							"data": {}
+						}
+					]
+				}`,
+				Explanation: "non-service as service",
+			},
+		},
+		Good: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: `{
+					"services": [
+						{
+							"type": "minmonitorredservice",
+							"data": {
+								"name": "wiki",
+								"address": "127.0.0.1",
+								"port": 80,
+								"protocol": "tcp",
+								"graceperiod": "1s"
+							}
+						}
+					]
+				}`,
+				Explanation: "basic valid status filter config",
+			},
+		},
+	}
+	test.Run(t)
+}
@@ -0,0 +1,148 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/proidiot/gone/errors"
+	"github.com/stuphlabs/pullcord/config"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// NoProbeDatagramError indicates that a UDPProbe was configured without a
+// datagram to send.
+const NoProbeDatagramError = errors.New(
+	"A UDP probe requires a datagram to send",
+)
+
+// maxProbeDatagram is the largest reply a UDPProbe will read.
+const maxProbeDatagram = 64 * 1024
+
+// UDPProbe is a Prober for services which communicate over UDP (i.e. a DNS
+// server or OpenVPN), for which just opening a connection says nothing since
+// no packets are exchanged. The datagram is sent to the service, and the
+// service is up if it replies before the timeout (with a reply which matches
+// the expected regex, if one is given). The datagram can be given either as
+// text (send) or hex encoded (sendhex), since many UDP protocols are binary.
+type UDPProbe struct {
+	Send []byte
+	Expect *regexp.Regexp
+	Timeout time.Duration
+}
+
+func init() {
+	config.RegisterResourceType(
+		"udpprobe",
+		func() json.Unmarshaler {
+			return new(UDPProbe)
+		},
+	)
+}
+
+func (p *UDPProbe) UnmarshalJSON(input []byte) error {
+	var t struct {
+		Send string
+		SendHex string
+		Expect string
+		Timeout string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	if t.Send != "" && t.SendHex != "" {
+		return errors.New(
+			"A UDP probe datagram can be given as text or as hex," +
+			" but not both",
+		)
+	} else if t.Send != "" {
+		p.Send = []byte(t.Send)
+	} else if t.SendHex != "" {
+		if b, e := hex.DecodeString(t.SendHex); e != nil {
+			return e
+		} else {
+			p.Send = b
+		}
+	} else {
+		return NoProbeDatagramError
+	}
+
+	p.Expect = nil
+	if t.Expect != "" {
+		if r, e := regexp.Compile(t.Expect); e != nil {
+			return e
+		} else {
+			p.Expect = r
+		}
+	}
+
+	d, e := parseProbeTimeout(t.Timeout)
+	p.Timeout = d
+	return e
+}
+
+// Probe sends the datagram to the service and waits for a reply, making
+// UDPProbe a valid Prober implementation. Replies which don't match are
+// ignored, so the service is down if no matching reply arrives before the
+// timeout (or if the host says the port is unreachable). An error is only
+// given if the datagram could not be sent at all. The protocol of the service
+// is ignored.
+func (p *UDPProbe) Probe(
+	protocol, address string,
+	port int,
+) (up bool, err error) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+	host := net.JoinHostPort(address, strconv.Itoa(port))
+
+	conn, err := net.DialTimeout("udp", host, timeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return false, err
+	}
+
+	if _, err = conn.Write(p.Send); err != nil {
+		return false, err
+	}
+
+	reply := make([]byte, maxProbeDatagram)
+	for {
+		n, e := conn.Read(reply)
+		if e != nil {
+			log().Debug(
+				fmt.Sprintf(
+					"minmonitor udp probe of %s did not" +
+					" receive a reply: %v",
+					host,
+					e,
+				),
+			)
+			return false, nil
+		}
+
+		if p.Expect == nil || p.Expect.Match(reply[:n]) {
+			return true, nil
+		}
+
+		log().Debug(
+			fmt.Sprintf(
+				"minmonitor udp probe of %s ignored a reply" +
+				" which does not match: %s",
+				host,
+				p.Expect,
+			),
+		)
+	}
+}
@@ -0,0 +1,151 @@
+package monitor
+
+import (
+	"encoding/json"
+	"github.com/proidiot/gone/errors"
+	"github.com/stretchr/testify/assert"
+	configutil "github.com/stuphlabs/pullcord/config/util"
+	"net"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serveUDPEcho answers each datagram received on the given connection (until
+// it is closed) with a datagram saying it is not ready, followed by the same
+// datagram in upper case.
+func serveUDPEcho(conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteTo([]byte("not ready"), addr)
+		reply := make([]byte, n)
+		for i, c := range buf[:n] {
+			if c >= 'a' && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			reply[i] = c
+		}
+		conn.WriteTo(reply, addr)
+	}
+}
+
+func TestUDPProbe(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go serveUDPEcho(conn)
+	_, rawPort, err := net.SplitHostPort(conn.LocalAddr().String())
+	assert.NoError(t, err)
+	port, err := strconv.Atoi(rawPort)
+	assert.NoError(t, err)
+
+	probe := &UDPProbe{
+		Send: []byte("ping"),
+		Timeout: 200 * time.Millisecond,
+	}
+	up, err := probe.Probe("udp", "127.0.0.1", port)
+	assert.NoError(t, err)
+	assert.True(t, up)
+
+	// the first reply doesn't match, but the second does
+	probe.Expect = regexp.MustCompile("^PING$")
+	up, err = probe.Probe("udp", "127.0.0.1", port)
+	assert.NoError(t, err)
+	assert.True(t, up)
+
+	probe.Expect = regexp.MustCompile("^PONG$")
+	up, err = probe.Probe("udp", "127.0.0.1", port)
+	assert.NoError(t, err)
+	assert.False(t, up)
+
+	conn.Close()
+	probe.Expect = nil
+	start := time.Now()
+	up, err = probe.Probe("udp", "127.0.0.1", port)
+	assert.NoError(t, err)
+	assert.False(t, up)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestUDPProbeFromConfig(t *testing.T) {
+	test := configutil.ConfigTest{
+		ResourceType: "udpprobe",
+		IsValid: func(i json.Unmarshaler) error {
+			p, ok := i.(*UDPProbe)
+			if !ok {
+				return errors.New(
+					"UDPProbe IsValid received an object" +
+					" of the wrong type.",
+				)
+			}
+
+			if len(p.Send) == 0 {
+				return errors.New(
+					"UDPProbe IsValid received a probe" +
+					" without a datagram.",
+				)
+			}
+
+			return nil
+		},
+		SyntacticallyBad: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: "",
+				Explanation: "empty config",
+			},
+			configutil.ConfigTestData{
+				Data: "{}",
+				Explanation: "empty object",
+			},
+			configutil.ConfigTestData{
+				Data: "null",
+				Explanation: "null config",
+			},
+			configutil.ConfigTestData{
+				Data: "42",
+				Explanation: "numeric config",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"send": "ping",
+					"sendhex": "00"
+				}`,
+				Explanation: "text and hex datagrams",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"sendhex": "xyz"
+				}`,
+				Explanation: "bad hex datagram",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"send": "ping",
+					"expect": "("
+				}`,
+				Explanation: "bad expected regex",
+			},
+		},
+		Good: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: `{
+					"send": "ping",
+					"expect": "^pong",
+					"timeout": "2s"
+				}`,
+				Explanation: "text datagram",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"sendhex": "38000000000000000000"
+				}`,
+				Explanation: "hex datagram",
+			},
+		},
+	}
+	test.Run(t)
+}
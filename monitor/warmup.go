@@ -0,0 +1,236 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fitstar/falcore"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultStatusPath is the path at which a MinMonitorredService answers with
+// its own status (for the warm-up page to poll) if no other path is given.
+const DefaultStatusPath = "/_pullcord/status"
+
+// PullcordQuery is the query parameter with which any request for a service
+// can ask for the status ("status") or stats ("stats") of the service, rather
+// than being passed along. Unlike the status and stats paths, this works
+// however the service is routed (i.e. behind an exactpathrouter), so it is
+// what the warm-up page polls.
+const PullcordQuery = "_pullcord"
+
+// DefaultRetryAfter is how long a client is asked to wait before trying again
+// when there is no history of boot durations from which to estimate the wait.
+const DefaultRetryAfter = 10 * time.Second
+
+// minRetryAfter and maxRetryAfter bound how long a client is asked to wait
+// before trying again.
+const minRetryAfter = 2 * time.Second
+const maxRetryAfter = time.Minute
+
+// WarmupPageData is what a warm-up page template is filled in with. The
+// estimated wait is only known (and only given) once the service has been
+// seen to boot at least once, and is the average of its recent boot durations
+// less the time it has been starting (but never less than zero). The retry
+// after value (in whole seconds) is also sent in the Retry-After header. The
+// status path is the URL which gives the status of the service, which is the
+// URL of the request itself with the PullcordQuery parameter added.
+type WarmupPageData struct {
+	Service string
+	State string
+	Since time.Time
+	Elapsed time.Duration
+	EstimateKnown bool
+	EstimatedWait time.Duration
+	RetryAfter int
+	StatusPath string
+}
+
+// DefaultWarmupPage is the warm-up page shown while a service is not up if no
+// other template is given. It polls the status path of the service, and then
+// reloads the page once the service is up. Without JavaScript, it refreshes
+// itself after the retry after time.
+var DefaultWarmupPage = template.Must(
+	template.New("warmup").Parse(
+		`<html><head><title>Pullcord - Service Not Ready</title>` +
+		`<noscript><meta http-equiv="refresh"` +
+		` content="{{.RetryAfter}}"></noscript>` +
+		`</head><body><h1>Pullcord - Service Not Ready</h1>` +
+		`<p>The requested service is starting, so hopefully it` +
+		` will be up {{if .EstimateKnown}}in about` +
+		` {{.EstimatedWait}}{{else}}in a few minutes{{end}}.` +
+		` This page will reload once it is.</p><p>If you would` +
+		` like further information, please contact the site` +
+		` administrator.</p><script>(function() {` +
+		`var poll = function() {` +
+		`var r = new XMLHttpRequest();` +
+		`r.onreadystatechange = function() {` +
+		`if (r.readyState !== 4) { return; }` +
+		`try { if (JSON.parse(r.responseText).up) {` +
+		` window.location.reload(); return; } } catch (e) {}` +
+		`setTimeout(poll, 2000); };` +
+		`r.open("GET", {{.StatusPath}}, true);` +
+		`r.setRequestHeader("Cache-Control", "no-cache");` +
+		`r.send(); };` +
+		`setTimeout(poll, 2000); })();</script></body></html>`,
+	),
+)
+
+// warmupPageData gives what the warm-up page should be filled in with right
+// now.
+func (svc *MinMonitorredService) warmupPageData(
+	req *http.Request,
+) WarmupPageData {
+	svc.mutex.Lock()
+	var total time.Duration
+	for _, d := range svc.stats.Boots {
+		total += d
+	}
+	boots := len(svc.stats.Boots)
+	svc.mutex.Unlock()
+
+	state, since := svc.State()
+	result := WarmupPageData{
+		Service: svc.Name,
+		State: state,
+		Since: since,
+		StatusPath: pullcordURL(req, "status"),
+	}
+	if state == ServiceStarting {
+		result.Elapsed = time.Since(since)
+	}
+
+	retryAfter := DefaultRetryAfter
+	if boots > 0 {
+		result.EstimateKnown = true
+		result.EstimatedWait = total / time.Duration(boots)
+		result.EstimatedWait -= result.Elapsed
+		if result.EstimatedWait < 0 {
+			result.EstimatedWait = 0
+		}
+		result.EstimatedWait -= result.EstimatedWait % time.Second
+
+		retryAfter = result.EstimatedWait
+		if retryAfter < minRetryAfter {
+			retryAfter = minRetryAfter
+		} else if retryAfter > maxRetryAfter {
+			retryAfter = maxRetryAfter
+		}
+	}
+	result.RetryAfter = int(retryAfter / time.Second)
+
+	return result
+}
+
+// statusPath gives the path at which the service answers with its status.
+func (svc *MinMonitorredService) statusPath() string {
+	if svc.StatusPath == "" {
+		return DefaultStatusPath
+	}
+	return svc.StatusPath
+}
+
+// pullcordURL gives the URL of the given request, but asking for the given
+// thing (status or stats) with the PullcordQuery parameter.
+func pullcordURL(req *http.Request, what string) string {
+	u := *req.URL
+	q := u.Query()
+	q.Set(PullcordQuery, what)
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// isStatusRequest reports whether the request is for the status of the
+// service.
+func (svc *MinMonitorredService) isStatusRequest(req *http.Request) bool {
+	return req.URL.Path == svc.statusPath() ||
+		req.URL.Query().Get(PullcordQuery) == "status"
+}
+
+// isStatsRequest reports whether the request is for the stats of the service.
+func (svc *MinMonitorredService) isStatsRequest(req *http.Request) bool {
+	return req.URL.Path == svc.statsPath() ||
+		req.URL.Query().Get(PullcordQuery) == "stats"
+}
+
+// warmupResponse produces the warm-up page for a service which is not up.
+func (svc *MinMonitorredService) warmupResponse(
+	req *falcore.Request,
+) (*http.Response) {
+	data := svc.warmupPageData(req.HttpRequest)
+
+	page := svc.WarmupPage
+	if page == nil {
+		page = DefaultWarmupPage
+	}
+
+	var body bytes.Buffer
+	if err := page.Execute(&body, data); err != nil {
+		log().Err(
+			fmt.Sprintf(
+				"minmonitor was unable to fill in the warm-up" +
+				" page for \"%s:%d\", using the default: %v",
+				svc.Address,
+				svc.Port,
+				err,
+			),
+		)
+		body.Reset()
+		DefaultWarmupPage.Execute(&body, data)
+	}
+
+	return falcore.StringResponse(
+		req.HttpRequest,
+		503,
+		http.Header{
+			"Content-Type": []string{"text/html; charset=utf-8"},
+			"Cache-Control": []string{"no-cache"},
+			"Retry-After": []string{strconv.Itoa(data.RetryAfter)},
+		},
+		body.String(),
+	)
+}
+
+// serviceStateDocument is the JSON representation of the status of a service
+// given at its status path, including the active window of its schedule (if
+// any).
+type serviceStateDocument struct {
+	Up bool `json:"up"`
+	State string `json:"state"`
+	EstimatedWait *int `json:"estimatedwait,omitempty"`
+	RetryAfter int `json:"retryafter"`
+	Window *scheduleWindowDocument `json:"window,omitempty"`
+}
+
+// statusResponse produces the status of the service, as given at its status
+// path.
+func (svc *MinMonitorredService) statusResponse(
+	req *falcore.Request,
+	up bool,
+) (*http.Response) {
+	data := svc.warmupPageData(req.HttpRequest)
+	doc := serviceStateDocument{
+		Up: up,
+		State: data.State,
+		RetryAfter: data.RetryAfter,
+		Window: svc.windowDocument(),
+	}
+	if data.EstimateKnown {
+		wait := int(data.EstimatedWait / time.Second)
+		doc.EstimatedWait = &wait
+	}
+
+	body, _ := json.Marshal(doc)
+	return falcore.StringResponse(
+		req.HttpRequest,
+		200,
+		http.Header{
+			"Content-Type": []string{"application/json"},
+			"Cache-Control": []string{"no-cache"},
+		},
+		string(body),
+	)
+}
@@ -0,0 +1,195 @@
+package monitor
+
+import (
+	"encoding/json"
+	"github.com/fitstar/falcore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stuphlabs/pullcord/util"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// warmupTestRequest runs a request for the given path through the given
+// service, giving the response and its body.
+func warmupTestRequest(
+	t *testing.T,
+	svc *MinMonitorredService,
+	path string,
+) (*http.Response, string) {
+	request, err := http.NewRequest("GET", "http://localhost" + path, nil)
+	assert.NoError(t, err)
+
+	_, response := falcore.TestWithRequest(request, svc, nil)
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	return response, string(body)
+}
+
+func TestWarmupPage(t *testing.T) {
+	onDown := &lockedCounterTriggerHandler{}
+	svc := newIdleTestService(t, onDown)
+
+	response, body := warmupTestRequest(t, svc, "/")
+	assert.Equal(t, 503, response.StatusCode)
+	assert.Equal(t, "10", response.Header.Get("Retry-After"))
+	assert.Equal(t, "no-cache", response.Header.Get("Cache-Control"))
+	assert.Contains(t, body, "Service Not Ready")
+	assert.Contains(t, body, "in a few minutes")
+	assert.Contains(t, body, `http-equiv="refresh" content="10"`)
+	assert.Contains(t, body, `"/?_pullcord=status"`)
+
+	svc.mutex.Lock()
+	svc.stats.Boots = []time.Duration{90 * time.Second, 30 * time.Second}
+	svc.mutex.Unlock()
+
+	response, body = warmupTestRequest(t, svc, "/")
+	assert.Equal(t, 503, response.StatusCode)
+	retryAfter, err := strconv.Atoi(response.Header.Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.True(t, retryAfter >= 58 && retryAfter <= 60)
+	assert.Contains(t, body, "in about")
+	assert.Equal(t, 1, onDown.Count())
+
+	svc.WarmupPage = template.Must(
+		template.New("test").Parse(
+			"{{.Service}} is {{.State}}, retry in {{.RetryAfter}}",
+		),
+	)
+	svc.mutex.Lock()
+	svc.stats.Boots = []time.Duration{time.Second}
+	svc.mutex.Unlock()
+
+	response, body = warmupTestRequest(t, svc, "/")
+	assert.Equal(t, 503, response.StatusCode)
+	assert.Equal(t, "2", response.Header.Get("Retry-After"))
+	assert.Equal(t, "test is starting, retry in 2", body)
+}
+
+func TestWarmupBootHistory(t *testing.T) {
+	svc := newIdleTestService(t, &lockedCounterTriggerHandler{})
+
+	warmupTestRequest(t, svc, "/")
+	svc.SetStatusUp()
+	svc.mutex.Lock()
+	assert.Equal(t, 1, len(svc.stats.Boots))
+	svc.mutex.Unlock()
+
+	// only boots (and not other transitions to up) are kept
+	_, err := svc.Reprobe()
+	assert.NoError(t, err)
+	svc.SetStatusUp()
+
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	assert.Equal(t, 1, len(svc.stats.Boots))
+
+	for i := 0; i < maxStatsHistory + 2; i++ {
+		svc.recordBoot(time.Duration(i) * time.Second)
+	}
+	assert.Equal(t, maxStatsHistory, len(svc.stats.Boots))
+	assert.Equal(t, 2 * time.Second, svc.stats.Boots[0])
+}
+
+func TestServiceStatusPath(t *testing.T) {
+	onDown := &lockedCounterTriggerHandler{}
+	svc := newIdleTestService(t, onDown)
+	svc.GracePeriod = time.Minute
+
+	var doc struct {
+		Up bool
+		State string
+		EstimatedWait *int
+		RetryAfter int
+	}
+
+	response, body := warmupTestRequest(t, svc, DefaultStatusPath)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "no-cache", response.Header.Get("Cache-Control"))
+	err := json.Unmarshal([]byte(body), &doc)
+	assert.NoError(t, err)
+	assert.False(t, doc.Up)
+	assert.Equal(t, ServiceStopped, doc.State)
+	assert.Nil(t, doc.EstimatedWait)
+	assert.Equal(t, 10, doc.RetryAfter)
+	assert.Equal(t, 0, onDown.Count())
+
+	svc.SetStatusUp()
+	svc.StatusPath = "/status"
+	response, body = warmupTestRequest(t, svc, "/status")
+	assert.Equal(t, 200, response.StatusCode)
+	err = json.Unmarshal([]byte(body), &doc)
+	assert.NoError(t, err)
+	assert.True(t, doc.Up)
+	assert.Equal(t, ServiceUp, doc.State)
+
+	// the default status path is now passed along to the service
+	response, body = warmupTestRequest(t, svc, DefaultStatusPath)
+	assert.False(t, strings.Contains(body, `"state"`))
+
+	// but the status can still be had with the query parameter
+	response, body = warmupTestRequest(t, svc, "/any?_pullcord=status")
+	assert.Equal(t, 200, response.StatusCode)
+	err = json.Unmarshal([]byte(body), &doc)
+	assert.NoError(t, err)
+	assert.True(t, doc.Up)
+}
+
+// TestWarmupPageBehindRouter verifies that the warm-up page of a service which
+// is routed by its path polls a URL which is routed to the service, and which
+// gives its status.
+func TestWarmupPageBehindRouter(t *testing.T) {
+	svc := newIdleTestService(t, &lockedCounterTriggerHandler{})
+	svc.GracePeriod = time.Minute
+	var filter falcore.RequestFilter = svc
+	pipeline := falcore.NewPipeline()
+	pipeline.Upstream.PushBack(
+		&util.ExactPathRouter{
+			Routes: map[string]*falcore.RequestFilter{
+				"/wiki": &filter,
+			},
+		},
+	)
+
+	get := func(url string) (*http.Response, string) {
+		request, err := http.NewRequest(
+			"GET",
+			"http://localhost" + url,
+			nil,
+		)
+		assert.NoError(t, err)
+		_, response := falcore.TestWithRequest(request, pipeline, nil)
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		assert.NoError(t, err)
+		return response, string(body)
+	}
+
+	response, body := get("/wiki?page=main")
+	assert.Equal(t, 503, response.StatusCode)
+	poll := "/wiki?_pullcord=status&page=main"
+	assert.Contains(t, body, `"/wiki?_pullcord=status\u0026page=main"`)
+
+	// the default status path isn't routed to the service at all
+	response, _ = get(DefaultStatusPath)
+	assert.Equal(t, 404, response.StatusCode)
+
+	var doc struct {
+		Up bool
+	}
+	response, body = get(poll)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.NoError(t, json.Unmarshal([]byte(body), &doc))
+	assert.False(t, doc.Up)
+
+	svc.SetStatusUp()
+	response, body = get(poll)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.NoError(t, json.Unmarshal([]byte(body), &doc))
+	assert.True(t, doc.Up)
+}
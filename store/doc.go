@@ -0,0 +1,2 @@
+// Persistent state storage for Pullcord
+package store
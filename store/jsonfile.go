@@ -0,0 +1,198 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/proidiot/gone/errors"
+	"github.com/stuphlabs/pullcord/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// NoStorePathError indicates that a JSONFileStore was configured without the
+// path of the file in which to keep its state.
+const NoStorePathError = errors.New(
+	"A JSON file store requires the path of its file",
+)
+
+// JSONFileStore is a StateStore which keeps every value in a single JSON file
+// (as an object with a member for each key). The file is read each time a
+// value is loaded, and each time a value is saved or deleted the whole file is
+// written to a temporary file which then replaces it, so a crash never leaves
+// a partial file behind. This suits the small amount of state Pullcord keeps,
+// which changes only as often as services start and stop.
+//
+// Every JSONFileStore with the same path shares the same file, so a store
+// which has been replaced by a reloaded config can still be used safely.
+type JSONFileStore struct {
+	Path string
+}
+
+// fileMutexes serializes access to each file used by a JSONFileStore.
+var fileMutexes = make(map[string]*sync.Mutex)
+var fileMutexesMutex sync.Mutex
+
+func init() {
+	config.RegisterResourceType(
+		"jsonfilestore",
+		func() json.Unmarshaler {
+			return new(JSONFileStore)
+		},
+	)
+}
+
+func (s *JSONFileStore) UnmarshalJSON(input []byte) error {
+	var t struct {
+		Path string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	if t.Path == "" {
+		return NoStorePathError
+	}
+	s.Path = t.Path
+
+	return nil
+}
+
+// NewJSONFileStore constructs a JSONFileStore which keeps its state in the
+// file at the given path. The file need not exist yet.
+func NewJSONFileStore(path string) *JSONFileStore {
+	return &JSONFileStore{Path: path}
+}
+
+// lock locks the mutex for the file of the store, returning it so that it can
+// be unlocked.
+func (s *JSONFileStore) lock() *sync.Mutex {
+	path, err := filepath.Abs(s.Path)
+	if err != nil {
+		path = s.Path
+	}
+
+	fileMutexesMutex.Lock()
+	m, present := fileMutexes[path]
+	if !present {
+		m = new(sync.Mutex)
+		fileMutexes[path] = m
+	}
+	fileMutexesMutex.Unlock()
+
+	m.Lock()
+	return m
+}
+
+// read gives every value in the file. The file must be locked.
+func (s *JSONFileStore) read() (map[string]json.RawMessage, error) {
+	values := make(map[string]json.RawMessage)
+
+	content, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(content, &values); err != nil {
+		return nil, err
+	} else if values == nil {
+		values = make(map[string]json.RawMessage)
+	}
+
+	return values, nil
+}
+
+// write replaces the file with the given values. The file must be locked.
+func (s *JSONFileStore) write(values map[string]json.RawMessage) error {
+	content, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	return WriteFile(s.Path, content)
+}
+
+// WriteFile replaces the file at the given path with the given content. The
+// content is written and synced to a temporary file (in the same directory)
+// which then replaces the file, so a crash never leaves a partial file
+// behind. This is how a JSONFileStore writes its file, and it may be used by
+// anything else which keeps its state in a file of its own.
+func WriteFile(path string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+func (s *JSONFileStore) Load(key string, value interface{}) (bool, error) {
+	m := s.lock()
+	defer m.Unlock()
+
+	values, err := s.read()
+	if err != nil {
+		return false, err
+	}
+
+	raw, present := values[key]
+	if !present {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(raw, value)
+}
+
+func (s *JSONFileStore) Save(key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	m := s.lock()
+	defer m.Unlock()
+
+	values, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	values[key] = raw
+	return s.write(values)
+}
+
+func (s *JSONFileStore) Delete(key string) error {
+	m := s.lock()
+	defer m.Unlock()
+
+	values, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	if _, present := values[key]; !present {
+		return nil
+	}
+
+	delete(values, key)
+	return s.write(values)
+}
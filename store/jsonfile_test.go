@@ -0,0 +1,154 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/proidiot/gone/errors"
+	"github.com/stretchr/testify/assert"
+	configutil "github.com/stuphlabs/pullcord/config/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testState struct {
+	Name string
+	When time.Time
+}
+
+func TestJSONFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullcord-store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewJSONFileStore(filepath.Join(dir, "state.json"))
+
+	var value testState
+	found, err := s.Load("test/a", &value)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	when := time.Unix(1500000000, 0)
+	err = s.Save("test/a", testState{"a", when})
+	assert.NoError(t, err)
+	err = s.Save("test/b", testState{"b", when})
+	assert.NoError(t, err)
+
+	// another store with the same path sees the same values
+	other := NewJSONFileStore(filepath.Join(dir, ".", "state.json"))
+	found, err = other.Load("test/a", &value)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "a", value.Name)
+	assert.True(t, when.Equal(value.When))
+
+	err = other.Delete("test/a")
+	assert.NoError(t, err)
+	err = other.Delete("test/nonexistent")
+	assert.NoError(t, err)
+
+	found, err = s.Load("test/a", &value)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	found, err = s.Load("test/b", &value)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "b", value.Name)
+
+	// only the file itself is left behind
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+
+	err = ioutil.WriteFile(s.Path, []byte("{"), 0600)
+	assert.NoError(t, err)
+	_, err = s.Load("test/b", &value)
+	assert.Error(t, err)
+	err = s.Save("test/b", testState{"b", when})
+	assert.Error(t, err)
+
+	missing := NewJSONFileStore(filepath.Join(dir, "nonexistent", "x"))
+	err = missing.Save("test/a", testState{"a", when})
+	assert.Error(t, err)
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullcord-store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	err = WriteFile(path, []byte("first"))
+	assert.NoError(t, err)
+	err = WriteFile(path, []byte("second"))
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(content))
+
+	// only the file itself is left behind
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+
+	err = WriteFile(filepath.Join(dir, "nonexistent", "x"), nil)
+	assert.Error(t, err)
+}
+
+func TestJSONFileStoreFromConfig(t *testing.T) {
+	test := configutil.ConfigTest{
+		ResourceType: "jsonfilestore",
+		IsValid: func(i json.Unmarshaler) error {
+			s, ok := i.(*JSONFileStore)
+			if !ok {
+				return errors.New(
+					"JSONFileStore IsValid received an" +
+					" object of the wrong type.",
+				)
+			}
+
+			if s.Path == "" {
+				return errors.New(
+					"JSONFileStore IsValid received a" +
+					" store without a path.",
+				)
+			}
+
+			return nil
+		},
+		SyntacticallyBad: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: "",
+				Explanation: "empty config",
+			},
+			configutil.ConfigTestData{
+				Data: "{}",
+				Explanation: "empty object",
+			},
+			configutil.ConfigTestData{
+				Data: "null",
+				Explanation: "null config",
+			},
+			configutil.ConfigTestData{
+				Data: "42",
+				Explanation: "numeric config",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"path": 42
+				}`,
+				Explanation: "numeric path",
+			},
+		},
+		Good: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: `{
+					"path": "/var/lib/pullcord/state.json"
+				}`,
+				Explanation: "basic store",
+			},
+		},
+	}
+	test.Run(t)
+}
@@ -0,0 +1,4 @@
+package store
+
+func LoadPlugin() {}
+
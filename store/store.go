@@ -0,0 +1,23 @@
+package store
+
+// StateStore is somewhere small pieces of state (such as the status of a
+// service, or when a delayed trigger is due) can be kept so that they outlive
+// a restart of Pullcord. Each value is kept under a key, which should begin
+// with the type of the resource keeping it (i.e.
+// "minmonitorredservice/wiki"), so that many resources may share a store.
+// Values are anything which can be marshaled to JSON.
+//
+// Load fills in the given value (which should be a pointer) with what was
+// kept under the given key, and reports whether there was anything kept under
+// it at all. Save keeps the given value under the given key, replacing
+// whatever was kept under it before. Delete forgets whatever was kept under
+// the given key (which is not an error if there was nothing).
+//
+// A StateStore must be safe for concurrent use. JSONFileStore is the store
+// distributed with Pullcord, but any other (i.e. one backed by a database)
+// can be used in its place by registering it as a resource type.
+type StateStore interface {
+	Load(key string, value interface{}) (found bool, err error)
+	Save(key string, value interface{}) (err error)
+	Delete(key string) (err error)
+}
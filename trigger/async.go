@@ -0,0 +1,210 @@
+package trigger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stuphlabs/pullcord/config"
+	"sync"
+	"time"
+)
+
+// The states a trigger run can be in, as given in a TriggerStatus.
+const (
+	TriggerIdle = "idle"
+	TriggerRunning = "running"
+	TriggerSucceeded = "succeeded"
+	TriggerFailed = "failed"
+)
+
+// TriggerStatus describes the most recent run of a trigger: whether it is
+// idle (having never run), still running, or has succeeded or failed, along
+// with when it started, how long it took (or has taken so far), and the error
+// if it failed.
+type TriggerStatus struct {
+	State string
+	Started time.Time
+	Duration time.Duration
+	Err error
+}
+
+// StatusReporter is implemented by triggers which keep track of the status of
+// their most recent run.
+type StatusReporter interface {
+	TriggerStatus() TriggerStatus
+}
+
+// AsyncTrigger is a TriggerHandler that runs another trigger in the background
+// and returns immediately, so that (for example) a slow start script doesn't
+// hold up the request which caused it to run. If the background trigger is
+// still running when AsyncTrigger is triggered again, the new trigger is
+// dropped rather than starting a second run. The status of the most recent
+// run can be retrieved, making AsyncTrigger a StatusReporter.
+type AsyncTrigger struct {
+	BackgroundTrigger TriggerHandler
+	mutex sync.Mutex
+	status TriggerStatus
+	running sync.WaitGroup
+	stopped bool
+}
+
+func init() {
+	config.RegisterResourceType(
+		"asynctrigger",
+		func() json.Unmarshaler {
+			return new(AsyncTrigger)
+		},
+	)
+}
+
+func (a *AsyncTrigger) UnmarshalJSON(input []byte) (error) {
+	var t struct {
+		BackgroundTrigger config.Resource
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	bt := t.BackgroundTrigger.Unmarshaled
+	switch bt := bt.(type) {
+	case TriggerHandler:
+		a.BackgroundTrigger = bt
+	default:
+		log().Err(
+			fmt.Sprintf(
+				"Registry value is not a Trigger: %s",
+				bt,
+			),
+		)
+		return config.UnexpectedResourceType
+	}
+
+	a.status = TriggerStatus{State: TriggerIdle}
+
+	return nil
+}
+
+// NewAsyncTrigger constructs a new AsyncTrigger which runs the given trigger
+// in the background.
+func NewAsyncTrigger(backgroundTrigger TriggerHandler) *AsyncTrigger {
+	return &AsyncTrigger{
+		BackgroundTrigger: backgroundTrigger,
+		status: TriggerStatus{State: TriggerIdle},
+	}
+}
+
+// TriggerStatus gives the status of the most recent run of the background
+// trigger, implementing the StatusReporter interface.
+func (a *AsyncTrigger) TriggerStatus() TriggerStatus {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	result := a.status
+	if result.State == "" {
+		result.State = TriggerIdle
+	} else if result.State == TriggerRunning {
+		result.Duration = time.Since(result.Started)
+	}
+	return result
+}
+
+// Trigger implements the required triggering function to make AsyncTrigger a
+// valid TriggerHandler implementation.
+func (a *AsyncTrigger) Trigger() error {
+	return a.TriggerWith(NewTriggerContext())
+}
+
+// TriggerWith starts the background trigger with the given context unless it
+// is already running, making AsyncTrigger a valid ContextTriggerHandler
+// implementation. No error is ever returned, as any error from the background
+// trigger will only be known later.
+func (a *AsyncTrigger) TriggerWith(ctx TriggerContext) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.stopped {
+		return TriggerStoppedError
+	}
+
+	if a.status.State == TriggerRunning {
+		log().Debug(
+			fmt.Sprintf(
+				"asynctrigger is already running for service" +
+				" \"%s\", so this trigger has been dropped",
+				ctx.Service,
+			),
+		)
+		return nil
+	}
+
+	a.status = TriggerStatus{
+		State: TriggerRunning,
+		Started: time.Now(),
+	}
+	a.running.Add(1)
+	go a.run(ctx, a.status.Started)
+
+	return nil
+}
+
+// Stop waits for any run of the background trigger which is in progress to
+// finish and then stops the background trigger if it can be stopped, making
+// AsyncTrigger a valid Stopper implementation. Once stopped, triggering the
+// AsyncTrigger will return TriggerStoppedError.
+func (a *AsyncTrigger) Stop() error {
+	a.mutex.Lock()
+	if a.stopped {
+		a.mutex.Unlock()
+		return nil
+	}
+	a.stopped = true
+	a.mutex.Unlock()
+
+	a.running.Wait()
+
+	return stopAll(a.BackgroundTrigger)
+}
+
+// StopsReferences tells the config that stopping the AsyncTrigger stops the
+// background trigger, making it a valid config.ReferenceStopper.
+func (a *AsyncTrigger) StopsReferences() bool {
+	return true
+}
+
+// run runs the background trigger and records the result.
+func (a *AsyncTrigger) run(ctx TriggerContext, started time.Time) {
+	defer a.running.Done()
+
+	err := WithContext(a.BackgroundTrigger).TriggerWith(ctx)
+	duration := time.Since(started)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.status.Duration = duration
+	a.status.Err = err
+	if err != nil {
+		a.status.State = TriggerFailed
+		log().Err(
+			fmt.Sprintf(
+				"asynctrigger background trigger for service" +
+				" \"%s\" failed after %v: %v",
+				ctx.Service,
+				duration,
+				err,
+			),
+		)
+	} else {
+		a.status.State = TriggerSucceeded
+		log().Info(
+			fmt.Sprintf(
+				"asynctrigger background trigger for service" +
+				" \"%s\" succeeded after %v",
+				ctx.Service,
+				duration,
+			),
+		)
+	}
+}
@@ -0,0 +1,211 @@
+package trigger
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	configutil "github.com/stuphlabs/pullcord/config/util"
+	"github.com/stuphlabs/pullcord/util"
+	"testing"
+	"time"
+)
+
+// blockingTriggerHandler is a testing trigger which doesn't return until it is
+// released, and which then returns the given error.
+type blockingTriggerHandler struct {
+	release chan struct{}
+	err error
+	contexts []TriggerContext
+}
+
+func newBlockingTriggerHandler(err error) *blockingTriggerHandler {
+	return &blockingTriggerHandler{make(chan struct{}), err, nil}
+}
+
+func (th *blockingTriggerHandler) Trigger() error {
+	return th.TriggerWith(NewTriggerContext())
+}
+
+func (th *blockingTriggerHandler) TriggerWith(ctx TriggerContext) error {
+	<-th.release
+	th.contexts = append(th.contexts, ctx)
+	return th.err
+}
+
+// waitForAsync waits until the given AsyncTrigger is no longer running, and
+// gives its status.
+func waitForAsync(a *AsyncTrigger) TriggerStatus {
+	for i := 0; i < 100; i++ {
+		status := a.TriggerStatus()
+		if status.State != TriggerRunning {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return a.TriggerStatus()
+}
+
+func TestAsyncTriggerSucceeded(t *testing.T) {
+	bth := newBlockingTriggerHandler(nil)
+
+	at := NewAsyncTrigger(bth)
+	assert.Equal(t, TriggerIdle, at.TriggerStatus().State)
+
+	err := at.Trigger()
+	assert.NoError(t, err)
+
+	status := at.TriggerStatus()
+	assert.Equal(t, TriggerRunning, status.State)
+	assert.False(t, status.Started.IsZero())
+
+	time.Sleep(50 * time.Millisecond)
+	close(bth.release)
+
+	status = waitForAsync(at)
+	assert.Equal(t, TriggerSucceeded, status.State)
+	assert.NoError(t, status.Err)
+	assert.True(t, status.Duration >= 50 * time.Millisecond)
+	assert.Equal(t, 1, len(bth.contexts))
+}
+
+func TestAsyncTriggerFailed(t *testing.T) {
+	testErr := errors.New("this trigger always errors")
+	bth := newBlockingTriggerHandler(testErr)
+	close(bth.release)
+
+	at := NewAsyncTrigger(bth)
+
+	err := at.Trigger()
+	assert.NoError(t, err)
+
+	status := waitForAsync(at)
+	assert.Equal(t, TriggerFailed, status.State)
+	assert.Equal(t, testErr, status.Err)
+}
+
+func TestAsyncTriggerDeduplicate(t *testing.T) {
+	bth := newBlockingTriggerHandler(nil)
+
+	at := NewAsyncTrigger(bth)
+
+	ctx := NewTriggerContext()
+	ctx.Path = "/first"
+	err := at.TriggerWith(ctx)
+	assert.NoError(t, err)
+
+	ctx.Path = "/second"
+	err = at.TriggerWith(ctx)
+	assert.NoError(t, err)
+
+	close(bth.release)
+
+	status := waitForAsync(at)
+	assert.Equal(t, TriggerSucceeded, status.State)
+	if assert.Equal(t, 1, len(bth.contexts)) {
+		assert.Equal(t, "/first", bth.contexts[0].Path)
+	}
+
+	err = at.Trigger()
+	assert.NoError(t, err)
+
+	status = waitForAsync(at)
+	assert.Equal(t, TriggerSucceeded, status.State)
+	assert.Equal(t, 2, len(bth.contexts))
+}
+
+func TestAsyncTriggerConcurrent(t *testing.T) {
+	bth := newBlockingTriggerHandler(nil)
+
+	at := NewAsyncTrigger(bth)
+
+	errs := hammer(at, 50, 10)
+	assert.Equal(t, 0, errs)
+	assert.Equal(t, TriggerRunning, at.TriggerStatus().State)
+
+	close(bth.release)
+
+	err := at.Stop()
+	assert.NoError(t, err)
+	assert.Equal(t, TriggerSucceeded, at.TriggerStatus().State)
+	assert.Equal(t, 1, len(bth.contexts))
+
+	err = at.Trigger()
+	assert.Equal(t, TriggerStoppedError, err)
+}
+
+func TestAsyncTriggerStop(t *testing.T) {
+	cth := &lockedCounterTriggerHandler{}
+
+	at := NewAsyncTrigger(cth)
+
+	err := at.Trigger()
+	assert.NoError(t, err)
+
+	err = at.Stop()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cth.Count())
+	assert.True(t, cth.Stopped())
+	assert.Equal(t, TriggerSucceeded, at.TriggerStatus().State)
+}
+
+func TestAsyncTriggerFromConfig(t *testing.T) {
+	util.LoadPlugin()
+	test := configutil.ConfigTest{
+		ResourceType: "asynctrigger",
+		IsValid: func(i json.Unmarshaler) error {
+			at := i.(*AsyncTrigger)
+			if at.BackgroundTrigger == nil {
+				return errors.New("nil background trigger")
+			}
+			if s := at.TriggerStatus().State; s != TriggerIdle {
+				return errors.New("unexpected state: " + s)
+			}
+			return nil
+		},
+		SyntacticallyBad: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: "",
+				Explanation: "empty config",
+			},
+			configutil.ConfigTestData{
+				Data: "{}",
+				Explanation: "empty object",
+			},
+			configutil.ConfigTestData{
+				Data: "null",
+				Explanation: "null config",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"backgroundtrigger": 7
+				}`,
+				Explanation: "numeric trigger",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"backgroundtrigger": {
+						"type": "landingfilter",
+						"data": {}
+					}
+				}`,
+				Explanation: "non-trigger as trigger",
+			},
+			configutil.ConfigTestData{
+				Data: "42",
+				Explanation: "numeric config",
+			},
+		},
+		Good: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: `{
+					"backgroundtrigger": {
+						"type": "compoundtrigger",
+						"data": {}
+					}
+				}`,
+				Explanation: "valid async trigger",
+			},
+		},
+	}
+	test.Run(t)
+}
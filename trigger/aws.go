@@ -0,0 +1,463 @@
+package trigger
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultAwsMaxRetries is the number of times a throttled (or otherwise
+// temporarily failed) AWS API call will be retried if no other value is given.
+const DefaultAwsMaxRetries = 3
+
+// DefaultAwsRetryBackoff is the amount of time waited before the first retry of
+// an AWS API call if no other value is given. Each later retry waits twice as
+// long as the one before.
+const DefaultAwsRetryBackoff = 200 * time.Millisecond
+
+// DefaultAwsTimeout is the amount of time allowed for any single AWS API call.
+const DefaultAwsTimeout = 30 * time.Second
+
+// MissingAwsCredentialsError indicates that no AWS credentials were configured
+// and none could be found in the environment.
+var MissingAwsCredentialsError = errors.New(
+	"No AWS credentials were configured, and AWS_ACCESS_KEY_ID and" +
+	" AWS_SECRET_ACCESS_KEY are not set.",
+)
+
+// MissingAwsRegionError indicates that no AWS region was configured and none
+// could be found in the environment.
+var MissingAwsRegionError = errors.New(
+	"No AWS region was configured, and AWS_REGION and AWS_DEFAULT_REGION" +
+	" are not set.",
+)
+
+// AwsApiError is an error returned by an AWS API (or a compatible API).
+type AwsApiError struct {
+	StatusCode int
+	Code string
+	Message string
+}
+
+func (e *AwsApiError) Error() string {
+	return fmt.Sprintf(
+		"AWS API error (HTTP status %d): %s: %s",
+		e.StatusCode,
+		e.Code,
+		e.Message,
+	)
+}
+
+// retryable determines whether the failed call which produced this error is
+// worth trying again.
+func (e *AwsApiError) retryable() bool {
+	switch e.Code {
+	case "Throttling",
+		"ThrottlingException",
+		"RequestThrottled",
+		"RequestLimitExceeded",
+		"ServiceUnavailable",
+		"InternalError",
+		"InternalFailure":
+		return true
+	default:
+		return e.StatusCode >= 500
+	}
+}
+
+// AwsSettings holds the settings shared by all the triggers which call AWS APIs
+// (or APIs compatible with them). If no region or credentials are given, they
+// are taken from the usual AWS environment variables at the time of the call.
+// If an endpoint is given (i.e. "http://localhost:9324"), every call is sent
+// to it instead of to the usual AWS endpoint.
+type AwsSettings struct {
+	Region string
+	Endpoint string
+	AccessKeyId string
+	SecretAccessKey string
+	SessionToken string
+	MaxRetries uint
+	RetryBackoff time.Duration
+	client *http.Client
+}
+
+// awsSettingsConfig is the config representation of AwsSettings, which is
+// meant to be embedded in the config representation of each AWS trigger.
+type awsSettingsConfig struct {
+	Region string
+	Endpoint string
+	AccessKeyId string
+	SecretAccessKey string
+	SessionToken string
+	MaxRetries *uint
+	RetryBackoff string
+}
+
+func (c *awsSettingsConfig) settings() (AwsSettings, error) {
+	s := NewAwsSettings(c.Region, c.Endpoint)
+	s.AccessKeyId = c.AccessKeyId
+	s.SecretAccessKey = c.SecretAccessKey
+	s.SessionToken = c.SessionToken
+
+	if c.MaxRetries != nil {
+		s.MaxRetries = *c.MaxRetries
+	}
+
+	if c.RetryBackoff != "" {
+		if b, e := time.ParseDuration(c.RetryBackoff); e != nil {
+			return s, e
+		} else {
+			s.RetryBackoff = b
+		}
+	}
+
+	if c.Endpoint != "" {
+		if u, e := url.Parse(c.Endpoint); e != nil {
+			return s, e
+		} else if u.Scheme == "" || u.Host == "" {
+			return s, errors.New(
+				fmt.Sprintf(
+					"AWS endpoint must be an absolute" +
+					" URL: %s",
+					c.Endpoint,
+				),
+			)
+		}
+	}
+
+	return s, nil
+}
+
+// NewAwsSettings constructs AwsSettings for the given region and endpoint
+// (either of which may be empty), with the default retry behavior and
+// credentials taken from the environment.
+func NewAwsSettings(region, endpoint string) AwsSettings {
+	return AwsSettings{
+		Region: region,
+		Endpoint: endpoint,
+		MaxRetries: DefaultAwsMaxRetries,
+		RetryBackoff: DefaultAwsRetryBackoff,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+			},
+			Timeout: DefaultAwsTimeout,
+		},
+	}
+}
+
+func (s *AwsSettings) region() (string, error) {
+	if s.Region != "" {
+		return s.Region, nil
+	} else if r := os.Getenv("AWS_REGION"); r != "" {
+		return r, nil
+	} else if r := os.Getenv("AWS_DEFAULT_REGION"); r != "" {
+		return r, nil
+	} else {
+		return "", MissingAwsRegionError
+	}
+}
+
+func (s *AwsSettings) credentials() (id, secret, token string, e error) {
+	if s.AccessKeyId != "" || s.SecretAccessKey != "" {
+		return s.AccessKeyId, s.SecretAccessKey, s.SessionToken, nil
+	}
+
+	id = os.Getenv("AWS_ACCESS_KEY_ID")
+	secret = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	token = os.Getenv("AWS_SESSION_TOKEN")
+	if id == "" || secret == "" {
+		return "", "", "", MissingAwsCredentialsError
+	}
+
+	return id, secret, token, nil
+}
+
+func (s *AwsSettings) httpClient() *http.Client {
+	if s.client == nil {
+		return http.DefaultClient
+	}
+	return s.client
+}
+
+// closeIdleConnections closes any connections kept alive for later calls.
+func (s *AwsSettings) closeIdleConnections() {
+	if s.client != nil {
+		if t, ok := s.client.Transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
+}
+
+// Close closes any connections kept alive for later calls, making every AWS
+// trigger a valid io.Closer implementation. The settings can still be used
+// afterwards, but new connections will need to be made.
+func (s *AwsSettings) Close() error {
+	s.closeIdleConnections()
+	return nil
+}
+
+// target determines where a call meant for the given URL should actually be
+// sent, taking into account any configured endpoint.
+func (s *AwsSettings) target(rawUrl string) (*url.URL, error) {
+	u, e := url.Parse(rawUrl)
+	if e != nil {
+		return nil, e
+	}
+
+	if s.Endpoint != "" {
+		ep, e := url.Parse(s.Endpoint)
+		if e != nil {
+			return nil, e
+		}
+		u.Scheme = ep.Scheme
+		u.Host = ep.Host
+		if u.Path == "" || u.Path == "/" {
+			u.Path = ep.Path
+		}
+	}
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	return u, nil
+}
+
+// call makes a signed AWS Query API call (as used by SQS and EC2) to the given
+// URL, retrying any throttled or temporarily failed call with an exponential
+// backoff. The body of the successful response is returned.
+func (s *AwsSettings) call(
+	service string,
+	rawUrl string,
+	params url.Values,
+) ([]byte, error) {
+	u, e := s.target(rawUrl)
+	if e != nil {
+		return nil, e
+	}
+
+	backoff := s.RetryBackoff
+	for attempt := uint(0); ; attempt++ {
+		body, e := s.callOnce(service, u, params)
+		if e == nil {
+			return body, nil
+		}
+
+		apiErr, isApiErr := e.(*AwsApiError)
+		if attempt >= s.MaxRetries || (isApiErr && !apiErr.retryable()) {
+			return nil, e
+		}
+
+		log().Warning(
+			fmt.Sprintf(
+				"AWS %s call to %s failed (attempt %d of" +
+				" %d), retrying in %v: %v",
+				service,
+				u.Host,
+				attempt + 1,
+				s.MaxRetries + 1,
+				backoff,
+				e,
+			),
+		)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *AwsSettings) callOnce(
+	service string,
+	u *url.URL,
+	params url.Values,
+) ([]byte, error) {
+	region, e := s.region()
+	if e != nil {
+		return nil, e
+	}
+
+	id, secret, token, e := s.credentials()
+	if e != nil {
+		return nil, e
+	}
+
+	body := []byte(params.Encode())
+	req, e := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set(
+		"Content-Type",
+		"application/x-www-form-urlencoded; charset=utf-8",
+	)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAwsRequest(
+		req,
+		body,
+		service,
+		region,
+		id,
+		secret,
+		time.Now(),
+	)
+
+	resp, e := s.httpClient().Do(req)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+
+	respBody, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return nil, e
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, parseAwsError(resp.StatusCode, respBody)
+	}
+
+	return respBody, nil
+}
+
+// parseAwsError extracts the error code and message from an error response,
+// which is structured a little differently depending on the API.
+func parseAwsError(status int, body []byte) *AwsApiError {
+	var t struct {
+		Error []struct {
+			Code string
+			Message string
+		}
+		Errors []struct {
+			Code string
+			Message string
+		} `xml:"Errors>Error"`
+	}
+
+	result := &AwsApiError{StatusCode: status}
+	if xml.Unmarshal(body, &t) == nil {
+		if len(t.Error) > 0 {
+			result.Code = t.Error[0].Code
+			result.Message = t.Error[0].Message
+		} else if len(t.Errors) > 0 {
+			result.Code = t.Errors[0].Code
+			result.Message = t.Errors[0].Message
+		}
+	}
+
+	if result.Code == "" {
+		result.Code = http.StatusText(status)
+		result.Message = string(body)
+	}
+
+	return result
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// signAwsRequest adds the headers needed to sign a request using AWS Signature
+// Version 4. The host header and any content type or security token headers
+// already on the request are signed.
+func signAwsRequest(
+	req *http.Request,
+	body []byte,
+	service string,
+	region string,
+	id string,
+	secret string,
+	now time.Time,
+) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	shortDate := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+		"x-amz-date": amzDate,
+	}
+	for _, h := range []string{"Content-Type", "X-Amz-Security-Token"} {
+		if v := req.Header.Get(h); v != "" {
+			headers[strings.ToLower(h)] = v
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(
+			name + ":" + strings.TrimSpace(headers[name]) + "\n",
+		)
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join(
+		[]string{
+			req.Method,
+			path,
+			strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+			canonicalHeaders.String(),
+			signedHeaders,
+			sha256Hex(body),
+		},
+		"\n",
+	)
+
+	scope := shortDate + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join(
+		[]string{
+			"AWS4-HMAC-SHA256",
+			amzDate,
+			scope,
+			sha256Hex([]byte(canonicalRequest)),
+		},
+		"\n",
+	)
+
+	key := hmacSha256([]byte("AWS4" + secret), shortDate)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, service)
+	key = hmacSha256(key, "aws4_request")
+
+	req.Header.Set(
+		"Authorization",
+		fmt.Sprintf(
+			"AWS4-HMAC-SHA256 Credential=%s/%s," +
+			" SignedHeaders=%s, Signature=%s",
+			id,
+			scope,
+			signedHeaders,
+			hex.EncodeToString(hmacSha256(key, stringToSign)),
+		),
+	)
+}
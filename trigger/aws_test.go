@@ -0,0 +1,170 @@
+package trigger
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestSignAwsRequest verifies the request signing against test cases from the
+// AWS Signature Version 4 test suite.
+func TestSignAwsRequest(t *testing.T) {
+	type testCase struct {
+		method string
+		contentType string
+		body string
+		expected string
+	}
+
+	testCases := []testCase{
+		testCase{
+			method: "GET",
+			expected: "AWS4-HMAC-SHA256" +
+				" Credential=AKIDEXAMPLE/20150830/us-east-1" +
+				"/service/aws4_request," +
+				" SignedHeaders=host;x-amz-date," +
+				" Signature=5fa00fa31553b73ebf1942676e86291e" +
+				"8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		testCase{
+			method: "POST",
+			contentType: "application/x-www-form-urlencoded",
+			body: "Param1=value1",
+			expected: "AWS4-HMAC-SHA256" +
+				" Credential=AKIDEXAMPLE/20150830/us-east-1" +
+				"/service/aws4_request," +
+				" SignedHeaders=content-type;host;x-amz-date," +
+				" Signature=ff11897932ad3f4e8b18135d722051e5" +
+				"ac45fc38421b1da7b9d196a0fe09473a",
+		},
+	}
+
+	now, err := time.Parse("20060102T150405Z", "20150830T123600Z")
+	assert.NoError(t, err)
+
+	for _, c := range testCases {
+		req, err := http.NewRequest(
+			c.method,
+			"https://example.amazonaws.com/",
+			bytes.NewReader([]byte(c.body)),
+		)
+		assert.NoError(t, err)
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+
+		signAwsRequest(
+			req,
+			[]byte(c.body),
+			"service",
+			"us-east-1",
+			"AKIDEXAMPLE",
+			"wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+			now,
+		)
+
+		assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+		assert.Equal(t, c.expected, req.Header.Get("Authorization"))
+	}
+}
+
+// TestParseAwsError verifies that errors from both the SQS and EC2 styles of
+// error responses are understood.
+func TestParseAwsError(t *testing.T) {
+	e := parseAwsError(
+		400,
+		[]byte(`<?xml version="1.0"?><ErrorResponse><Error>` +
+		`<Type>Sender</Type><Code>Throttling</Code>` +
+		`<Message>Rate exceeded</Message></Error>` +
+		`<RequestId>1</RequestId></ErrorResponse>`),
+	)
+	assert.Equal(t, "Throttling", e.Code)
+	assert.Equal(t, "Rate exceeded", e.Message)
+	assert.True(t, e.retryable())
+
+	e = parseAwsError(
+		400,
+		[]byte(`<Response><Errors><Error>` +
+		`<Code>InvalidInstanceID.NotFound</Code>` +
+		`<Message>No such instance</Message></Error></Errors>` +
+		`<RequestID>1</RequestID></Response>`),
+	)
+	assert.Equal(t, "InvalidInstanceID.NotFound", e.Code)
+	assert.Equal(t, "No such instance", e.Message)
+	assert.False(t, e.retryable())
+
+	e = parseAwsError(502, []byte("bad gateway"))
+	assert.Equal(t, 502, e.StatusCode)
+	assert.True(t, e.retryable())
+}
+
+// TestAwsSettingsTarget verifies that a configured endpoint replaces the
+// scheme and host of the URL a call is sent to.
+func TestAwsSettingsTarget(t *testing.T) {
+	s := NewAwsSettings("us-east-1", "")
+	u, err := s.target("https://sqs.us-east-1.amazonaws.com/123/q")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sqs.us-east-1.amazonaws.com/123/q", u.String())
+
+	s = NewAwsSettings("us-east-1", "http://localhost:9324")
+	u, err = s.target("https://sqs.us-east-1.amazonaws.com/123/q")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:9324/123/q", u.String())
+
+	u, err = s.target("https://ec2.us-east-1.amazonaws.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:9324/", u.String())
+}
+
+// TestAwsSettingsEnvironment verifies that missing regions and credentials
+// are reported as such.
+func TestAwsSettingsEnvironment(t *testing.T) {
+	for _, v := range []string{
+		"AWS_REGION",
+		"AWS_DEFAULT_REGION",
+		"AWS_ACCESS_KEY_ID",
+		"AWS_SECRET_ACCESS_KEY",
+	} {
+		defer restoreEnv(v)()
+	}
+
+	s := NewAwsSettings("", "")
+	_, err := s.region()
+	assert.Equal(t, MissingAwsRegionError, err)
+	_, _, _, err = s.credentials()
+	assert.Equal(t, MissingAwsCredentialsError, err)
+
+	setenv(t, "AWS_DEFAULT_REGION", "eu-west-1")
+	setenv(t, "AWS_ACCESS_KEY_ID", "AKID")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "SECRET")
+
+	region, err := s.region()
+	assert.NoError(t, err)
+	assert.Equal(t, "eu-west-1", region)
+	id, secret, _, err := s.credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, "AKID", id)
+	assert.Equal(t, "SECRET", secret)
+}
+
+// restoreEnv is a testing helper function that unsets an environment variable,
+// returning a function which will put back its original value.
+func restoreEnv(name string) func() {
+	value, present := os.LookupEnv(name)
+	os.Unsetenv(name)
+	return func() {
+		if present {
+			os.Setenv(name, value)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// setenv is a testing helper function that sets an environment variable.
+func setenv(t *testing.T, name, value string) {
+	assert.NoError(t, os.Setenv(name, value))
+}
@@ -32,7 +32,7 @@ func (c *CompoundTrigger) UnmarshalJSON(input []byte) (error) {
 	if e := dec.Decode(&t); e != nil {
 		return e
 	} else {
-		c.Triggers = make([]TriggerHandler, len(t.Triggers))
+		c.Triggers = make([]TriggerHandler, 0, len(t.Triggers))
 
 		for _, i := range t.Triggers {
 			th := i.Unmarshaled
@@ -55,14 +55,31 @@ func (c *CompoundTrigger) UnmarshalJSON(input []byte) (error) {
 	}
 }
 
-// TriggerString implements the required string-based triggering function to
-// make CompoundTrigger a valid TriggerHandler implementation.
+// Trigger implements the required triggering function to make CompoundTrigger
+// a valid TriggerHandler implementation.
 func (ct *CompoundTrigger) Trigger() error {
+	return ct.TriggerWith(NewTriggerContext())
+}
+
+// TriggerWith fires each of the triggers with the given context, making
+// CompoundTrigger a valid ContextTriggerHandler implementation.
+func (ct *CompoundTrigger) TriggerWith(ctx TriggerContext) error {
 	for _, t := range ct.Triggers {
-		if err := t.Trigger(); err != nil {
+		if err := WithContext(t).TriggerWith(ctx); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// Stop stops each of the triggers which can be stopped, making CompoundTrigger
+// a valid Stopper implementation.
+func (ct *CompoundTrigger) Stop() error {
+	return stopAll(ct.Triggers...)
+}
+
+// StopsReferences tells the config that stopping the CompoundTrigger stops the
+// triggers it references, making it a valid config.ReferenceStopper.
+func (ct *CompoundTrigger) StopsReferences() bool {
+	return true
+}
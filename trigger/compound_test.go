@@ -1,10 +1,12 @@
 package trigger
 
 import (
+	"encoding/json"
 	"errors"
 	"github.com/stretchr/testify/assert"
 	configutil "github.com/stuphlabs/pullcord/config/util"
 	"github.com/stuphlabs/pullcord/util"
+	"sync"
 	"testing"
 )
 
@@ -21,6 +23,100 @@ func (th *counterTriggerHandler) Trigger() error {
 	}
 }
 
+// contextTriggerHandler is a testing trigger which keeps each context it is
+// fired with.
+type contextTriggerHandler struct {
+	mutex sync.Mutex
+	contexts []TriggerContext
+}
+
+func (th *contextTriggerHandler) Trigger() error {
+	return th.TriggerWith(NewTriggerContext())
+}
+
+func (th *contextTriggerHandler) TriggerWith(ctx TriggerContext) error {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	th.contexts = append(th.contexts, ctx)
+	return nil
+}
+
+func (th *contextTriggerHandler) Contexts() []TriggerContext {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	return append([]TriggerContext(nil), th.contexts...)
+}
+
+// lockedCounterTriggerHandler is a testing trigger like counterTriggerHandler
+// (including always erroring if the count is negative) which also keeps track
+// of whether it has been stopped, and which can be used from many goroutines
+// at once.
+type lockedCounterTriggerHandler struct {
+	mutex sync.Mutex
+	count int
+	stopped bool
+}
+
+func (th *lockedCounterTriggerHandler) Trigger() error {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	if th.count >= 0 {
+		th.count += 1
+		return nil
+	} else {
+		return errors.New("this trigger always errors")
+	}
+}
+
+func (th *lockedCounterTriggerHandler) Stop() error {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	th.stopped = true
+	return nil
+}
+
+func (th *lockedCounterTriggerHandler) Count() int {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	return th.count
+}
+
+func (th *lockedCounterTriggerHandler) SetCount(count int) {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	th.count = count
+}
+
+func (th *lockedCounterTriggerHandler) Stopped() bool {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	return th.stopped
+}
+
+// hammer fires the given trigger the given number of times from each of the
+// given number of goroutines at once, and returns how many of those calls
+// produced an error.
+func hammer(th TriggerHandler, goroutines, calls int) int {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	errs := 0
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < calls; j++ {
+				if th.Trigger() != nil {
+					mutex.Lock()
+					errs += 1
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
 func TestCompoundTriggerNoErrors(t *testing.T) {
 	th1 := &counterTriggerHandler{}
 	th2 := &counterTriggerHandler{}
@@ -63,10 +159,41 @@ func TestCompoundTriggerSomeErrors(t *testing.T) {
 	assert.Equal(t, -1, th2.count)
 }
 
+func TestCompoundTriggerContext(t *testing.T) {
+	th1 := &contextTriggerHandler{}
+	th2 := &counterTriggerHandler{}
+
+	ct := CompoundTrigger{[]TriggerHandler{th1, th2}}
+
+	ctx := NewTriggerContext()
+	ctx.Service = "wiki"
+	ctx.Hook = "OnDown"
+	err := ct.TriggerWith(ctx)
+	assert.NoError(t, err)
+
+	err = ct.Trigger()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, len(th1.contexts))
+	assert.Equal(t, ctx, th1.contexts[0])
+	assert.Equal(t, "", th1.contexts[1].Service)
+	assert.False(t, th1.contexts[1].Time.IsZero())
+	assert.Equal(t, 2, th2.count)
+}
+
 func TestCompoundTriggerFromConfig(t *testing.T) {
 	util.LoadPlugin()
 	test := configutil.ConfigTest{
 		ResourceType: "compoundtrigger",
+		IsValid: func(i json.Unmarshaler) error {
+			ct := i.(*CompoundTrigger)
+			for _, th := range ct.Triggers {
+				if th == nil {
+					return errors.New("nil trigger")
+				}
+			}
+			return ct.Trigger()
+		},
 		SyntacticallyBad: []configutil.ConfigTestData{
 			configutil.ConfigTestData{
 				Data: "",
@@ -129,3 +256,20 @@ func TestCompoundTriggerFromConfig(t *testing.T) {
 	}
 	test.Run(t)
 }
+
+func TestCompoundTriggerConcurrent(t *testing.T) {
+	th1 := &lockedCounterTriggerHandler{}
+	th2 := &lockedCounterTriggerHandler{}
+
+	ct := &CompoundTrigger{[]TriggerHandler{th1, th2}}
+
+	errs := hammer(ct, 20, 50)
+	assert.Equal(t, 0, errs)
+	assert.Equal(t, 1000, th1.Count())
+	assert.Equal(t, 1000, th2.Count())
+
+	err := ct.Stop()
+	assert.NoError(t, err)
+	assert.True(t, th1.Stopped())
+	assert.True(t, th2.Stopped())
+}
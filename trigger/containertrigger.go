@@ -0,0 +1,604 @@
+package trigger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stuphlabs/pullcord/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DockerApiVersion is the version of the Docker Engine API used by
+// ContainerTrigger.
+const DockerApiVersion = "1.24"
+
+// DefaultDockerHost is the address of the Docker Engine API used by
+// ContainerTrigger if no other value is given.
+const DefaultDockerHost = "unix:///var/run/docker.sock"
+
+// DefaultContainerTimeout is the amount of time a ContainerTrigger will wait
+// for its containers to become healthy if no other value is given.
+const DefaultContainerTimeout = 5 * time.Minute
+
+// DefaultContainerPollInterval is the amount of time a ContainerTrigger will
+// wait between checks of its containers' health if no other value is given.
+const DefaultContainerPollInterval = 2 * time.Second
+
+// DefaultDockerApiTimeout is the amount of time allowed for any single Docker
+// Engine API call. Stopping a container can take a while, so this is fairly
+// generous.
+const DefaultDockerApiTimeout = time.Minute
+
+// NoMatchingContainersError indicates that no containers have the labels given
+// to a ContainerTrigger.
+var NoMatchingContainersError = errors.New(
+	"No containers match the given labels.",
+)
+
+// ContainerTimeoutError indicates that the containers did not all become
+// healthy before the timeout.
+var ContainerTimeoutError = errors.New(
+	"Timed out waiting for the containers to become healthy.",
+)
+
+// ContainerApiError is an error returned by the Docker Engine API (or a
+// compatible API).
+type ContainerApiError struct {
+	StatusCode int
+	Message string
+}
+
+func (e *ContainerApiError) Error() string {
+	return fmt.Sprintf(
+		"Docker API error (HTTP status %d): %s",
+		e.StatusCode,
+		e.Message,
+	)
+}
+
+// ContainerTrigger is a TriggerHandler that starts, stops, pauses, or unpauses
+// containers using the Docker Engine API (or any compatible API) when
+// triggered. Either a single container is given by name (or ID), or all of the
+// containers with a given set of labels are acted on.
+//
+// The API is reached at Host, which may be a unix socket (i.e.
+// "unix:///var/run/docker.sock"), a TCP address (i.e. "tcp://localhost:2375"),
+// or an HTTP URL. Starting a paused container unpauses it. If WaitHealthy is
+// set, the trigger will not return after starting or unpausing until each of
+// the containers is running and (if it has a health check) healthy, returning
+// an error if that doesn't happen within the timeout. As with an
+// Ec2InstanceTrigger, a timeout of zero means that the trigger returns as soon
+// as the containers have been told to start without waiting at all.
+type ContainerTrigger struct {
+	Host string
+	Name string
+	Labels map[string]string
+	Action string
+	WaitHealthy bool
+	Timeout time.Duration
+	PollInterval time.Duration
+	client *http.Client
+}
+
+// containerActions is the set of actions which can be taken on a container.
+var containerActions = map[string]bool{
+	"start": true,
+	"stop": true,
+	"pause": true,
+	"unpause": true,
+}
+
+func init() {
+	config.RegisterResourceType(
+		"containertrigger",
+		func() json.Unmarshaler {
+			return new(ContainerTrigger)
+		},
+	)
+}
+
+func (c *ContainerTrigger) UnmarshalJSON(input []byte) (error) {
+	var t struct {
+		Host string
+		Name string
+		Labels map[string]string
+		Action string
+		WaitHealthy bool
+		Timeout string
+		PollInterval string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	if (t.Name == "") == (len(t.Labels) == 0) {
+		return errors.New(
+			"containertrigger requires either a name or labels," +
+			" but not both",
+		)
+	}
+
+	if !containerActions[t.Action] {
+		return errors.New(
+			fmt.Sprintf(
+				"containertrigger action must be one of" +
+				" start, stop, pause, or unpause, not: %s",
+				t.Action,
+			),
+		)
+	}
+
+	if t.Host == "" {
+		t.Host = DefaultDockerHost
+	}
+	client, e := newDockerClient(t.Host)
+	if e != nil {
+		return e
+	}
+
+	c.Timeout = DefaultContainerTimeout
+	if t.Timeout != "" {
+		if d, e := time.ParseDuration(t.Timeout); e != nil {
+			return e
+		} else {
+			c.Timeout = d
+		}
+	}
+
+	c.PollInterval = DefaultContainerPollInterval
+	if t.PollInterval != "" {
+		if d, e := time.ParseDuration(t.PollInterval); e != nil {
+			return e
+		} else if d <= 0 {
+			return errors.New(
+				"containertrigger poll interval must be" +
+				" positive",
+			)
+		} else {
+			c.PollInterval = d
+		}
+	}
+
+	c.Host = t.Host
+	c.Name = t.Name
+	c.Labels = t.Labels
+	c.Action = t.Action
+	c.WaitHealthy = t.WaitHealthy
+	c.client = client
+
+	return nil
+}
+
+// NewContainerTrigger constructs a new ContainerTrigger which takes the given
+// action (one of "start", "stop", "pause", or "unpause") on the named
+// container using the Docker Engine API at the given host (which may be empty
+// to use the default unix socket). To act on containers by label instead, the
+// Name can be cleared and Labels set.
+func NewContainerTrigger(
+	host string,
+	name string,
+	action string,
+) (*ContainerTrigger, error) {
+	log().Info("initializing container trigger")
+
+	if host == "" {
+		host = DefaultDockerHost
+	}
+	client, err := newDockerClient(host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ContainerTrigger{
+		host,
+		name,
+		nil,
+		action,
+		false,
+		DefaultContainerTimeout,
+		DefaultContainerPollInterval,
+		client,
+	}, nil
+}
+
+// newDockerClient creates an HTTP client which sends every request to the
+// given Docker host, regardless of the host in the request URL.
+func newDockerClient(host string) (*http.Client, error) {
+	u, e := url.Parse(host)
+	if e != nil {
+		return nil, e
+	}
+
+	var network, address string
+	switch u.Scheme {
+	case "unix":
+		network = "unix"
+		address = u.Path
+	case "tcp", "http":
+		network = "tcp"
+		address = u.Host
+	default:
+		return nil, errors.New(
+			fmt.Sprintf(
+				"Docker host must be a unix, tcp, or http" +
+				" URL: %s",
+				host,
+			),
+		)
+	}
+
+	if address == "" {
+		return nil, errors.New(
+			fmt.Sprintf("Docker host has no address: %s", host),
+		)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.DialTimeout(
+					network,
+					address,
+					DefaultDockerApiTimeout,
+				)
+			},
+		},
+		Timeout: DefaultDockerApiTimeout,
+	}, nil
+}
+
+// call makes a single Docker Engine API call, decoding any JSON response into
+// result (if it isn't nil). A 304 (Not Modified) response, which is given when
+// a container is already in the requested state, is not considered an error.
+func (c *ContainerTrigger) call(
+	method string,
+	path string,
+	query url.Values,
+	result interface{},
+) error {
+	client := c.client
+	if client == nil {
+		host := c.Host
+		if host == "" {
+			host = DefaultDockerHost
+		}
+		var e error
+		if client, e = newDockerClient(host); e != nil {
+			return e
+		}
+	}
+
+	u := url.URL{
+		Scheme: "http",
+		Host: "docker",
+		Path: "/v" + DockerApiVersion + path,
+		RawQuery: query.Encode(),
+	}
+	req, e := http.NewRequest(method, u.String(), nil)
+	if e != nil {
+		return e
+	}
+
+	resp, e := client.Do(req)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+
+	body, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return e
+	}
+
+	if resp.StatusCode == 304 {
+		return nil
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var t struct {
+			Message string
+		}
+		if json.Unmarshal(body, &t) != nil || t.Message == "" {
+			t.Message = strings.TrimSpace(string(body))
+		}
+		return &ContainerApiError{resp.StatusCode, t.Message}
+	}
+
+	if result != nil {
+		return json.Unmarshal(body, result)
+	}
+	return nil
+}
+
+// containerState is the part of the state of a container which is of interest
+// to a ContainerTrigger.
+type containerState struct {
+	Status string
+	Running bool
+	Paused bool
+	Health *struct {
+		Status string
+	}
+}
+
+// inspect retrieves the current state of a container.
+func (c *ContainerTrigger) inspect(id string) (containerState, error) {
+	var t struct {
+		State containerState
+	}
+	e := c.call(
+		"GET",
+		"/containers/" + id + "/json",
+		url.Values{},
+		&t,
+	)
+	return t.State, e
+}
+
+// containers determines which containers the trigger acts on.
+func (c *ContainerTrigger) containers() ([]string, error) {
+	if c.Name != "" {
+		return []string{c.Name}, nil
+	}
+
+	labels := make([]string, 0, len(c.Labels))
+	for k, v := range c.Labels {
+		labels = append(labels, k + "=" + v)
+	}
+	sort.Strings(labels)
+	filters, e := json.Marshal(map[string][]string{"label": labels})
+	if e != nil {
+		return nil, e
+	}
+
+	var list []struct {
+		Id string
+	}
+	e = c.call(
+		"GET",
+		"/containers/json",
+		url.Values{
+			"all": []string{"1"},
+			"filters": []string{string(filters)},
+		},
+		&list,
+	)
+	if e != nil {
+		return nil, e
+	} else if len(list) == 0 {
+		return nil, NoMatchingContainersError
+	}
+
+	ids := make([]string, 0, len(list))
+	for _, container := range list {
+		ids = append(ids, container.Id)
+	}
+	return ids, nil
+}
+
+// act takes the action on a single container, checking its state first so
+// that nothing is done to a container which is already in the desired state.
+func (c *ContainerTrigger) act(id string) error {
+	state, e := c.inspect(id)
+	if e != nil {
+		return e
+	}
+
+	action := c.Action
+	switch action {
+	case "start":
+		if state.Paused {
+			action = "unpause"
+		} else if state.Running {
+			return nil
+		}
+	case "stop":
+		if !state.Running && !state.Paused {
+			return nil
+		}
+	case "pause":
+		if state.Paused {
+			return nil
+		} else if !state.Running {
+			return errors.New(
+				fmt.Sprintf(
+					"Container %s cannot be paused as it" +
+					" is %s",
+					id,
+					state.Status,
+				),
+			)
+		}
+	case "unpause":
+		if !state.Paused {
+			return nil
+		}
+	default:
+		return errors.New(
+			fmt.Sprintf("Unknown container action: %s", action),
+		)
+	}
+
+	log().Debug(
+		fmt.Sprintf(
+			"containertrigger sending %s to container %s",
+			action,
+			id,
+		),
+	)
+	return c.call(
+		"POST",
+		"/containers/" + id + "/" + action,
+		url.Values{},
+		nil,
+	)
+}
+
+// healthy determines whether a container is running and (if it has a health
+// check) healthy. A container which has stopped or been found to be unhealthy
+// results in an error, as waiting any longer wouldn't help.
+func (c *ContainerTrigger) healthy(id string) (bool, error) {
+	state, e := c.inspect(id)
+	if e != nil {
+		return false, e
+	}
+
+	if !state.Running {
+		return false, errors.New(
+			fmt.Sprintf(
+				"Container %s is %s rather than running",
+				id,
+				state.Status,
+			),
+		)
+	} else if state.Paused {
+		return false, nil
+	} else if state.Health == nil {
+		return true, nil
+	}
+
+	switch state.Health.Status {
+	case "healthy", "none", "":
+		return true, nil
+	case "unhealthy":
+		return false, errors.New(
+			fmt.Sprintf("Container %s is unhealthy", id),
+		)
+	default:
+		return false, nil
+	}
+}
+
+// Close closes any connections to the Docker host kept alive for later calls,
+// making ContainerTrigger a valid io.Closer implementation. The trigger can
+// still be used afterwards, but new connections will need to be made.
+func (c *ContainerTrigger) Close() error {
+	if c.client != nil {
+		if t, ok := c.client.Transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
+	return nil
+}
+
+// Trigger takes the action on the containers, implementing the TriggerHandler
+// interface.
+func (c *ContainerTrigger) Trigger() error {
+	return c.TriggerWith(NewTriggerContext())
+}
+
+// TriggerWith takes the action on the containers, implementing the
+// ContextTriggerHandler interface. The context is only used to say which
+// service the action was taken for in the logs.
+func (c *ContainerTrigger) TriggerWith(ctx TriggerContext) error {
+	log().Debug(
+		fmt.Sprintf(
+			"containertrigger running %s%s for containers: %s%v",
+			c.Action,
+			firedFor(ctx),
+			c.Name,
+			c.Labels,
+		),
+	)
+
+	ids, err := c.containers()
+	if err != nil {
+		log().Err(
+			fmt.Sprintf(
+				"containertrigger was unable to find the" +
+				" containers: %v",
+				err,
+			),
+		)
+		return err
+	}
+
+	for _, id := range ids {
+		if err = c.act(id); err != nil {
+			log().Err(
+				fmt.Sprintf(
+					"containertrigger failed during %s of" +
+					" container %s: %v",
+					c.Action,
+					id,
+					err,
+				),
+			)
+			return err
+		}
+	}
+
+	wait := c.WaitHealthy && c.Timeout > 0
+	if !wait || (c.Action != "start" && c.Action != "unpause") {
+		log().Info(
+			fmt.Sprintf(
+				"containertrigger sent %s to containers%s:" +
+				" %v",
+				c.Action,
+				firedFor(ctx),
+				ids,
+			),
+		)
+		return nil
+	}
+
+	deadline := time.Now().Add(c.Timeout)
+	for {
+		waiting := []string{}
+		for _, id := range ids {
+			healthy, err := c.healthy(id)
+			if err != nil {
+				log().Err(
+					fmt.Sprintf(
+						"containertrigger failed" +
+						" while waiting for container" +
+						" %s: %v",
+						id,
+						err,
+					),
+				)
+				return err
+			} else if !healthy {
+				waiting = append(waiting, id)
+			}
+		}
+
+		if len(waiting) == 0 {
+			log().Info(
+				fmt.Sprintf(
+					"containertrigger found containers %v" +
+					" to be healthy",
+					ids,
+				),
+			)
+			return nil
+		}
+
+		// the last check is made at the deadline, however the poll
+		// interval compares to the timeout
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			log().Err(
+				fmt.Sprintf(
+					"containertrigger timed out waiting" +
+					" for containers to be healthy: %v",
+					waiting,
+				),
+			)
+			return ContainerTimeoutError
+		}
+
+		interval := c.PollInterval
+		if interval > remaining {
+			interval = remaining
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,554 @@
+package trigger
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	configutil "github.com/stuphlabs/pullcord/config/util"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeContainer is a container known to a fakeDocker. A container with a
+// health check starts out with a "starting" health status, which becomes
+// "healthy" (or "unhealthy") after it has been inspected a number of times.
+type fakeContainer struct {
+	Id string
+	Labels map[string]string
+	Status string
+	Health string
+	healthyAfter int
+	unhealthy bool
+}
+
+// fakeDocker is a minimal in-process stand-in for the Docker Engine API which
+// listens on a unix socket.
+type fakeDocker struct {
+	mutex sync.Mutex
+	server *httptest.Server
+	dir string
+	containers map[string]*fakeContainer
+	requests []string
+}
+
+func newFakeDocker(t *testing.T, containers ...*fakeContainer) *fakeDocker {
+	dir, err := ioutil.TempDir("/tmp", "test_container_trigger")
+	assert.NoError(t, err)
+
+	f := &fakeDocker{
+		dir: dir,
+		containers: make(map[string]*fakeContainer),
+	}
+	for _, c := range containers {
+		f.containers[c.Id] = c
+	}
+
+	listener, err := net.Listen("unix", dir + "/docker.sock")
+	assert.NoError(t, err)
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.Listener.Close()
+	f.server.Listener = listener
+	f.server.Start()
+	return f
+}
+
+func (f *fakeDocker) host() string {
+	return "unix://" + f.dir + "/docker.sock"
+}
+
+func (f *fakeDocker) close() {
+	f.server.Close()
+	goRemoveAll(f.dir)
+}
+
+func (f *fakeDocker) writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+func (f *fakeDocker) list(w http.ResponseWriter, r *http.Request) {
+	var filters map[string][]string
+	err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+	if err != nil {
+		f.writeError(w, 400, err.Error())
+		return
+	}
+
+	result := []map[string]string{}
+	for _, c := range f.containers {
+		match := true
+		for _, label := range filters["label"] {
+			kv := strings.SplitN(label, "=", 2)
+			if c.Labels[kv[0]] != kv[1] {
+				match = false
+			}
+		}
+		if match {
+			result = append(result, map[string]string{"Id": c.Id})
+		}
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeDocker) inspect(w http.ResponseWriter, c *fakeContainer) {
+	if c.Status == "running" && c.Health == "starting" {
+		if c.healthyAfter > 0 {
+			c.healthyAfter -= 1
+		} else if c.unhealthy {
+			c.Health = "unhealthy"
+		} else {
+			c.Health = "healthy"
+		}
+	}
+
+	state := map[string]interface{}{
+		"Status": c.Status,
+		"Running": c.Status == "running" || c.Status == "paused",
+		"Paused": c.Status == "paused",
+	}
+	if c.Health != "" {
+		state["Health"] = map[string]string{"Status": c.Health}
+	}
+	json.NewEncoder(w).Encode(
+		map[string]interface{}{"Id": c.Id, "State": state},
+	)
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.requests = append(f.requests, r.Method + " " + r.URL.Path)
+
+	prefix := "/v" + DockerApiVersion + "/containers/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		f.writeError(w, 404, "page not found")
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	if r.Method == "GET" && len(parts) == 1 && parts[0] == "json" {
+		f.list(w, r)
+		return
+	} else if len(parts) != 2 {
+		f.writeError(w, 404, "page not found")
+		return
+	}
+
+	c, present := f.containers[parts[0]]
+	if !present {
+		f.writeError(w, 404, "No such container: " + parts[0])
+		return
+	}
+
+	switch r.Method + " " + parts[1] {
+	case "GET json":
+		f.inspect(w, c)
+	case "POST start":
+		if c.Status == "running" {
+			w.WriteHeader(304)
+		} else if c.Status == "paused" {
+			f.writeError(
+				w,
+				500,
+				"cannot start a paused container, try" +
+				" unpause instead",
+			)
+		} else {
+			c.Status = "running"
+			if c.Health != "" {
+				c.Health = "starting"
+			}
+			w.WriteHeader(204)
+		}
+	case "POST stop":
+		if c.Status == "exited" {
+			w.WriteHeader(304)
+		} else {
+			c.Status = "exited"
+			w.WriteHeader(204)
+		}
+	case "POST pause":
+		if c.Status != "running" {
+			f.writeError(
+				w,
+				409,
+				fmt.Sprintf(
+					"Container %s is not running",
+					c.Id,
+				),
+			)
+		} else {
+			c.Status = "paused"
+			w.WriteHeader(204)
+		}
+	case "POST unpause":
+		if c.Status != "paused" {
+			f.writeError(
+				w,
+				500,
+				fmt.Sprintf(
+					"Container %s is not paused",
+					c.Id,
+				),
+			)
+		} else {
+			c.Status = "running"
+			w.WriteHeader(204)
+		}
+	default:
+		f.writeError(w, 404, "page not found")
+	}
+}
+
+// newTestContainerTrigger creates a ContainerTrigger that talks to the fake
+// Docker.
+func newTestContainerTrigger(
+	t *testing.T,
+	f *fakeDocker,
+	name string,
+	action string,
+) *ContainerTrigger {
+	trigger, err := NewContainerTrigger(f.host(), name, action)
+	assert.NoError(t, err)
+	trigger.PollInterval = time.Millisecond
+	trigger.Timeout = time.Second
+	return trigger
+}
+
+func TestContainerTriggerStart(t *testing.T) {
+	f := newFakeDocker(t, &fakeContainer{Id: "web", Status: "exited"})
+	defer f.close()
+
+	ct := newTestContainerTrigger(t, f, "web", "start")
+	err := ct.Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, "running", f.containers["web"].Status)
+	assert.Equal(
+		t,
+		[]string{
+			"GET /v1.24/containers/web/json",
+			"POST /v1.24/containers/web/start",
+		},
+		f.requests,
+	)
+
+	var closer io.Closer = ct
+	err = closer.Close()
+	assert.NoError(t, err)
+}
+
+func TestContainerTriggerWith(t *testing.T) {
+	f := newFakeDocker(t, &fakeContainer{Id: "web", Status: "exited"})
+	defer f.close()
+
+	var handler ContextTriggerHandler = newTestContainerTrigger(
+		t,
+		f,
+		"web",
+		"start",
+	)
+	err := handler.TriggerWith(TriggerContext{Service: "web"})
+	assert.NoError(t, err)
+	assert.Equal(t, "running", f.containers["web"].Status)
+}
+
+func TestContainerTriggerStartRunning(t *testing.T) {
+	f := newFakeDocker(t, &fakeContainer{Id: "web", Status: "running"})
+	defer f.close()
+
+	err := newTestContainerTrigger(t, f, "web", "start").Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GET /v1.24/containers/web/json"}, f.requests)
+}
+
+func TestContainerTriggerStartPaused(t *testing.T) {
+	f := newFakeDocker(t, &fakeContainer{Id: "web", Status: "paused"})
+	defer f.close()
+
+	err := newTestContainerTrigger(t, f, "web", "start").Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, "running", f.containers["web"].Status)
+	assert.Contains(t, f.requests, "POST /v1.24/containers/web/unpause")
+}
+
+func TestContainerTriggerPauseAndUnpause(t *testing.T) {
+	f := newFakeDocker(t, &fakeContainer{Id: "web", Status: "running"})
+	defer f.close()
+
+	err := newTestContainerTrigger(t, f, "web", "pause").Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, "paused", f.containers["web"].Status)
+
+	err = newTestContainerTrigger(t, f, "web", "unpause").Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, "running", f.containers["web"].Status)
+}
+
+func TestContainerTriggerPauseStopped(t *testing.T) {
+	f := newFakeDocker(t, &fakeContainer{Id: "web", Status: "exited"})
+	defer f.close()
+
+	err := newTestContainerTrigger(t, f, "web", "pause").Trigger()
+	assert.Error(t, err)
+	assert.Equal(t, "exited", f.containers["web"].Status)
+}
+
+func TestContainerTriggerStopByLabel(t *testing.T) {
+	f := newFakeDocker(
+		t,
+		&fakeContainer{
+			Id: "wiki-app",
+			Labels: map[string]string{"app": "wiki", "tier": "web"},
+			Status: "running",
+		},
+		&fakeContainer{
+			Id: "wiki-db",
+			Labels: map[string]string{"app": "wiki", "tier": "db"},
+			Status: "paused",
+		},
+		&fakeContainer{
+			Id: "blog",
+			Labels: map[string]string{"app": "blog"},
+			Status: "running",
+		},
+	)
+	defer f.close()
+
+	trigger := newTestContainerTrigger(t, f, "", "stop")
+	trigger.Labels = map[string]string{"app": "wiki"}
+	err := trigger.Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, "exited", f.containers["wiki-app"].Status)
+	assert.Equal(t, "exited", f.containers["wiki-db"].Status)
+	assert.Equal(t, "running", f.containers["blog"].Status)
+}
+
+func TestContainerTriggerNoMatchingLabels(t *testing.T) {
+	f := newFakeDocker(t, &fakeContainer{Id: "web", Status: "exited"})
+	defer f.close()
+
+	trigger := newTestContainerTrigger(t, f, "", "start")
+	trigger.Labels = map[string]string{"app": "wiki"}
+	err := trigger.Trigger()
+	assert.Equal(t, NoMatchingContainersError, err)
+}
+
+func TestContainerTriggerUnknownContainer(t *testing.T) {
+	f := newFakeDocker(t)
+	defer f.close()
+
+	err := newTestContainerTrigger(t, f, "web", "start").Trigger()
+	if apiErr, ok := err.(*ContainerApiError); assert.True(t, ok) {
+		assert.Equal(t, 404, apiErr.StatusCode)
+		assert.Equal(t, "No such container: web", apiErr.Message)
+	}
+}
+
+func TestContainerTriggerWaitHealthy(t *testing.T) {
+	f := newFakeDocker(
+		t,
+		&fakeContainer{
+			Id: "web",
+			Status: "exited",
+			Health: "unhealthy",
+			healthyAfter: 3,
+		},
+	)
+	defer f.close()
+
+	trigger := newTestContainerTrigger(t, f, "web", "start")
+	trigger.WaitHealthy = true
+	err := trigger.Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, "healthy", f.containers["web"].Health)
+}
+
+func TestContainerTriggerWaitUnhealthy(t *testing.T) {
+	f := newFakeDocker(
+		t,
+		&fakeContainer{
+			Id: "web",
+			Status: "exited",
+			Health: "none",
+			healthyAfter: 1,
+			unhealthy: true,
+		},
+	)
+	defer f.close()
+
+	trigger := newTestContainerTrigger(t, f, "web", "start")
+	trigger.WaitHealthy = true
+	err := trigger.Trigger()
+	assert.Error(t, err)
+	assert.NotEqual(t, ContainerTimeoutError, err)
+}
+
+func TestContainerTriggerWaitTimeout(t *testing.T) {
+	f := newFakeDocker(
+		t,
+		&fakeContainer{
+			Id: "web",
+			Status: "exited",
+			Health: "none",
+			healthyAfter: 1000000,
+		},
+	)
+	defer f.close()
+
+	trigger := newTestContainerTrigger(t, f, "web", "start")
+	trigger.WaitHealthy = true
+	trigger.Timeout = 20 * time.Millisecond
+	err := trigger.Trigger()
+	assert.Equal(t, ContainerTimeoutError, err)
+}
+
+func TestContainerTriggerWaitTimeoutShorterThanPoll(t *testing.T) {
+	f := newFakeDocker(
+		t,
+		&fakeContainer{
+			Id: "web",
+			Status: "exited",
+			Health: "none",
+			healthyAfter: 1,
+		},
+	)
+	defer f.close()
+
+	// the container is healthy by the second check, which should be made
+	// at the deadline rather than after the whole poll interval
+	trigger := newTestContainerTrigger(t, f, "web", "start")
+	trigger.WaitHealthy = true
+	trigger.PollInterval = time.Hour
+	trigger.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	err := trigger.Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, "healthy", f.containers["web"].Health)
+	assert.True(t, time.Since(start) < 5 * time.Second)
+}
+
+func TestContainerTriggerWaitNoTimeout(t *testing.T) {
+	f := newFakeDocker(
+		t,
+		&fakeContainer{
+			Id: "web",
+			Status: "exited",
+			Health: "none",
+			healthyAfter: 1000000,
+		},
+	)
+	defer f.close()
+
+	// a timeout of zero means not waiting at all
+	trigger := newTestContainerTrigger(t, f, "web", "start")
+	trigger.WaitHealthy = true
+	trigger.Timeout = 0
+	err := trigger.Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, "running", f.containers["web"].Status)
+}
+
+func TestContainerTriggerFromConfig(t *testing.T) {
+	test := configutil.ConfigTest{
+		ResourceType: "containertrigger",
+		SyntacticallyBad: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: "",
+				Explanation: "empty config",
+			},
+			configutil.ConfigTestData{
+				Data: "42",
+				Explanation: "numeric config",
+			},
+			configutil.ConfigTestData{
+				Data: "{}",
+				Explanation: "empty object",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"action": "start"
+				}`,
+				Explanation: "missing name and labels",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "web",
+					"labels": {
+						"app": "wiki"
+					},
+					"action": "start"
+				}`,
+				Explanation: "both name and labels",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "web"
+				}`,
+				Explanation: "missing action",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "web",
+					"action": "restart"
+				}`,
+				Explanation: "unknown action",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "web",
+					"action": "start",
+					"host": "ftp://localhost"
+				}`,
+				Explanation: "unsupported host scheme",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "web",
+					"action": "start",
+					"timeout": "42q"
+				}`,
+				Explanation: "nonsensical timeout",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "web",
+					"action": "start",
+					"pollinterval": "0s"
+				}`,
+				Explanation: "zero poll interval",
+			},
+		},
+		Good: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: `{
+					"name": "web",
+					"action": "start"
+				}`,
+				Explanation: "minimal container trigger",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"host": "tcp://localhost:2375",
+					"labels": {
+						"app": "wiki"
+					},
+					"action": "start",
+					"waithealthy": true,
+					"timeout": "2m",
+					"pollinterval": "1s"
+				}`,
+				Explanation: "full container trigger",
+			},
+		},
+	}
+	test.Run(t)
+}
@@ -3,19 +3,47 @@ package trigger
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/stuphlabs/pullcord/config"
+	"github.com/stuphlabs/pullcord/store"
+	"sync"
 	"time"
 )
 
+// NoDelayTriggerNameError indicates that a DelayTrigger was given a state store
+// without a name under which to keep its pending trigger.
+var NoDelayTriggerNameError = errors.New(
+	"A delaytrigger with a store requires a name",
+)
+
 // DelayTrigger is a TriggerHandler that delays the execution of another
 // trigger for at least a minimum amount of time after the most recent request.
 // The obvious analogy would be a screen saver, which will start after a
 // certain period has elapsed, but the timer is reset quite often.
+//
+// DelayTrigger is safe for concurrent use. The goroutine which waits out the
+// delay is started the first time it is triggered, and runs until Stop is
+// called.
+//
+// If the DelayTrigger is given a state store (and a name under which to keep
+// its state in the store), a pending trigger outlives a restart of Pullcord:
+// when the trigger is due is kept in the store until the trigger has run, and
+// once the DelayTrigger is started again, it waits out whatever remains of
+// the delay (running the trigger right away if it is already overdue). So as
+// not to write to the store every time it is triggered, when the trigger is due
+// is only kept once it has moved on by a tenth of the delay (and when the
+// DelayTrigger is stopped), so after a crash the trigger may run that much
+// sooner, with the context it was given at the time.
 type DelayTrigger struct {
 	DelayedTrigger TriggerHandler
 	Delay time.Duration
-	c chan<- interface{}
+	Name string
+	Store store.StateStore
+	mutex sync.Mutex
+	c chan delayedContext
+	done <-chan struct{}
+	stopped bool
 }
 
 func init() {
@@ -31,6 +59,8 @@ func (d *DelayTrigger) UnmarshalJSON(input []byte) (error) {
 	var t struct {
 		DelayedTrigger config.Resource
 		Delay string
+		Name string
+		Store *config.Resource
 	}
 
 	dec := json.NewDecoder(bytes.NewReader(input))
@@ -58,6 +88,28 @@ func (d *DelayTrigger) UnmarshalJSON(input []byte) (error) {
 		d.Delay = dp
 	}
 
+	d.Name = t.Name
+	d.Store = nil
+	if t.Store != nil && t.Store.Unmarshaled != nil {
+		switch s := t.Store.Unmarshaled.(type) {
+		case store.StateStore:
+			d.Store = s
+		default:
+			log().Err(
+				fmt.Sprintf(
+					"Registry value is not a StateStore:" +
+					" %s",
+					s,
+				),
+			)
+			return config.UnexpectedResourceType
+		}
+
+		if d.Name == "" {
+			return NoDelayTriggerNameError
+		}
+	}
+
 	return nil
 }
 
@@ -66,58 +118,247 @@ func NewDelayTrigger(
 	delay time.Duration,
 ) (*DelayTrigger) {
 	return &DelayTrigger{
-		delayedTrigger,
-		delay,
-		nil,
+		DelayedTrigger: delayedTrigger,
+		Delay: delay,
 	}
 }
 
+// pendingDelayedTrigger is what a DelayTrigger keeps in its state store while
+// its trigger is pending.
+type pendingDelayedTrigger struct {
+	Due time.Time `json:"due"`
+	Context TriggerContext `json:"context"`
+}
+
+// delayedContext is the context of a request to a DelayTrigger, along with
+// when it was made (from which the delay is waited out).
+type delayedContext struct {
+	ctx TriggerContext
+	at time.Time
+}
+
+// delayKeepFraction is the fraction of the delay by which the due time of a
+// pending trigger must move on before it is kept in the state store again.
+const delayKeepFraction = 10
+
 func delaytrigger(
 	tr TriggerHandler,
 	dla time.Duration,
-	ac <-chan interface{},
+	first time.Duration,
+	ctx TriggerContext,
+	ac <-chan delayedContext,
+	done chan<- struct{},
+	keep func(pending *pendingDelayedTrigger),
 ) {
-	tmr := time.NewTimer(dla)
+	defer close(done)
+
+	due := time.Now().Add(first)
+	kept := due
+	keep(&pendingDelayedTrigger{due, ctx})
+	tmr := time.NewTimer(first)
+	pending := true
 	for {
 		select {
-		case _, ok := <-ac:
-			if tmr != nil && !tmr.Stop() {
+		case c, ok := <-ac:
+			if pending && !tmr.Stop() {
 				<-tmr.C
 			}
 			if !ok {
+				// the store is told exactly when the trigger
+				// is due, so it can be resumed
+				if pending && !due.Equal(kept) {
+					keep(&pendingDelayedTrigger{due, ctx})
+				}
 				return
-			} else {
-				tmr.Reset(dla)
 			}
+			ctx = c.ctx
+			due = c.at.Add(dla)
+			moved := due.Sub(kept)
+			if !pending || moved >= dla / delayKeepFraction {
+				kept = due
+				keep(&pendingDelayedTrigger{due, ctx})
+			}
+			tmr.Reset(due.Sub(time.Now()))
+			pending = true
 		case <-tmr.C:
-			if err := tr.Trigger(); err != nil {
+			pending = false
+			err := WithContext(tr).TriggerWith(ctx)
+			if err != nil {
 				log().Err(
 					fmt.Sprintf(
-						"delaytrigger received an",
+						"delaytrigger received an" +
 						" error: %v",
 						err,
 					),
 				)
 			}
-			tmr.Stop()
+			keep(nil)
 		}
 	}
 }
 
-// TriggerString implements the required string-based triggering function to
-// make DelayTrigger a valid TriggerHandler implementation. This function
-// effectively cancels any previous trigger and replaces it with a call using
-// only this most recent string value.
+// storeKey gives the key under which the pending trigger is kept in the state
+// store.
+func (dt *DelayTrigger) storeKey() string {
+	return "delaytrigger/" + dt.Name
+}
+
+// keep records the pending trigger in the state store (if there is one), or
+// forgets it if there is no longer a pending trigger.
+func (dt *DelayTrigger) keep(pending *pendingDelayedTrigger) {
+	if dt.Store == nil {
+		return
+	}
+
+	var err error
+	if pending == nil {
+		err = dt.Store.Delete(dt.storeKey())
+	} else {
+		err = dt.Store.Save(dt.storeKey(), pending)
+	}
+	if err != nil {
+		log().Err(
+			fmt.Sprintf(
+				"delaytrigger \"%s\" was unable to update its" +
+				" state store: %v",
+				dt.Name,
+				err,
+			),
+		)
+	}
+}
+
+// run starts the goroutine which waits out the delay, first waiting the given
+// amount of time. The mutex must be held.
+func (dt *DelayTrigger) run(first time.Duration, ctx TriggerContext) {
+	// only the most recent request matters, so one is enough
+	fc := make(chan delayedContext, 1)
+	done := make(chan struct{})
+	dt.c = fc
+	dt.done = done
+
+	go delaytrigger(
+		dt.DelayedTrigger,
+		dt.Delay,
+		first,
+		ctx,
+		fc,
+		done,
+		dt.keep,
+	)
+}
+
+// Trigger implements the required triggering function to make DelayTrigger a
+// valid TriggerHandler implementation. This function effectively cancels any
+// previous trigger and replaces it with a later one.
 func (dt *DelayTrigger) Trigger() error {
-	if dt.c == nil {
-		fc := make(chan interface{})
-		dt.c = fc
+	return dt.TriggerWith(NewTriggerContext())
+}
 
-		go delaytrigger(dt.DelayedTrigger, dt.Delay, fc)
+// TriggerWith makes DelayTrigger a valid ContextTriggerHandler implementation.
+// This function effectively cancels any previous trigger and replaces it with
+// a later one using only this most recent context. It never waits for the
+// delayed trigger, even if the delayed trigger is running.
+func (dt *DelayTrigger) TriggerWith(ctx TriggerContext) error {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+
+	if dt.stopped {
+		return TriggerStoppedError
+	}
+
+	if dt.c == nil {
+		dt.run(dt.Delay, ctx)
 	} else {
-		dt.c <-nil
+		dt.replace(delayedContext{ctx, time.Now()})
+	}
+
+	return nil
+}
+
+// replace hands the given request to the goroutine waiting out the delay
+// without waiting for it, in place of any request it hasn't yet taken (as only
+// the most recent request matters). The mutex must be held, so nothing else is
+// handing over a request at the same time, and so the send never blocks.
+func (dt *DelayTrigger) replace(c delayedContext) {
+	select {
+	case dt.c <- c:
+	default:
+		select {
+		case <-dt.c:
+		default:
+		}
+		dt.c <- c
+	}
+}
+
+// Start resumes any trigger which was still pending in the state store (if
+// there is one), making DelayTrigger a valid config.Starter implementation.
+func (dt *DelayTrigger) Start() error {
+	if dt.Store == nil {
+		return nil
+	}
+
+	var pending pendingDelayedTrigger
+	found, err := dt.Store.Load(dt.storeKey(), &pending)
+	if err != nil || !found {
+		return err
+	}
+
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+
+	if dt.stopped || dt.c != nil {
+		return nil
 	}
 
+	remaining := pending.Due.Sub(time.Now())
+	if remaining < 0 {
+		remaining = 0
+	}
+	dt.run(remaining, pending.Context)
+
+	log().Info(
+		fmt.Sprintf(
+			"delaytrigger \"%s\" resumed a pending trigger due in" +
+			" %v",
+			dt.Name,
+			remaining,
+		),
+	)
+
 	return nil
 }
 
+// Stop cancels any pending trigger and shuts down the goroutine waiting out
+// the delay, and then stops the delayed trigger if it can be stopped, making
+// DelayTrigger a valid Stopper implementation. Once stopped, triggering the
+// DelayTrigger will return TriggerStoppedError. A pending trigger is not
+// forgotten by the state store (if there is one), so it will be resumed once a
+// DelayTrigger with the same name and store is started.
+func (dt *DelayTrigger) Stop() error {
+	dt.mutex.Lock()
+	if dt.stopped {
+		dt.mutex.Unlock()
+		return nil
+	}
+	dt.stopped = true
+	done := dt.done
+	if dt.c != nil {
+		close(dt.c)
+		dt.c = nil
+	}
+	dt.mutex.Unlock()
+
+	if done != nil {
+		<-done
+	}
+
+	return stopAll(dt.DelayedTrigger)
+}
+
+// StopsReferences tells the config that stopping the DelayTrigger stops the
+// delayed trigger, making it a valid config.ReferenceStopper.
+func (dt *DelayTrigger) StopsReferences() bool {
+	return true
+}
@@ -2,28 +2,34 @@ package trigger
 
 import (
 	"github.com/stretchr/testify/assert"
+	"github.com/stuphlabs/pullcord/config"
 	configutil "github.com/stuphlabs/pullcord/config/util"
+	"github.com/stuphlabs/pullcord/store"
 	"github.com/stuphlabs/pullcord/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestDelayTriggerSingleDelay(t *testing.T) {
-	cth := &counterTriggerHandler{}
+	cth := &lockedCounterTriggerHandler{}
 
 	dt := NewDelayTrigger(cth, time.Second)
 
 	err := dt.Trigger()
 	assert.NoError(t, err)
-	assert.Equal(t, 0, cth.count)
+	assert.Equal(t, 0, cth.Count())
 
 	time.Sleep(2*time.Second)
 
-	assert.Equal(t, 1, cth.count)
+	assert.Equal(t, 1, cth.Count())
 }
 
 func TestDelayTriggerDoubleDelay(t *testing.T) {
-	cth := &counterTriggerHandler{}
+	cth := &lockedCounterTriggerHandler{}
 
 	dt := NewDelayTrigger(
 		cth,
@@ -32,25 +38,25 @@ func TestDelayTriggerDoubleDelay(t *testing.T) {
 
 	err := dt.Trigger()
 	assert.NoError(t, err)
-	assert.Equal(t, 0, cth.count)
+	assert.Equal(t, 0, cth.Count())
 
 	time.Sleep(2 * time.Second)
-	assert.Equal(t, 0, cth.count)
+	assert.Equal(t, 0, cth.Count())
 	err = dt.Trigger()
 	assert.NoError(t, err)
-	assert.Equal(t, 0, cth.count)
+	assert.Equal(t, 0, cth.Count())
 
 	time.Sleep(2 * time.Second)
 	// the trigger would have definitely fired by now if the second delay
 	// hadn't occurred when it did
-	assert.Equal(t, 0, cth.count)
+	assert.Equal(t, 0, cth.Count())
 
 	time.Sleep(2*time.Second)
-	assert.Equal(t, 1, cth.count)
+	assert.Equal(t, 1, cth.Count())
 }
 
 func TestDelayTriggerErrorMasking(t *testing.T) {
-	cth := &counterTriggerHandler{-1}
+	cth := &lockedCounterTriggerHandler{count: -1}
 
 	dt := NewDelayTrigger(
 		cth,
@@ -59,15 +65,15 @@ func TestDelayTriggerErrorMasking(t *testing.T) {
 
 	err := dt.Trigger()
 	assert.NoError(t, err)
-	assert.Equal(t, -1, cth.count)
+	assert.Equal(t, -1, cth.Count())
 
 	time.Sleep(2*time.Second)
 
-	assert.Equal(t, -1, cth.count)
+	assert.Equal(t, -1, cth.Count())
 }
 
 func TestDelayTriggerReplaceError(t *testing.T) {
-	cth := &counterTriggerHandler{-1}
+	cth := &lockedCounterTriggerHandler{count: -1}
 
 	dt := NewDelayTrigger(
 		cth,
@@ -76,29 +82,29 @@ func TestDelayTriggerReplaceError(t *testing.T) {
 
 	err := dt.Trigger()
 	assert.NoError(t, err)
-	assert.Equal(t, -1, cth.count)
+	assert.Equal(t, -1, cth.Count())
 
 	time.Sleep(2 * time.Second)
-	assert.Equal(t, -1, cth.count)
+	assert.Equal(t, -1, cth.Count())
 	err = dt.Trigger()
 	assert.NoError(t, err)
-	assert.Equal(t, -1, cth.count)
+	assert.Equal(t, -1, cth.Count())
 
 	time.Sleep(2 * time.Second)
 	// the trigger would have definitely fired by now if the second delay
 	// hadn't occurred when it did
-	assert.Equal(t, -1, cth.count)
+	assert.Equal(t, -1, cth.Count())
 
 	// removes error situation
-	cth.count = 0
-	assert.Equal(t, 0, cth.count)
+	cth.SetCount(0)
+	assert.Equal(t, 0, cth.Count())
 
 	time.Sleep(2*time.Second)
-	assert.Equal(t, 1, cth.count)
+	assert.Equal(t, 1, cth.Count())
 }
 
 func TestDelayTriggerIntroduceError(t *testing.T) {
-	cth := &counterTriggerHandler{}
+	cth := &lockedCounterTriggerHandler{}
 
 	dt := NewDelayTrigger(
 		cth,
@@ -107,25 +113,86 @@ func TestDelayTriggerIntroduceError(t *testing.T) {
 
 	err := dt.Trigger()
 	assert.NoError(t, err)
-	assert.Equal(t, 0, cth.count)
+	assert.Equal(t, 0, cth.Count())
 
 	time.Sleep(2 * time.Second)
-	assert.Equal(t, 0, cth.count)
+	assert.Equal(t, 0, cth.Count())
 	err = dt.Trigger()
 	assert.NoError(t, err)
-	assert.Equal(t, 0, cth.count)
+	assert.Equal(t, 0, cth.Count())
 
 	// introduces error situation
-	cth.count = -1
-	assert.Equal(t, -1, cth.count)
+	cth.SetCount(-1)
+	assert.Equal(t, -1, cth.Count())
 
 	time.Sleep(2 * time.Second)
 	// the trigger would have definitely fired by now if the second delay
 	// hadn't occurred when it did
-	assert.Equal(t, -1, cth.count)
+	assert.Equal(t, -1, cth.Count())
 
 	time.Sleep(2*time.Second)
-	assert.Equal(t, -1, cth.count)
+	assert.Equal(t, -1, cth.Count())
+}
+
+func TestDelayTriggerConcurrent(t *testing.T) {
+	cth := &lockedCounterTriggerHandler{}
+
+	dt := NewDelayTrigger(cth, 500 * time.Millisecond)
+
+	errs := hammer(dt, 50, 10)
+	assert.Equal(t, 0, errs)
+	assert.Equal(t, 0, cth.Count())
+
+	time.Sleep(time.Second)
+	assert.Equal(t, 1, cth.Count())
+
+	err := dt.Stop()
+	assert.NoError(t, err)
+	assert.True(t, cth.Stopped())
+}
+
+func TestDelayTriggerStop(t *testing.T) {
+	cth := &lockedCounterTriggerHandler{}
+
+	dt := NewDelayTrigger(cth, 500 * time.Millisecond)
+	var _ config.Stopper = dt
+	var _ config.ReferenceStopper = dt
+
+	err := dt.Trigger()
+	assert.NoError(t, err)
+
+	err = dt.Stop()
+	assert.NoError(t, err)
+	assert.True(t, cth.Stopped())
+
+	err = dt.Trigger()
+	assert.Equal(t, TriggerStoppedError, err)
+
+	time.Sleep(time.Second)
+	assert.Equal(t, 0, cth.Count())
+
+	err = dt.Stop()
+	assert.NoError(t, err)
+}
+
+func TestDelayTriggerRepeated(t *testing.T) {
+	cth := &lockedCounterTriggerHandler{}
+
+	dt := NewDelayTrigger(cth, 200 * time.Millisecond)
+
+	err := dt.Trigger()
+	assert.NoError(t, err)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 1, cth.Count())
+
+	// the timer has already fired, so triggering again must not wait on it
+	err = dt.Trigger()
+	assert.NoError(t, err)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 2, cth.Count())
+
+	err = dt.Stop()
+	assert.NoError(t, err)
 }
 
 func TestDelayTriggerFromConfig(t *testing.T) {
@@ -193,6 +260,37 @@ func TestDelayTriggerFromConfig(t *testing.T) {
 				Data: "42",
 				Explanation: "numeric config",
 			},
+			configutil.ConfigTestData{
+				Data: `{
+					"delayedtrigger": {
+						"type": "compoundtrigger",
+						"data": {}
+					},
+					"delay": "42s",
+					"store": {
+						"type": "jsonfilestore",
+						"data": {
+							"path": "/var/lib/pullcord/state.json"
+						}
+					}
+				}`,
+				Explanation: "store without a name",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"delayedtrigger": {
+						"type": "compoundtrigger",
+						"data": {}
+					},
+					"delay": "42s",
+					"name": "wiki",
+					"store": {
+						"type": "landingfilter",
+						"data": {}
+					}
+				}`,
+				Explanation: "non-store as store",
+			},
 		},
 		Good: []configutil.ConfigTestData{
 			configutil.ConfigTestData{
@@ -205,7 +303,197 @@ func TestDelayTriggerFromConfig(t *testing.T) {
 				}`,
 				Explanation: "valid delay trigger",
 			},
+			configutil.ConfigTestData{
+				Data: `{
+					"delayedtrigger": {
+						"type": "compoundtrigger",
+						"data": {}
+					},
+					"delay": "42s",
+					"name": "wiki",
+					"store": {
+						"type": "jsonfilestore",
+						"data": {
+							"path": "/var/lib/pullcord/state.json"
+						}
+					}
+				}`,
+				Explanation: "delay trigger with a store",
+			},
 		},
 	}
 	test.Run(t)
 }
+
+func TestDelayTriggerContext(t *testing.T) {
+	cth := &contextTriggerHandler{}
+
+	dt := NewDelayTrigger(cth, 500 * time.Millisecond)
+
+	ctx := NewTriggerContext()
+	ctx.Path = "/first"
+	err := dt.TriggerWith(ctx)
+	assert.NoError(t, err)
+
+	ctx.Path = "/second"
+	err = dt.TriggerWith(ctx)
+	assert.NoError(t, err)
+
+	time.Sleep(time.Second)
+	contexts := cth.Contexts()
+	if assert.Equal(t, 1, len(contexts)) {
+		assert.Equal(t, "/second", contexts[0].Path)
+	}
+}
+
+// TestDelayTriggerWhileRunning verifies that triggering a DelayTrigger doesn't
+// wait for its delayed trigger to finish running, and that only the most
+// recent of the contexts given in the meantime is used once it has.
+func TestDelayTriggerWhileRunning(t *testing.T) {
+	bth := newBlockingTriggerHandler(nil)
+	dt := NewDelayTrigger(bth, 50 * time.Millisecond)
+
+	err := dt.Trigger()
+	assert.NoError(t, err)
+	time.Sleep(150 * time.Millisecond)
+
+	start := time.Now()
+	for _, path := range []string{"/first", "/second", "/third"} {
+		ctx := NewTriggerContext()
+		ctx.Path = path
+		err = dt.TriggerWith(ctx)
+		assert.NoError(t, err)
+	}
+	assert.True(t, time.Since(start) < 100 * time.Millisecond)
+
+	close(bth.release)
+	time.Sleep(200 * time.Millisecond)
+	err = dt.Stop()
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(bth.contexts)) {
+		assert.Equal(t, "/third", bth.contexts[1].Path)
+	}
+}
+
+// TestDelayTriggerResume verifies that a pending trigger kept in a state store
+// is resumed by another DelayTrigger with the same name once it is started.
+func TestDelayTriggerResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullcord-delay")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := store.NewJSONFileStore(filepath.Join(dir, "state.json"))
+
+	first := &contextTriggerHandler{}
+	dt := NewDelayTrigger(first, time.Second)
+	dt.Name = "test"
+	dt.Store = s
+
+	ctx := NewTriggerContext()
+	ctx.Path = "/pending"
+	err = dt.TriggerWith(ctx)
+	assert.NoError(t, err)
+	err = dt.Stop()
+	assert.NoError(t, err)
+
+	second := &contextTriggerHandler{}
+	resumed := NewDelayTrigger(second, time.Minute)
+	resumed.Name = "test"
+	resumed.Store = s
+	err = resumed.Start()
+	assert.NoError(t, err)
+
+	// the remainder of the original delay is waited out, not the new delay
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 0, len(second.Contexts()))
+	time.Sleep(time.Second)
+	contexts := second.Contexts()
+	if assert.Equal(t, 1, len(contexts)) {
+		assert.Equal(t, "/pending", contexts[0].Path)
+	}
+	assert.Equal(t, 0, len(first.Contexts()))
+
+	// once the trigger has run, there is nothing left to resume
+	var pending pendingDelayedTrigger
+	found, err := s.Load(resumed.storeKey(), &pending)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	err = resumed.Stop()
+	assert.NoError(t, err)
+
+	// an overdue trigger is run right away
+	err = s.Save(
+		"delaytrigger/overdue",
+		pendingDelayedTrigger{Due: time.Now().Add(-time.Hour)},
+	)
+	assert.NoError(t, err)
+	overdue := NewDelayTrigger(second, time.Minute)
+	overdue.Name = "overdue"
+	overdue.Store = s
+	err = overdue.Start()
+	assert.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 2, len(second.Contexts()))
+	err = overdue.Stop()
+	assert.NoError(t, err)
+}
+
+// countingStore is a StateStore which counts the values saved to it.
+type countingStore struct {
+	store.StateStore
+	mutex sync.Mutex
+	saves int
+}
+
+func (s *countingStore) Save(key string, value interface{}) error {
+	s.mutex.Lock()
+	s.saves += 1
+	s.mutex.Unlock()
+	return s.StateStore.Save(key, value)
+}
+
+func (s *countingStore) Saves() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saves
+}
+
+// TestDelayTriggerKeepSparingly verifies that a DelayTrigger which is
+// triggered often doesn't save to its state store every time, but that the
+// store is told exactly when the trigger is due once it is stopped.
+func TestDelayTriggerKeepSparingly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullcord-delay")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := &countingStore{
+		StateStore: store.NewJSONFileStore(
+			filepath.Join(dir, "state.json"),
+		),
+	}
+
+	cth := &lockedCounterTriggerHandler{}
+	dt := NewDelayTrigger(cth, time.Minute)
+	dt.Name = "test"
+	dt.Store = s
+
+	for i := 0; i < 20; i++ {
+		err = dt.Trigger()
+		assert.NoError(t, err)
+	}
+	last := time.Now()
+	err = dt.Trigger()
+	assert.NoError(t, err)
+	// the requests are handed over without waiting for them to be taken
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, s.Saves())
+
+	err = dt.Stop()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, s.Saves())
+
+	var pending pendingDelayedTrigger
+	found, err := s.Load(dt.storeKey(), &pending)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.False(t, pending.Due.Before(last.Add(time.Minute)))
+	assert.Equal(t, 0, cth.Count())
+}
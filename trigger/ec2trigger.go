@@ -0,0 +1,328 @@
+package trigger
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/stuphlabs/pullcord/config"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ec2ApiVersion is the version of the EC2 API used by Ec2InstanceTrigger.
+const Ec2ApiVersion = "2016-11-15"
+
+const ec2Service = "ec2"
+
+// DefaultEc2Timeout is the amount of time an Ec2InstanceTrigger will wait for
+// its instances to reach the desired state if no other value is given.
+const DefaultEc2Timeout = 5 * time.Minute
+
+// DefaultEc2PollInterval is the amount of time an Ec2InstanceTrigger will wait
+// between checks of its instances' states if no other value is given.
+const DefaultEc2PollInterval = 5 * time.Second
+
+// Ec2TimeoutError indicates that the instances did not all reach the desired
+// state before the timeout.
+var Ec2TimeoutError = errors.New(
+	"Timed out waiting for the EC2 instances to reach the desired state.",
+)
+
+// Ec2InstanceTrigger is a TriggerHandler that either starts or stops a list of
+// EC2 instances (or instances provided by any service compatible with the EC2
+// API) when triggered, and then waits for all of the instances to be either
+// running or stopped (respectively). If the instances do not reach the desired
+// state within the timeout, an error is returned. A timeout of zero means that
+// the trigger returns as soon as the instances have been told to start or stop
+// without waiting at all.
+type Ec2InstanceTrigger struct {
+	AwsSettings
+	InstanceIds []string
+	Timeout time.Duration
+	PollInterval time.Duration
+	start bool
+}
+
+func init() {
+	config.RegisterResourceType(
+		"ec2starttrigger",
+		func() json.Unmarshaler {
+			return &Ec2InstanceTrigger{start: true}
+		},
+	)
+	config.RegisterResourceType(
+		"ec2stoptrigger",
+		func() json.Unmarshaler {
+			return &Ec2InstanceTrigger{start: false}
+		},
+	)
+}
+
+func (t *Ec2InstanceTrigger) UnmarshalJSON(input []byte) (error) {
+	var c struct {
+		awsSettingsConfig
+		InstanceIds []string
+		Timeout string
+		PollInterval string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&c); e != nil {
+		return e
+	}
+
+	if len(c.InstanceIds) == 0 {
+		return errors.New("An EC2 trigger requires instance IDs")
+	}
+
+	if settings, e := c.awsSettingsConfig.settings(); e != nil {
+		return e
+	} else {
+		t.AwsSettings = settings
+	}
+
+	t.Timeout = DefaultEc2Timeout
+	if c.Timeout != "" {
+		if d, e := time.ParseDuration(c.Timeout); e != nil {
+			return e
+		} else {
+			t.Timeout = d
+		}
+	}
+
+	t.PollInterval = DefaultEc2PollInterval
+	if c.PollInterval != "" {
+		if d, e := time.ParseDuration(c.PollInterval); e != nil {
+			return e
+		} else if d <= 0 {
+			return errors.New(
+				"An EC2 trigger poll interval must be" +
+				" positive",
+			)
+		} else {
+			t.PollInterval = d
+		}
+	}
+
+	t.InstanceIds = c.InstanceIds
+
+	return nil
+}
+
+// NewEc2StartTrigger constructs a new Ec2InstanceTrigger which starts the given
+// instances. The region and credentials will be taken from the environment
+// unless the AwsSettings are changed.
+func NewEc2StartTrigger(instanceIds []string) *Ec2InstanceTrigger {
+	log().Info("initializing ec2 start trigger")
+
+	return &Ec2InstanceTrigger{
+		NewAwsSettings("", ""),
+		instanceIds,
+		DefaultEc2Timeout,
+		DefaultEc2PollInterval,
+		true,
+	}
+}
+
+// NewEc2StopTrigger constructs a new Ec2InstanceTrigger which stops the given
+// instances. The region and credentials will be taken from the environment
+// unless the AwsSettings are changed.
+func NewEc2StopTrigger(instanceIds []string) *Ec2InstanceTrigger {
+	log().Info("initializing ec2 stop trigger")
+
+	return &Ec2InstanceTrigger{
+		NewAwsSettings("", ""),
+		instanceIds,
+		DefaultEc2Timeout,
+		DefaultEc2PollInterval,
+		false,
+	}
+}
+
+func (t *Ec2InstanceTrigger) names() (action, desired string) {
+	if t.start {
+		return "StartInstances", "running"
+	} else {
+		return "StopInstances", "stopped"
+	}
+}
+
+// endpoint determines the usual EC2 endpoint for the region, which will be
+// replaced in the call by any configured endpoint.
+func (t *Ec2InstanceTrigger) endpoint() (string, error) {
+	if region, e := t.region(); e != nil {
+		return "", e
+	} else {
+		return "https://ec2." + region + ".amazonaws.com/", nil
+	}
+}
+
+func (t *Ec2InstanceTrigger) params(action string) url.Values {
+	params := url.Values{}
+	params.Set("Action", action)
+	params.Set("Version", Ec2ApiVersion)
+	for i, id := range t.InstanceIds {
+		params.Set("InstanceId." + strconv.Itoa(i + 1), id)
+	}
+	return params
+}
+
+// states retrieves the current state of each of the instances.
+func (t *Ec2InstanceTrigger) states(
+	endpoint string,
+) (map[string]string, error) {
+	body, e := t.call(ec2Service, endpoint, t.params("DescribeInstances"))
+	if e != nil {
+		return nil, e
+	}
+
+	var resp struct {
+		Instances []struct {
+			InstanceId string `xml:"instanceId"`
+			State string `xml:"instanceState>name"`
+		} `xml:"reservationSet>item>instancesSet>item"`
+	}
+	if e = xml.Unmarshal(body, &resp); e != nil {
+		return nil, e
+	}
+
+	result := make(map[string]string)
+	for _, i := range resp.Instances {
+		result[i.InstanceId] = i.State
+	}
+	return result, nil
+}
+
+// Trigger starts or stops the instances and waits for them to reach the
+// desired state, implementing the TriggerHandler interface.
+func (t *Ec2InstanceTrigger) Trigger() error {
+	return t.TriggerWith(NewTriggerContext())
+}
+
+// TriggerWith starts or stops the instances and waits for them to reach the
+// desired state, implementing the ContextTriggerHandler interface. The context
+// is only used to say which service the instances were started or stopped for
+// in the logs.
+func (t *Ec2InstanceTrigger) TriggerWith(ctx TriggerContext) error {
+	action, desired := t.names()
+	log().Debug(
+		fmt.Sprintf(
+			"ec2 trigger running %s for instances%s: %v",
+			action,
+			firedFor(ctx),
+			t.InstanceIds,
+		),
+	)
+
+	endpoint, err := t.endpoint()
+	if err != nil {
+		log().Err(fmt.Sprintf("ec2 trigger failed: %v", err))
+		return err
+	}
+
+	if _, err = t.call(ec2Service, endpoint, t.params(action)); err != nil {
+		log().Err(
+			fmt.Sprintf(
+				"ec2 trigger failed during %s for instances" +
+				" %v: %v",
+				action,
+				t.InstanceIds,
+				err,
+			),
+		)
+		return err
+	}
+
+	if t.Timeout <= 0 {
+		log().Info(
+			fmt.Sprintf(
+				"ec2 trigger sent %s for instances%s: %v",
+				action,
+				firedFor(ctx),
+				t.InstanceIds,
+			),
+		)
+		return nil
+	}
+
+	deadline := time.Now().Add(t.Timeout)
+	for {
+		states, err := t.states(endpoint)
+		if err != nil {
+			log().Err(
+				fmt.Sprintf(
+					"ec2 trigger was unable to check the" +
+					" state of instances %v: %v",
+					t.InstanceIds,
+					err,
+				),
+			)
+			return err
+		}
+
+		waiting := []string{}
+		for _, id := range t.InstanceIds {
+			state := states[id]
+			if state == desired {
+				continue
+			} else if t.start && (state == "terminated" ||
+			    state == "shutting-down") {
+				err = errors.New(
+					fmt.Sprintf(
+						"EC2 instance %s cannot be" +
+						" started as it is %s",
+						id,
+						state,
+					),
+				)
+				log().Err(
+					fmt.Sprintf(
+						"ec2 trigger failed: %v",
+						err,
+					),
+				)
+				return err
+			}
+			waiting = append(waiting, id + " (" + state + ")")
+		}
+
+		if len(waiting) == 0 {
+			log().Info(
+				fmt.Sprintf(
+					"ec2 trigger found instances %v to be" +
+					" %s",
+					t.InstanceIds,
+					desired,
+				),
+			)
+			return nil
+		}
+
+		// the last check is made at the deadline, however the poll
+		// interval compares to the timeout
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			sort.Strings(waiting)
+			log().Err(
+				fmt.Sprintf(
+					"ec2 trigger timed out waiting for" +
+					" instances to be %s: %s",
+					desired,
+					strings.Join(waiting, ", "),
+				),
+			)
+			return Ec2TimeoutError
+		}
+
+		interval := t.PollInterval
+		if interval > remaining {
+			interval = remaining
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,363 @@
+package trigger
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	configutil "github.com/stuphlabs/pullcord/config/util"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEc2 is a minimal in-process stand-in for the EC2 API. Each instance
+// spends a number of DescribeInstances calls in a transitional state after
+// being started or stopped before reaching its final state.
+type fakeEc2 struct {
+	mutex sync.Mutex
+	server *httptest.Server
+	states map[string]string
+	pending map[string]int
+	transitionDelay int
+	stuck bool
+	actions []string
+}
+
+func newFakeEc2(states map[string]string) *fakeEc2 {
+	f := &fakeEc2{
+		states: states,
+		pending: make(map[string]int),
+		transitionDelay: 2,
+	}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeEc2) instanceIds(r *http.Request) []string {
+	var ids []string
+	for i := 1; ; i++ {
+		id := r.PostForm.Get(fmt.Sprintf("InstanceId.%d", i))
+		if id == "" {
+			return ids
+		}
+		ids = append(ids, id)
+	}
+}
+
+func (f *fakeEc2) writeError(w http.ResponseWriter, code string) {
+	w.WriteHeader(400)
+	fmt.Fprintf(
+		w,
+		`<Response><Errors><Error><Code>%s</Code>` +
+		`<Message>Failed</Message></Error></Errors>` +
+		`<RequestID>1</RequestID></Response>`,
+		code,
+	)
+}
+
+func (f *fakeEc2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if e := r.ParseForm(); e != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	action := r.PostForm.Get("Action")
+	f.actions = append(f.actions, action)
+	ids := f.instanceIds(r)
+	for _, id := range ids {
+		if _, present := f.states[id]; !present {
+			f.writeError(w, "InvalidInstanceID.NotFound")
+			return
+		}
+	}
+
+	switch action {
+	case "StartInstances", "StopInstances":
+		transitional := "pending"
+		if action == "StopInstances" {
+			transitional = "stopping"
+		}
+		for _, id := range ids {
+			if f.states[id] == "terminated" {
+				continue
+			}
+			f.states[id] = transitional
+			f.pending[id] = f.transitionDelay
+		}
+		fmt.Fprintf(w, "<%sResponse/>", action)
+	case "DescribeInstances":
+		sort.Strings(ids)
+		fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet>`)
+		for _, id := range ids {
+			if f.pending[id] > 0 && !f.stuck {
+				f.pending[id] -= 1
+			} else if f.pending[id] == 0 {
+				switch f.states[id] {
+				case "pending":
+					f.states[id] = "running"
+				case "stopping":
+					f.states[id] = "stopped"
+				}
+			}
+			fmt.Fprintf(
+				w,
+				`<item><instancesSet><item>` +
+				`<instanceId>%s</instanceId><instanceState>` +
+				`<name>%s</name></instanceState></item>` +
+				`</instancesSet></item>`,
+				id,
+				f.states[id],
+			)
+		}
+		fmt.Fprint(w, `</reservationSet></DescribeInstancesResponse>`)
+	default:
+		f.writeError(w, "InvalidAction")
+	}
+}
+
+// setupTestEc2Trigger points an Ec2InstanceTrigger at the fake EC2.
+func setupTestEc2Trigger(
+	f *fakeEc2,
+	trigger *Ec2InstanceTrigger,
+) *Ec2InstanceTrigger {
+	trigger.Region = "us-east-1"
+	trigger.Endpoint = f.server.URL
+	trigger.AccessKeyId = "AKID"
+	trigger.SecretAccessKey = "SECRET"
+	trigger.RetryBackoff = time.Millisecond
+	trigger.PollInterval = time.Millisecond
+	trigger.Timeout = time.Second
+	return trigger
+}
+
+func TestEc2StartTrigger(t *testing.T) {
+	f := newFakeEc2(map[string]string{
+		"i-1": "stopped",
+		"i-2": "stopped",
+		"i-3": "stopped",
+	})
+	defer f.server.Close()
+
+	err := setupTestEc2Trigger(
+		f,
+		NewEc2StartTrigger([]string{"i-1", "i-2"}),
+	).Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, "running", f.states["i-1"])
+	assert.Equal(t, "running", f.states["i-2"])
+	assert.Equal(t, "stopped", f.states["i-3"])
+	assert.Equal(t, "StartInstances", f.actions[0])
+	assert.Equal(t, "DescribeInstances", f.actions[len(f.actions) - 1])
+}
+
+func TestEc2StopTrigger(t *testing.T) {
+	f := newFakeEc2(map[string]string{
+		"i-1": "running",
+	})
+	defer f.server.Close()
+
+	et := setupTestEc2Trigger(
+		f,
+		NewEc2StopTrigger([]string{"i-1"}),
+	)
+	err := et.Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, "stopped", f.states["i-1"])
+	assert.Equal(t, "StopInstances", f.actions[0])
+
+	var closer io.Closer = et
+	err = closer.Close()
+	assert.NoError(t, err)
+}
+
+func TestEc2TriggerWith(t *testing.T) {
+	f := newFakeEc2(map[string]string{
+		"i-1": "stopped",
+	})
+	defer f.server.Close()
+
+	var handler ContextTriggerHandler = setupTestEc2Trigger(
+		f,
+		NewEc2StartTrigger([]string{"i-1"}),
+	)
+	err := handler.TriggerWith(
+		TriggerContext{Service: "web", Hook: "OnDown"},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "running", f.states["i-1"])
+	assert.Equal(t, "StartInstances", f.actions[0])
+}
+
+func TestEc2TriggerNoWait(t *testing.T) {
+	f := newFakeEc2(map[string]string{
+		"i-1": "stopped",
+	})
+	defer f.server.Close()
+
+	trigger := setupTestEc2Trigger(
+		f,
+		NewEc2StartTrigger([]string{"i-1"}),
+	)
+	trigger.Timeout = 0
+	err := trigger.Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, "pending", f.states["i-1"])
+	assert.Equal(t, []string{"StartInstances"}, f.actions)
+}
+
+func TestEc2TriggerTimeout(t *testing.T) {
+	f := newFakeEc2(map[string]string{
+		"i-1": "stopped",
+	})
+	defer f.server.Close()
+	f.stuck = true
+
+	trigger := setupTestEc2Trigger(
+		f,
+		NewEc2StartTrigger([]string{"i-1"}),
+	)
+	trigger.Timeout = 20 * time.Millisecond
+	err := trigger.Trigger()
+	assert.Equal(t, Ec2TimeoutError, err)
+	assert.Equal(t, "pending", f.states["i-1"])
+}
+
+func TestEc2TriggerTimeoutShorterThanPoll(t *testing.T) {
+	f := newFakeEc2(map[string]string{
+		"i-1": "stopped",
+	})
+	defer f.server.Close()
+	f.transitionDelay = 1
+
+	// the instance is running by the second check, which should be made
+	// at the deadline rather than after the whole poll interval
+	trigger := setupTestEc2Trigger(
+		f,
+		NewEc2StartTrigger([]string{"i-1"}),
+	)
+	trigger.PollInterval = time.Hour
+	trigger.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	err := trigger.Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, "running", f.states["i-1"])
+	assert.True(t, time.Since(start) < 5 * time.Second)
+}
+
+func TestEc2StartTriggerTerminated(t *testing.T) {
+	f := newFakeEc2(map[string]string{
+		"i-1": "terminated",
+	})
+	defer f.server.Close()
+
+	err := setupTestEc2Trigger(
+		f,
+		NewEc2StartTrigger([]string{"i-1"}),
+	).Trigger()
+	assert.Error(t, err)
+	assert.NotEqual(t, Ec2TimeoutError, err)
+}
+
+func TestEc2TriggerUnknownInstance(t *testing.T) {
+	f := newFakeEc2(map[string]string{
+		"i-1": "stopped",
+	})
+	defer f.server.Close()
+
+	err := setupTestEc2Trigger(
+		f,
+		NewEc2StartTrigger([]string{"i-1", "i-9"}),
+	).Trigger()
+	assert.Error(t, err)
+	if apiErr, ok := err.(*AwsApiError); assert.True(t, ok) {
+		assert.Equal(t, "InvalidInstanceID.NotFound", apiErr.Code)
+	}
+	assert.Equal(t, []string{"StartInstances"}, f.actions)
+}
+
+func TestEc2TriggerFromConfig(t *testing.T) {
+	for _, resourceType := range []string{
+		"ec2starttrigger",
+		"ec2stoptrigger",
+	} {
+		test := configutil.ConfigTest{
+			ResourceType: resourceType,
+			SyntacticallyBad: []configutil.ConfigTestData{
+				configutil.ConfigTestData{
+					Data: "",
+					Explanation: "empty config",
+				},
+				configutil.ConfigTestData{
+					Data: "42",
+					Explanation: "numeric config",
+				},
+				configutil.ConfigTestData{
+					Data: "{}",
+					Explanation: "empty object",
+				},
+				configutil.ConfigTestData{
+					Data: `{
+						"instanceids": []
+					}`,
+					Explanation: "no instance ids",
+				},
+				configutil.ConfigTestData{
+					Data: `{
+						"instanceids": "i-1"
+					}`,
+					Explanation: "string instance ids",
+				},
+				configutil.ConfigTestData{
+					Data: `{
+						"instanceids": ["i-1"],
+						"timeout": "42q"
+					}`,
+					Explanation: "nonsensical timeout",
+				},
+				configutil.ConfigTestData{
+					Data: `{
+						"instanceids": ["i-1"],
+						"pollinterval": "0s"
+					}`,
+					Explanation: "zero poll interval",
+				},
+				configutil.ConfigTestData{
+					Data: `{
+						"instanceids": ["i-1"],
+						"endpoint": "localhost"
+					}`,
+					Explanation: "relative endpoint",
+				},
+			},
+			Good: []configutil.ConfigTestData{
+				configutil.ConfigTestData{
+					Data: `{
+						"instanceids": ["i-1"]
+					}`,
+					Explanation: "minimal ec2 trigger",
+				},
+				configutil.ConfigTestData{
+					Data: `{
+						"instanceids": ["i-1", "i-2"],
+						"timeout": "10m",
+						"pollinterval": "15s",
+						"region": "us-west-2",
+						"endpoint": "http://localhost:5000",
+						"accesskeyid": "AKID",
+						"secretaccesskey": "SECRET",
+						"maxretries": 5,
+						"retrybackoff": "1s"
+					}`,
+					Explanation: "full ec2 trigger",
+				},
+			},
+		}
+		test.Run(t)
+	}
+}
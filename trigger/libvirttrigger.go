@@ -0,0 +1,266 @@
+package trigger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stuphlabs/pullcord/config"
+	"os/exec"
+	"strings"
+)
+
+// DefaultVirsh is the virsh command used by LibvirtTrigger if no other value is
+// given.
+const DefaultVirsh = "virsh"
+
+// LibvirtError is an error produced by a failed virsh command, which keeps the
+// error output of the command so that the reason for the failure isn't lost.
+type LibvirtError struct {
+	Action string
+	Domain string
+	Stderr string
+	Err error
+}
+
+func (e *LibvirtError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf(
+			"virsh %s of domain %s failed: %v",
+			e.Action,
+			e.Domain,
+			e.Err,
+		)
+	}
+
+	return fmt.Sprintf(
+		"virsh %s of domain %s failed: %v: %s",
+		e.Action,
+		e.Domain,
+		e.Err,
+		e.Stderr,
+	)
+}
+
+// LibvirtTrigger is a TriggerHandler that starts, shuts down, suspends, or
+// resumes a libvirt domain (using virsh) when triggered. If a connection URI
+// is given (i.e. "qemu:///system" or "qemu+ssh://kvm.example.com/system"), it
+// will be used to connect to libvirt, otherwise virsh will use its default
+// connection.
+//
+// The state of the domain is checked before the action is taken, and no action
+// is taken if the domain is already in the desired state. Starting a suspended
+// (paused) domain resumes it. If a domain is to be started while it is
+// otherwise in a transitional state, ServiceStartingError is returned so that
+// a monitor can treat the domain as starting.
+type LibvirtTrigger struct {
+	Uri string
+	Domain string
+	Action string
+	Virsh string
+}
+
+// libvirtDesiredStates maps each of the actions to the domain state it will
+// produce.
+var libvirtDesiredStates = map[string]string{
+	"start": "running",
+	"shutdown": "shut off",
+	"suspend": "paused",
+	"resume": "running",
+}
+
+func init() {
+	config.RegisterResourceType(
+		"libvirttrigger",
+		func() json.Unmarshaler {
+			return new(LibvirtTrigger)
+		},
+	)
+}
+
+func (l *LibvirtTrigger) UnmarshalJSON(input []byte) (error) {
+	var t struct {
+		Uri string
+		Domain string
+		Action string
+		Virsh string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	if t.Domain == "" {
+		return errors.New("libvirttrigger requires a domain")
+	}
+
+	if _, present := libvirtDesiredStates[t.Action]; !present {
+		return errors.New(
+			fmt.Sprintf(
+				"libvirttrigger action must be one of start," +
+				" shutdown, suspend, or resume, not: %s",
+				t.Action,
+			),
+		)
+	}
+
+	l.Uri = t.Uri
+	l.Domain = t.Domain
+	l.Action = t.Action
+	l.Virsh = t.Virsh
+	if l.Virsh == "" {
+		l.Virsh = DefaultVirsh
+	}
+
+	return nil
+}
+
+// NewLibvirtTrigger constructs a new LibvirtTrigger which takes the given
+// action (one of "start", "shutdown", "suspend", or "resume") on the named
+// domain over the given connection URI (which may be empty).
+func NewLibvirtTrigger(uri, domain, action string) *LibvirtTrigger {
+	log().Info("initializing libvirt trigger")
+
+	return &LibvirtTrigger{
+		uri,
+		domain,
+		action,
+		DefaultVirsh,
+	}
+}
+
+// virsh runs a single virsh command against the domain, returning its output.
+func (l *LibvirtTrigger) virsh(command string) (string, error) {
+	var args []string
+	if l.Uri != "" {
+		args = append(args, "-c", l.Uri)
+	}
+	args = append(args, command, l.Domain)
+
+	virsh := l.Virsh
+	if virsh == "" {
+		virsh = DefaultVirsh
+	}
+
+	cmd := exec.Command(virsh, args...)
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if e := cmd.Run(); e != nil {
+		return "", &LibvirtError{
+			command,
+			l.Domain,
+			strings.TrimSpace(stderr.String()),
+			e,
+		}
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// State retrieves the current state of the domain as reported by virsh (i.e.
+// "running", "paused", or "shut off").
+func (l *LibvirtTrigger) State() (string, error) {
+	return l.virsh("domstate")
+}
+
+// Trigger takes the action on the domain, implementing the TriggerHandler
+// interface.
+func (l *LibvirtTrigger) Trigger() error {
+	return l.TriggerWith(NewTriggerContext())
+}
+
+// TriggerWith takes the action on the domain, implementing the
+// ContextTriggerHandler interface. The context is only used to say which
+// service the action was taken for in the logs.
+func (l *LibvirtTrigger) TriggerWith(ctx TriggerContext) error {
+	log().Debug(
+		fmt.Sprintf(
+			"libvirttrigger running %s%s for domain: %s",
+			l.Action,
+			firedFor(ctx),
+			l.Domain,
+		),
+	)
+
+	desired, present := libvirtDesiredStates[l.Action]
+	if !present {
+		log().Err(
+			fmt.Sprintf(
+				"libvirttrigger has an unknown action: %s",
+				l.Action,
+			),
+		)
+		return errors.New(
+			fmt.Sprintf("Unknown libvirt action: %s", l.Action),
+		)
+	}
+
+	state, err := l.State()
+	if err != nil {
+		log().Err(
+			fmt.Sprintf(
+				"libvirttrigger was unable to get the state of" +
+				" domain %s: %v",
+				l.Domain,
+				err,
+			),
+		)
+		return err
+	}
+
+	// An idle domain is running, but is blocked on a resource.
+	if state == "idle" {
+		state = "running"
+	}
+
+	if state == desired {
+		log().Info(
+			fmt.Sprintf(
+				"libvirttrigger found domain %s to already be" +
+				" %s",
+				l.Domain,
+				state,
+			),
+		)
+		return nil
+	}
+
+	action := l.Action
+	if l.Action == "start" && state == "paused" {
+		action = "resume"
+	} else if l.Action == "start" && state != "shut off" &&
+		state != "crashed" {
+		log().Info(
+			fmt.Sprintf(
+				"libvirttrigger cannot start domain %s as it" +
+				" is %s, so it is considered to be starting",
+				l.Domain,
+				state,
+			),
+		)
+		return ServiceStartingError
+	}
+
+	if _, err = l.virsh(action); err != nil {
+		log().Err(
+			fmt.Sprintf(
+				"libvirttrigger failed during trigger: %v",
+				err,
+			),
+		)
+		return err
+	}
+
+	log().Info(
+		fmt.Sprintf(
+			"libvirttrigger sent %s to domain %s%s",
+			action,
+			l.Domain,
+			firedFor(ctx),
+		),
+	)
+	return nil
+}
@@ -0,0 +1,301 @@
+package trigger
+
+import (
+	"github.com/stretchr/testify/assert"
+	configutil "github.com/stuphlabs/pullcord/config/util"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakeVirshScript is a stand-in for virsh which keeps the state of a single
+// domain named "web" in a file and appends each of its invocations to a log.
+const fakeVirshScript = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" >> "$dir/log"
+if [ "$1" = "-c" ]; then
+	shift 2
+fi
+if [ "$2" != "web" ]; then
+	echo "error: failed to get domain '$2'" >&2
+	exit 1
+fi
+state=$(cat "$dir/state")
+case "$1" in
+domstate)
+	echo "$state"
+	echo
+	;;
+start)
+	if [ "$state" != "shut off" ]; then
+		echo "error: Domain is already active" >&2
+		exit 1
+	fi
+	echo "running" > "$dir/state"
+	;;
+shutdown)
+	echo "shut off" > "$dir/state"
+	;;
+suspend)
+	echo "paused" > "$dir/state"
+	;;
+resume)
+	if [ "$state" != "paused" ]; then
+		echo "error: Requested operation is not valid" >&2
+		exit 1
+	fi
+	echo "running" > "$dir/state"
+	;;
+*)
+	exit 2
+	;;
+esac
+`
+
+// setupFakeVirsh is a testing helper function that creates a fake virsh with a
+// domain in the given state, returning the directory it was created in.
+func setupFakeVirsh(t *testing.T, state string) string {
+	dir, err := ioutil.TempDir("/tmp", "test_libvirt_trigger")
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(dir + "/virsh", []byte(fakeVirshScript), 0755)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(dir + "/state", []byte(state + "\n"), 0644)
+	assert.NoError(t, err)
+	return dir
+}
+
+// readFakeVirsh is a testing helper function that gives the current state of
+// the fake domain and the invocations of the fake virsh.
+func readFakeVirsh(t *testing.T, dir string) (string, []string) {
+	state, err := ioutil.ReadFile(dir + "/state")
+	assert.NoError(t, err)
+	log, err := ioutil.ReadFile(dir + "/log")
+	if err != nil && !os.IsNotExist(err) {
+		assert.NoError(t, err)
+	}
+	return strings.TrimSpace(string(state)),
+		strings.Split(strings.TrimSpace(string(log)), "\n")
+}
+
+func TestLibvirtTriggerActions(t *testing.T) {
+	type testCase struct {
+		action string
+		initial string
+		final string
+		calls []string
+	}
+
+	testCases := []testCase{
+		testCase{
+			"start",
+			"shut off",
+			"running",
+			[]string{
+				"-c test:///default domstate web",
+				"-c test:///default start web",
+			},
+		},
+		testCase{
+			"start",
+			"running",
+			"running",
+			[]string{
+				"-c test:///default domstate web",
+			},
+		},
+		testCase{
+			"shutdown",
+			"running",
+			"shut off",
+			[]string{
+				"-c test:///default domstate web",
+				"-c test:///default shutdown web",
+			},
+		},
+		testCase{
+			"suspend",
+			"running",
+			"paused",
+			[]string{
+				"-c test:///default domstate web",
+				"-c test:///default suspend web",
+			},
+		},
+		testCase{
+			"resume",
+			"paused",
+			"running",
+			[]string{
+				"-c test:///default domstate web",
+				"-c test:///default resume web",
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		dir := setupFakeVirsh(t, c.initial)
+		defer goRemoveAll(dir)
+
+		trigger := NewLibvirtTrigger("test:///default", "web", c.action)
+		trigger.Virsh = dir + "/virsh"
+		err := trigger.Trigger()
+		assert.NoError(t, err)
+
+		state, calls := readFakeVirsh(t, dir)
+		assert.Equal(t, c.final, state)
+		assert.Equal(t, c.calls, calls)
+	}
+}
+
+func TestLibvirtTriggerStartSuspended(t *testing.T) {
+	dir := setupFakeVirsh(t, "paused")
+	defer goRemoveAll(dir)
+
+	trigger := NewLibvirtTrigger("", "web", "start")
+	trigger.Virsh = dir + "/virsh"
+	err := trigger.Trigger()
+	assert.NoError(t, err)
+
+	state, calls := readFakeVirsh(t, dir)
+	assert.Equal(t, "running", state)
+	assert.Equal(t, []string{"domstate web", "resume web"}, calls)
+}
+
+func TestLibvirtTriggerWith(t *testing.T) {
+	dir := setupFakeVirsh(t, "shut off")
+	defer goRemoveAll(dir)
+
+	trigger := NewLibvirtTrigger("", "web", "start")
+	trigger.Virsh = dir + "/virsh"
+	var handler ContextTriggerHandler = trigger
+	err := handler.TriggerWith(TriggerContext{Service: "web"})
+	assert.NoError(t, err)
+
+	state, calls := readFakeVirsh(t, dir)
+	assert.Equal(t, "running", state)
+	assert.Equal(t, []string{"domstate web", "start web"}, calls)
+}
+
+func TestLibvirtTriggerStartTransitional(t *testing.T) {
+	dir := setupFakeVirsh(t, "in shutdown")
+	defer goRemoveAll(dir)
+
+	trigger := NewLibvirtTrigger("", "web", "start")
+	trigger.Virsh = dir + "/virsh"
+	err := trigger.Trigger()
+	assert.Equal(t, ServiceStartingError, err)
+
+	state, calls := readFakeVirsh(t, dir)
+	assert.Equal(t, "in shutdown", state)
+	assert.Equal(t, []string{"domstate web"}, calls)
+}
+
+func TestLibvirtTriggerUnknownDomain(t *testing.T) {
+	dir := setupFakeVirsh(t, "shut off")
+	defer goRemoveAll(dir)
+
+	trigger := NewLibvirtTrigger("", "db", "start")
+	trigger.Virsh = dir + "/virsh"
+	err := trigger.Trigger()
+	assert.Error(t, err)
+	if virshErr, ok := err.(*LibvirtError); assert.True(t, ok) {
+		assert.Equal(t, "domstate", virshErr.Action)
+		assert.Equal(t, "db", virshErr.Domain)
+		assert.Equal(
+			t,
+			"error: failed to get domain 'db'",
+			virshErr.Stderr,
+		)
+	}
+	assert.Contains(t, err.Error(), "failed to get domain 'db'")
+}
+
+func TestLibvirtTriggerFailedAction(t *testing.T) {
+	dir := setupFakeVirsh(t, "shut off")
+	defer goRemoveAll(dir)
+
+	trigger := NewLibvirtTrigger("", "web", "resume")
+	trigger.Virsh = dir + "/virsh"
+	err := trigger.Trigger()
+	if virshErr, ok := err.(*LibvirtError); assert.True(t, ok) {
+		assert.Equal(t, "resume", virshErr.Action)
+		assert.Equal(
+			t,
+			"error: Requested operation is not valid",
+			virshErr.Stderr,
+		)
+	}
+}
+
+func TestLibvirtTriggerMissingVirsh(t *testing.T) {
+	trigger := NewLibvirtTrigger("", "web", "start")
+	trigger.Virsh = "/nonexistent/virsh"
+	err := trigger.Trigger()
+	assert.Error(t, err)
+}
+
+func TestLibvirtTriggerFromConfig(t *testing.T) {
+	test := configutil.ConfigTest{
+		ResourceType: "libvirttrigger",
+		SyntacticallyBad: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: "",
+				Explanation: "empty config",
+			},
+			configutil.ConfigTestData{
+				Data: "42",
+				Explanation: "numeric config",
+			},
+			configutil.ConfigTestData{
+				Data: "{}",
+				Explanation: "empty object",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"action": "start"
+				}`,
+				Explanation: "missing domain",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"domain": "web"
+				}`,
+				Explanation: "missing action",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"domain": "web",
+					"action": "reboot"
+				}`,
+				Explanation: "unknown action",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"domain": 7,
+					"action": "start"
+				}`,
+				Explanation: "numeric domain",
+			},
+		},
+		Good: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: `{
+					"domain": "web",
+					"action": "start"
+				}`,
+				Explanation: "minimal libvirt trigger",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"uri": "qemu+ssh://kvm.example.com/system",
+					"domain": "web",
+					"action": "shutdown",
+					"virsh": "/usr/local/bin/virsh"
+				}`,
+				Explanation: "full libvirt trigger",
+			},
+		},
+	}
+	test.Run(t)
+}
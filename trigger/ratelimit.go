@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/stuphlabs/pullcord/config"
+	"sync"
 	"time"
 )
 
@@ -16,11 +17,12 @@ var RateLimitExceededError = errors.New("Rate limit exceeded for trigger.")
 
 // RateLimitTrigger is a TriggerHandler that will prevent a guarded trigger
 // from being called more than a specified number of times over a specified
-// duration.
+// duration. RateLimitTrigger is safe for concurrent use.
 type RateLimitTrigger struct {
 	GuardedTrigger TriggerHandler
 	MaxAllowed uint
 	Period time.Duration
+	mutex sync.Mutex
 	previousTriggers []time.Time
 }
 
@@ -76,36 +78,59 @@ func NewRateLimitTrigger(
 	period time.Duration,
 ) (*RateLimitTrigger) {
 	return &RateLimitTrigger{
-		guardedTrigger,
-		maxAllowed,
-		period,
-		nil,
+		GuardedTrigger: guardedTrigger,
+		MaxAllowed: maxAllowed,
+		Period: period,
 	}
 }
 
-// TriggerString implements the required string-based triggering function to
-// make RateLimitTrigger a valid TriggerHandler implementation. If the rate
-// limit is exceeded, RateLimitExceededError will be returned, and the guarded
-// trigger will not be called.
+// Trigger implements the required triggering function to make
+// RateLimitTrigger a valid TriggerHandler implementation. If the rate limit is
+// exceeded, RateLimitExceededError will be returned, and the guarded trigger
+// will not be called.
 func (rlt *RateLimitTrigger) Trigger() error {
-	now := time.Now()
-
-	if rlt.previousTriggers != nil {
-		for len(
-			rlt.previousTriggers,
-		) > 0 && now.After(rlt.previousTriggers[0].Add(rlt.Period)) {
-			rlt.previousTriggers = rlt.previousTriggers[1:]
-		}
-
-		if uint(len(rlt.previousTriggers)) >= rlt.MaxAllowed {
-			return RateLimitExceededError
-		}
-	} else {
-		rlt.previousTriggers = make([]time.Time, rlt.MaxAllowed)
+	return rlt.TriggerWith(NewTriggerContext())
+}
+
+// TriggerWith passes the context along to the guarded trigger (as long as the
+// rate limit has not been exceeded), making RateLimitTrigger a valid
+// ContextTriggerHandler implementation.
+func (rlt *RateLimitTrigger) TriggerWith(ctx TriggerContext) error {
+	if !rlt.allow(time.Now()) {
+		return RateLimitExceededError
+	}
+
+	return WithContext(rlt.GuardedTrigger).TriggerWith(ctx)
+}
+
+// allow records a trigger at the given time unless doing so would exceed the
+// rate limit, and reports whether it was recorded.
+func (rlt *RateLimitTrigger) allow(now time.Time) bool {
+	rlt.mutex.Lock()
+	defer rlt.mutex.Unlock()
+
+	for len(
+		rlt.previousTriggers,
+	) > 0 && now.After(rlt.previousTriggers[0].Add(rlt.Period)) {
+		rlt.previousTriggers = rlt.previousTriggers[1:]
+	}
+
+	if uint(len(rlt.previousTriggers)) >= rlt.MaxAllowed {
+		return false
 	}
 
 	rlt.previousTriggers = append(rlt.previousTriggers, now)
+	return true
+}
 
-	return rlt.GuardedTrigger.Trigger()
+// Stop stops the guarded trigger if it can be stopped, making
+// RateLimitTrigger a valid Stopper implementation.
+func (rlt *RateLimitTrigger) Stop() error {
+	return stopAll(rlt.GuardedTrigger)
 }
 
+// StopsReferences tells the config that stopping the RateLimitTrigger stops
+// the guarded trigger, making it a valid config.ReferenceStopper.
+func (rlt *RateLimitTrigger) StopsReferences() bool {
+	return true
+}
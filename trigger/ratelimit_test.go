@@ -28,6 +28,38 @@ func TestRateLimit(t *testing.T) {
 	assert.Equal(t, 2, cth.count)
 }
 
+func TestRateLimitContext(t *testing.T) {
+	cth := &contextTriggerHandler{}
+
+	rlt := NewRateLimitTrigger(cth, 1, time.Second)
+
+	ctx := NewTriggerContext()
+	ctx.Service = "wiki"
+	err := rlt.TriggerWith(ctx)
+	assert.NoError(t, err)
+
+	err = rlt.TriggerWith(ctx)
+	assert.Equal(t, RateLimitExceededError, err)
+
+	if assert.Equal(t, 1, len(cth.contexts)) {
+		assert.Equal(t, "wiki", cth.contexts[0].Service)
+	}
+}
+
+func TestRateLimitConcurrent(t *testing.T) {
+	cth := &lockedCounterTriggerHandler{}
+
+	rlt := NewRateLimitTrigger(cth, 100, time.Minute)
+
+	errs := hammer(rlt, 50, 10)
+	assert.Equal(t, 400, errs)
+	assert.Equal(t, 100, cth.Count())
+
+	err := rlt.Stop()
+	assert.NoError(t, err)
+	assert.True(t, cth.Stopped())
+}
+
 func TestRateLimitTriggerFromConfig(t *testing.T) {
 	util.LoadPlugin()
 	test := configutil.ConfigTest{
@@ -3,18 +3,104 @@ package trigger
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/stuphlabs/pullcord/config"
+	"io"
+	"os"
 	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// DefaultShellTimeout is the amount of time a ShellTriggerHandler will allow
+// its command to run if no other value is given.
+const DefaultShellTimeout = time.Minute
+
+// DefaultShellMaxOutput is the number of bytes of each of stdout and stderr
+// which a ShellTriggerHandler will keep if no other value is given.
+const DefaultShellMaxOutput = 64 * 1024
+
+// DefaultShellInheritEnv is the list of environment variables which a
+// ShellTriggerHandler passes along to its command if no other list is given.
+var DefaultShellInheritEnv = []string{
+	"HOME",
+	"LANG",
+	"LC_ALL",
+	"LOGNAME",
+	"PATH",
+	"SHELL",
+	"TMPDIR",
+	"TZ",
+	"USER",
+}
+
+// ShellTimeoutError indicates that the command did not finish before the
+// timeout, and so it (and anything else in its process group) was killed.
+var ShellTimeoutError = errors.New(
+	"The shell trigger command timed out and was killed.",
+)
+
+// ShellCommandError is the error given when the command of a
+// ShellTriggerHandler fails. The exit code is -1 if the command did not exit
+// normally, and the (possibly truncated) stderr of the command is kept so that
+// the reason for the failure isn't lost.
+type ShellCommandError struct {
+	ExitCode int
+	Stderr string
+	Err error
+}
+
+func (e *ShellCommandError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf(
+			"shell trigger command failed with exit code %d: %v",
+			e.ExitCode,
+			e.Err,
+		)
+	}
+
+	return fmt.Sprintf(
+		"shell trigger command failed with exit code %d: %v: %s",
+		e.ExitCode,
+		e.Err,
+		e.Stderr,
+	)
+}
+
 // ShellTriggerHandler is a basic TriggerHandler that calls a stored shell
 // command (along with arguments) when triggered.
 //
-// The message given to TriggerString will be passed to the command via stdin.
+// The context of the trigger is passed to the command via stdin as a JSON
+// object, and is also available in the environment variables PULLCORD_SERVICE,
+// PULLCORD_HOOK, PULLCORD_TIME, PULLCORD_CLIENT_IP, PULLCORD_HOST, and
+// PULLCORD_PATH.
+//
+// Only the environment variables named in InheritEnv (or in
+// DefaultShellInheritEnv if InheritEnv is nil) are passed along from the
+// environment of pullcord (all of them are if the list contains "*"), along
+// with any variables given in Env. The command is run in Dir (if given) as
+// User and Group (if given, which requires sufficient privileges). The command
+// is started in its own process group, and the whole group is killed if the
+// command runs for longer than the timeout. Anything the command leaves running
+// once it exits (such as a daemon it starts) is left alone, even if it still
+// has the output of the command open. Only the first MaxOutput bytes (or
+// DefaultShellMaxOutput bytes if MaxOutput is zero) of each of stdout and
+// stderr are kept.
 type ShellTriggerHandler struct {
 	Command string
 	Args []string
+	Timeout time.Duration
+	Env map[string]string
+	InheritEnv []string
+	Dir string
+	User string
+	Group string
+	MaxOutput int
 }
 
 func init() {
@@ -35,6 +121,13 @@ func (s *ShellTriggerHandler) UnmarshalJSON(input []byte) (error) {
 	var t struct {
 		Command string
 		Args []string
+		Timeout string
+		Env map[string]string
+		InheritEnv []string
+		Dir string
+		User string
+		Group string
+		MaxOutput *int
 	}
 
 	dec := json.NewDecoder(bytes.NewReader(input))
@@ -42,22 +135,387 @@ func (s *ShellTriggerHandler) UnmarshalJSON(input []byte) (error) {
 		return e
 	}
 
+	s.Timeout = DefaultShellTimeout
+	if t.Timeout != "" {
+		if d, e := time.ParseDuration(t.Timeout); e != nil {
+			return e
+		} else if d <= 0 {
+			return errors.New(
+				"shelltrigger timeout must be positive",
+			)
+		} else {
+			s.Timeout = d
+		}
+	}
+
+	s.MaxOutput = DefaultShellMaxOutput
+	if t.MaxOutput != nil {
+		if *t.MaxOutput < 0 {
+			return errors.New(
+				"shelltrigger max output must not be negative",
+			)
+		}
+		s.MaxOutput = *t.MaxOutput
+	}
+
+	s.InheritEnv = DefaultShellInheritEnv
+	if t.InheritEnv != nil {
+		s.InheritEnv = t.InheritEnv
+	}
+
 	s.Command = t.Command
 	s.Args = t.Args
+	s.Env = t.Env
+	s.Dir = t.Dir
+	s.User = t.User
+	s.Group = t.Group
 
 	return nil
 }
 
-// TriggerString for the ShellTriggerHandler is an implementation of the
-// TriggerString function required by all TriggerHandler instances.
-//
-// In this case, the message will be passed to the command via stdin.
+// contextEnv gives the environment variables describing a trigger context.
+func contextEnv(ctx TriggerContext) []string {
+	var t string
+	if !ctx.Time.IsZero() {
+		t = ctx.Time.Format(time.RFC3339)
+	}
+
+	return []string{
+		"PULLCORD_SERVICE=" + ctx.Service,
+		"PULLCORD_HOOK=" + ctx.Hook,
+		"PULLCORD_TIME=" + t,
+		"PULLCORD_CLIENT_IP=" + ctx.ClientIP,
+		"PULLCORD_HOST=" + ctx.Host,
+		"PULLCORD_PATH=" + ctx.Path,
+	}
+}
+
+// env gives the full environment of the command for the given context.
+func (handler *ShellTriggerHandler) env(ctx TriggerContext) []string {
+	var result []string
+	inherit := handler.InheritEnv
+	if inherit == nil {
+		inherit = DefaultShellInheritEnv
+	}
+	inherited := make(map[string]bool)
+	for _, name := range inherit {
+		inherited[name] = true
+	}
+	for _, v := range os.Environ() {
+		name := strings.SplitN(v, "=", 2)[0]
+		if inherited["*"] || inherited[name] {
+			result = append(result, v)
+		}
+	}
+
+	for name, value := range handler.Env {
+		result = append(result, name + "=" + value)
+	}
+
+	return append(result, contextEnv(ctx)...)
+}
+
+// lookupUser finds the user ID (and primary group ID) for a user name or ID.
+func lookupUser(name string) (uid, gid uint32, e error) {
+	u, e := user.Lookup(name)
+	if e != nil {
+		if _, numErr := strconv.ParseUint(name, 10, 32); numErr != nil {
+			return 0, 0, e
+		} else if u, e = user.LookupId(name); e != nil {
+			return 0, 0, e
+		}
+	}
+
+	uid64, e := strconv.ParseUint(u.Uid, 10, 32)
+	if e != nil {
+		return 0, 0, e
+	}
+	gid64, e := strconv.ParseUint(u.Gid, 10, 32)
+	if e != nil {
+		return 0, 0, e
+	}
+	return uint32(uid64), uint32(gid64), nil
+}
+
+// lookupGroup finds the group ID for a group name or ID.
+func lookupGroup(name string) (uint32, error) {
+	g, e := user.LookupGroup(name)
+	if e != nil {
+		if _, numErr := strconv.ParseUint(name, 10, 32); numErr != nil {
+			return 0, e
+		} else if g, e = user.LookupGroupId(name); e != nil {
+			return 0, e
+		}
+	}
+
+	gid, e := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(gid), e
+}
+
+// credential determines the user and group the command should be run as, or
+// nil if the command should be run as the same user as pullcord.
+func (handler *ShellTriggerHandler) credential() (
+	*syscall.Credential,
+	error,
+) {
+	if handler.User == "" && handler.Group == "" {
+		return nil, nil
+	}
+
+	cred := &syscall.Credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+
+	if handler.User != "" {
+		uid, gid, e := lookupUser(handler.User)
+		if e != nil {
+			return nil, e
+		}
+		cred.Uid = uid
+		cred.Gid = gid
+	}
+
+	if handler.Group != "" {
+		gid, e := lookupGroup(handler.Group)
+		if e != nil {
+			return nil, e
+		}
+		cred.Gid = gid
+	}
+
+	return cred, nil
+}
+
+// cappedBuffer keeps only the first max bytes written to it, while still
+// accepting (and discarding) everything after that. It may be written to while
+// it is being read (by something the command left running).
+type cappedBuffer struct {
+	mutex sync.Mutex
+	buf bytes.Buffer
+	max int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if remaining := b.max - b.buf.Len(); remaining < len(p) {
+		b.truncated = true
+		if remaining > 0 {
+			b.buf.Write(p[:remaining])
+		}
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.truncated {
+		return b.buf.String() + "... (truncated)"
+	}
+	return b.buf.String()
+}
+
+// shellOutputDelay is how long the rest of the output of a command is waited
+// for once the command has exited.
+const shellOutputDelay = 100 * time.Millisecond
+
+// collect makes a pipe for output of a command, copying everything written to
+// it into the given buffer. It gives the end of the pipe to be written to, and
+// a channel which is closed once everything written to the pipe has been
+// copied.
+func collect(buf *cappedBuffer) (*os.File, <-chan struct{}, error) {
+	r, w, e := os.Pipe()
+	if e != nil {
+		return nil, nil, e
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(buf, r)
+		r.Close()
+	}()
+
+	return w, done, nil
+}
+
+// waitOutput waits a short while for the output of a command to be collected,
+// reporting whether it was.
+func waitOutput(done <-chan struct{}) bool {
+	timer := time.NewTimer(shellOutputDelay)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// exitCode determines the exit code of a failed command, which is -1 if the
+// command did not exit normally.
+func exitCode(e error) int {
+	if exitErr, ok := e.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
+
+// Trigger for the ShellTriggerHandler is an implementation of the Trigger
+// function required by all TriggerHandler instances.
 func (handler *ShellTriggerHandler) Trigger() (err error) {
+	return handler.TriggerWith(NewTriggerContext())
+}
+
+// TriggerWith runs the command with the given context, making the
+// ShellTriggerHandler a valid ContextTriggerHandler.
+//
+// In this case, the context will be passed to the command via stdin and the
+// environment.
+func (handler *ShellTriggerHandler) TriggerWith(
+	ctx TriggerContext,
+) (err error) {
 	log().Debug("shelltrigger running trigger")
+	input, err := json.Marshal(ctx)
+	if err != nil {
+		log().Err(
+			fmt.Sprintf(
+				"shelltrigger was unable to encode the trigger" +
+				" context: %v",
+				err,
+			),
+		)
+		return err
+	}
+
+	cred, err := handler.credential()
+	if err != nil {
+		log().Err(
+			fmt.Sprintf(
+				"shelltrigger was unable to find the user or" +
+				" group to run as: %v",
+				err,
+			),
+		)
+		return err
+	}
+
 	cmd := exec.Command(handler.Command, handler.Args...)
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-	err = cmd.Run()
+	cmd.Env = handler.env(ctx)
+	cmd.Dir = handler.Dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+		Credential: cred,
+	}
+
+	// The pipes are made here rather than by exec, as cmd.Wait would wait
+	// for the output to be closed, which doesn't happen until everything
+	// the command started has exited (and so a command which starts a
+	// daemon would seem to run until the timeout).
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	maxOutput := handler.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = DefaultShellMaxOutput
+	}
+	stdout := &cappedBuffer{max: maxOutput}
+	stdoutW, stdoutDone, err := collect(stdout)
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return err
+	}
+	stderr := &cappedBuffer{max: maxOutput}
+	stderrW, stderrDone, err := collect(stderr)
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		stdoutW.Close()
+		return err
+	}
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+
+	err = cmd.Start()
+	// the command has its own copies of these now (if it was started)
+	stdinR.Close()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdinW.Close()
+		log().Err(
+			fmt.Sprintf(
+				"shelltrigger was unable to start the command:" +
+				" %v",
+				err,
+			),
+		)
+		return err
+	}
+
+	go func() {
+		stdinW.Write(append(input, '\n'))
+		stdinW.Close()
+	}()
+
+	timeout := handler.Timeout
+	if timeout <= 0 {
+		timeout = DefaultShellTimeout
+	}
+
+	// Only the command itself is waited for, not the output.
+	done := make(chan error, 1)
+	go func() {
+		state, err := cmd.Process.Wait()
+		if err == nil && !state.Success() {
+			err = &exec.ExitError{ProcessState: state}
+		}
+		done <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	select {
+	case err = <-done:
+		timer.Stop()
+	case <-timer.C:
+		// Killing the negated process ID kills the whole process
+		// group, so nothing started by the command is left behind.
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		waitOutput(stderrDone)
+		log().Err(
+			fmt.Sprintf(
+				"shelltrigger command timed out after %v and" +
+				" was killed, stderr: %s",
+				timeout,
+				stderr.String(),
+			),
+		)
+		return ShellTimeoutError
+	}
+
+	// Whatever the command started is left alone once the command has
+	// exited, even if it still has the output open.
+	if !waitOutput(stdoutDone) || !waitOutput(stderrDone) {
+		log().Debug(
+			"shelltrigger command exited, but left something" +
+			" running which still has its output open",
+		)
+	}
+
 	log().Debug(
 		fmt.Sprintf(
 			"shelltrigger command wrote to stdout: %s",
@@ -65,13 +523,18 @@ func (handler *ShellTriggerHandler) Trigger() (err error) {
 		),
 	)
 	if err != nil {
+		cmdErr := &ShellCommandError{
+			exitCode(err),
+			strings.TrimSpace(stderr.String()),
+			err,
+		}
 		log().Err(
 			fmt.Sprintf(
 				"shelltrigger failed during trigger: %v",
-				err,
+				cmdErr,
 			),
 		)
-		return err
+		return cmdErr
 	} else {
 		log().Info("shelltrigger trigger sent")
 		return nil
@@ -79,11 +542,11 @@ func (handler *ShellTriggerHandler) Trigger() (err error) {
 }
 
 // NewShellTriggerHandler constructs a new ShellTriggerHandler given the
-// command (and arguments) to be run each time TriggerString is called. Entire
-// shell scripts could potentially be stored in the arguments, though the
-// trigger could just as easily call an external shell script. As a result, a
-// wide variety of actions could be taken based on the message passed in via
-// stdin.
+// command (and arguments) to be run each time Trigger is called. Entire shell
+// scripts could potentially be stored in the arguments, though the trigger
+// could just as easily call an external shell script. As a result, a wide
+// variety of actions could be taken based on the context passed in via stdin
+// and the environment.
 func NewShellTriggerHandler(
 	command string,
 	args []string,
@@ -100,6 +563,9 @@ func NewShellTriggerHandler(
 	var handler ShellTriggerHandler
 	handler.Command = command
 	handler.Args = args
+	handler.Timeout = DefaultShellTimeout
+	handler.InheritEnv = DefaultShellInheritEnv
+	handler.MaxOutput = DefaultShellMaxOutput
 
 	return &handler
 }
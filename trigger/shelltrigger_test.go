@@ -1,11 +1,15 @@
 package trigger
 
 import (
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	configutil "github.com/stuphlabs/pullcord/config/util"
 	"io/ioutil"
 	"os"
+	"os/user"
+	"strings"
 	"testing"
+	"time"
 )
 
 func goRemoveAll(dir string) {
@@ -38,6 +42,47 @@ func TestShellTriggerTee(t *testing.T) {
 	assert.Equal(t, testMessage, string(data))
 }
 
+func TestShellTriggerContext(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("/tmp", "test_shell_trigger")
+	defer goRemoveAll(tmpdir)
+	assert.NoError(t, err)
+	testArgs := []string{
+		"-c",
+		`cat > ` + tmpdir + `/stdin;` +
+		` printf "%s %s %s %s %s"` +
+		` "$PULLCORD_SERVICE" "$PULLCORD_HOOK" "$PULLCORD_CLIENT_IP"` +
+		` "$PULLCORD_HOST" "$PULLCORD_PATH" > ` + tmpdir + `/env`,
+	}
+
+	ctx := NewTriggerContext()
+	ctx.Service = "wiki"
+	ctx.Hook = "OnDown"
+	ctx.ClientIP = "192.0.2.1"
+	ctx.Host = "wiki.example.com"
+	ctx.Path = "/index"
+
+	handler := NewShellTriggerHandler("/bin/sh", testArgs)
+	err = handler.TriggerWith(ctx)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(tmpdir + "/env")
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		"wiki OnDown 192.0.2.1 wiki.example.com /index",
+		string(data),
+	)
+
+	data, err = ioutil.ReadFile(tmpdir + "/stdin")
+	assert.NoError(t, err)
+	var input TriggerContext
+	err = json.Unmarshal(data, &input)
+	assert.NoError(t, err)
+	assert.Equal(t, "wiki", input.Service)
+	assert.Equal(t, "/index", input.Path)
+	assert.True(t, ctx.Time.Equal(input.Time))
+}
+
 func TestShellTriggerFail(t *testing.T) {
 	testCommand := "["
 	testArgs := []string{"1", "-eq", "0"}
@@ -48,6 +93,179 @@ func TestShellTriggerFail(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestShellTriggerFailureDetail(t *testing.T) {
+	handler := NewShellTriggerHandler(
+		"/bin/sh",
+		[]string{
+			"-c",
+			"echo starting; echo no such domain >&2; exit 3",
+		},
+	)
+	err := handler.Trigger()
+
+	if cmdErr, ok := err.(*ShellCommandError); assert.True(t, ok) {
+		assert.Equal(t, 3, cmdErr.ExitCode)
+		assert.Equal(t, "no such domain", cmdErr.Stderr)
+	}
+	assert.Contains(t, err.Error(), "exit code 3")
+}
+
+func TestShellTriggerTimeout(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("/tmp", "test_shell_trigger")
+	defer goRemoveAll(tmpdir)
+	assert.NoError(t, err)
+
+	// The background sleep is in the same process group, and so should be
+	// killed along with the shell, or else the marker file would appear.
+	handler := NewShellTriggerHandler(
+		"/bin/sh",
+		[]string{
+			"-c",
+			"(sleep 1; touch " + tmpdir + "/marker) & sleep 10",
+		},
+	)
+	handler.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	err = handler.Trigger()
+	assert.Equal(t, ShellTimeoutError, err)
+	assert.True(t, time.Since(start) < 5 * time.Second)
+
+	time.Sleep(1500 * time.Millisecond)
+	_, err = os.Stat(tmpdir + "/marker")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestShellTriggerBackground(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("/tmp", "test_shell_trigger")
+	defer goRemoveAll(tmpdir)
+	assert.NoError(t, err)
+
+	// The background sleep still has stdout open once the shell has
+	// exited, but the trigger should neither wait for it nor kill it.
+	handler := NewShellTriggerHandler(
+		"/bin/sh",
+		[]string{
+			"-c",
+			"(sleep 1; touch " + tmpdir + "/marker) & echo started",
+		},
+	)
+	handler.Timeout = 5 * time.Second
+
+	start := time.Now()
+	err = handler.Trigger()
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	time.Sleep(1500 * time.Millisecond)
+	_, err = os.Stat(tmpdir + "/marker")
+	assert.NoError(t, err)
+}
+
+func TestShellTriggerEnvAndDir(t *testing.T) {
+	defer restoreEnv("PULLCORD_TEST_SECRET")()
+	setenv(t, "PULLCORD_TEST_SECRET", "hunter2")
+
+	tmpdir, err := ioutil.TempDir("/tmp", "test_shell_trigger")
+	defer goRemoveAll(tmpdir)
+	assert.NoError(t, err)
+
+	testArgs := []string{
+		"-c",
+		`printf "%s|%s|%s|%s" "$PULLCORD_TEST_SECRET" "$EXTRA"` +
+		` "$PULLCORD_SERVICE" "$(pwd)" > out`,
+	}
+
+	handler := NewShellTriggerHandler("/bin/sh", testArgs)
+	handler.Dir = tmpdir
+	handler.Env = map[string]string{"EXTRA": "value"}
+	ctx := NewTriggerContext()
+	ctx.Service = "wiki"
+	err = handler.TriggerWith(ctx)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(tmpdir + "/out")
+	assert.NoError(t, err)
+	assert.Equal(t, "|value|wiki|" + tmpdir, string(data))
+
+	handler.InheritEnv = []string{"*"}
+	err = handler.TriggerWith(ctx)
+	assert.NoError(t, err)
+
+	data, err = ioutil.ReadFile(tmpdir + "/out")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2|value|wiki|" + tmpdir, string(data))
+}
+
+func TestShellTriggerZeroValueDefaults(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("/tmp", "test_shell_trigger")
+	defer goRemoveAll(tmpdir)
+	assert.NoError(t, err)
+
+	// A handler which wasn't made by NewShellTriggerHandler or from a
+	// config should still inherit the default environment and keep the
+	// default amount of output.
+	handler := &ShellTriggerHandler{
+		Command: "/bin/sh",
+		Args: []string{
+			"-c",
+			`printf "%s" "$PATH" > ` + tmpdir + `/path;` +
+			` echo no such domain >&2; exit 3`,
+		},
+	}
+	err = handler.Trigger()
+
+	if cmdErr, ok := err.(*ShellCommandError); assert.True(t, ok) {
+		assert.Equal(t, 3, cmdErr.ExitCode)
+		assert.Equal(t, "no such domain", cmdErr.Stderr)
+	}
+
+	data, err := ioutil.ReadFile(tmpdir + "/path")
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getenv("PATH"), string(data))
+}
+
+func TestShellTriggerUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running as another user requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("there is no nobody user")
+	}
+
+	handler := NewShellTriggerHandler(
+		"/bin/sh",
+		[]string{"-c", `[ "$(id -u)" = "` + nobody.Uid + `" ]`},
+	)
+	err = handler.Trigger()
+	assert.Error(t, err)
+
+	handler.User = "nobody"
+	err = handler.Trigger()
+	assert.NoError(t, err)
+
+	handler.User = "no-such-user-for-pullcord"
+	err = handler.Trigger()
+	assert.Error(t, err)
+}
+
+func TestCappedBuffer(t *testing.T) {
+	b := &cappedBuffer{max: 5}
+	n, err := b.Write([]byte("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, "abc", b.String())
+
+	n, err = b.Write([]byte("defgh"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	n, err = b.Write([]byte("ijk"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.True(t, strings.HasPrefix(b.String(), "abcde..."))
+}
+
 func TestShellTriggerFromConfig(t *testing.T) {
 	test := configutil.ConfigTest{
 		ResourceType: "shelltrigger",
@@ -94,6 +312,34 @@ func TestShellTriggerFromConfig(t *testing.T) {
 				}`,
 				Explanation: "numeric array args",
 			},
+			configutil.ConfigTestData{
+				Data: `{
+					"command": "echo",
+					"timeout": "0s"
+				}`,
+				Explanation: "zero timeout",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"command": "echo",
+					"timeout": "42q"
+				}`,
+				Explanation: "nonsensical timeout",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"command": "echo",
+					"env": ["FOO=bar"]
+				}`,
+				Explanation: "array env",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"command": "echo",
+					"maxoutput": -1
+				}`,
+				Explanation: "negative max output",
+			},
 			configutil.ConfigTestData{
 				Data: "42",
 				Explanation: "numeric config",
@@ -124,6 +370,27 @@ func TestShellTriggerFromConfig(t *testing.T) {
 				}`,
 				Explanation: "basic valid compound trigger",
 			},
+			configutil.ConfigTestData{
+				Data: `{
+					"command": "/usr/local/bin/start-wiki",
+					"args": [
+						"--fast"
+					],
+					"timeout": "5m",
+					"env": {
+						"WIKI_ENV": "production"
+					},
+					"inheritenv": [
+						"PATH",
+						"AWS_PROFILE"
+					],
+					"dir": "/srv/wiki",
+					"user": "wiki",
+					"group": "wiki",
+					"maxoutput": 4096
+				}`,
+				Explanation: "full shell trigger",
+			},
 		},
 	}
 	test.Run(t)
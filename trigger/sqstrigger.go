@@ -1,21 +1,221 @@
 package trigger
 
 import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
-	// "github.com/stuphlabs/pullcord"
+	"fmt"
+	"github.com/stuphlabs/pullcord/config"
+	"net/url"
+	"sort"
+	"strconv"
 )
 
+// SqsApiVersion is the version of the SQS API used by SqsTriggerHandler.
+const SqsApiVersion = "2012-11-05"
+
+// SqsTriggerHandler is a TriggerHandler that sends a message to an SQS queue
+// (or to a queue provided by any service compatible with the SQS API) when
+// triggered. The message has a body and an optional set of string message
+// attributes, each of which is a text/template filled in with the
+// TriggerContext (as with WebhookTrigger).
 type SqsTriggerHandler struct {
-	url string
+	AwsSettings
+	QueueUrl string
+	MessageBody string
+	MessageAttributes map[string]string
+}
+
+func init() {
+	config.RegisterResourceType(
+		"sqstrigger",
+		func() json.Unmarshaler {
+			return new(SqsTriggerHandler)
+		},
+	)
+}
+
+func (s *SqsTriggerHandler) UnmarshalJSON(input []byte) (error) {
+	var t struct {
+		awsSettingsConfig
+		QueueUrl string
+		MessageBody string
+		MessageAttributes map[string]string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	if t.QueueUrl == "" {
+		return errors.New("sqstrigger requires a queue URL")
+	} else if u, e := url.Parse(t.QueueUrl); e != nil {
+		return e
+	} else if u.Scheme == "" || u.Host == "" {
+		return errors.New(
+			fmt.Sprintf(
+				"sqstrigger queue URL must be an absolute" +
+				" URL: %s",
+				t.QueueUrl,
+			),
+		)
+	}
+
+	if settings, e := t.awsSettingsConfig.settings(); e != nil {
+		return e
+	} else {
+		s.AwsSettings = settings
+	}
+
+	if _, e := newContextTemplate("body", t.MessageBody); e != nil {
+		return e
+	}
+	for name, value := range t.MessageAttributes {
+		if _, e := newContextTemplate(name, value); e != nil {
+			return e
+		}
+	}
+
+	s.QueueUrl = t.QueueUrl
+	s.MessageBody = t.MessageBody
+	s.MessageAttributes = t.MessageAttributes
+
+	return nil
+}
+
+// NewSqsTriggerHandler constructs a new SqsTriggerHandler which will send the
+// given message body to the given queue URL. The region and credentials will
+// be taken from the environment unless the AwsSettings are changed.
+func NewSqsTriggerHandler(
+	queueUrl string,
+	messageBody string,
+	messageAttributes map[string]string,
+) *SqsTriggerHandler {
+	log().Info("initializing sqs trigger handler")
+
+	return &SqsTriggerHandler{
+		NewAwsSettings("", ""),
+		queueUrl,
+		messageBody,
+		messageAttributes,
+	}
 }
 
-func (handler *SqsTriggerHandler) Trigger(message string) (err error) {
-	return errors.New("Not yet implemented")
+// renderContextTemplate fills in a template with the given context.
+func renderContextTemplate(
+	name string,
+	text string,
+	ctx TriggerContext,
+) (string, error) {
+	tmpl, e := newContextTemplate(name, text)
+	if e != nil {
+		return "", e
+	}
+
+	var result bytes.Buffer
+	if e = tmpl.Execute(&result, ctx); e != nil {
+		return "", e
+	}
+	return result.String(), nil
 }
 
-func NewSqsTriggerHandler(url string) *SqsTriggerHandler {
-	var handler SqsTriggerHandler
-	handler.url = url
+// params produces the parameters of the SendMessage call for the given
+// context.
+func (handler *SqsTriggerHandler) params(
+	ctx TriggerContext,
+) (url.Values, error) {
+	body, e := renderContextTemplate("body", handler.MessageBody, ctx)
+	if e != nil {
+		return nil, e
+	}
+
+	params := url.Values{}
+	params.Set("Action", "SendMessage")
+	params.Set("Version", SqsApiVersion)
+	params.Set("MessageBody", body)
+
+	names := make([]string, 0, len(handler.MessageAttributes))
+	for name := range handler.MessageAttributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		value, e := renderContextTemplate(
+			name,
+			handler.MessageAttributes[name],
+			ctx,
+		)
+		if e != nil {
+			return nil, e
+		}
+
+		prefix := "MessageAttribute." + strconv.Itoa(i + 1)
+		params.Set(prefix + ".Name", name)
+		params.Set(prefix + ".Value.DataType", "String")
+		params.Set(prefix + ".Value.StringValue", value)
+	}
+
+	return params, nil
+}
+
+// Trigger sends the message to the queue, implementing the TriggerHandler
+// interface.
+func (handler *SqsTriggerHandler) Trigger() error {
+	return handler.TriggerWith(NewTriggerContext())
+}
+
+// TriggerWith sends the message filled in with the given context to the
+// queue, implementing the ContextTriggerHandler interface.
+func (handler *SqsTriggerHandler) TriggerWith(ctx TriggerContext) error {
+	log().Debug("sqstrigger running trigger")
+
+	params, err := handler.params(ctx)
+	if err != nil {
+		log().Err(
+			fmt.Sprintf(
+				"sqstrigger was unable to render the message" +
+				" for %s: %v",
+				handler.QueueUrl,
+				err,
+			),
+		)
+		return err
+	}
+
+	body, err := handler.call("sqs", handler.QueueUrl, params)
+	if err != nil {
+		log().Err(
+			fmt.Sprintf(
+				"sqstrigger failed to send message to %s: %v",
+				handler.QueueUrl,
+				err,
+			),
+		)
+		return err
+	}
+
+	var resp struct {
+		MessageId string `xml:"SendMessageResult>MessageId"`
+	}
+	if err = xml.Unmarshal(body, &resp); err != nil {
+		log().Warning(
+			fmt.Sprintf(
+				"sqstrigger was unable to parse the response" +
+				" from %s: %v",
+				handler.QueueUrl,
+				err,
+			),
+		)
+	}
 
-	return &handler
+	log().Info(
+		fmt.Sprintf(
+			"sqstrigger sent message %s to %s",
+			resp.MessageId,
+			handler.QueueUrl,
+		),
+	)
+	return nil
 }
@@ -0,0 +1,290 @@
+package trigger
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	configutil "github.com/stuphlabs/pullcord/config/util"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSqs is a minimal in-process stand-in for the SQS API which records the
+// messages it receives. It can be told to throttle a number of requests before
+// accepting any.
+type fakeSqs struct {
+	mutex sync.Mutex
+	server *httptest.Server
+	throttle int
+	errorCode string
+	requests int
+	messages []url.Values
+	authorizations []string
+}
+
+func newFakeSqs() *fakeSqs {
+	f := &fakeSqs{}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeSqs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.requests += 1
+
+	if e := r.ParseForm(); e != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	if f.throttle > 0 {
+		f.throttle -= 1
+		w.WriteHeader(400)
+		fmt.Fprint(
+			w,
+			`<ErrorResponse><Error><Type>Sender</Type>` +
+			`<Code>Throttling</Code><Message>Rate exceeded` +
+			`</Message></Error></ErrorResponse>`,
+		)
+		return
+	}
+
+	if f.errorCode != "" {
+		w.WriteHeader(400)
+		fmt.Fprintf(
+			w,
+			`<ErrorResponse><Error><Type>Sender</Type>` +
+			`<Code>%s</Code><Message>Failed</Message></Error>` +
+			`</ErrorResponse>`,
+			f.errorCode,
+		)
+		return
+	}
+
+	if r.PostForm.Get("Action") != "SendMessage" {
+		w.WriteHeader(400)
+		return
+	}
+
+	f.messages = append(f.messages, r.PostForm)
+	f.authorizations = append(
+		f.authorizations,
+		r.Header.Get("Authorization"),
+	)
+	fmt.Fprintf(
+		w,
+		`<SendMessageResponse><SendMessageResult>` +
+		`<MessageId>message-%d</MessageId></SendMessageResult>` +
+		`</SendMessageResponse>`,
+		len(f.messages),
+	)
+}
+
+// newTestSqsTrigger creates an SqsTriggerHandler that sends to the fake SQS.
+func newTestSqsTrigger(f *fakeSqs) *SqsTriggerHandler {
+	sqs := NewSqsTriggerHandler(
+		"https://sqs.us-east-1.amazonaws.com/123456789012/pullcord",
+		"start",
+		map[string]string{
+			"service": "wiki",
+			"action": "start",
+		},
+	)
+	sqs.Region = "us-east-1"
+	sqs.Endpoint = f.server.URL
+	sqs.AccessKeyId = "AKID"
+	sqs.SecretAccessKey = "SECRET"
+	sqs.RetryBackoff = time.Millisecond
+	return sqs
+}
+
+func TestSqsTriggerSend(t *testing.T) {
+	f := newFakeSqs()
+	defer f.server.Close()
+
+	err := newTestSqsTrigger(f).Trigger()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, len(f.messages))
+	if len(f.messages) == 1 {
+		m := f.messages[0]
+		assert.Equal(t, "start", m.Get("MessageBody"))
+		assert.Equal(t, "action", m.Get("MessageAttribute.1.Name"))
+		assert.Equal(
+			t,
+			"start",
+			m.Get("MessageAttribute.1.Value.StringValue"),
+		)
+		assert.Equal(t, "service", m.Get("MessageAttribute.2.Name"))
+		assert.Equal(
+			t,
+			"wiki",
+			m.Get("MessageAttribute.2.Value.StringValue"),
+		)
+		assert.Equal(
+			t,
+			"String",
+			m.Get("MessageAttribute.2.Value.DataType"),
+		)
+		assert.True(
+			t,
+			strings.HasPrefix(
+				f.authorizations[0],
+				"AWS4-HMAC-SHA256 Credential=AKID/",
+			),
+		)
+		assert.Contains(
+			t,
+			f.authorizations[0],
+			"/us-east-1/sqs/aws4_request",
+		)
+	}
+}
+
+func TestSqsTriggerContext(t *testing.T) {
+	f := newFakeSqs()
+	defer f.server.Close()
+
+	sqs := newTestSqsTrigger(f)
+	sqs.MessageBody = `{"service": {{json .Service}}}`
+	sqs.MessageAttributes = map[string]string{"hook": "{{.Hook}}"}
+
+	ctx := NewTriggerContext()
+	ctx.Service = "wiki"
+	ctx.Hook = "OnDown"
+	err := sqs.TriggerWith(ctx)
+	assert.NoError(t, err)
+
+	if assert.Equal(t, 1, len(f.messages)) {
+		m := f.messages[0]
+		assert.Equal(t, `{"service": "wiki"}`, m.Get("MessageBody"))
+		assert.Equal(t, "hook", m.Get("MessageAttribute.1.Name"))
+		assert.Equal(
+			t,
+			"OnDown",
+			m.Get("MessageAttribute.1.Value.StringValue"),
+		)
+	}
+}
+
+func TestSqsTriggerThrottled(t *testing.T) {
+	f := newFakeSqs()
+	defer f.server.Close()
+	f.throttle = 2
+
+	err := newTestSqsTrigger(f).Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, f.requests)
+	assert.Equal(t, 1, len(f.messages))
+}
+
+func TestSqsTriggerThrottledTooLong(t *testing.T) {
+	f := newFakeSqs()
+	defer f.server.Close()
+	f.throttle = 10
+
+	sqs := newTestSqsTrigger(f)
+	sqs.MaxRetries = 2
+	err := sqs.Trigger()
+	assert.Error(t, err)
+	assert.Equal(t, 3, f.requests)
+	assert.Equal(t, 0, len(f.messages))
+	if apiErr, ok := err.(*AwsApiError); assert.True(t, ok) {
+		assert.Equal(t, "Throttling", apiErr.Code)
+	}
+}
+
+func TestSqsTriggerNonRetryableError(t *testing.T) {
+	f := newFakeSqs()
+	defer f.server.Close()
+	f.errorCode = "AWS.SimpleQueueService.NonExistentQueue"
+
+	err := newTestSqsTrigger(f).Trigger()
+	assert.Error(t, err)
+	assert.Equal(t, 1, f.requests)
+}
+
+func TestSqsTriggerFromConfig(t *testing.T) {
+	test := configutil.ConfigTest{
+		ResourceType: "sqstrigger",
+		SyntacticallyBad: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: "",
+				Explanation: "empty config",
+			},
+			configutil.ConfigTestData{
+				Data: "42",
+				Explanation: "numeric config",
+			},
+			configutil.ConfigTestData{
+				Data: "{}",
+				Explanation: "empty object",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"queueurl": "not/absolute"
+				}`,
+				Explanation: "relative queue url",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"queueurl": "https://sqs.example.com/1/q",
+					"messageattributes": ["a"]
+				}`,
+				Explanation: "array message attributes",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"queueurl": "https://sqs.example.com/1/q",
+					"messagebody": "{{.Service"
+				}`,
+				Explanation: "bad message body template",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"queueurl": "https://sqs.example.com/1/q",
+					"retrybackoff": "42q"
+				}`,
+				Explanation: "nonsensical retry backoff",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"queueurl": "https://sqs.example.com/1/q",
+					"endpoint": "localhost"
+				}`,
+				Explanation: "relative endpoint",
+			},
+		},
+		Good: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: `{
+					"queueurl": "https://sqs.example.com/1/q"
+				}`,
+				Explanation: "minimal sqs trigger",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"queueurl": "https://sqs.example.com/1/q",
+					"messagebody": "start",
+					"messageattributes": {
+						"service": "wiki"
+					},
+					"region": "us-west-2",
+					"endpoint": "http://localhost:9324",
+					"accesskeyid": "AKID",
+					"secretaccesskey": "SECRET",
+					"maxretries": 5,
+					"retrybackoff": "1s"
+				}`,
+				Explanation: "full sqs trigger",
+			},
+		},
+	}
+	test.Run(t)
+}
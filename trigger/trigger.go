@@ -1,20 +1,122 @@
 package trigger
 
 import (
+	"errors"
+	"fmt"
 	// "github.com/stuphlabs/pullcord"
+	"time"
 )
 
+// ServiceStartingError indicates that a trigger could not act because the
+// service is in a transitional state (i.e. it is suspended or paused, or it is
+// still in the middle of starting or stopping). A monitor should treat the
+// service as starting rather than as having encountered a hard error.
+var ServiceStartingError = errors.New(
+	"The service is in a transitional state and is not yet ready.",
+)
+
+// TriggerStoppedError indicates that a trigger has been stopped, and so it
+// will not run again.
+var TriggerStoppedError = errors.New("The trigger has been stopped.")
+
 // TriggerHandler is an abstract interface describing a system which provides
 // triggers that can be called based on certain events (like a service being
 // detected as down, an amount of time passing without a service being
-// accessed, etc.). For the moment, the only trigger mechanism provided is a
-// simple string being passed in, and although additional trigger mechanisms
-// could be added later, it is not yet clear that others would be necessary.
+// accessed, etc.).
 //
-// TriggerString is a function that provides a trigger mechanism based on an
-// arbitrary string. A minimal amount of additional structure could be achieved
-// through the use of serialization format like JSON.
+// Trigger fires the trigger without any information about why it was fired.
+// Triggers which can make use of that information should also implement
+// ContextTriggerHandler.
 type TriggerHandler interface {
 	Trigger() (err error)
 }
 
+// TriggerContext describes the circumstances under which a trigger was fired:
+// the name of the service, which hook of the service fired the trigger (i.e.
+// "OnDown", "OnUp", or "Always"), the time, and some details of the request
+// which caused it. Any of these may be empty if they are not known.
+type TriggerContext struct {
+	Service string `json:"service"`
+	Hook string `json:"hook"`
+	Time time.Time `json:"time"`
+	ClientIP string `json:"clientip"`
+	Host string `json:"host"`
+	Path string `json:"path"`
+}
+
+// NewTriggerContext creates a TriggerContext for the current time with nothing
+// else filled in, which is what a trigger fired through the Trigger function
+// receives.
+func NewTriggerContext() TriggerContext {
+	return TriggerContext{Time: time.Now()}
+}
+
+// firedFor describes the service (and hook) for which a trigger was fired, as
+// given by its context, for use in log messages. It is empty if the service
+// isn't known.
+func firedFor(ctx TriggerContext) string {
+	if ctx.Service == "" {
+		return ""
+	} else if ctx.Hook == "" {
+		return fmt.Sprintf(" for service \"%s\"", ctx.Service)
+	}
+	return fmt.Sprintf(
+		" for the %s hook of service \"%s\"",
+		ctx.Hook,
+		ctx.Service,
+	)
+}
+
+// ContextTriggerHandler is a TriggerHandler which can make use of the context
+// under which it was fired. Calling Trigger on a ContextTriggerHandler should
+// be the same as calling TriggerWith with a context from NewTriggerContext.
+type ContextTriggerHandler interface {
+	TriggerHandler
+	TriggerWith(ctx TriggerContext) (err error)
+}
+
+// contextAdapter allows a TriggerHandler which knows nothing of contexts to be
+// used as a ContextTriggerHandler.
+type contextAdapter struct {
+	TriggerHandler
+}
+
+func (a contextAdapter) TriggerWith(ctx TriggerContext) error {
+	return a.Trigger()
+}
+
+// WithContext gives a ContextTriggerHandler for any TriggerHandler. If the
+// TriggerHandler is already a ContextTriggerHandler, it is returned as is,
+// otherwise it is wrapped in an adapter which ignores the context.
+func WithContext(t TriggerHandler) ContextTriggerHandler {
+	if ct, ok := t.(ContextTriggerHandler); ok {
+		return ct
+	}
+	return contextAdapter{t}
+}
+
+// Stopper is implemented by triggers which can be shut down, such as those
+// which keep goroutines running in the background. Stop should not return
+// until those goroutines have finished, and a trigger which wraps other
+// triggers should stop them as well. Triggering a stopped trigger should
+// return TriggerStoppedError (or simply do nothing).
+//
+// A Stopper is also a valid config.Stopper. As a wrapped trigger may be
+// stopped both by its wrapper and by the config it came from, stopping a
+// trigger which has already been stopped should do nothing.
+type Stopper interface {
+	Stop() (err error)
+}
+
+// stopAll stops each of the given triggers which implements Stopper, returning
+// the first error encountered (though every trigger is stopped regardless).
+func stopAll(triggers ...TriggerHandler) (err error) {
+	for _, t := range triggers {
+		if s, ok := t.(Stopper); ok {
+			if e := s.Stop(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
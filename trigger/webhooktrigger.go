@@ -0,0 +1,342 @@
+package trigger
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stuphlabs/pullcord/config"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+)
+
+// DefaultWebhookTimeout is the amount of time allowed for each attempt to call
+// a webhook if no other value is given.
+const DefaultWebhookTimeout = 10 * time.Second
+
+// DefaultWebhookRetries is the number of times a failed webhook call will be
+// retried if no other value is given.
+const DefaultWebhookRetries = 2
+
+// DefaultWebhookRetryBackoff is the amount of time waited before the first
+// retry of a webhook call if no other value is given. Each later retry waits
+// twice as long as the one before.
+const DefaultWebhookRetryBackoff = 500 * time.Millisecond
+
+// DefaultWebhookSignatureHeader is the header in which the signature of the
+// request body is sent if a secret is given but no header is.
+const DefaultWebhookSignatureHeader = "X-Pullcord-Signature"
+
+// maxWebhookErrorBody is the most of a failed response body which will be kept
+// in a WebhookResponseError.
+const maxWebhookErrorBody = 512
+
+// WebhookResponseError indicates that a webhook responded with a status other
+// than 2xx.
+type WebhookResponseError struct {
+	StatusCode int
+	Body string
+}
+
+func (e *WebhookResponseError) Error() string {
+	return fmt.Sprintf(
+		"Webhook responded with HTTP status %d: %s",
+		e.StatusCode,
+		e.Body,
+	)
+}
+
+// retryable determines whether the failed call which produced this error is
+// worth trying again.
+func (e *WebhookResponseError) retryable() bool {
+	return e.StatusCode == 429 || e.StatusCode >= 500
+}
+
+// contextTemplateFuncs are the functions available to the templates which are
+// filled in with a TriggerContext, in addition to the usual text/template
+// functions. The json function allows a value to be safely included in a JSON
+// document.
+var contextTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, e := json.Marshal(v)
+		return string(b), e
+	},
+}
+
+// newContextTemplate parses a template which will be filled in with a
+// TriggerContext.
+func newContextTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(contextTemplateFuncs).Parse(text)
+}
+
+// WebhookTrigger is a TriggerHandler that sends an HTTP request (i.e. to a chat
+// service, a workflow tool, or an orchestrator) when triggered. The body of
+// the request is produced by a text/template, which is filled in with the
+// TriggerContext (so {{.Service}}, {{.Hook}}, {{.Time}}, {{.ClientIP}},
+// {{.Host}}, and {{.Path}} are available) and has a json function for quoting
+// values.
+//
+// Any response with a status other than 2xx is an error. Failed requests are
+// retried with an exponential backoff, unless the response was a client error
+// (other than 429). If a secret is given, an HMAC-SHA256 signature of the body
+// is sent in a header as "sha256=" followed by the hex encoded signature.
+type WebhookTrigger struct {
+	Method string
+	Url string
+	Headers map[string]string
+	Body *template.Template
+	Timeout time.Duration
+	Retries uint
+	RetryBackoff time.Duration
+	Secret string
+	SignatureHeader string
+}
+
+func init() {
+	config.RegisterResourceType(
+		"webhooktrigger",
+		func() json.Unmarshaler {
+			return new(WebhookTrigger)
+		},
+	)
+}
+
+func (w *WebhookTrigger) UnmarshalJSON(input []byte) (error) {
+	var t struct {
+		Method string
+		Url string
+		Headers map[string]string
+		Body string
+		Timeout string
+		Retries *uint
+		RetryBackoff string
+		Secret string
+		SignatureHeader string
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	if e := dec.Decode(&t); e != nil {
+		return e
+	}
+
+	if t.Url == "" {
+		return errors.New("webhooktrigger requires a URL")
+	} else if u, e := url.Parse(t.Url); e != nil {
+		return e
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New(
+			fmt.Sprintf(
+				"webhooktrigger URL must be an absolute HTTP" +
+				" or HTTPS URL: %s",
+				t.Url,
+			),
+		)
+	}
+
+	body, e := newContextTemplate("body", t.Body)
+	if e != nil {
+		return e
+	}
+
+	w.Method = "POST"
+	if t.Method != "" {
+		w.Method = t.Method
+	}
+
+	w.Timeout = DefaultWebhookTimeout
+	if t.Timeout != "" {
+		if d, e := time.ParseDuration(t.Timeout); e != nil {
+			return e
+		} else if d <= 0 {
+			return errors.New(
+				"webhooktrigger timeout must be positive",
+			)
+		} else {
+			w.Timeout = d
+		}
+	}
+
+	w.Retries = DefaultWebhookRetries
+	if t.Retries != nil {
+		w.Retries = *t.Retries
+	}
+
+	w.RetryBackoff = DefaultWebhookRetryBackoff
+	if t.RetryBackoff != "" {
+		if d, e := time.ParseDuration(t.RetryBackoff); e != nil {
+			return e
+		} else {
+			w.RetryBackoff = d
+		}
+	}
+
+	w.SignatureHeader = t.SignatureHeader
+	if t.Secret != "" && t.SignatureHeader == "" {
+		w.SignatureHeader = DefaultWebhookSignatureHeader
+	}
+
+	w.Url = t.Url
+	w.Headers = t.Headers
+	w.Body = body
+	w.Secret = t.Secret
+
+	return nil
+}
+
+// NewWebhookTrigger constructs a new WebhookTrigger which sends a request with
+// the given method to the given URL, with a body produced by the given
+// template text. The headers, secret, and retry behavior can be changed after
+// construction.
+func NewWebhookTrigger(
+	method string,
+	rawUrl string,
+	body string,
+) (*WebhookTrigger, error) {
+	log().Info("initializing webhook trigger")
+
+	tmpl, err := newContextTemplate("body", body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookTrigger{
+		method,
+		rawUrl,
+		make(map[string]string),
+		tmpl,
+		DefaultWebhookTimeout,
+		DefaultWebhookRetries,
+		DefaultWebhookRetryBackoff,
+		"",
+		DefaultWebhookSignatureHeader,
+	}, nil
+}
+
+// sign produces the value of the signature header for the given body.
+func (w *WebhookTrigger) sign(body []byte) string {
+	h := hmac.New(sha256.New, []byte(w.Secret))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// render produces the body of the request.
+func (w *WebhookTrigger) render(ctx TriggerContext) ([]byte, error) {
+	var body bytes.Buffer
+	if w.Body != nil {
+		if e := w.Body.Execute(&body, ctx); e != nil {
+			return nil, e
+		}
+	}
+	return body.Bytes(), nil
+}
+
+// send makes a single attempt to call the webhook.
+func (w *WebhookTrigger) send(body []byte) error {
+	method := w.Method
+	if method == "" {
+		method = "POST"
+	}
+
+	req, e := http.NewRequest(method, w.Url, bytes.NewReader(body))
+	if e != nil {
+		return e
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	if w.Secret != "" {
+		header := w.SignatureHeader
+		if header == "" {
+			header = DefaultWebhookSignatureHeader
+		}
+		req.Header.Set(header, w.sign(body))
+	}
+
+	client := http.Client{Timeout: w.Timeout}
+	resp, e := client.Do(req)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(
+			io.LimitReader(resp.Body, maxWebhookErrorBody),
+		)
+		return &WebhookResponseError{resp.StatusCode, string(respBody)}
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// Trigger calls the webhook, implementing the TriggerHandler interface.
+func (w *WebhookTrigger) Trigger() error {
+	return w.TriggerWith(NewTriggerContext())
+}
+
+// TriggerWith calls the webhook with a body filled in with the given context,
+// implementing the ContextTriggerHandler interface.
+func (w *WebhookTrigger) TriggerWith(ctx TriggerContext) error {
+	log().Debug(fmt.Sprintf("webhooktrigger calling %s", w.Url))
+
+	body, err := w.render(ctx)
+	if err != nil {
+		log().Err(
+			fmt.Sprintf(
+				"webhooktrigger was unable to render the body" +
+				" for %s: %v",
+				w.Url,
+				err,
+			),
+		)
+		return err
+	}
+
+	backoff := w.RetryBackoff
+	for attempt := uint(0); ; attempt++ {
+		err = w.send(body)
+		if err == nil {
+			log().Info(
+				fmt.Sprintf("webhooktrigger called %s", w.Url),
+			)
+			return nil
+		}
+
+		respErr, isRespErr := err.(*WebhookResponseError)
+		if attempt >= w.Retries || (isRespErr && !respErr.retryable()) {
+			log().Err(
+				fmt.Sprintf(
+					"webhooktrigger failed to call %s: %v",
+					w.Url,
+					err,
+				),
+			)
+			return err
+		}
+
+		log().Warning(
+			fmt.Sprintf(
+				"webhooktrigger call to %s failed (attempt %d" +
+				" of %d), retrying in %v: %v",
+				w.Url,
+				attempt + 1,
+				w.Retries + 1,
+				backoff,
+				err,
+			),
+		)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
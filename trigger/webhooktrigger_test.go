@@ -0,0 +1,294 @@
+package trigger
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	configutil "github.com/stuphlabs/pullcord/config/util"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWebhook is an in-process webhook receiver which records the requests it
+// receives. It can be told to fail a number of requests with a given status,
+// or to take a while to respond.
+type fakeWebhook struct {
+	mutex sync.Mutex
+	server *httptest.Server
+	failures int
+	failureStatus int
+	delay time.Duration
+	requests []*http.Request
+	bodies []string
+}
+
+func newFakeWebhook() *fakeWebhook {
+	f := &fakeWebhook{failureStatus: 503}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	f.mutex.Lock()
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, string(body))
+	fail := f.failures > 0
+	if fail {
+		f.failures -= 1
+	}
+	f.mutex.Unlock()
+
+	time.Sleep(f.delay)
+	if fail {
+		w.WriteHeader(f.failureStatus)
+		w.Write([]byte("nope"))
+	} else {
+		w.Write([]byte("ok"))
+	}
+}
+
+// newTestWebhookTrigger creates a WebhookTrigger that calls the fake webhook.
+func newTestWebhookTrigger(
+	t *testing.T,
+	f *fakeWebhook,
+	body string,
+) *WebhookTrigger {
+	w, err := NewWebhookTrigger("POST", f.server.URL + "/hook", body)
+	assert.NoError(t, err)
+	w.RetryBackoff = time.Millisecond
+	return w
+}
+
+func TestWebhookTriggerSend(t *testing.T) {
+	f := newFakeWebhook()
+	defer f.server.Close()
+
+	w := newTestWebhookTrigger(
+		t,
+		f,
+		`{"text": {{json "wiki is \"starting\""}},` +
+		` "year": {{.Time.Year}}}`,
+	)
+	w.Headers["Authorization"] = "Bearer token"
+	err := w.Trigger()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, len(f.requests))
+	if len(f.requests) == 1 {
+		r := f.requests[0]
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/hook", r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.Equal(
+			t,
+			"application/json",
+			r.Header.Get("Content-Type"),
+		)
+		assert.Equal(t, "", r.Header.Get("X-Pullcord-Signature"))
+
+		var body struct {
+			Text string
+			Year int
+		}
+		err = json.Unmarshal([]byte(f.bodies[0]), &body)
+		assert.NoError(t, err)
+		assert.Equal(t, `wiki is "starting"`, body.Text)
+		assert.Equal(t, time.Now().Year(), body.Year)
+	}
+}
+
+func TestWebhookTriggerContext(t *testing.T) {
+	f := newFakeWebhook()
+	defer f.server.Close()
+
+	w := newTestWebhookTrigger(
+		t,
+		f,
+		`{{.Service}} {{.Hook}} {{.ClientIP}} {{.Host}} {{.Path}}`,
+	)
+
+	ctx := NewTriggerContext()
+	ctx.Service = "wiki"
+	ctx.Hook = "OnDown"
+	ctx.ClientIP = "192.0.2.1"
+	ctx.Host = "wiki.example.com"
+	ctx.Path = "/index"
+	err := w.TriggerWith(ctx)
+	assert.NoError(t, err)
+
+	assert.Equal(
+		t,
+		[]string{"wiki OnDown 192.0.2.1 wiki.example.com /index"},
+		f.bodies,
+	)
+}
+
+func TestWebhookTriggerSigned(t *testing.T) {
+	f := newFakeWebhook()
+	defer f.server.Close()
+
+	w := newTestWebhookTrigger(t, f, `{"service": "wiki"}`)
+	w.Secret = "s3cret"
+	err := w.Trigger()
+	assert.NoError(t, err)
+
+	h := hmac.New(sha256.New, []byte("s3cret"))
+	h.Write([]byte(`{"service": "wiki"}`))
+	assert.Equal(
+		t,
+		"sha256=" + hex.EncodeToString(h.Sum(nil)),
+		f.requests[0].Header.Get("X-Pullcord-Signature"),
+	)
+}
+
+func TestWebhookTriggerRetry(t *testing.T) {
+	f := newFakeWebhook()
+	defer f.server.Close()
+	f.failures = 2
+
+	err := newTestWebhookTrigger(t, f, "").Trigger()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(f.requests))
+	assert.Equal(t, "", f.requests[0].Header.Get("Content-Type"))
+}
+
+func TestWebhookTriggerRetriesExhausted(t *testing.T) {
+	f := newFakeWebhook()
+	defer f.server.Close()
+	f.failures = 10
+
+	w := newTestWebhookTrigger(t, f, "")
+	w.Retries = 1
+	err := w.Trigger()
+	assert.Equal(t, 2, len(f.requests))
+	if respErr, ok := err.(*WebhookResponseError); assert.True(t, ok) {
+		assert.Equal(t, 503, respErr.StatusCode)
+		assert.Equal(t, "nope", respErr.Body)
+	}
+}
+
+func TestWebhookTriggerClientError(t *testing.T) {
+	f := newFakeWebhook()
+	defer f.server.Close()
+	f.failures = 1
+	f.failureStatus = 404
+
+	err := newTestWebhookTrigger(t, f, "").Trigger()
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(f.requests))
+}
+
+func TestWebhookTriggerTimeout(t *testing.T) {
+	f := newFakeWebhook()
+	defer f.server.Close()
+	f.delay = 100 * time.Millisecond
+
+	w := newTestWebhookTrigger(t, f, "")
+	w.Timeout = 10 * time.Millisecond
+	w.Retries = 0
+	err := w.Trigger()
+	assert.Error(t, err)
+}
+
+func TestWebhookTriggerBadTemplate(t *testing.T) {
+	_, err := NewWebhookTrigger("POST", "http://localhost/", "{{.Nope")
+	assert.Error(t, err)
+
+	w, err := NewWebhookTrigger("POST", "http://localhost/", "{{.Nope}}")
+	assert.NoError(t, err)
+	err = w.Trigger()
+	assert.Error(t, err)
+}
+
+func TestWebhookTriggerFromConfig(t *testing.T) {
+	test := configutil.ConfigTest{
+		ResourceType: "webhooktrigger",
+		SyntacticallyBad: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: "",
+				Explanation: "empty config",
+			},
+			configutil.ConfigTestData{
+				Data: "42",
+				Explanation: "numeric config",
+			},
+			configutil.ConfigTestData{
+				Data: "{}",
+				Explanation: "empty object",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"url": "/hook"
+				}`,
+				Explanation: "relative url",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"url": "ftp://example.com/hook"
+				}`,
+				Explanation: "non-http url",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"url": "https://example.com/hook",
+					"body": "{{.Time"
+				}`,
+				Explanation: "bad body template",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"url": "https://example.com/hook",
+					"headers": ["a"]
+				}`,
+				Explanation: "array headers",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"url": "https://example.com/hook",
+					"timeout": "0s"
+				}`,
+				Explanation: "zero timeout",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"url": "https://example.com/hook",
+					"retrybackoff": "42q"
+				}`,
+				Explanation: "nonsensical retry backoff",
+			},
+		},
+		Good: []configutil.ConfigTestData{
+			configutil.ConfigTestData{
+				Data: `{
+					"url": "https://example.com/hook"
+				}`,
+				Explanation: "minimal webhook trigger",
+			},
+			configutil.ConfigTestData{
+				Data: `{
+					"method": "PUT",
+					"url": "https://example.com/hook",
+					"headers": {
+						"Authorization": "Bearer token"
+					},
+					"body": "{\"text\": {{json \"hello\"}}}",
+					"timeout": "5s",
+					"retries": 4,
+					"retrybackoff": "1s",
+					"secret": "s3cret",
+					"signatureheader": "X-Hub-Signature-256"
+				}`,
+				Explanation: "full webhook trigger",
+			},
+		},
+	}
+	test.Run(t)
+}